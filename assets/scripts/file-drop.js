@@ -0,0 +1,72 @@
+;(function (w, d) {
+  if (!w.fetch || !w.Headers) return
+
+  const form = d.getElementById('file-drop-form')
+  const field = d.getElementById('file-drop-field')
+  const input = d.getElementById('file-drop-input')
+  const list = d.getElementById('file-drop-list')
+  const submitButton = d.getElementById('file-drop-submit')
+
+  const sharecode = form.dataset.sharecode
+  const dirID = form.dataset.dirId
+
+  const upload = function (file) {
+    const item = d.createElement('li')
+    item.textContent = file.name
+    list.appendChild(item)
+
+    const headers = new Headers()
+    headers.append('Accept', 'application/vnd.api+json')
+    headers.append('Authorization', 'Bearer ' + sharecode)
+    if (file.type) {
+      headers.append('Content-Type', file.type)
+    }
+    const url =
+      '/files/' +
+      encodeURIComponent(dirID) +
+      '?Type=file&Name=' +
+      encodeURIComponent(file.name)
+    return fetch(url, {
+      method: 'POST',
+      headers: headers,
+      body: file,
+    }).then((response) => {
+      if (response.status !== 201) {
+        item.classList.add('text-danger')
+        throw new Error(form.dataset.error)
+      }
+      item.classList.add('text-success')
+    })
+  }
+
+  const onSubmit = function (event) {
+    event.preventDefault()
+    const files = Array.prototype.slice.call(input.files)
+    if (files.length === 0) return
+    submitButton.setAttribute('disabled', true)
+    input.setAttribute('disabled', true)
+
+    // The files are sent one after the other, to stop on the first error
+    // (for example when a limit of the link has been reached)
+    files
+      .reduce((p, file) => p.then(() => upload(file)), Promise.resolve())
+      .then(() => {
+        input.value = ''
+        input.removeAttribute('disabled')
+        submitButton.removeAttribute('disabled')
+        const tooltip = field.querySelector('.invalid-tooltip')
+        if (tooltip) {
+          tooltip.classList.add('d-none')
+        }
+        const success = d.createElement('li')
+        success.textContent = submitButton.dataset.success
+        list.appendChild(success)
+      })
+      .catch((err) => {
+        input.removeAttribute('disabled')
+        w.showError(field, err.message || form.dataset.error)
+      })
+  }
+
+  form.addEventListener('submit', onSubmit)
+})(window, document)
@@ -11,6 +11,7 @@
   const loginField = d.getElementById('login-field')
   const longRunCheckbox = d.getElementById('long-run-session')
   const trustedTokenInput = d.getElementById('trusted-device-token')
+  const webauthnButton = d.getElementById('webauthn-login')
 
   // Set the trusted device token from the localstorage in the form if it exists
   try {
@@ -83,7 +84,53 @@
       .catch((err) => w.showError(loginField, err))
   }
 
+  const onClickWebAuthn = function (event) {
+    event.preventDefault()
+    webauthnButton.setAttribute('disabled', true)
+
+    const longRun = longRunCheckbox && longRunCheckbox.checked ? '1' : '0'
+    const redirect = redirectInput && redirectInput.value + w.location.hash
+
+    w.webauthn
+      .getAssertion()
+      .then((assertion) => {
+        const data = new URLSearchParams()
+        data.append('webauthn-credential', assertion)
+        data.append('long-run-session', longRun)
+        data.append('redirect', redirect)
+        data.append('csrf_token', csrfTokenInput.value)
+
+        const headers = new Headers()
+        headers.append('Content-Type', 'application/x-www-form-urlencoded')
+        headers.append('Accept', 'application/json')
+        return fetch('/auth/webauthn/login', {
+          method: 'POST',
+          headers: headers,
+          body: data,
+          credentials: 'same-origin',
+        })
+      })
+      .then((response) => {
+        return response.json().then((body) => {
+          if (response.status < 400) {
+            w.location = body.redirect
+          } else {
+            webauthnButton.removeAttribute('disabled')
+            w.showError(loginField, body.error)
+          }
+        })
+      })
+      .catch((err) => {
+        webauthnButton.removeAttribute('disabled')
+        w.showError(loginField, webauthnButton.dataset.error || err)
+      })
+  }
+
   loginForm.addEventListener('submit', onSubmitPassphrase)
+  if (webauthnButton && w.webauthn && w.webauthn.isAvailable()) {
+    webauthnButton.classList.remove('d-none')
+    webauthnButton.addEventListener('click', onClickWebAuthn)
+  }
   passphraseInput.focus()
   submitButton.removeAttribute('disabled')
 })(window, document)
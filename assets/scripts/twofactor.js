@@ -12,6 +12,7 @@
   const tokenInput = d.getElementById('two-factor-token')
   const trustCheckbox = d.getElementById('two-factor-trust-device')
   const longRunCheckbox = d.getElementById('long-run-session')
+  const webauthnButton = d.getElementById('two-factor-webauthn')
 
   const storage = w.localStorage
 
@@ -19,7 +20,22 @@
     event.preventDefault()
     passcodeInput.setAttribute('disabled', true)
     submitButton.setAttribute('disabled', true)
+    return sendTwoFactor(null)
+  }
+
+  const onClickWebAuthn = function (event) {
+    event.preventDefault()
+    webauthnButton.setAttribute('disabled', true)
+    return w.webauthn
+      .getAssertion()
+      .then((assertion) => sendTwoFactor(assertion))
+      .catch((err) => {
+        webauthnButton.removeAttribute('disabled')
+        w.showError(twofaField, webauthnButton.dataset.error || err)
+      })
+  }
 
+  const sendTwoFactor = function (assertion) {
     const longRun = longRunCheckbox && longRunCheckbox.checked ? '1' : '0'
     const passcode = passcodeInput.value
     const token = tokenInput.value
@@ -27,7 +43,11 @@
     const redirect = redirectInput.value + w.location.hash
 
     const data = new URLSearchParams()
-    data.append('two-factor-passcode', passcode)
+    if (assertion) {
+      data.append('two-factor-webauthn', assertion)
+    } else {
+      data.append('two-factor-passcode', passcode)
+    }
     data.append('long-run-session', longRun)
     data.append('two-factor-token', token)
     data.append('two-factor-generate-trusted-device-token', trustDevice)
@@ -75,6 +95,9 @@
             submitButton.classList.add('btn-done')
             w.location = body.redirect
           } else {
+            if (webauthnButton) {
+              webauthnButton.removeAttribute('disabled')
+            }
             w.showError(twofaField, body.error)
           }
         })
@@ -83,4 +106,8 @@
   }
 
   twofaForm.addEventListener('submit', onSubmitTwoFactorCode)
+  if (webauthnButton && w.webauthn && w.webauthn.isAvailable()) {
+    webauthnButton.classList.remove('d-none')
+    webauthnButton.addEventListener('click', onClickWebAuthn)
+  }
 })(window, document)
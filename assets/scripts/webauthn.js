@@ -0,0 +1,76 @@
+;(function (w) {
+  function fromB64URLToBuffer(str) {
+    const b64 = str.replace(/-/g, '+').replace(/_/g, '/')
+    const binary = w.atob(b64 + '==='.slice((b64.length + 3) % 4))
+    const bytes = new Uint8Array(binary.length)
+    for (let i = 0; i < binary.length; i++) {
+      bytes[i] = binary.charCodeAt(i)
+    }
+    return bytes.buffer
+  }
+
+  function fromBufferToB64URL(buffer) {
+    if (!buffer) return undefined
+    const bytes = new Uint8Array(buffer)
+    let binary = ''
+    for (let i = 0; i < bytes.byteLength; i++) {
+      binary += String.fromCharCode(bytes[i])
+    }
+    return w
+      .btoa(binary)
+      .replace(/\+/g, '-')
+      .replace(/\//g, '_')
+      .replace(/=+$/, '')
+  }
+
+  function isAvailable() {
+    return !!(w.PublicKeyCredential && w.navigator.credentials)
+  }
+
+  // Ask the stack for the options, then ask the authenticator for an
+  // assertion, and returns it serialized in JSON.
+  function getAssertion() {
+    const headers = new Headers()
+    headers.append('Accept', 'application/json')
+    return fetch('/auth/webauthn/options', {
+      method: 'POST',
+      headers: headers,
+      credentials: 'same-origin',
+    })
+      .then((response) => {
+        return response.json().then((body) => {
+          if (response.status >= 400) {
+            throw new Error(body.error)
+          }
+          return body
+        })
+      })
+      .then(({ publicKey }) => {
+        publicKey.challenge = fromB64URLToBuffer(publicKey.challenge)
+        publicKey.allowCredentials = (publicKey.allowCredentials || []).map(
+          (cred) => ({ type: cred.type, id: fromB64URLToBuffer(cred.id) })
+        )
+        return w.navigator.credentials.get({ publicKey: publicKey })
+      })
+      .then((cred) => {
+        return JSON.stringify({
+          id: cred.id,
+          rawId: fromBufferToB64URL(cred.rawId),
+          type: cred.type,
+          response: {
+            clientDataJSON: fromBufferToB64URL(cred.response.clientDataJSON),
+            authenticatorData: fromBufferToB64URL(
+              cred.response.authenticatorData
+            ),
+            signature: fromBufferToB64URL(cred.response.signature),
+            userHandle: fromBufferToB64URL(cred.response.userHandle),
+          },
+        })
+      })
+  }
+
+  w.webauthn = {
+    isAvailable: isAvailable,
+    getAssertion: getAssertion,
+  }
+})(window)
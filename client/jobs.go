@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/cozy/cozy-stack/client/request"
@@ -28,9 +29,17 @@ type JobLog struct {
 	Time    time.Time              `json:"time"`
 	Message string                 `json:"message"`
 	Level   string                 `json:"level"`
+	Stream  string                 `json:"stream,omitempty"`
 	Data    map[string]interface{} `json:"data"`
 }
 
+// JobLogs are the last lines of the logs of a job.
+type JobLogs struct {
+	JobID   string    `json:"job_id"`
+	Lines   []*JobLog `json:"lines"`
+	Dropped int       `json:"dropped"`
+}
+
 // Job is a struct representing a job
 type Job struct {
 	ID    string `json:"id"`
@@ -172,6 +181,40 @@ func (c *Client) JobPush(r *JobOptions) (*Job, error) {
 	return j, nil
 }
 
+// JobCancel cancels the job with the specified ID.
+func (c *Client) JobCancel(jobID string) (*Job, error) {
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   fmt.Sprintf("/jobs/%s/cancel", url.PathEscape(jobID)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var j *Job
+	if err := readJSONAPI(res.Body, &j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// GetJobLogs returns the logs of the last execution of the job with the
+// specified ID.
+func (c *Client) GetJobLogs(jobID string) (*JobLogs, error) {
+	res, err := c.Req(&request.Options{
+		Method: "GET",
+		Path:   fmt.Sprintf("/jobs/%s/logs", url.PathEscape(jobID)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var logs JobLogs
+	if err := json.NewDecoder(res.Body).Decode(&logs); err != nil {
+		return nil, err
+	}
+	return &logs, nil
+}
+
 // GetTrigger return the trigger with the specified ID.
 func (c *Client) GetTrigger(triggerID string) (*Trigger, error) {
 	res, err := c.Req(&request.Options{
@@ -236,3 +279,176 @@ func (c *Client) ListTriggers() ([]*Trigger, error) {
 	}
 	return list, nil
 }
+
+// DeadJob is a job that has failed after all its attempts, and that is kept
+// in the dead-letter queue.
+type DeadJob struct {
+	ID        string          `json:"_id"`
+	Domain    string          `json:"domain"`
+	Worker    string          `json:"worker"`
+	TriggerID string          `json:"trigger_id,omitempty"`
+	Message   json.RawMessage `json:"message"`
+	Error     string          `json:"error"`
+	Attempts  []struct {
+		StartedAt  time.Time `json:"started_at"`
+		FinishedAt time.Time `json:"finished_at"`
+		Error      string    `json:"error,omitempty"`
+	} `json:"attempts"`
+	QueuedAt time.Time `json:"queued_at"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// DeadJobsFilter is used to select the jobs of the dead-letter queue.
+type DeadJobsFilter struct {
+	Domain string
+	Worker string
+}
+
+func (f *DeadJobsFilter) queries() url.Values {
+	q := url.Values{}
+	if f.Domain != "" {
+		q.Add("Domain", f.Domain)
+	}
+	if f.Worker != "" {
+		q.Add("Worker", f.Worker)
+	}
+	return q
+}
+
+// ListDeadJobs returns the jobs of the dead-letter queue that match the
+// filter.
+func (c *Client) ListDeadJobs(filter *DeadJobsFilter) ([]*DeadJob, error) {
+	res, err := c.Req(&request.Options{
+		Method:  "GET",
+		Path:    "/jobs/dlq",
+		Queries: filter.queries(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var list []*DeadJob
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ReplayDeadJob pushes again the job with the given ID from the dead-letter
+// queue, and returns the new job.
+func (c *Client) ReplayDeadJob(jobID string) (*Job, error) {
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   fmt.Sprintf("/jobs/dlq/%s/replay", url.PathEscape(jobID)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var j *Job
+	if err := readJSONAPI(res.Body, &j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// DropDeadJob removes the job with the given ID from the dead-letter queue.
+func (c *Client) DropDeadJob(jobID string) error {
+	_, err := c.Req(&request.Options{
+		Method:     "DELETE",
+		Path:       fmt.Sprintf("/jobs/dlq/%s", url.PathEscape(jobID)),
+		NoResponse: true,
+	})
+	return err
+}
+
+// ReplayDeadJobs pushes again all the jobs of the dead-letter queue that
+// match the filter, and returns the number of replayed jobs.
+func (c *Client) ReplayDeadJobs(filter *DeadJobsFilter) (int, error) {
+	res, err := c.Req(&request.Options{
+		Method:  "POST",
+		Path:    "/jobs/dlq/replay",
+		Queries: filter.queries(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	var data struct {
+		Replayed int `json:"replayed"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return 0, err
+	}
+	return data.Replayed, nil
+}
+
+// DropDeadJobs removes all the jobs of the dead-letter queue that match the
+// filter, and returns the number of dropped jobs.
+func (c *Client) DropDeadJobs(filter *DeadJobsFilter) (int, error) {
+	res, err := c.Req(&request.Options{
+		Method:  "DELETE",
+		Path:    "/jobs/dlq",
+		Queries: filter.queries(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	var data struct {
+		Dropped int `json:"dropped"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return 0, err
+	}
+	return data.Dropped, nil
+}
+
+// JobsStats are the statistics of the jobs of an instance since a date.
+type JobsStats struct {
+	Since   time.Time `json:"since"`
+	Workers []*struct {
+		Worker       string  `json:"worker"`
+		Total        int     `json:"total"`
+		Queued       int     `json:"queued"`
+		Running      int     `json:"running"`
+		Done         int     `json:"done"`
+		Errored      int     `json:"errored"`
+		Cancelled    int     `json:"cancelled"`
+		SuccessRatio float64 `json:"success_ratio"`
+		FailureRatio float64 `json:"failure_ratio"`
+		DurationP50  float64 `json:"duration_p50"`
+		DurationP95  float64 `json:"duration_p95"`
+		LastErrors   []*struct {
+			JobID      string    `json:"job_id"`
+			Error      string    `json:"error"`
+			FinishedAt time.Time `json:"finished_at"`
+		} `json:"last_errors,omitempty"`
+		QueueLen int `json:"queue_len"`
+	} `json:"workers"`
+}
+
+// GetJobsStats returns the statistics of the jobs queued during the given
+// duration (like 24h or 7D), for the given workers (all by default).
+func (c *Client) GetJobsStats(duration string, workers []string) (*JobsStats, error) {
+	q := url.Values{}
+	if duration != "" {
+		q.Add("duration", duration)
+	}
+	if len(workers) > 0 {
+		q.Add("workers", strings.Join(workers, ","))
+	}
+	res, err := c.Req(&request.Options{
+		Method:  "GET",
+		Path:    "/jobs/stats",
+		Queries: q,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var stats JobsStats
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
@@ -143,6 +143,39 @@ keyfiles written in:
 	},
 }
 
+var genFilesKeyCmd = &cobra.Command{
+	Use:   "gen-files-key <filepath>",
+	Short: "Generate a key for the encryption at rest of the files",
+	Long: `
+cozy-stack config gen-files-key generate a secret key and save it in the
+specified path. This key can be added to vault.files_encryption_keys in the
+configuration file to wrap the keys used for encrypting the content of the
+files.
+
+The file permissions are 0400.`,
+
+	Example: `$ cozy-stack config gen-files-key ~/files-key
+keyfile written in:
+	~/files-key
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+
+		filename := filepath.Join(utils.AbsPath(args[0]))
+		marshaledKey, err := keymgmt.GenerateEncodedSecretKey()
+		if err != nil {
+			return err
+		}
+		if err = writeFile(filename, marshaledKey, 0400); err != nil {
+			return err
+		}
+		errPrintfln("keyfile written in:\n  %s", filename)
+		return nil
+	},
+}
+
 var encryptCredentialsDataCmd = &cobra.Command{
 	Use:   "encrypt-data <encoding keyfile> <text>",
 	Short: "Encrypt data with the specified encryption keyfile.",
@@ -398,6 +431,7 @@ var listContextsCmd = &cobra.Command{
 func init() {
 	configCmdGroup.AddCommand(adminPasswdCmd)
 	configCmdGroup.AddCommand(genKeysCmd)
+	configCmdGroup.AddCommand(genFilesKeyCmd)
 	configCmdGroup.AddCommand(encryptCredentialsDataCmd)
 	configCmdGroup.AddCommand(decryptCredentialsDataCmd)
 	configCmdGroup.AddCommand(encryptCredentialsCmd)
@@ -12,6 +12,7 @@ import (
 	"net/url"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -61,6 +62,7 @@ var flagOnboardingSecret string
 var flagOnboardingApp string
 var flagOnboardingPermissions string
 var flagOnboardingState string
+var flagReencrypt bool
 
 // instanceCmdGroup represents the instances command
 var instanceCmdGroup = &cobra.Command{
@@ -1016,8 +1018,10 @@ var setAuthModeCmd = &cobra.Command{
 	Use:     "auth-mode [domain] [auth-mode]",
 	Short:   `Set instance auth-mode`,
 	Example: "$ cozy-stack instances auth-mode cozy.localhost:8080 two_factor_mail",
-	Long: `Change the authentication mode for an instance. Two options are allowed:
+	Long: `Change the authentication mode for an instance. Three options are allowed:
 - two_factor_mail
+- two_factor_totp (the authenticator application must have been enrolled
+  from the settings first)
 - basic
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -1063,6 +1067,104 @@ var setAuthModeCmd = &cobra.Command{
 	},
 }
 
+var enableFilesEncryptionCmd = &cobra.Command{
+	Use:     "enable-files-encryption <domain>",
+	Short:   "Enable the encryption at rest of the content of the files",
+	Example: "$ cozy-stack instances enable-files-encryption cozy.localhost:8080",
+	Long: `Enable the encryption at rest of the content of the files for an instance.
+A key is generated for the instance, and wrapped by the current key configured
+in vault.files_encryption_keys. The new contents are encrypted with it, the
+existing ones are kept in clear until the key is rotated with --reencrypt.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		domain := args[0]
+		c := newAdminClient()
+		_, err := c.Req(&request.Options{
+			Method: "POST",
+			Path:   "/instances/" + url.PathEscape(domain) + "/files-encryption",
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Encryption of the files is enabled for %s\n", domain)
+		return nil
+	},
+}
+
+var rotateFilesKeyCmd = &cobra.Command{
+	Use:     "rotate-files-key <domain>",
+	Short:   "Rotate the key used for the encryption of the files",
+	Example: "$ cozy-stack instances rotate-files-key cozy.localhost:8080 --reencrypt",
+	Long: `Generate a new key for the encryption at rest of the content of the files
+of an instance. The new contents are encrypted with the new key. With the
+--reencrypt flag, the existing contents (and their old versions) are also
+re-encrypted with it, including the ones that were still in clear.
+
+The keys of the instance are wrapped again with the current key of the vault,
+so this command must also be used after adding a new key to
+vault.files_encryption_keys.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		domain := args[0]
+		c := newAdminClient()
+		res, err := c.Req(&request.Options{
+			Method:  "POST",
+			Path:    "/instances/" + url.PathEscape(domain) + "/files-encryption/rotate",
+			Queries: url.Values{"Reencrypt": {strconv.FormatBool(flagReencrypt)}},
+		})
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		var out struct {
+			Reencrypted int `json:"reencrypted"`
+		}
+		if err = json.NewDecoder(res.Body).Decode(&out); err != nil {
+			return err
+		}
+		fmt.Printf("The key has been rotated for %s\n", domain)
+		if flagReencrypt {
+			fmt.Printf("%d contents have been re-encrypted\n", out.Reencrypted)
+		}
+		return nil
+	},
+}
+
+var transferSharingCmd = &cobra.Command{
+	Use:     "transfer-sharing <domain> <sharing-id> <email>",
+	Short:   "Transfer the ownership of a sharing to one of its recipients",
+	Example: "$ cozy-stack instances transfer-sharing alice.cozy.localhost:8080 7f47c470c7b1013a8a8818c04daba326 bob@example.net",
+	Long: `Hand the role of owner of a sharing to the recipient with the given email
+address. The recipient must have accepted the sharing, and must not be
+read-only. The new owner takes over the credentials, the replication and the
+invitations for all the recipients, and the current owner becomes a recipient.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 3 {
+			return cmd.Usage()
+		}
+		domain := args[0]
+		c := newAdminClient()
+		_, err := c.Req(&request.Options{
+			Method:     "POST",
+			Path:       "/instances/" + url.PathEscape(domain) + "/sharings/" + url.PathEscape(args[1]) + "/transfer",
+			Queries:    url.Values{"Email": {args[2]}},
+			NoResponse: true,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("The sharing %s has been transferred to %s\n", args[1], args[2])
+		return nil
+	},
+}
+
 func init() {
 	instanceCmdGroup.AddCommand(showInstanceCmd)
 	instanceCmdGroup.AddCommand(showDBPrefixInstanceCmd)
@@ -1088,6 +1190,9 @@ func init() {
 	instanceCmdGroup.AddCommand(instanceAppVersionCmd)
 	instanceCmdGroup.AddCommand(updateInstancePassphraseCmd)
 	instanceCmdGroup.AddCommand(setAuthModeCmd)
+	instanceCmdGroup.AddCommand(enableFilesEncryptionCmd)
+	instanceCmdGroup.AddCommand(rotateFilesKeyCmd)
+	instanceCmdGroup.AddCommand(transferSharingCmd)
 	addInstanceCmd.Flags().StringSliceVar(&flagDomainAliases, "domain-aliases", nil, "Specify one or more aliases domain for the instance (separated by ',')")
 	addInstanceCmd.Flags().StringVar(&flagLocale, "locale", consts.DefaultLocale, "Locale of the new cozy instance")
 	addInstanceCmd.Flags().StringVar(&flagUUID, "uuid", "", "The UUID of the instance")
@@ -1147,6 +1252,7 @@ func init() {
 	exportCmd.Flags().StringVar(&flagDomain, "domain", "", "Specify the domain name of the instance")
 	importCmd.Flags().StringVar(&flagDomain, "domain", "", "Specify the domain name of the instance")
 	importCmd.Flags().BoolVar(&flagForce, "force", false, "Force the import without asking for confirmation")
+	rotateFilesKeyCmd.Flags().BoolVar(&flagReencrypt, "reencrypt", false, "Re-encrypt the existing contents with the new key")
 	_ = exportCmd.MarkFlagRequired("domain")
 	_ = importCmd.MarkFlagRequired("domain")
 	RootCmd.AddCommand(instanceCmdGroup)
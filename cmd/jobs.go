@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/url"
+	"os"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/cozy/cozy-stack/client"
@@ -20,6 +22,10 @@ var flagJobPrintLogs bool
 var flagJobPrintLogsVerbose bool
 var flagJobWorkers []string
 var flagJobsPurgeDuration string
+var flagJobsStatsDuration string
+var flagJobsStatsJSON bool
+var flagJobsDLQWorker string
+var flagJobsDLQAll bool
 
 var jobsCmdGroup = &cobra.Command{
 	Use:   "jobs <command>",
@@ -73,6 +79,71 @@ var jobsRunCmd = &cobra.Command{
 	},
 }
 
+var jobsCancelCmd = &cobra.Command{
+	Use:   "cancel <job-id>",
+	Short: "Cancel a queued or running job",
+	Long: `
+Cancel a job: if the job is queued, it is removed from the queue, and if it is
+running, its execution is stopped (the process is killed for the konnectors
+and services).
+`,
+	Example: `$ cozy-stack jobs cancel --domain example.mycozy.cloud 4b1f1ac0e6a65a86f3d6c3a0bd0134e3`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		if flagDomain == "" {
+			return errMissingDomain
+		}
+		c := newClient(flagDomain, "io.cozy.jobs")
+		j, err := c.JobCancel(args[0])
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(j, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+var jobsLogsCmd = &cobra.Command{
+	Use:   "logs <job-id>",
+	Short: "Show the logs of a job",
+	Long: `
+Show the last lines written by a job on its standard and error outputs, for
+its last execution. The logs of a job are kept for 24 hours.
+`,
+	Example: `$ cozy-stack jobs logs --domain example.mycozy.cloud 4b1f1ac0e6a65a86f3d6c3a0bd0134e3`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		if flagDomain == "" {
+			return errMissingDomain
+		}
+		c := newClient(flagDomain, "io.cozy.jobs")
+		logs, err := c.GetJobLogs(args[0])
+		if err != nil {
+			return err
+		}
+		if logs.Dropped > 0 {
+			fmt.Printf("(%d older lines dropped)\n", logs.Dropped)
+		}
+		for _, line := range logs.Lines {
+			fmt.Printf("%s %s %s %s\n",
+				line.Time.Format(time.RFC3339),
+				line.Stream,
+				line.Level,
+				line.Message,
+			)
+		}
+		return nil
+	},
+}
+
 var jobsPurgeCmd = &cobra.Command{
 	Use:     "purge-old-jobs <domain>",
 	Short:   `Purge old jobs from an instance`,
@@ -113,6 +184,169 @@ var jobsPurgeCmd = &cobra.Command{
 	},
 }
 
+var jobsStatsCmd = &cobra.Command{
+	Use:   "stats <domain>",
+	Short: "Show statistics about the jobs of an instance",
+	Long: `
+Show, for each worker, the number of jobs queued during the given duration by
+state, the success and failure ratios of the executed jobs, the median and 95th
+percentile of their durations (in seconds), and the number of jobs waiting in
+the queue of the worker (for all the instances).
+
+The last errors are shown with the --json flag.
+`,
+	Example: `$ cozy-stack jobs stats example.mycozy.cloud --duration 7D --workers konnector,service`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		c := newClient(args[0], "io.cozy.jobs:GET")
+		stats, err := c.GetJobsStats(flagJobsStatsDuration, flagJobWorkers)
+		if err != nil {
+			return err
+		}
+		if flagJobsStatsJSON {
+			b, err := json.MarshalIndent(stats, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "WORKER\tTOTAL\tQUEUED\tRUNNING\tDONE\tERRORED\tCANCELLED\tSUCCESS\tP50\tP95\tQUEUE")
+		for _, s := range stats.Workers {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%.1f%%\t%.2fs\t%.2fs\t%d\n",
+				s.Worker,
+				s.Total,
+				s.Queued,
+				s.Running,
+				s.Done,
+				s.Errored,
+				s.Cancelled,
+				100*s.SuccessRatio,
+				s.DurationP50,
+				s.DurationP95,
+				s.QueueLen,
+			)
+		}
+		return w.Flush()
+	},
+}
+
+var jobsDLQCmdGroup = &cobra.Command{
+	Use:   "dlq <command>",
+	Short: "Manage the dead-letter queue of the jobs",
+	Long: `
+The jobs that have failed after all their attempts are kept in a dead-letter
+queue, with their message, their last error and the history of their attempts.
+They can be listed, replayed after a fix, or dropped, for all the instances.
+
+The --domain flag can be used to select the jobs of a single instance.
+`,
+}
+
+func deadJobsFilter(cmd *cobra.Command) *client.DeadJobsFilter {
+	filter := &client.DeadJobsFilter{Worker: flagJobsDLQWorker}
+	if cmd.Flag("domain").Changed {
+		filter.Domain = flagDomain
+	}
+	return filter
+}
+
+var jobsDLQListCmd = &cobra.Command{
+	Use:     "ls",
+	Aliases: []string{"list"},
+	Short:   "List the jobs of the dead-letter queue",
+	Example: `$ cozy-stack jobs dlq ls --worker konnector`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		list, err := c.ListDeadJobs(deadJobsFilter(cmd))
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, dead := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n",
+				dead.ID,
+				dead.Domain,
+				dead.Worker,
+				len(dead.Attempts),
+				dead.FailedAt.Format(time.RFC3339),
+				dead.Error,
+			)
+		}
+		return w.Flush()
+	},
+}
+
+var jobsDLQReplayCmd = &cobra.Command{
+	Use:   "replay [job-id]",
+	Short: "Push again jobs of the dead-letter queue",
+	Long: `
+Push again a job of the dead-letter queue, or all the jobs that match the
+filters with the --all flag. The replayed jobs are removed from the queue.
+`,
+	Example: `$ cozy-stack jobs dlq replay 4b1f1ac0e6a65a86f3d6c3a0bd0134e3
+$ cozy-stack jobs dlq replay --all --worker konnector --domain example.mycozy.cloud`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		if flagJobsDLQAll {
+			if len(args) != 0 {
+				return cmd.Help()
+			}
+			n, err := c.ReplayDeadJobs(deadJobsFilter(cmd))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d job(s) replayed\n", n)
+			return nil
+		}
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		j, err := c.ReplayDeadJob(args[0])
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(j, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+var jobsDLQDropCmd = &cobra.Command{
+	Use:   "drop [job-id]",
+	Short: "Remove jobs from the dead-letter queue",
+	Long: `
+Remove a job from the dead-letter queue, or all the jobs that match the filters
+with the --all flag.
+`,
+	Example: `$ cozy-stack jobs dlq drop 4b1f1ac0e6a65a86f3d6c3a0bd0134e3
+$ cozy-stack jobs dlq drop --all --worker thumbnail`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		if flagJobsDLQAll {
+			if len(args) != 0 {
+				return cmd.Help()
+			}
+			n, err := c.DropDeadJobs(deadJobsFilter(cmd))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d job(s) dropped\n", n)
+			return nil
+		}
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+		return c.DropDeadJob(args[0])
+	},
+}
+
 func init() {
 	jobsCmdGroup.PersistentFlags().StringVar(&flagDomain, "domain", cozyDomain(), "specify the domain name of the instance")
 
@@ -123,7 +357,22 @@ func init() {
 	jobsPurgeCmd.Flags().StringSliceVar(&flagJobWorkers, "workers", nil, "worker types to iterate over (all workers by default)")
 	jobsPurgeCmd.Flags().StringVar(&flagJobsPurgeDuration, "duration", "", "duration to look for (ie. 3D, 2M)")
 
+	jobsStatsCmd.Flags().StringSliceVar(&flagJobWorkers, "workers", nil, "worker types to show (all workers by default)")
+	jobsStatsCmd.Flags().StringVar(&flagJobsStatsDuration, "duration", "24h", "duration to look for (ie. 24h, 7D)")
+	jobsStatsCmd.Flags().BoolVar(&flagJobsStatsJSON, "json", false, "print the statistics in JSON, with the last errors")
+
+	jobsDLQCmdGroup.PersistentFlags().StringVar(&flagJobsDLQWorker, "worker", "", "select only the jobs of this worker type")
+	jobsDLQReplayCmd.Flags().BoolVar(&flagJobsDLQAll, "all", false, "replay all the jobs that match the filters")
+	jobsDLQDropCmd.Flags().BoolVar(&flagJobsDLQAll, "all", false, "drop all the jobs that match the filters")
+	jobsDLQCmdGroup.AddCommand(jobsDLQListCmd)
+	jobsDLQCmdGroup.AddCommand(jobsDLQReplayCmd)
+	jobsDLQCmdGroup.AddCommand(jobsDLQDropCmd)
+
 	jobsCmdGroup.AddCommand(jobsRunCmd)
 	jobsCmdGroup.AddCommand(jobsPurgeCmd)
+	jobsCmdGroup.AddCommand(jobsCancelCmd)
+	jobsCmdGroup.AddCommand(jobsLogsCmd)
+	jobsCmdGroup.AddCommand(jobsStatsCmd)
+	jobsCmdGroup.AddCommand(jobsDLQCmdGroup)
 	RootCmd.AddCommand(jobsCmdGroup)
 }
@@ -264,5 +264,8 @@ func init() {
 	flags.String("vault-encryptor-key", "", "the path to the key used to encrypt credentials")
 	checkNoErr(viper.BindPFlag("vault.credentials_encryptor_key", flags.Lookup("vault-encryptor-key")))
 
+	flags.StringSlice("vault-files-keys", nil, "the paths to the keys used to wrap the keys for the encryption of the files (the first one is the current key)")
+	checkNoErr(viper.BindPFlag("vault.files_encryption_keys", flags.Lookup("vault-files-keys")))
+
 	RootCmd.AddCommand(serveCmd)
 }
@@ -29,6 +29,7 @@ require (
 	github.com/justincampbell/bigduration v0.0.0-20160531141349-e45bf03c0666
 	github.com/labstack/echo/v4 v4.7.2
 	github.com/leonelquinteros/gotext v1.5.0
+	github.com/minio/minio-go/v7 v7.0.16
 	github.com/mitchellh/mapstructure v1.5.0
 	github.com/mssola/user_agent v0.5.3
 	github.com/ncw/swift/v2 v2.0.1
@@ -149,6 +149,8 @@ func Copier(appsType consts.AppType, inst *instance.Instance) appfs.Copier {
 		return appfs.NewAferoCopier(baseFS)
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		return appfs.NewSwiftCopier(config.GetSwiftConnection(), appsType)
+	case config.SchemeS3, config.SchemeS3Insecure:
+		return appfs.NewS3Copier(config.GetS3Client(), appsType)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -168,6 +170,8 @@ func AppsFileServer(i *instance.Instance) appfs.FileServer {
 		return appfs.NewAferoFileServer(baseFS, nil)
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		return appfs.NewSwiftFileServer(config.GetSwiftConnection(), consts.WebappType)
+	case config.SchemeS3, config.SchemeS3Insecure:
+		return appfs.NewS3FileServer(config.GetS3Client(), consts.WebappType)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -187,6 +191,8 @@ func KonnectorsFileServer(i *instance.Instance) appfs.FileServer {
 		return appfs.NewAferoFileServer(baseFS, nil)
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		return appfs.NewSwiftFileServer(config.GetSwiftConnection(), consts.KonnectorType)
+	case config.SchemeS3, config.SchemeS3Insecure:
+		return appfs.NewS3FileServer(config.GetS3Client(), consts.KonnectorType)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -0,0 +1,139 @@
+// Package apppassword manages the application passwords: long-lived secrets
+// that the user can create for the WebDAV clients, and revoke at any time.
+// Unlike the OAuth access tokens, they don't expire.
+package apppassword
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+)
+
+// secretLen is the length of the random part of a password.
+const secretLen = 32
+
+// separator is between the identifier of the document and the secret in a
+// password. A JWT can't be confused with an application password, as it has
+// dots and no dashes.
+const separator = "-"
+
+// ErrInvalidPassword is used when an application password is unknown, or
+// has been revoked.
+var ErrInvalidPassword = errors.New("apppassword: invalid password")
+
+// AppPassword is an application password. Only a hash of the secret is
+// stored: the password is given to the user when it is created, and can't
+// be retrieved later.
+type AppPassword struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	Name      string    `json:"name"`
+	Hash      []byte    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Password is only filled when the application password is created
+	Password string `json:"password,omitempty"`
+}
+
+// ID implements the couchdb.Doc interface
+func (p *AppPassword) ID() string { return p.DocID }
+
+// Rev implements the couchdb.Doc interface
+func (p *AppPassword) Rev() string { return p.DocRev }
+
+// DocType implements the couchdb.Doc interface
+func (p *AppPassword) DocType() string { return consts.AppPasswords }
+
+// SetID implements the couchdb.Doc interface
+func (p *AppPassword) SetID(id string) { p.DocID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (p *AppPassword) SetRev(rev string) { p.DocRev = rev }
+
+// Clone implements the couchdb.Doc interface
+func (p *AppPassword) Clone() couchdb.Doc {
+	cloned := *p
+	cloned.Hash = make([]byte, len(p.Hash))
+	copy(cloned.Hash, p.Hash)
+	return &cloned
+}
+
+// Create generates a new application password with the given name. The
+// returned document is the only one with the Password field.
+func Create(inst *instance.Instance, name string) (*AppPassword, error) {
+	if name == "" {
+		name = "WebDAV"
+	}
+	secret := crypto.GenerateRandomString(secretLen)
+	hash := sha256.Sum256([]byte(secret))
+	p := &AppPassword{
+		Name:      name,
+		Hash:      hash[:],
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := couchdb.CreateDoc(inst, p); err != nil {
+		return nil, err
+	}
+	p.Password = p.DocID + separator + secret
+	return p, nil
+}
+
+// List returns the application passwords of the instance.
+func List(inst *instance.Instance) ([]*AppPassword, error) {
+	var list []*AppPassword
+	req := &couchdb.AllDocsRequest{Limit: 1000}
+	err := couchdb.GetAllDocs(inst, consts.AppPasswords, req, &list)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Find returns the application password with the given identifier.
+func Find(inst *instance.Instance, id string) (*AppPassword, error) {
+	var p AppPassword
+	if err := couchdb.GetDoc(inst, consts.AppPasswords, id, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Revoke deletes the application password: it can no longer be used.
+func (p *AppPassword) Revoke(inst *instance.Instance) error {
+	return couchdb.DeleteDoc(inst, p)
+}
+
+// IsAppPassword returns true if the given string has the format of an
+// application password (it does not check that it is valid).
+func IsAppPassword(password string) bool {
+	parts := strings.SplitN(password, separator, 2)
+	return len(parts) == 2 && len(parts[1]) == secretLen && !strings.Contains(password, ".")
+}
+
+// Check returns the application password document for the given password,
+// or ErrInvalidPassword if it is unknown or has been revoked.
+func Check(inst *instance.Instance, password string) (*AppPassword, error) {
+	if !IsAppPassword(password) {
+		return nil, ErrInvalidPassword
+	}
+	parts := strings.SplitN(password, separator, 2)
+	p, err := Find(inst, parts[0])
+	if err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, ErrInvalidPassword
+		}
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[1]))
+	if subtle.ConstantTimeCompare(p.Hash, hash[:]) != 1 {
+		return nil, ErrInvalidPassword
+	}
+	return p, nil
+}
@@ -0,0 +1,78 @@
+package contact
+
+import (
+	"encoding/json"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// Group is a struct for a group of contacts. Like for the contacts, a map is
+// used to not lose the fields added by the front applications.
+type Group struct {
+	couchdb.JSONDoc
+}
+
+// NewGroup returns a new blank group.
+func NewGroup() *Group {
+	return &Group{
+		JSONDoc: couchdb.JSONDoc{
+			M: make(map[string]interface{}),
+		},
+	}
+}
+
+// DocType returns the group document type
+func (g *Group) DocType() string { return consts.Groups }
+
+// Name returns the name of the group
+func (g *Group) Name() string {
+	name, _ := g.Get("name").(string)
+	return name
+}
+
+// ListContacts returns the contacts of this group.
+func (g *Group) ListContacts(db prefixer.Prefixer) ([]*Contact, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(db, couchdb.ContactsByGroupView, &couchdb.ViewRequest{
+		Key:         g.ID(),
+		IncludeDocs: true,
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	contacts := make([]*Contact, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		doc := &Contact{}
+		if err := json.Unmarshal(row.Doc, &doc); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, doc)
+	}
+	return contacts, nil
+}
+
+// FindGroup returns the group of contacts stored in database from a given ID
+func FindGroup(db prefixer.Prefixer, groupID string) (*Group, error) {
+	doc := &Group{}
+	err := couchdb.GetDoc(db, consts.Groups, groupID, doc)
+	return doc, err
+}
+
+// GroupIDs returns the identifiers of the groups of the contact.
+func (c *Contact) GroupIDs() []string {
+	rels, _ := c.Get("relationships").(map[string]interface{})
+	groups, _ := rels["groups"].(map[string]interface{})
+	data, _ := groups["data"].([]interface{})
+	ids := make([]string, 0, len(data))
+	for _, ref := range data {
+		item, _ := ref.(map[string]interface{})
+		if id, ok := item["_id"].(string); ok && id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+var _ couchdb.Doc = &Group{}
@@ -51,6 +51,9 @@ const (
 	Basic AuthMode = iota
 	// TwoFactorMail authentication mode, with passcode sent via email
 	TwoFactorMail
+	// TwoFactorTOTP authentication mode, with passcode generated by an
+	// authenticator application (RFC 6238)
+	TwoFactorTOTP
 )
 
 // AuthModeToString encode authentication mode in a string
@@ -58,6 +61,8 @@ func AuthModeToString(authMode AuthMode) string {
 	switch authMode {
 	case TwoFactorMail:
 		return "two_factor_mail"
+	case TwoFactorTOTP:
+		return "two_factor_totp"
 	default:
 		return "basic"
 	}
@@ -69,6 +74,8 @@ func StringToAuthMode(authMode string) (AuthMode, error) {
 	switch authMode {
 	case "two_factor_mail":
 		return TwoFactorMail, nil
+	case "two_factor_totp":
+		return TwoFactorTOTP, nil
 	case "basic":
 		return Basic, nil
 	default:
@@ -82,6 +89,20 @@ func (i *Instance) HasAuthMode(authMode AuthMode) bool {
 	return i.AuthMode == authMode
 }
 
+// HasTwoFactorAuth returns true if a second factor is required to log in on
+// this instance, whatever the authentication mode for it.
+func (i *Instance) HasTwoFactorAuth() bool {
+	return i.AuthMode == TwoFactorMail || i.AuthMode == TwoFactorTOTP
+}
+
+// GenerateTwoFactorToken generates a token that can be used to allow the
+// two-factor form, when the passcode is not generated by the stack but by an
+// authenticator application.
+func (i *Instance) GenerateTwoFactorToken() ([]byte, error) {
+	salt := crypto.GenerateRandomBytes(sha256.Size)
+	return crypto.EncodeAuthMessage(totpMACConfig, i.SessionSecret(), salt, nil)
+}
+
 // GenerateTwoFactorSecrets generates a (token, passcode) pair that can be
 // used as a two factor authentication secret value. The token is used to allow
 // the two-factor form — meaning the user has correctly entered its passphrase
@@ -112,12 +133,22 @@ func (i *Instance) GenerateTwoFactorSecrets() (token []byte, passcode string, er
 
 // ValidateTwoFactorPasscode validates the given (token, passcode) pair for two
 // factor authentication.
+//
+// For the TwoFactorTOTP authentication mode, the passcode is checked against
+// the secret of the authenticator application, or it can be a recovery code.
+// In this mode, the instance is modified (time step of the passcode or
+// consumed recovery code), and the caller is responsible for saving it: see
+// lifecycle.CheckTwoFactorPasscode.
 func (i *Instance) ValidateTwoFactorPasscode(token []byte, passcode string) bool {
 	salt, err := crypto.DecodeAuthMessage(totpMACConfig, i.SessionSecret(), token, nil)
 	if err != nil {
 		return false
 	}
 
+	if i.HasAuthMode(TwoFactorTOTP) {
+		return i.ValidateTOTPPasscode(passcode) || i.ConsumeRecoveryCode(passcode)
+	}
+
 	h := hkdf.New(sha256.New, i.SessionSecret(), salt, nil)
 	key := make([]byte, 32)
 	_, err = io.ReadFull(h, key)
@@ -129,6 +160,14 @@ func (i *Instance) ValidateTwoFactorPasscode(token []byte, passcode string) bool
 	return ok && err == nil
 }
 
+// ValidateTwoFactorToken returns true if the token has been generated for the
+// two-factor form, without checking a passcode. It is used when the second
+// factor is a security key.
+func (i *Instance) ValidateTwoFactorToken(token []byte) bool {
+	_, err := crypto.DecodeAuthMessage(totpMACConfig, i.SessionSecret(), token, nil)
+	return err == nil
+}
+
 // GenerateTwoFactorTrustedDeviceSecret generates a token that can be kept by the
 // user on-demand to avoid having two-factor authentication on a specific
 // machine.
@@ -25,10 +25,26 @@ var (
 	// ErrUnknownAuthMode is returned when an unknown authentication mode is
 	// used.
 	ErrUnknownAuthMode = errors.New("Unknown authentication mode")
+	// ErrTOTPNotEnrolled is returned when trying to activate the TOTP
+	// authentication mode before an authenticator application has been
+	// configured.
+	ErrTOTPNotEnrolled = errors.New("No authenticator application has been configured")
+	// ErrTOTPAtCreation is returned when an instance is created with the TOTP
+	// authentication mode.
+	ErrTOTPAtCreation = errors.New("TOTP must be enrolled by the user")
 	// ErrBadTOSVersion is returned when a malformed TOS version is provided.
 	ErrBadTOSVersion = errors.New("Bad format for TOS version")
 	// ErrInvalidSwiftLayout is returned when the Swift layout is unknown.
 	ErrInvalidSwiftLayout = errors.New("Invalid Swift layout")
 	// ErrDeletionAlreadyRequested is returned when a deletion has already been requested.
 	ErrDeletionAlreadyRequested = errors.New("The deletion has already been requested")
+	// ErrNoFilesEncryptionKey is returned when trying to encrypt the content
+	// of the files, but no key has been configured in the vault for that.
+	ErrNoFilesEncryptionKey = errors.New("No key has been configured for the encryption of the files")
+	// ErrMissingFilesEncryptionKey is returned when the key of the vault that
+	// has wrapped a key of the instance is no longer configured.
+	ErrMissingFilesEncryptionKey = errors.New("The key of the vault for the encryption of the files is missing")
+	// ErrFilesEncryptionNotEnabled is returned when the encryption at rest of
+	// the content of the files has not been enabled for the instance.
+	ErrFilesEncryptionNotEnabled = errors.New("The encryption of the files is not enabled")
 )
@@ -0,0 +1,113 @@
+package instance
+
+import (
+	"crypto/rand"
+	"io"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// filesKeyLen is the length in bytes of the keys used for encrypting the
+// content of the files.
+const filesKeyLen = 32
+
+// FilesKey is a key used for the encryption at rest of the content of the
+// files. It is persisted wrapped by a key of the vault: VaultKey is the
+// identifier of this key of the vault.
+type FilesKey struct {
+	ID       uint32 `json:"id"`
+	VaultKey string `json:"vault_key"`
+	Wrapped  []byte `json:"wrapped"`
+}
+
+// HasFilesEncryption returns true if the content of the files of this
+// instance is encrypted at rest.
+func (i *Instance) HasFilesEncryption() bool {
+	return len(i.FilesKeys) > 0
+}
+
+// CurrentFilesKey returns the key that must be used for encrypting new
+// contents. It implements the vfs.Keyring interface.
+func (i *Instance) CurrentFilesKey() (uint32, []byte, error) {
+	if len(i.FilesKeys) == 0 {
+		return 0, nil, ErrFilesEncryptionNotEnabled
+	}
+	k := i.FilesKeys[len(i.FilesKeys)-1]
+	key, err := k.unwrap()
+	if err != nil {
+		return 0, nil, err
+	}
+	return k.ID, key, nil
+}
+
+// FilesKey returns the key with the given identifier, for decrypting a
+// content. It implements the vfs.Keyring interface.
+func (i *Instance) FilesKey(id uint32) ([]byte, error) {
+	for _, k := range i.FilesKeys {
+		if k.ID == id {
+			return k.unwrap()
+		}
+	}
+	return nil, vfs.ErrUnknownEncryptionKey
+}
+
+// AddFilesKey generates a new key for the encryption of the content of the
+// files, that becomes the current key. The previous keys are kept for reading
+// the contents encrypted with them, but they are wrapped again with the
+// current key of the vault. The caller is responsible for saving the
+// instance.
+func (i *Instance) AddFilesKey() error {
+	vaultKey := config.GetVault().FilesEncryptionKey()
+	if vaultKey == nil {
+		return ErrNoFilesEncryptionKey
+	}
+
+	var id uint32
+	for _, k := range i.FilesKeys {
+		if k.VaultKey != vaultKey.ID() {
+			key, err := k.unwrap()
+			if err != nil {
+				return err
+			}
+			if k.Wrapped, err = vaultKey.Wrap(key); err != nil {
+				return err
+			}
+			k.VaultKey = vaultKey.ID()
+		}
+		if k.ID > id {
+			id = k.ID
+		}
+	}
+
+	key := make([]byte, filesKeyLen)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	wrapped, err := vaultKey.Wrap(key)
+	if err != nil {
+		return err
+	}
+	i.FilesKeys = append(i.FilesKeys, &FilesKey{
+		ID:       id + 1,
+		VaultKey: vaultKey.ID(),
+		Wrapped:  wrapped,
+	})
+
+	// The VFS must be created again to use the new keyring
+	i.vfs = nil
+	if err := i.MakeVFS(); err != nil {
+		i.FilesKeys = i.FilesKeys[:len(i.FilesKeys)-1]
+		i.vfs = nil
+		return err
+	}
+	return nil
+}
+
+func (k *FilesKey) unwrap() ([]byte, error) {
+	vaultKey := config.GetVault().FilesDecryptionKey(k.VaultKey)
+	if vaultKey == nil {
+		return nil, ErrMissingFilesEncryptionKey
+	}
+	return vaultKey.Unwrap(k.Wrapped)
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/cozy/cozy-stack/model/permission"
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/model/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/model/vfs/vfss3"
 	"github.com/cozy/cozy-stack/model/vfs/vfsswift"
 	build "github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/config/config"
@@ -91,6 +92,23 @@ type Instance struct {
 	OAuthSecret []byte `json:"oauth_secret,omitempty"`
 	// CLISecret is used to authenticate request from the CLI
 	CLISecret []byte `json:"cli_secret,omitempty"`
+	// TOTPSecret is the secret shared with the authenticator application of
+	// the user, for the two_factor_totp authentication mode
+	TOTPSecret []byte `json:"totp_secret,omitempty"`
+	// TOTPPendingSecret is a secret generated for an authenticator
+	// application, but not yet confirmed by the user
+	TOTPPendingSecret []byte `json:"totp_pending_secret,omitempty"`
+	// TOTPLastStep is the time step of the last passcode accepted from the
+	// authenticator application, to prevent it from being used again
+	TOTPLastStep int64 `json:"totp_last_step,omitempty"`
+	// RecoveryCodes are the hashes of the one-time codes that can be used
+	// when the authenticator application has been lost
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+
+	// FilesKeys are the keys used for the encryption at rest of the content
+	// of the files. They are wrapped by a key of the vault, and the last one
+	// is the current key.
+	FilesKeys []*FilesKey `json:"files_keys,omitempty"`
 
 	// FeatureFlags is the feature flags that are specific to this instance
 	FeatureFlags map[string]interface{} `json:"feature_flags,omitempty"`
@@ -145,6 +163,21 @@ func (i *Instance) Clone() couchdb.Doc {
 
 	cloned.CLISecret = make([]byte, len(i.CLISecret))
 	copy(cloned.CLISecret, i.CLISecret)
+
+	cloned.TOTPSecret = make([]byte, len(i.TOTPSecret))
+	copy(cloned.TOTPSecret, i.TOTPSecret)
+
+	cloned.TOTPPendingSecret = make([]byte, len(i.TOTPPendingSecret))
+	copy(cloned.TOTPPendingSecret, i.TOTPPendingSecret)
+
+	cloned.RecoveryCodes = make([]string, len(i.RecoveryCodes))
+	copy(cloned.RecoveryCodes, i.RecoveryCodes)
+
+	cloned.FilesKeys = make([]*FilesKey, len(i.FilesKeys))
+	for idx, k := range i.FilesKeys {
+		tmp := *k
+		cloned.FilesKeys[idx] = &tmp
+	}
 	return &cloned
 }
 
@@ -217,21 +250,30 @@ func (i *Instance) MakeVFS() error {
 	mutex := lock.ReadWrite(i, "vfs")
 	index := vfs.NewCouchdbIndexer(i)
 	disk := vfs.DiskThresholder(i)
+	var keys vfs.Keyring
+	if i.HasFilesEncryption() {
+		keys = i
+	}
 	var err error
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
-		i.vfs, err = vfsafero.New(i, index, disk, mutex, fsURL, i.DirName())
+		i.vfs, err = vfsafero.New(i, index, disk, keys, mutex, fsURL, i.DirName())
 	case config.SchemeSwift, config.SchemeSwiftSecure:
+		if keys != nil && i.SwiftLayout < 2 {
+			return vfs.ErrEncryptionNotSupported
+		}
 		switch i.SwiftLayout {
 		case 0:
 			i.vfs, err = vfsswift.New(i, index, disk, mutex)
 		case 1:
 			i.vfs, err = vfsswift.NewV2(i, index, disk, mutex)
 		case 2:
-			i.vfs, err = vfsswift.NewV3(i, index, disk, mutex)
+			i.vfs, err = vfsswift.NewV3(i, index, disk, keys, mutex)
 		default:
 			err = ErrInvalidSwiftLayout
 		}
+	case config.SchemeS3, config.SchemeS3Insecure:
+		i.vfs, err = vfss3.New(i, index, disk, keys, mutex)
 	default:
 		err = fmt.Errorf("instance: unknown storage provider %s", fsURL.Scheme)
 	}
@@ -261,6 +303,8 @@ func (i *Instance) ThumbsFS() vfs.Thumbser {
 		default:
 			panic(ErrInvalidSwiftLayout)
 		}
+	case config.SchemeS3, config.SchemeS3Insecure:
+		return vfss3.NewThumbsFs(i)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -617,7 +661,8 @@ func (i *Instance) PickKey(audience string) ([]byte, error) {
 	switch audience {
 	case consts.AppAudience, consts.KonnectorAudience:
 		return i.SessionSecret(), nil
-	case consts.RefreshTokenAudience, consts.AccessTokenAudience, consts.ShareAudience:
+	case consts.RefreshTokenAudience, consts.AccessTokenAudience,
+		consts.ShareAudience, consts.UnlockedShareAudience:
 		return i.OAuthSecret, nil
 	case consts.CLIAudience:
 		return i.CLISecret, nil
@@ -674,6 +719,14 @@ func (i *Instance) CreateShareCode(subject string) (string, error) {
 	return i.MakeJWT(consts.ShareAudience, subject, scope, sessionID, time.Now())
 }
 
+// CreateUnlockedShareCode returns a short-lived code for a share by link
+// protected by a password, that can be used after the password has been
+// checked. The stamp is used to invalidate the code if the password changes.
+func (i *Instance) CreateUnlockedShareCode(permID, stamp string) (string, error) {
+	sessionID := ""
+	return i.MakeJWT(consts.UnlockedShareAudience, permID, stamp, sessionID, time.Now())
+}
+
 // MovedError is used to return an error when the instance has been moved to a
 // new domain/hoster.
 func (i *Instance) MovedError() *jsonapi.Error {
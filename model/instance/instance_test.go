@@ -2,12 +2,15 @@ package instance_test
 
 import (
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/pquerna/otp/totp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -50,6 +53,59 @@ func TestBuildAppToken(t *testing.T) {
 	assert.Equal(t, "my-app", claims["sub"])
 }
 
+func TestTOTPEnrollment(t *testing.T) {
+	inst := &instance.Instance{
+		Domain:     "test-totp.example.com",
+		SessSecret: crypto.GenerateRandomBytes(64),
+	}
+
+	key, err := inst.NewTOTPKey()
+	assert.NoError(t, err)
+	assert.Empty(t, inst.TOTPSecret)
+	assert.False(t, inst.ValidateTOTPPasscode("123456"))
+
+	assert.False(t, inst.ConfirmTOTPKey("000000x"))
+	passcode, err := totp.GenerateCode(key.Secret(), time.Now().UTC())
+	assert.NoError(t, err)
+	assert.True(t, inst.ConfirmTOTPKey(passcode))
+	assert.Equal(t, key.Secret(), string(inst.TOTPSecret))
+	assert.Empty(t, inst.TOTPPendingSecret)
+
+	// A passcode cannot be used twice
+	assert.False(t, inst.ValidateTOTPPasscode(passcode))
+	next, err := totp.GenerateCode(key.Secret(), time.Now().UTC().Add(30*time.Second))
+	assert.NoError(t, err)
+	assert.True(t, inst.ValidateTOTPPasscode(next))
+	assert.False(t, inst.ValidateTOTPPasscode(next))
+	assert.False(t, inst.ValidateTOTPPasscode(passcode))
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	inst := &instance.Instance{}
+	codes := inst.GenerateRecoveryCodes()
+	assert.Len(t, codes, instance.RecoveryCodesCount)
+	assert.Len(t, inst.RecoveryCodes, instance.RecoveryCodesCount)
+	for k, code := range codes {
+		assert.Regexp(t, `^[a-z2-7]{4}-[a-z2-7]{4}$`, code)
+		assert.NotContains(t, inst.RecoveryCodes, code)
+		assert.NotContains(t, codes[k+1:], code)
+	}
+}
+
+func TestConsumeRecoveryCode(t *testing.T) {
+	inst := &instance.Instance{}
+	codes := inst.GenerateRecoveryCodes()
+	assert.False(t, inst.ConsumeRecoveryCode("aaaa-bbbb"))
+	assert.Len(t, inst.RecoveryCodes, instance.RecoveryCodesCount)
+	// The case and the separators are ignored
+	assert.True(t, inst.ConsumeRecoveryCode(strings.ToUpper(strings.Replace(codes[3], "-", " ", 1))))
+	assert.Len(t, inst.RecoveryCodes, instance.RecoveryCodesCount-1)
+	// A recovery code can be used only once
+	assert.False(t, inst.ConsumeRecoveryCode(codes[3]))
+	assert.True(t, inst.ConsumeRecoveryCode(codes[0]))
+	assert.Len(t, inst.RecoveryCodes, instance.RecoveryCodesCount-2)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	res := m.Run()
@@ -167,6 +167,11 @@ func CreateWithoutHooks(opts *Options) (*instance.Instance, error) {
 	if opts.AuthMode != "" {
 		var authMode instance.AuthMode
 		if authMode, err = instance.StringToAuthMode(opts.AuthMode); err == nil {
+			// The TOTP authentication mode can't be used until the user has
+			// configured an authenticator application
+			if authMode == instance.TwoFactorTOTP {
+				return nil, instance.ErrTOTPAtCreation
+			}
 			i.AuthMode = authMode
 		}
 	}
@@ -0,0 +1,39 @@
+package lifecycle
+
+import (
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/vfs"
+)
+
+// EnableFilesEncryption enables the encryption at rest of the content of the
+// files for the given instance. The files already present are kept in clear
+// until they are re-encrypted (see RotateFilesKey).
+func EnableFilesEncryption(inst *instance.Instance) error {
+	if inst.HasFilesEncryption() {
+		return nil
+	}
+	if err := inst.AddFilesKey(); err != nil {
+		return err
+	}
+	return update(inst)
+}
+
+// RotateFilesKey generates a new key for the encryption of the content of
+// the files. The new contents are encrypted with this key, and if reencrypt
+// is true, the existing contents are re-encrypted with it. It returns the
+// number of contents that have been re-encrypted.
+func RotateFilesKey(inst *instance.Instance, reencrypt bool) (int, error) {
+	if !inst.HasFilesEncryption() {
+		return 0, instance.ErrFilesEncryptionNotEnabled
+	}
+	if err := inst.AddFilesKey(); err != nil {
+		return 0, err
+	}
+	if err := update(inst); err != nil {
+		return 0, err
+	}
+	if !reencrypt {
+		return 0, nil
+	}
+	return vfs.ReencryptContents(inst.VFS())
+}
@@ -216,9 +216,9 @@ func UpdatePassphrase(
 	// With two factor authentication, we do not check the validity of the
 	// current passphrase, but the validity of the pair passcode/token which has
 	// been exchanged against the current passphrase.
-	if inst.HasAuthMode(instance.TwoFactorMail) {
-		if !inst.ValidateTwoFactorPasscode(twoFactorToken, twoFactorPasscode) {
-			return instance.ErrInvalidTwoFactor
+	if inst.HasTwoFactorAuth() {
+		if err := CheckTwoFactorPasscode(inst, twoFactorToken, twoFactorPasscode); err != nil {
+			return err
 		}
 	} else {
 		// the needUpdate flag is not checked against since the passphrase will be
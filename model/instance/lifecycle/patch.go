@@ -92,6 +92,14 @@ func Patch(i *instance.Instance, opts *Options) error {
 				return err
 			}
 			if i.AuthMode != authMode {
+				if authMode == instance.TwoFactorTOTP && len(i.TOTPSecret) == 0 {
+					return instance.ErrTOTPNotEnrolled
+				}
+				if i.AuthMode == instance.TwoFactorTOTP {
+					i.TOTPSecret = nil
+					i.TOTPLastStep = 0
+					i.RecoveryCodes = nil
+				}
 				i.AuthMode = authMode
 				needUpdate = true
 			}
@@ -1,6 +1,10 @@
 package lifecycle
 
-import "github.com/cozy/cozy-stack/model/instance"
+import (
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/pquerna/otp"
+)
 
 // SendTwoFactorPasscode sends by mail the two factor secret to the owner of
 // the instance. It returns the generated token.
@@ -31,3 +35,75 @@ func SendMailConfirmationCode(inst *instance.Instance) error {
 		TemplateValues: map[string]interface{}{"TwoFactorActivationPasscode": passcode},
 	})
 }
+
+// StartTwoFactorAuth is called when the user has entered their passphrase on
+// an instance with two-factor authentication. It returns the token for the
+// two-factor form, and sends the passcode by mail if needed.
+func StartTwoFactorAuth(inst *instance.Instance) ([]byte, error) {
+	if inst.HasAuthMode(instance.TwoFactorTOTP) {
+		return inst.GenerateTwoFactorToken()
+	}
+	return SendTwoFactorPasscode(inst)
+}
+
+// CheckTwoFactorPasscode validates the (token, passcode) pair for the
+// two-factor authentication, and returns instance.ErrInvalidTwoFactor if it
+// is not valid. With the TOTP authentication mode, the instance is saved with
+// the time step of the passcode, or without the recovery code that has been
+// used: if a concurrent request has used the same passcode, the update fails
+// with a conflict, and the passcode is refused.
+func CheckTwoFactorPasscode(inst *instance.Instance, token []byte, passcode string) error {
+	if !inst.ValidateTwoFactorPasscode(token, passcode) {
+		return instance.ErrInvalidTwoFactor
+	}
+	if !inst.HasAuthMode(instance.TwoFactorTOTP) {
+		return nil
+	}
+	if err := update(inst); err != nil {
+		if couchdb.IsConflictError(err) {
+			return instance.ErrInvalidTwoFactor
+		}
+		return err
+	}
+	return nil
+}
+
+// NewTOTPKey generates a new secret for an authenticator application. It must
+// be confirmed with EnableTOTP before being used.
+func NewTOTPKey(inst *instance.Instance) (*otp.Key, error) {
+	key, err := inst.NewTOTPKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := update(inst); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// EnableTOTP checks the passcode generated by the authenticator application,
+// and activates the TOTP authentication mode. It returns the recovery codes.
+func EnableTOTP(inst *instance.Instance, passcode string) ([]string, error) {
+	if !inst.ConfirmTOTPKey(passcode) {
+		return nil, instance.ErrInvalidTwoFactor
+	}
+	codes := inst.GenerateRecoveryCodes()
+	inst.AuthMode = instance.TwoFactorTOTP
+	if err := update(inst); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of an instance with the
+// TOTP authentication mode by new ones.
+func RegenerateRecoveryCodes(inst *instance.Instance) ([]string, error) {
+	if !inst.HasAuthMode(instance.TwoFactorTOTP) {
+		return nil, instance.ErrTOTPNotEnrolled
+	}
+	codes := inst.GenerateRecoveryCodes()
+	if err := update(inst); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
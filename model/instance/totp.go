@@ -0,0 +1,146 @@
+package instance
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// RecoveryCodesCount is the number of recovery codes generated for the
+// TwoFactorTOTP authentication mode.
+const RecoveryCodesCount = 10
+
+// The options for the authenticator applications are the ones of RFC 6238, as
+// most applications ignore the algorithm and digits parameters of the
+// otpauth:// URL.
+var authenticatorTOTPOptions = totp.ValidateOpts{
+	Period:    30,
+	Skew:      1,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// NewTOTPKey generates a new secret for an authenticator application. The
+// secret is kept as pending until the user has confirmed it with a passcode
+// (see ConfirmTOTPKey). The caller is responsible for saving the instance.
+func (i *Instance) NewTOTPKey() (*otp.Key, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      i.TemplateTitle(),
+		AccountName: i.ContextualDomain(),
+		Period:      authenticatorTOTPOptions.Period,
+		Digits:      authenticatorTOTPOptions.Digits,
+		Algorithm:   authenticatorTOTPOptions.Algorithm,
+	})
+	if err != nil {
+		return nil, err
+	}
+	i.TOTPPendingSecret = []byte(key.Secret())
+	return key, nil
+}
+
+// ConfirmTOTPKey checks the passcode against the pending secret, and if it is
+// valid, the pending secret becomes the secret for the authenticator
+// application. The caller is responsible for saving the instance.
+func (i *Instance) ConfirmTOTPKey(passcode string) bool {
+	if len(i.TOTPPendingSecret) == 0 {
+		return false
+	}
+	step, ok := validateTOTP(i.TOTPPendingSecret, passcode, 0)
+	if !ok {
+		return false
+	}
+	i.TOTPSecret = i.TOTPPendingSecret
+	i.TOTPPendingSecret = nil
+	i.TOTPLastStep = step
+	return true
+}
+
+// ValidateTOTPPasscode returns true if the passcode has been generated by the
+// authenticator application of the user. A passcode can be used only once: the
+// time step of the accepted passcode is kept in the instance, and the
+// passcodes for this step or an earlier one are rejected. The caller is
+// responsible for saving the instance.
+func (i *Instance) ValidateTOTPPasscode(passcode string) bool {
+	if len(i.TOTPSecret) == 0 {
+		return false
+	}
+	step, ok := validateTOTP(i.TOTPSecret, passcode, i.TOTPLastStep)
+	if !ok {
+		return false
+	}
+	i.TOTPLastStep = step
+	return true
+}
+
+// validateTOTP checks the passcode for the current time step, and the steps
+// around it allowed by the skew. It returns the matching step, if it is after
+// the given one.
+func validateTOTP(secret []byte, passcode string, after int64) (int64, bool) {
+	passcode = strings.TrimSpace(passcode)
+	period := int64(authenticatorTOTPOptions.Period)
+	current := time.Now().UTC().Unix() / period
+	skew := int64(authenticatorTOTPOptions.Skew)
+	for step := current - skew; step <= current+skew; step++ {
+		if step <= after {
+			continue
+		}
+		code, err := totp.GenerateCodeCustom(string(secret),
+			time.Unix(step*period, 0).UTC(), authenticatorTOTPOptions)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(passcode)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// GenerateRecoveryCodes generates a new set of recovery codes, that replace
+// the previous ones. Only a hash of the codes is kept in the instance, so the
+// codes must be shown to the user now. The caller is responsible for saving
+// the instance.
+func (i *Instance) GenerateRecoveryCodes() []string {
+	codes := make([]string, RecoveryCodesCount)
+	hashes := make([]string, RecoveryCodesCount)
+	for k := range codes {
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(crypto.GenerateRandomBytes(5)))
+		codes[k] = code[:4] + "-" + code[4:]
+		hashes[k] = hashRecoveryCode(codes[k])
+	}
+	i.RecoveryCodes = hashes
+	return codes
+}
+
+// ConsumeRecoveryCode returns true if the given code is one of the recovery
+// codes of the instance. A recovery code can be used only once: it is removed
+// from the instance. The caller is responsible for saving the instance.
+func (i *Instance) ConsumeRecoveryCode(code string) bool {
+	hash := hashRecoveryCode(code)
+	for k, h := range i.RecoveryCodes {
+		if h == hash {
+			i.RecoveryCodes = append(i.RecoveryCodes[:k:k], i.RecoveryCodes[k+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
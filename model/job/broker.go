@@ -26,15 +26,18 @@ const (
 	Done State = "done"
 	// Errored state
 	Errored State = "errored"
+	// Cancelled state
+	Cancelled State = "cancelled"
 )
 
 // defaultMaxLimits defines the maximum limit of how much jobs will be returned
 // for each job state
 var defaultMaxLimits map[State]int = map[State]int{
-	Queued:  50,
-	Running: 50,
-	Done:    50,
-	Errored: 50,
+	Queued:    50,
+	Running:   50,
+	Done:      50,
+	Errored:   50,
+	Cancelled: 50,
 }
 
 type (
@@ -49,6 +52,10 @@ type (
 		// This method is asynchronous.
 		PushJob(db prefixer.Prefixer, request *JobRequest) (*Job, error)
 
+		// CancelJob cancels a job: it is removed from its queue if it is
+		// queued, and its execution is stopped if it is running.
+		CancelJob(db prefixer.Prefixer, jobID string) (*Job, error)
+
 		// WorkerQueueLen returns the total element in the queue of the specified
 		// worker type.
 		WorkerQueueLen(workerType string) (int, error)
@@ -93,6 +100,18 @@ type (
 		FinishedAt  time.Time   `json:"finished_at"`
 		Error       string      `json:"error,omitempty"`
 		ForwardLogs bool        `json:"forward_logs,omitempty"`
+
+		// Fields for the workflows
+		WorkflowID string          `json:"workflow_id,omitempty"`
+		Parent     *JobParent      `json:"parent,omitempty"`
+		OnSuccess  []*JobFollowUp  `json:"on_success,omitempty"`
+		OnFailure  []*JobFollowUp  `json:"on_failure,omitempty"`
+		Children   []string        `json:"children,omitempty"`
+		Result     json.RawMessage `json:"result,omitempty"`
+
+		// Attempts are the previous executions of a job waiting for a retry
+		// scheduled by its retry policy
+		Attempts []JobAttempt `json:"attempts,omitempty"`
 	}
 
 	// JobRequest struct is used to represent a new job request.
@@ -107,12 +126,18 @@ type (
 		Debounced   bool
 		ForwardLogs bool
 		Options     *JobOptions
+		OnSuccess   []*JobFollowUp
+		OnFailure   []*JobFollowUp
+		Parent      *JobParent
+		WorkflowID  string
 	}
 
 	// JobOptions struct contains the execution properties of the jobs.
 	JobOptions struct {
 		MaxExecCount int           `json:"max_exec_count"`
 		Timeout      time.Duration `json:"timeout"`
+		Priority     int           `json:"priority,omitempty"`
+		Retry        *RetryPolicy  `json:"retry,omitempty"`
 	}
 )
 
@@ -164,6 +189,14 @@ func (j *Job) Clone() couchdb.Doc {
 		j.Payload = make([]byte, len(tmp))
 		copy(j.Payload[:], tmp)
 	}
+	if j.Children != nil {
+		cloned.Children = make([]string, len(j.Children))
+		copy(cloned.Children, j.Children)
+	}
+	if j.Attempts != nil {
+		cloned.Attempts = make([]JobAttempt, len(j.Attempts))
+		copy(cloned.Attempts, j.Attempts)
+	}
 	return &cloned
 }
 
@@ -239,6 +272,16 @@ func (j *Job) Nack(errorMessage string) error {
 	return j.Update()
 }
 
+// Retry sets the job infos state back to Queued, with the attempts made so
+// far, for a retry that will be executed later.
+func (j *Job) Retry(attempts []JobAttempt, errorMessage string) error {
+	j.Logger().Debugf("retry %s", j.ID())
+	j.State = Queued
+	j.Error = errorMessage
+	j.Attempts = attempts
+	return j.Update()
+}
+
 // Update updates the job in couchdb
 func (j *Job) Update() error {
 	err := couchdb.UpdateDoc(j, j)
@@ -336,6 +379,10 @@ func NewJob(db prefixer.Prefixer, req *JobRequest) *Job {
 		Payload:     req.Payload,
 		Options:     req.Options,
 		ForwardLogs: req.ForwardLogs,
+		OnSuccess:   req.OnSuccess,
+		OnFailure:   req.OnFailure,
+		Parent:      req.Parent,
+		WorkflowID:  req.WorkflowID,
 		State:       Queued,
 		QueuedAt:    time.Now(),
 	}
@@ -454,7 +501,7 @@ func GetLastsJobs(jobs []*Job, workerType string) ([]*Job, error) {
 	// Ordering by QueuedAt before filtering jobs
 	sort.Slice(jobs, func(i, j int) bool { return jobs[i].QueuedAt.Before(jobs[j].QueuedAt) })
 
-	for _, state := range []State{Queued, Running, Done, Errored} {
+	for _, state := range []State{Queued, Running, Done, Errored, Cancelled} {
 		limit := defaultMaxLimits[state]
 
 		filtered := FilterByWorkerAndState(jobs, workerType, state, limit)
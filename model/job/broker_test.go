@@ -1,11 +1,14 @@
 package job_test
 
 import (
+	"context"
+	"sync"
 	"testing"
 	"time"
 
 	jobs "github.com/cozy/cozy-stack/model/job"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetJobsBeforeDate(t *testing.T) {
@@ -146,3 +149,97 @@ func TestGetLastsJobs(t *testing.T) {
 	assert.Equal(t, futureDate.String(), j[len(j)-1].QueuedAt.String())
 	assert.Equal(t, jobs.Errored, j[len(j)-1].State)
 }
+
+func TestJobPriority(t *testing.T) {
+	j := &jobs.Job{}
+	assert.Equal(t, jobs.PriorityNormal, j.Priority())
+	j.Options = &jobs.JobOptions{Priority: jobs.PriorityLow}
+	assert.Equal(t, jobs.PriorityLow, j.Priority())
+	j.Options.Priority = -5
+	assert.Equal(t, jobs.PriorityLow, j.Priority())
+	j.Options.Priority = 5
+	assert.Equal(t, jobs.PriorityHigh, j.Priority())
+	j.Options.Priority = jobs.PriorityLow
+	j.Manual = true
+	assert.Equal(t, jobs.PriorityHigh, j.Priority())
+}
+
+// priorityCases are the orders of execution of the jobs pushed by
+// runJobsWithPriorities, for each random number used to choose the first
+// queue: with the weights of 4 for the high priority, 2 for the normal
+// priority and 1 for the low priority, the high queue is looked at first for
+// 4 numbers out of 7, the normal queue for 2 and the low queue for 1.
+var priorityCases = []struct {
+	r        int
+	expected []string
+}{
+	{0, []string{"h1", "h2", "n", "l"}},
+	{1, []string{"h1", "h2", "n", "l"}},
+	{2, []string{"h1", "h2", "n", "l"}},
+	{3, []string{"h1", "h2", "n", "l"}},
+	{4, []string{"h1", "n", "h2", "l"}},
+	{5, []string{"h1", "n", "h2", "l"}},
+	{6, []string{"h1", "l", "h2", "n"}},
+}
+
+// runJobsWithPriorities pushes a job that blocks the only worker, then the
+// jobs h1 (high), l (low), n (normal) and h2 (high) while it is blocked, and
+// returns the order of execution of these 4 jobs. The job h1 is always the
+// first, as the others are pushed once it has been taken from the queues.
+func runJobsWithPriorities(t *testing.T, broker jobs.Broker, workerType string) []string {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	var w sync.WaitGroup
+	w.Add(4)
+
+	err := broker.StartWorkers(jobs.WorkersList{
+		{
+			WorkerType:  workerType,
+			Concurrency: 1,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				var msg string
+				if err := ctx.UnmarshalMessage(&msg); err != nil {
+					return err
+				}
+				if msg == "blocker" {
+					close(started)
+					<-unblock
+					return nil
+				}
+				mu.Lock()
+				order = append(order, msg)
+				mu.Unlock()
+				w.Done()
+				return nil
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	push := func(name string, priority int) {
+		msg, _ := jobs.NewMessage(name)
+		_, err := broker.PushJob(testInstance, &jobs.JobRequest{
+			WorkerType: workerType,
+			Message:    msg,
+			Options:    &jobs.JobOptions{Priority: priority},
+		})
+		require.NoError(t, err)
+	}
+	push("blocker", jobs.PriorityNormal)
+	<-started
+	push("h1", jobs.PriorityHigh)
+	require.Eventually(t, func() bool {
+		n, err := broker.WorkerQueueLen(workerType)
+		return err == nil && n == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	push("l", jobs.PriorityLow)
+	push("n", jobs.PriorityNormal)
+	push("h2", jobs.PriorityHigh)
+	close(unblock)
+
+	w.Wait()
+	require.NoError(t, broker.ShutdownWorkers(context.Background()))
+	return order
+}
@@ -0,0 +1,120 @@
+package job
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// cancelFunc stops the execution of a job, and returns false if the job can
+// no longer be stopped by this function.
+type cancelFunc func() bool
+
+// runningJobs keeps the functions to cancel the contexts of the jobs executed
+// by the workers of this process.
+var runningJobs = struct {
+	sync.Mutex
+	cancels map[string]cancelFunc
+}{cancels: make(map[string]cancelFunc)}
+
+func registerRunningJob(jobID string, cancel cancelFunc) {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	runningJobs.cancels[jobID] = cancel
+}
+
+func unregisterRunningJob(jobID string) {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	delete(runningJobs.cancels, jobID)
+}
+
+// cancelRunningJob cancels the context of the given job, and returns false if
+// the job is not executed by this process. The lock is not held while the
+// job is cancelled, as the fair dispatcher needs it to remove a pending job.
+func cancelRunningJob(jobID string) bool {
+	runningJobs.Lock()
+	cancel, ok := runningJobs.cancels[jobID]
+	runningJobs.Unlock()
+	return ok && cancel()
+}
+
+// isCancelledJob returns true if the error for marking the job as running is
+// a conflict with its cancellation.
+func isCancelledJob(j *Job, err error) bool {
+	if !couchdb.IsConflictError(err) {
+		return false
+	}
+	current, err := Get(j, j.ID())
+	return err == nil && current.State == Cancelled
+}
+
+// Cancel sets the job infos state to Cancelled and sends the new job infos
+// on the channel.
+func (j *Job) Cancel() error {
+	j.Logger().Debugf("cancel %s", j.ID())
+	j.FinishedAt = time.Now()
+	j.State = Cancelled
+	j.Event = nil
+	j.Payload = nil
+	return j.Update()
+}
+
+// cancelJob is the common part of the CancelJob method of the brokers. A
+// queued job is removed from its queue by dequeue, which returns false if the
+// job was no longer in the queue, and the execution of a running job is
+// stopped by interrupt. For a running job, the state is set to cancelled by
+// the worker when the execution has been stopped.
+func cancelJob(
+	db prefixer.Prefixer,
+	jobID string,
+	dequeue func(j *Job) (bool, error),
+	interrupt func(j *Job) error,
+) (*Job, error) {
+	j, err := Get(db, jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch j.State {
+	case Queued:
+		// The jobs for the client worker are not in a queue
+		if j.WorkerType != "client" {
+			removed, err := dequeue(j)
+			if err != nil {
+				return nil, err
+			}
+			if !removed {
+				// A worker has taken the job in the meantime, but it may
+				// not have started it yet. Cancelling it with the revision
+				// read above is atomic: either the worker has not marked it
+				// as running and it will see the cancellation, or the update
+				// conflicts and the execution must be interrupted.
+				err := j.Cancel()
+				if !couchdb.IsConflictError(err) {
+					return j, err
+				}
+				if j, err = Get(db, jobID); err != nil {
+					return nil, err
+				}
+				if j.State != Running && j.State != Queued {
+					return nil, ErrNotCancellable
+				}
+				return j, interrupt(j)
+			}
+		}
+	case Running:
+		if j.WorkerType != "client" {
+			return j, interrupt(j)
+		}
+	default:
+		return nil, ErrNotCancellable
+	}
+
+	if err := j.Cancel(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
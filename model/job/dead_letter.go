@@ -0,0 +1,194 @@
+package job
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// JobAttempt is an execution of a job by a worker.
+type JobAttempt struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// DeadJob is a job that has failed after all its attempts. It is kept in the
+// dead-letter queue, in the global database, to be replayed or dropped by an
+// administrator. Its identifier is the one of the failed job.
+type DeadJob struct {
+	DocID      string       `json:"_id,omitempty"`
+	DocRev     string       `json:"_rev,omitempty"`
+	Cluster    int          `json:"couch_cluster,omitempty"`
+	Domain     string       `json:"domain"`
+	Prefix     string       `json:"prefix,omitempty"`
+	WorkerType string       `json:"worker"`
+	TriggerID  string       `json:"trigger_id,omitempty"`
+	Message    Message      `json:"message"`
+	Manual     bool         `json:"manual_execution,omitempty"`
+	Options    *JobOptions  `json:"options,omitempty"`
+	Error      string       `json:"error"`
+	Attempts   []JobAttempt `json:"attempts"`
+	QueuedAt   time.Time    `json:"queued_at"`
+	FailedAt   time.Time    `json:"failed_at"`
+}
+
+// ID implements the couchdb.Doc interface
+func (d *DeadJob) ID() string { return d.DocID }
+
+// Rev implements the couchdb.Doc interface
+func (d *DeadJob) Rev() string { return d.DocRev }
+
+// DocType implements the couchdb.Doc interface
+func (d *DeadJob) DocType() string { return consts.DeadJobs }
+
+// Clone implements the couchdb.Doc interface
+func (d *DeadJob) Clone() couchdb.Doc {
+	cloned := *d
+	if d.Options != nil {
+		tmp := *d.Options
+		cloned.Options = &tmp
+	}
+	cloned.Message = make(Message, len(d.Message))
+	copy(cloned.Message, d.Message)
+	cloned.Attempts = make([]JobAttempt, len(d.Attempts))
+	copy(cloned.Attempts, d.Attempts)
+	return &cloned
+}
+
+// SetID implements the couchdb.Doc interface
+func (d *DeadJob) SetID(id string) { d.DocID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (d *DeadJob) SetRev(rev string) { d.DocRev = rev }
+
+// DBCluster implements the prefixer.Prefixer interface.
+func (d *DeadJob) DBCluster() int { return d.Cluster }
+
+// DBPrefix implements the prefixer.Prefixer interface.
+func (d *DeadJob) DBPrefix() string {
+	if d.Prefix != "" {
+		return d.Prefix
+	}
+	return d.Domain
+}
+
+// DomainName implements the prefixer.Prefixer interface.
+func (d *DeadJob) DomainName() string { return d.Domain }
+
+// addDeadJob puts a failed job in the dead-letter queue.
+func addDeadJob(j *Job, attempts []JobAttempt) error {
+	dead := &DeadJob{
+		DocID:      j.ID(),
+		Cluster:    j.Cluster,
+		Domain:     j.Domain,
+		Prefix:     j.Prefix,
+		WorkerType: j.WorkerType,
+		TriggerID:  j.TriggerID,
+		Message:    j.Message,
+		Manual:     j.Manual,
+		Options:    j.Options,
+		Error:      j.Error,
+		Attempts:   attempts,
+		QueuedAt:   j.QueuedAt,
+		FailedAt:   j.FinishedAt,
+	}
+	return couchdb.CreateNamedDocWithDB(prefixer.GlobalPrefixer, dead)
+}
+
+// ListDeadJobs returns the jobs in the dead-letter queue, optionally filtered
+// by domain and worker type.
+func ListDeadJobs(domain, workerType string) ([]*DeadJob, error) {
+	list := []*DeadJob{}
+	err := couchdb.ForeachDocs(prefixer.GlobalPrefixer, consts.DeadJobs, func(_ string, raw json.RawMessage) error {
+		var dead DeadJob
+		if err := json.Unmarshal(raw, &dead); err != nil {
+			return err
+		}
+		if domain != "" && dead.Domain != domain {
+			return nil
+		}
+		if workerType != "" && dead.WorkerType != workerType {
+			return nil
+		}
+		list = append(list, &dead)
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetDeadJob returns the job with the given identifier from the dead-letter
+// queue.
+func GetDeadJob(id string) (*DeadJob, error) {
+	var dead DeadJob
+	if err := couchdb.GetDoc(prefixer.GlobalPrefixer, consts.DeadJobs, id, &dead); err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return nil, ErrNotFoundJob
+		}
+		return nil, err
+	}
+	return &dead, nil
+}
+
+// Replay pushes again the job, and removes it from the dead-letter queue.
+func (d *DeadJob) Replay(b Broker) (*Job, error) {
+	j, err := b.PushJob(d, &JobRequest{
+		WorkerType: d.WorkerType,
+		TriggerID:  d.TriggerID,
+		Message:    d.Message,
+		Manual:     d.Manual,
+		Options:    d.Options,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Drop(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Drop removes the job from the dead-letter queue.
+func (d *DeadJob) Drop() error {
+	return couchdb.DeleteDoc(prefixer.GlobalPrefixer, d)
+}
+
+// PurgeDeadJobs removes from the dead-letter queue the jobs of the given
+// domain that have failed before the given date. If some worker types are
+// given, only the jobs of these workers are removed. It returns the number of
+// removed jobs.
+func PurgeDeadJobs(domain string, workerTypes []string, before time.Time) (int, error) {
+	list, err := ListDeadJobs(domain, "")
+	if err != nil {
+		return 0, err
+	}
+	var docs []couchdb.Doc
+	for _, dead := range list {
+		if !dead.FailedAt.Before(before) {
+			continue
+		}
+		if len(workerTypes) > 0 && !isInList(workerTypes, dead.WorkerType) {
+			continue
+		}
+		docs = append(docs, dead)
+	}
+	if err := couchdb.BulkDeleteDocs(prefixer.GlobalPrefixer, consts.DeadJobs, docs); err != nil {
+		return 0, err
+	}
+	return len(docs), nil
+}
+
+func isInList(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package job_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jobs "github.com/cozy/cozy-stack/model/job"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func waitDeadJob(t *testing.T, workerType string, count int) []*jobs.DeadJob {
+	var list []*jobs.DeadJob
+	for i := 0; i < 100; i++ {
+		var err error
+		list, err = jobs.ListDeadJobs(testInstance.Domain, workerType)
+		require.NoError(t, err)
+		if len(list) >= count {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Len(t, list, count)
+	return list
+}
+
+func TestDeadLetterQueue(t *testing.T) {
+	var fail int32 = 1
+	done := make(chan string, 10)
+
+	broker := jobs.NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(jobs.WorkersList{
+		{
+			WorkerType:   "dead",
+			Concurrency:  1,
+			MaxExecCount: 2,
+			Timeout:      1 * time.Second,
+			RetryDelay:   1 * time.Millisecond,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				var msg string
+				_ = ctx.UnmarshalMessage(&msg)
+				defer func() { done <- msg }()
+				if msg == "no-retry" {
+					ctx.SetNoRetry()
+					return errors.New("VENDOR_DOWN")
+				}
+				if atomic.LoadInt32(&fail) == 1 {
+					return errors.New("VENDOR_DOWN")
+				}
+				return nil
+			},
+		},
+	}))
+
+	// Add: a job that has failed after all its attempts is in the queue
+	msg, _ := jobs.NewMessage("failed")
+	j, err := broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "dead",
+		Message:    msg,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "failed", <-done)
+	assert.Equal(t, "failed", <-done)
+	list := waitDeadJob(t, "dead", 1)
+	dead := list[0]
+	assert.Equal(t, j.ID(), dead.ID())
+	assert.Equal(t, testInstance.Domain, dead.Domain)
+	assert.Equal(t, "VENDOR_DOWN", dead.Error)
+	assert.Len(t, dead.Attempts, 2)
+	assert.Equal(t, "VENDOR_DOWN", dead.Attempts[1].Error)
+	assert.Equal(t, msg, dead.Message)
+
+	// List: the filters on the domain and the worker type
+	list, err = jobs.ListDeadJobs("", "dead")
+	require.NoError(t, err)
+	assert.NotEmpty(t, list)
+	list, err = jobs.ListDeadJobs("unknown.cozy.localhost", "")
+	require.NoError(t, err)
+	assert.Empty(t, list)
+	list, err = jobs.ListDeadJobs(testInstance.Domain, "unknown")
+	require.NoError(t, err)
+	assert.Empty(t, list)
+
+	// A job that has asked to not be retried is not put in the queue
+	noRetry, _ := jobs.NewMessage("no-retry")
+	_, err = broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "dead",
+		Message:    noRetry,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "no-retry", <-done)
+	time.Sleep(50 * time.Millisecond)
+	waitDeadJob(t, "dead", 1)
+
+	// Replay: the job is pushed again and removed from the queue
+	atomic.StoreInt32(&fail, 0)
+	dead, err = jobs.GetDeadJob(j.ID())
+	require.NoError(t, err)
+	replayed, err := dead.Replay(broker)
+	require.NoError(t, err)
+	assert.NotEqual(t, j.ID(), replayed.ID())
+	assert.Equal(t, "failed", <-done)
+	_, err = jobs.GetDeadJob(j.ID())
+	assert.Equal(t, jobs.ErrNotFoundJob, err)
+
+	// Drop: the job is removed from the queue without being executed
+	atomic.StoreInt32(&fail, 1)
+	_, err = broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "dead",
+		Message:    msg,
+	})
+	require.NoError(t, err)
+	<-done
+	<-done
+	dead = waitDeadJob(t, "dead", 1)[0]
+	assert.NoError(t, dead.Drop())
+	_, err = jobs.GetDeadJob(dead.ID())
+	assert.Equal(t, jobs.ErrNotFoundJob, err)
+
+	// Purge: only the jobs failed before the date are removed
+	_, err = broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "dead",
+		Message:    msg,
+	})
+	require.NoError(t, err)
+	<-done
+	<-done
+	waitDeadJob(t, "dead", 1)
+	n, err := jobs.PurgeDeadJobs(testInstance.Domain, nil, time.Now().Add(-1*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	n, err = jobs.PurgeDeadJobs(testInstance.Domain, []string{"other"}, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	n, err = jobs.PurgeDeadJobs(testInstance.Domain, []string{"dead"}, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	waitDeadJob(t, "dead", 0)
+}
@@ -23,6 +23,14 @@ var (
 	// ErrAbort can be used to abort the execution of the job without causing
 	// errors.
 	ErrAbort = errors.New("jobs: abort")
+	// ErrNotCancellable is used when trying to cancel a job that is already
+	// finished
+	ErrNotCancellable = errors.New("jobs: the job is already finished")
+	// ErrInvalidWorkflow is used when the follow-ups of a job are not valid
+	ErrInvalidWorkflow = errors.New("jobs: invalid follow-ups")
+	// ErrInvalidRetryPolicy is used when the retry policy of a job is not
+	// valid
+	ErrInvalidRetryPolicy = errors.New("jobs: invalid retry policy")
 
 	// ErrUnknownTrigger is used when the trigger type is not recognized
 	ErrUnknownTrigger = errors.New("Unknown trigger type")
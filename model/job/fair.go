@@ -0,0 +1,284 @@
+package job
+
+import "time"
+
+const (
+	// fairPendingFactor is used to limit the number of jobs taken from the
+	// queue of the broker and kept in memory by the dispatcher: it can keep
+	// up to fairPendingFactor times the concurrency of the worker when all
+	// those jobs are for instances that have reached their limit.
+	fairPendingFactor = 4
+
+	// fairPushBackPause is how long the dispatcher waits before taking jobs
+	// from the queue again, when all the jobs of the queue have been pushed
+	// back (and no job has finished in the meantime).
+	fairPushBackPause = 1 * time.Second
+	// fairMaxPushBacks is the maximal number of jobs pushed back before a
+	// pause, for when the first pushed back job has been taken by another
+	// stack process.
+	fairMaxPushBacks = 1000
+)
+
+// fairDispatcher sits between the queue of a worker and its goroutines. The
+// jobs taken from the queue are given to the goroutines in a round-robin
+// fashion between the instances, and the number of jobs executed in parallel
+// for an instance can be limited, so that an instance with a lot of jobs
+// can't take all the slots of the worker.
+type fairDispatcher struct {
+	in        <-chan *Job
+	out       chan *Job
+	done      chan string
+	cancelled chan cancelRequest
+	stopped   chan struct{}
+	requeue   func(j *Job) error
+	pushBack  func(j *Job) error
+
+	concurrency    int
+	maxPerInstance int
+
+	pending   map[string][]*Job // the jobs waiting for a goroutine, by domain
+	ring      []string          // the domains with pending jobs
+	next      int               // the index in ring of the next domain to serve
+	running   map[string]int    // the number of running jobs, by domain
+	nbPending int
+
+	firstPushedBack string           // the first job pushed back since a job has finished
+	nbPushedBack    int              // the number of jobs pushed back since then
+	paused          <-chan time.Time // not nil when the queue is not read
+}
+
+// cancelRequest asks the dispatcher to remove a pending job. The dispatcher
+// responds on removed if the job was still pending.
+type cancelRequest struct {
+	jobID   string
+	removed chan bool
+}
+
+// newFairDispatcher creates a dispatcher for the jobs of the in channel. The
+// requeue function, if not nil, is used on shutdown to put back in the queue
+// of the broker the jobs that have not been executed. The pushBack function,
+// if not nil, is used to put at the tail of the queue the jobs for the
+// instances that have reached their limit, instead of keeping them in memory.
+func newFairDispatcher(in <-chan *Job, conf *WorkerConfig, requeue, pushBack func(j *Job) error) *fairDispatcher {
+	return &fairDispatcher{
+		in:             in,
+		out:            make(chan *Job),
+		done:           make(chan string, conf.Concurrency),
+		cancelled:      make(chan cancelRequest),
+		stopped:        make(chan struct{}),
+		requeue:        requeue,
+		pushBack:       pushBack,
+		concurrency:    conf.Concurrency,
+		maxPerInstance: conf.MaxPerInstance,
+		pending:        make(map[string][]*Job),
+		running:        make(map[string]int),
+	}
+}
+
+func (d *fairDispatcher) run() {
+	defer close(d.stopped)
+	for {
+		var out chan *Job
+		var next *Job
+		idx := d.pick()
+		if idx >= 0 {
+			out = d.out
+			next = d.pending[d.ring[idx]][0]
+		}
+
+		// The jobs are taken from the queue only if the dispatcher has few
+		// jobs, or if it has only jobs that can't be executed now
+		var in <-chan *Job
+		if d.paused == nil && (d.nbPending < d.concurrency ||
+			(idx < 0 && d.nbPending < fairPendingFactor*d.concurrency)) {
+			in = d.in
+		}
+
+		select {
+		case j, ok := <-in:
+			if !ok {
+				d.shutdown()
+				return
+			}
+			if !d.tryPushBack(j) {
+				d.push(j)
+			}
+		case out <- next:
+			d.pop(idx)
+			d.running[next.Domain]++
+		case domain := <-d.done:
+			if d.running[domain] <= 1 {
+				delete(d.running, domain)
+			} else {
+				d.running[domain]--
+			}
+			d.resume()
+		case <-d.paused:
+			d.resume()
+		case req := <-d.cancelled:
+			req.removed <- d.cancel(req.jobID)
+		}
+	}
+}
+
+// pick returns the index in the ring of the next domain for which a job can
+// be executed, or -1 if there are none.
+func (d *fairDispatcher) pick() int {
+	for i := 0; i < len(d.ring); i++ {
+		idx := (d.next + i) % len(d.ring)
+		domain := d.ring[idx]
+		if d.maxPerInstance <= 0 || d.running[domain] < d.maxPerInstance {
+			return idx
+		}
+	}
+	return -1
+}
+
+// tryPushBack puts the job at the tail of the queue of the broker if its
+// instance has already reached its limit with the running and pending jobs,
+// so that the jobs of the other instances don't have to wait behind it. When
+// all the jobs of the queue have been pushed back, the dispatcher stops
+// reading the queue until a job has finished.
+func (d *fairDispatcher) tryPushBack(j *Job) bool {
+	if d.pushBack == nil || d.maxPerInstance <= 0 {
+		return false
+	}
+	if d.running[j.Domain]+len(d.pending[j.Domain]) < d.maxPerInstance {
+		return false
+	}
+	if err := d.pushBack(j); err != nil {
+		j.Logger().Warnf("cannot push back the job in the queue: %s", err)
+		return false
+	}
+	d.nbPushedBack++
+	if d.firstPushedBack == "" {
+		d.firstPushedBack = j.ID()
+	} else if d.firstPushedBack == j.ID() || d.nbPushedBack >= fairMaxPushBacks {
+		d.paused = time.After(fairPushBackPause)
+	}
+	return true
+}
+
+// resume allows the dispatcher to take again jobs from the queue.
+func (d *fairDispatcher) resume() {
+	d.firstPushedBack = ""
+	d.nbPushedBack = 0
+	d.paused = nil
+}
+
+func (d *fairDispatcher) push(j *Job) {
+	if len(d.pending[j.Domain]) == 0 {
+		// The new domain is served last
+		if len(d.ring) == 0 {
+			d.ring = append(d.ring, j.Domain)
+		} else {
+			d.ring = append(d.ring[:d.next], append([]string{j.Domain}, d.ring[d.next:]...)...)
+			d.next++
+		}
+	}
+	d.pending[j.Domain] = append(d.pending[j.Domain], j)
+	d.nbPending++
+
+	// A job waiting in the dispatcher can be cancelled, like a running job.
+	// The request is handled by the loop of the dispatcher, like the pop, so
+	// the cancellation is acknowledged only if the job was still pending.
+	jobID := j.ID()
+	registerRunningJob(jobID, func() bool {
+		req := cancelRequest{jobID: jobID, removed: make(chan bool, 1)}
+		select {
+		case d.cancelled <- req:
+			return <-req.removed
+		case <-d.stopped:
+			return false
+		}
+	})
+}
+
+// pop removes the first job of the domain at the given index in the ring.
+func (d *fairDispatcher) pop(idx int) {
+	domain := d.ring[idx]
+	d.removeAt(domain, 0)
+	if len(d.pending[domain]) > 0 {
+		d.next = idx + 1
+	} else {
+		d.next = idx
+	}
+	if len(d.ring) > 0 {
+		d.next %= len(d.ring)
+	} else {
+		d.next = 0
+	}
+}
+
+// removeAt removes the pending job at position i for the given domain, and
+// removes the domain from the ring if it has no more pending jobs.
+func (d *fairDispatcher) removeAt(domain string, i int) {
+	jobs := d.pending[domain]
+	d.pending[domain] = append(jobs[:i], jobs[i+1:]...)
+	d.nbPending--
+	if len(d.pending[domain]) > 0 {
+		return
+	}
+	delete(d.pending, domain)
+	for idx, dom := range d.ring {
+		if dom == domain {
+			d.ring = append(d.ring[:idx], d.ring[idx+1:]...)
+			if idx < d.next {
+				d.next--
+			}
+			break
+		}
+	}
+	if d.next >= len(d.ring) {
+		d.next = 0
+	}
+}
+
+// cancel removes the pending job with the given identifier, and returns false
+// if it has already been given to a goroutine of the worker.
+func (d *fairDispatcher) cancel(jobID string) bool {
+	for domain, jobs := range d.pending {
+		for i, j := range jobs {
+			if j.ID() != jobID {
+				continue
+			}
+			d.removeAt(domain, i)
+			unregisterRunningJob(jobID)
+			go func(j *Job) {
+				if err := j.Cancel(); err != nil {
+					j.Logger().Errorf("error while cancelling job: %s", err)
+				}
+			}(j)
+			return true
+		}
+	}
+	return false
+}
+
+// finished must be called by the goroutines of the worker when they have
+// finished to execute a job given by the dispatcher.
+func (d *fairDispatcher) finished(j *Job) {
+	unregisterRunningJob(j.ID())
+	d.done <- j.Domain
+}
+
+// shutdown puts back the pending jobs in the queue of the broker, and closes
+// the out channel.
+func (d *fairDispatcher) shutdown() {
+	for _, jobs := range d.pending {
+		for _, j := range jobs {
+			unregisterRunningJob(j.ID())
+			if d.requeue == nil {
+				j.Logger().Warnf("job not executed before the shutdown")
+				continue
+			}
+			if err := d.requeue(j); err != nil {
+				j.Logger().Errorf("cannot put back the job in the queue: %s", err)
+			}
+		}
+	}
+	d.pending = nil
+	d.ring = nil
+	d.nbPending = 0
+	close(d.out)
+}
@@ -0,0 +1,157 @@
+package job
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+const (
+	// LogStreamStdout is the stream of the lines written by a job on its
+	// standard output.
+	LogStreamStdout = "stdout"
+	// LogStreamStderr is the stream of the lines written by a job on its
+	// error output.
+	LogStreamStderr = "stderr"
+
+	// maxLogLines is the number of lines kept in the logs of a job: when the
+	// buffer is full, the oldest lines are dropped.
+	maxLogLines = 1000
+	// maxLogLineLength is the maximal length of a line in the logs.
+	maxLogLineLength = 4000
+	// logsCacheDuration is how long the logs of a job can be retrieved after
+	// its execution.
+	logsCacheDuration = 24 * time.Hour
+)
+
+// JobLogLine is a line of the output of a job.
+type JobLogLine struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Stream  string    `json:"stream"`
+	Message string    `json:"message"`
+}
+
+// JobLogs are the last lines of the output of a job. Dropped is the number of
+// older lines that have been removed from the buffer.
+type JobLogs struct {
+	JobID   string        `json:"job_id"`
+	Lines   []*JobLogLine `json:"lines"`
+	Dropped int           `json:"dropped"`
+}
+
+// logEvent is the document sent on the realtime hub for a line of the logs.
+// It has the same format as the logs forwarded by the forward_logs option.
+type logEvent struct {
+	JobID   string    `json:"_id"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+	Level   string    `json:"level"`
+	Stream  string    `json:"stream"`
+}
+
+func (e *logEvent) ID() string      { return e.JobID }
+func (e *logEvent) DocType() string { return consts.JobsLogs }
+
+// logRing is a bounded ring buffer for the lines of the logs of a job. It
+// can be used concurrently by the goroutines reading stdout and stderr.
+type logRing struct {
+	mu      sync.Mutex
+	lines   []*JobLogLine
+	start   int
+	dropped int
+}
+
+func (r *logRing) add(line *JobLogLine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.lines) < maxLogLines {
+		r.lines = append(r.lines, line)
+		return
+	}
+	r.lines[r.start] = line
+	r.start = (r.start + 1) % maxLogLines
+	r.dropped++
+}
+
+func (r *logRing) snapshot(jobID string) *JobLogs {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lines := make([]*JobLogLine, 0, len(r.lines))
+	lines = append(lines, r.lines[r.start:]...)
+	lines = append(lines, r.lines[:r.start]...)
+	return &JobLogs{JobID: jobID, Lines: lines, Dropped: r.dropped}
+}
+
+func (r *logRing) empty() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.lines) == 0
+}
+
+// AppendLog adds a line to the logs of the job, and sends it on the realtime
+// hub with the io.cozy.jobs.logs doctype. When the job has the forward_logs
+// option, the logs of the stack are already sent on the realtime hub, and
+// the line is only kept in the logs of the job.
+func (c *WorkerContext) AppendLog(stream, level, message string) {
+	if len(message) > maxLogLineLength {
+		message = message[:maxLogLineLength]
+	}
+	line := &JobLogLine{
+		Time:    time.Now(),
+		Level:   level,
+		Stream:  stream,
+		Message: message,
+	}
+	c.logs.add(line)
+	if c.job.ForwardLogs {
+		return
+	}
+	realtime.GetHub().Publish(c.job, realtime.EventCreate, &logEvent{
+		JobID:   c.job.ID(),
+		Time:    line.Time,
+		Message: line.Message,
+		Level:   line.Level,
+		Stream:  line.Stream,
+	}, nil)
+}
+
+// saveLogs puts the logs of the job in the cache, so that they can be
+// retrieved after its execution.
+func (c *WorkerContext) saveLogs() {
+	if c.logs.empty() {
+		return
+	}
+	buf, err := json.Marshal(c.logs.snapshot(c.job.ID()))
+	if err != nil {
+		c.Logger().Warnf("Cannot save the logs: %s", err)
+		return
+	}
+	cache := config.GetConfig().CacheStorage
+	cache.Set(logsCacheKey(c.job, c.job.ID()), buf, logsCacheDuration)
+}
+
+// GetLogs returns the logs of the last execution of a job. The logs of a job
+// are kept for 24 hours, and a job without logs has no lines.
+func GetLogs(db prefixer.Prefixer, jobID string) (*JobLogs, error) {
+	logs := &JobLogs{JobID: jobID, Lines: []*JobLogLine{}}
+	cache := config.GetConfig().CacheStorage
+	buf, ok := cache.Get(logsCacheKey(db, jobID))
+	if !ok {
+		return logs, nil
+	}
+	if err := json.Unmarshal(buf, logs); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+func logsCacheKey(db prefixer.Prefixer, jobID string) string {
+	return fmt.Sprintf("jobs-logs:%s:%s", db.DomainName(), jobID)
+}
@@ -4,8 +4,10 @@ import (
 	"container/list"
 	"context"
 	"fmt"
+	"math/rand"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/limits"
@@ -21,9 +23,11 @@ type (
 		Jobs        chan *Job
 		closed      chan struct{}
 
-		list *list.List
-		run  bool
-		jmu  sync.RWMutex
+		lists   map[int]*list.List     // a list by priority
+		delayed map[string]*time.Timer // the jobs waiting for a retry
+		run     bool
+		stopped bool
+		jmu     sync.RWMutex
 	}
 
 	// memBroker is an in-memory broker implementation of the Broker interface.
@@ -37,10 +41,15 @@ type (
 
 // newMemQueue creates and a new in-memory queue.
 func newMemQueue(workerType string) *memQueue {
+	lists := make(map[int]*list.List, len(priorities))
+	for _, prio := range priorities {
+		lists[prio] = list.New()
+	}
 	return &memQueue{
-		list:   list.New(),
-		Jobs:   make(chan *Job),
-		closed: make(chan struct{}),
+		lists:   lists,
+		delayed: make(map[string]*time.Timer),
+		Jobs:    make(chan *Job),
+		closed:  make(chan struct{}),
 	}
 }
 
@@ -48,7 +57,10 @@ func newMemQueue(workerType string) *memQueue {
 func (q *memQueue) Enqueue(job *Job) error {
 	q.jmu.Lock()
 	defer q.jmu.Unlock()
-	q.list.PushBack(job.Clone())
+	if q.stopped {
+		return ErrClosed
+	}
+	q.lists[job.Priority()].PushBack(job.Clone())
 	if !q.run {
 		q.run = true
 		go q.send()
@@ -56,16 +68,44 @@ func (q *memQueue) Enqueue(job *Job) error {
 	return nil
 }
 
+// EnqueueAfter puts the job into the queue after the given delay.
+func (q *memQueue) EnqueueAfter(job *Job, delay time.Duration) error {
+	q.jmu.Lock()
+	defer q.jmu.Unlock()
+	if q.stopped {
+		return ErrClosed
+	}
+	id := job.ID()
+	cloned := job.Clone().(*Job)
+	q.delayed[id] = time.AfterFunc(delay, func() {
+		q.jmu.Lock()
+		_, ok := q.delayed[id]
+		delete(q.delayed, id)
+		q.jmu.Unlock()
+		if ok {
+			_ = q.Enqueue(cloned)
+		}
+	})
+	return nil
+}
+
 func (q *memQueue) send() {
 	for {
 		q.jmu.Lock()
-		e := q.list.Front()
+		var e *list.Element
+		var l *list.List
+		for _, prio := range priorityOrder(rand.Intn) {
+			l = q.lists[prio]
+			if e = l.Front(); e != nil {
+				break
+			}
+		}
 		if e == nil || !q.run {
 			q.run = false
 			q.jmu.Unlock()
 			return
 		}
-		q.list.Remove(e)
+		l.Remove(e)
 		q.jmu.Unlock()
 		select {
 		case <-q.closed:
@@ -78,6 +118,11 @@ func (q *memQueue) send() {
 func (q *memQueue) close() {
 	q.jmu.Lock()
 	defer q.jmu.Unlock()
+	q.stopped = true
+	for id, timer := range q.delayed {
+		timer.Stop()
+		delete(q.delayed, id)
+	}
 	if !q.run {
 		return
 	}
@@ -85,11 +130,36 @@ func (q *memQueue) close() {
 	go func() { q.closed <- struct{}{} }()
 }
 
+// Remove removes the job with the given identifier from the queue, and
+// returns false if it was not in the queue.
+func (q *memQueue) Remove(jobID string) bool {
+	q.jmu.Lock()
+	defer q.jmu.Unlock()
+	if timer, ok := q.delayed[jobID]; ok {
+		timer.Stop()
+		delete(q.delayed, jobID)
+		return true
+	}
+	for _, l := range q.lists {
+		for e := l.Front(); e != nil; e = e.Next() {
+			if e.Value.(*Job).ID() == jobID {
+				l.Remove(e)
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Len returns the length of the queue
 func (q *memQueue) Len() int {
 	q.jmu.RLock()
 	defer q.jmu.RUnlock()
-	return q.list.Len()
+	n := 0
+	for _, l := range q.lists {
+		n += l.Len()
+	}
+	return n
 }
 
 // NewMemBroker creates a new in-memory broker system.
@@ -116,6 +186,8 @@ func (b *memBroker) StartWorkers(ws WorkersList) error {
 		w := NewWorker(conf)
 		b.queues[conf.WorkerType] = q
 		b.workers = append(b.workers, w)
+		w.retryLater = q.EnqueueAfter
+		w.pushBack = q.Enqueue
 		if err := w.Start(q.Jobs); err != nil {
 			return err
 		}
@@ -230,6 +302,26 @@ func (b *memBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error)
 	return job, nil
 }
 
+// CancelJob removes the job from its queue, or cancels the context of its
+// execution.
+func (b *memBroker) CancelJob(db prefixer.Prefixer, jobID string) (*Job, error) {
+	dequeue := func(j *Job) (bool, error) {
+		q, ok := b.queues[j.WorkerType]
+		if !ok {
+			return false, nil
+		}
+		return q.Remove(j.ID()), nil
+	}
+	interrupt := func(j *Job) error {
+		if cancelRunningJob(j.ID()) {
+			return nil
+		}
+		// The job is not executed (it may be a job from before a restart)
+		return j.Cancel()
+	}
+	return cancelJob(db, jobID, dequeue, interrupt)
+}
+
 // WorkerQueueLen returns the size of the number of elements in queue of the
 // specified worker type.
 func (b *memBroker) WorkerQueueLen(workerType string) (int, error) {
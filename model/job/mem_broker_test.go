@@ -1,7 +1,9 @@
 package job_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"strconv"
 	"strings"
 	"sync"
@@ -131,6 +133,16 @@ func TestInMemoryJobs(t *testing.T) {
 	w.Wait()
 }
 
+func TestInMemoryJobsPriorities(t *testing.T) {
+	defer jobs.SetPriorityRandomForTest(nil)
+	for _, c := range priorityCases {
+		r := c.r
+		jobs.SetPriorityRandomForTest(func(n int) int { return r })
+		order := runJobsWithPriorities(t, jobs.NewMemBroker(), "test-priority")
+		assert.Equal(t, c.expected, order, "random number %d", r)
+	}
+}
+
 func TestUnknownWorkerError(t *testing.T) {
 	broker := jobs.NewMemBroker()
 	assert.NoError(t, broker.StartWorkers(jobs.WorkersList{}))
@@ -199,6 +211,60 @@ func TestTimeout(t *testing.T) {
 	w.Wait()
 }
 
+func TestCancel(t *testing.T) {
+	started := make(chan struct{})
+	stopped := make(chan error)
+
+	broker := jobs.NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(jobs.WorkersList{
+		{
+			WorkerType:   "cancel",
+			Concurrency:  1,
+			MaxExecCount: 3,
+			Timeout:      10 * time.Second,
+			RetryDelay:   1 * time.Millisecond,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				started <- struct{}{}
+				<-ctx.Done()
+				stopped <- ctx.Err()
+				return ctx.Err()
+			},
+		},
+	}))
+
+	running, err := broker.PushJob(testInstance, &jobs.JobRequest{WorkerType: "cancel"})
+	assert.NoError(t, err)
+	<-started
+
+	// The worker is busy, so this job stays in the queue
+	queued, err := broker.PushJob(testInstance, &jobs.JobRequest{WorkerType: "cancel"})
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	j, err := broker.CancelJob(testInstance, queued.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, jobs.Cancelled, j.State)
+	n, err := broker.WorkerQueueLen("cancel")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	_, err = broker.CancelJob(testInstance, running.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, context.Canceled, <-stopped)
+
+	// The job is not retried, and its state is set by the worker
+	for i := 0; i < 100; i++ {
+		j, err = jobs.Get(testInstance, running.ID())
+		assert.NoError(t, err)
+		if j.State == jobs.Cancelled {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, jobs.Cancelled, j.State)
+	_, err = broker.CancelJob(testInstance, running.ID())
+	assert.Equal(t, jobs.ErrNotCancellable, err)
+}
+
 func TestRetry(t *testing.T) {
 	var w sync.WaitGroup
 
@@ -235,6 +301,77 @@ func TestRetry(t *testing.T) {
 	w.Wait()
 }
 
+func TestRetryLater(t *testing.T) {
+	var mu sync.Mutex
+	var executions []string
+	done := make(chan struct{}, 3)
+
+	broker := jobs.NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(jobs.WorkersList{
+		{
+			WorkerType:   "test",
+			Concurrency:  1,
+			MaxExecCount: 2,
+			Timeout:      1 * time.Second,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				var msg string
+				_ = ctx.UnmarshalMessage(&msg)
+				mu.Lock()
+				executions = append(executions, msg)
+				count := len(executions)
+				mu.Unlock()
+				done <- struct{}{}
+				if msg == "retried" && count == 1 {
+					return errors.New("VENDOR_DOWN")
+				}
+				return nil
+			},
+		},
+	}))
+
+	retried, _ := jobs.NewMessage("retried")
+	j, err := broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "test",
+		Message:    retried,
+		Options: &jobs.JobOptions{
+			MaxExecCount: 2,
+			Retry: &jobs.RetryPolicy{
+				Strategy: jobs.RetryFixed,
+				Delay:    "300ms",
+			},
+		},
+	})
+	assert.NoError(t, err)
+	<-done
+
+	// The worker is not kept waiting for the retry
+	other, _ := jobs.NewMessage("other")
+	_, err = broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "test",
+		Message:    other,
+	})
+	assert.NoError(t, err)
+	<-done
+	<-done
+	mu.Lock()
+	assert.Equal(t, []string{"retried", "other", "retried"}, executions)
+	mu.Unlock()
+
+	var job *jobs.Job
+	for i := 0; i < 50; i++ {
+		job, err = jobs.Get(testInstance, j.ID())
+		assert.NoError(t, err)
+		if job.State == jobs.Done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, jobs.Done, job.State)
+	if assert.Len(t, job.Attempts, 1) {
+		assert.Equal(t, "VENDOR_DOWN", job.Attempts[0].Error)
+	}
+}
+
 func TestPanicRetried(t *testing.T) {
 	var w sync.WaitGroup
 
@@ -354,3 +491,175 @@ func TestMemAddJobRateLimitExceeded(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, j)
 }
+
+func TestInMemoryJobsMaxPerInstance(t *testing.T) {
+	var mu sync.Mutex
+	running := make(map[string]int)
+	maxRunning := make(map[string]int)
+	var w sync.WaitGroup
+
+	workersTestList := jobs.WorkersList{
+		{
+			WorkerType:     "test-fair",
+			Concurrency:    3,
+			MaxPerInstance: 1,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				defer w.Done()
+				var msg string
+				if err := ctx.UnmarshalMessage(&msg); err != nil {
+					return err
+				}
+				domain := strings.SplitN(msg, "-", 2)[0]
+				mu.Lock()
+				running[domain]++
+				if running[domain] > maxRunning[domain] {
+					maxRunning[domain] = running[domain]
+				}
+				mu.Unlock()
+				time.Sleep(20 * time.Millisecond)
+				mu.Lock()
+				running[domain]--
+				mu.Unlock()
+				return nil
+			},
+		},
+	}
+
+	broker := jobs.NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(workersTestList))
+	dbs := map[string]prefixer.Prefixer{
+		"instance": testInstance,
+		"global":   prefixer.GlobalPrefixer,
+	}
+	for i := 0; i < 4; i++ {
+		for name, db := range dbs {
+			w.Add(1)
+			msg, _ := jobs.NewMessage(name + "-" + strconv.Itoa(i))
+			_, err := broker.PushJob(db, &jobs.JobRequest{
+				WorkerType: "test-fair",
+				Message:    msg,
+			})
+			assert.NoError(t, err)
+		}
+	}
+	w.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, maxRunning["instance"])
+	assert.Equal(t, 1, maxRunning["global"])
+	assert.NoError(t, broker.ShutdownWorkers(context.Background()))
+}
+
+func TestInMemoryJobsMaxPerInstanceLongQueue(t *testing.T) {
+	var mu sync.Mutex
+	var instanceDone int
+	globalStart := -1
+	var w sync.WaitGroup
+
+	// The blocked instance has more jobs than the dispatcher can keep in
+	// memory (fairPendingFactor * concurrency)
+	nbJobs := 20
+	workersTestList := jobs.WorkersList{
+		{
+			WorkerType:     "test-fair-long",
+			Concurrency:    2,
+			MaxPerInstance: 1,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				defer w.Done()
+				var msg string
+				if err := ctx.UnmarshalMessage(&msg); err != nil {
+					return err
+				}
+				if msg == "global" {
+					mu.Lock()
+					globalStart = instanceDone
+					mu.Unlock()
+					return nil
+				}
+				time.Sleep(20 * time.Millisecond)
+				mu.Lock()
+				instanceDone++
+				mu.Unlock()
+				return nil
+			},
+		},
+	}
+
+	broker := jobs.NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(workersTestList))
+	for i := 0; i < nbJobs; i++ {
+		w.Add(1)
+		msg, _ := jobs.NewMessage("instance-" + strconv.Itoa(i))
+		_, err := broker.PushJob(testInstance, &jobs.JobRequest{
+			WorkerType: "test-fair-long",
+			Message:    msg,
+		})
+		assert.NoError(t, err)
+	}
+	w.Add(1)
+	msg, _ := jobs.NewMessage("global")
+	_, err := broker.PushJob(prefixer.GlobalPrefixer, &jobs.JobRequest{
+		WorkerType: "test-fair-long",
+		Message:    msg,
+	})
+	assert.NoError(t, err)
+	w.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, nbJobs, instanceDone)
+	assert.True(t, globalStart >= 0 && globalStart < 5,
+		"the global job has waited for %d jobs", globalStart)
+	assert.NoError(t, broker.ShutdownWorkers(context.Background()))
+}
+
+func TestJobLogs(t *testing.T) {
+	broker := jobs.NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(jobs.WorkersList{
+		{
+			WorkerType:  "test-logs",
+			Concurrency: 1,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				for i := 0; i < 1005; i++ {
+					ctx.AppendLog(jobs.LogStreamStdout, "info", "line "+strconv.Itoa(i))
+				}
+				ctx.AppendLog(jobs.LogStreamStderr, "error", strings.Repeat("x", 5000))
+				return nil
+			},
+		},
+	}))
+
+	job, err := broker.PushJob(testInstance, &jobs.JobRequest{
+		WorkerType: "test-logs",
+		Message:    nil,
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		job, err = jobs.Get(testInstance, job.ID())
+		assert.NoError(t, err)
+		if job.State == jobs.Done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, jobs.Done, job.State)
+
+	logs, err := jobs.GetLogs(testInstance, job.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, job.ID(), logs.JobID)
+	assert.Equal(t, 6, logs.Dropped)
+	if assert.Len(t, logs.Lines, 1000) {
+		assert.Equal(t, "line 6", logs.Lines[0].Message)
+		assert.Equal(t, jobs.LogStreamStdout, logs.Lines[0].Stream)
+		last := logs.Lines[999]
+		assert.Equal(t, jobs.LogStreamStderr, last.Stream)
+		assert.Equal(t, "error", last.Level)
+		assert.Len(t, last.Message, 4000)
+	}
+
+	logs, err = jobs.GetLogs(testInstance, "unknown")
+	assert.NoError(t, err)
+	assert.Empty(t, logs.Lines)
+}
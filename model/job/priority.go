@@ -0,0 +1,83 @@
+package job
+
+const (
+	// PriorityLow is the priority for the background jobs that can wait.
+	PriorityLow = -1
+	// PriorityNormal is the default priority.
+	PriorityNormal = 0
+	// PriorityHigh is the priority for the jobs that a user is waiting for,
+	// like the manual executions of the konnectors.
+	PriorityHigh = 1
+)
+
+// priorities is the list of the priorities, from the highest to the lowest.
+var priorities = []int{PriorityHigh, PriorityNormal, PriorityLow}
+
+// priorityWeights are used to avoid starving the jobs with a low priority:
+// when there are jobs with each priority, a job with the high priority is
+// taken 4 times more often than a job with the low priority, but the jobs
+// with the low priority are still executed.
+var priorityWeights = map[int]int{
+	PriorityHigh:   4,
+	PriorityNormal: 2,
+	PriorityLow:    1,
+}
+
+// priorityIntn, when set, replaces the random number used to choose the
+// first queue to look at.
+var priorityIntn func(n int) int
+
+// SetPriorityRandomForTest is used by unit tests to have a deterministic
+// order for the priority queues.
+func SetPriorityRandomForTest(intn func(n int) int) {
+	priorityIntn = intn
+}
+
+// Priority returns the priority of the job. The manual executions have the
+// high priority.
+func (j *Job) Priority() int {
+	prio := PriorityNormal
+	if j.Options != nil {
+		prio = j.Options.Priority
+	}
+	if j.Manual {
+		prio = PriorityHigh
+	}
+	if prio > PriorityHigh {
+		prio = PriorityHigh
+	} else if prio < PriorityLow {
+		prio = PriorityLow
+	}
+	return prio
+}
+
+// priorityOrder returns the priorities in the order the queues must be
+// looked at to take the next job: the first one is chosen randomly with the
+// weights, and it is followed by the others, from the highest to the lowest.
+func priorityOrder(intn func(n int) int) []int {
+	if priorityIntn != nil {
+		intn = priorityIntn
+	}
+	total := 0
+	for _, prio := range priorities {
+		total += priorityWeights[prio]
+	}
+	first := PriorityHigh
+	r := intn(total)
+	for _, prio := range priorities {
+		r -= priorityWeights[prio]
+		if r < 0 {
+			first = prio
+			break
+		}
+	}
+
+	order := make([]int, 0, len(priorities))
+	order = append(order, first)
+	for _, prio := range priorities {
+		if prio != first {
+			order = append(order, prio)
+		}
+	}
+	return order
+}
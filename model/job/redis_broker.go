@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/go-redis/redis/v8"
@@ -22,8 +23,24 @@ const (
 	redisPrefix = "j/"
 	// redisHighPrioritySuffix suffix is the suffix used for prioritized queue.
 	redisHighPrioritySuffix = "/p0"
+	// redisLowPrioritySuffix suffix is the suffix used for the queue of the
+	// jobs with a low priority.
+	redisLowPrioritySuffix = "/p2"
+	// redisCancelChannel is the pub/sub channel used to ask the stack
+	// processes to stop the execution of a job.
+	redisCancelChannel = "j/cancel"
+	// redisCancelAckPrefix is the prefix of the keys of the lists where the
+	// stack process that executes a job acknowledges its cancellation. It is
+	// followed by the job identifier.
+	redisCancelAckPrefix = "j/cancel/ack/"
+	// redisDelayedKey is the key of the sorted set of the jobs waiting for a
+	// retry, with the time of the retry as their score.
+	redisDelayedKey = "j/delayed"
 )
 
+// redisDelayedInterval is how often the jobs waiting for a retry are checked.
+var redisDelayedInterval = 1 * time.Second
+
 type redisBroker struct {
 	client         redis.UniversalClient
 	ctx            context.Context
@@ -32,6 +49,7 @@ type redisBroker struct {
 	workersTypes   []string
 	running        uint32
 	closed         chan struct{}
+	cancelSub      *redis.PubSub
 }
 
 // NewRedisBroker creates a new broker that will use redis to distribute
@@ -58,6 +76,9 @@ func (b *redisBroker) StartWorkers(ws WorkersList) error {
 			continue
 		}
 		b.workersRunning = append(b.workersRunning, w)
+		w.requeue = b.requeue
+		w.pushBack = b.pushBack
+		w.retryLater = b.retryLater
 		ch := make(chan *Job)
 		if err := w.Start(ch); err != nil {
 			return err
@@ -66,6 +87,9 @@ func (b *redisBroker) StartWorkers(ws WorkersList) error {
 	}
 
 	if len(b.workersRunning) > 0 {
+		b.cancelSub = b.client.Subscribe(b.ctx, redisCancelChannel)
+		go b.cancelLoop(b.cancelSub.Channel())
+		go b.delayedLoop()
 		joblog.Infof("Started redis broker for %d workers type", len(b.workersRunning))
 	}
 
@@ -93,6 +117,9 @@ func (b *redisBroker) ShutdownWorkers(ctx context.Context) error {
 
 	fmt.Print("  shutting down redis broker...")
 	defer b.client.Close()
+	if b.cancelSub != nil {
+		_ = b.cancelSub.Close()
+	}
 
 	for i := 0; i < len(b.workersRunning); i++ {
 		select {
@@ -125,10 +152,15 @@ func (b *redisBroker) ShutdownWorkers(ctx context.Context) error {
 
 var redisBRPopTimeout = 10 * time.Second
 
+// redisCancelAckTimeout is how long the cancellation of a running job waits
+// for the acknowledgement of the process that executes it.
+var redisCancelAckTimeout = 5 * time.Second
+
 // SetRedisTimeoutForTest is used by unit test to avoid waiting 10 seconds on
 // cleanup.
 func SetRedisTimeoutForTest() {
 	redisBRPopTimeout = 1 * time.Second
+	redisCancelAckTimeout = 1 * time.Second
 }
 
 func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
@@ -144,16 +176,16 @@ func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
 
 		// The brpop redis command will always take elements in priority from the
 		// first key containing elements at the call. By always priorizing the
-		// manual queue, this would cause a starvation for our main queue if too
-		// many "manual" jobs are pushed. By randomizing the order we make sure we
-		// avoid such starvation. For one in three call, the main queue is
-		// selected.
-		keyP0 := key + redisHighPrioritySuffix
-		keyP1 := key
-		if rng.Intn(3) == 0 {
-			keyP1, keyP0 = keyP0, keyP1
+		// high priority queue, this would cause a starvation for the other
+		// queues if too many jobs with a high priority are pushed. By
+		// randomizing the order with some weights, we make sure we avoid such
+		// starvation.
+		order := priorityOrder(rng.Intn)
+		keys := make([]string, len(order))
+		for i, prio := range order {
+			keys[i] = redisQueueKey(key, prio)
 		}
-		results, err := b.client.BRPop(b.ctx, redisBRPopTimeout, keyP0, keyP1).Result()
+		results, err := b.client.BRPop(b.ctx, redisBRPopTimeout, keys...).Result()
 		if err != nil || len(results) < 2 {
 			time.Sleep(100 * time.Millisecond)
 			continue
@@ -189,6 +221,59 @@ func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
 	}
 }
 
+// cancelLoop stops the execution of the jobs for the cancellations published
+// by the stack processes.
+func (b *redisBroker) cancelLoop(ch <-chan *redis.Message) {
+	for msg := range ch {
+		if !cancelRunningJob(msg.Payload) {
+			continue
+		}
+		joblog.Debugf("Cancel job %s", msg.Payload)
+		key := redisCancelAckPrefix + msg.Payload
+		if err := b.client.LPush(b.ctx, key, "1").Err(); err != nil {
+			joblog.Warnf("Cannot acknowledge the cancellation of %s: %s", msg.Payload, err)
+			continue
+		}
+		b.client.Expire(b.ctx, key, 2*redisCancelAckTimeout)
+	}
+}
+
+// delayedLoop moves the jobs whose retry time has come from the sorted set of
+// the delayed jobs to their queues.
+func (b *redisBroker) delayedLoop() {
+	ticker := time.NewTicker(redisDelayedInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadUint32(&b.running) == 0 {
+			return
+		}
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		members, err := b.client.ZRangeByScore(b.ctx, redisDelayedKey, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: now,
+		}).Result()
+		if err != nil {
+			continue
+		}
+		for _, member := range members {
+			// Only the stack process that has removed the job from the
+			// sorted set puts it in its queue
+			n, err := b.client.ZRem(b.ctx, redisDelayedKey, member).Result()
+			if err != nil || n == 0 {
+				continue
+			}
+			parts := strings.SplitN(member, "|", 2)
+			if len(parts) != 2 {
+				joblog.Warnf("Invalid delayed job %s", member)
+				continue
+			}
+			if err := b.client.LPush(b.ctx, parts[0], parts[1]).Err(); err != nil {
+				joblog.Errorf("Cannot queue the delayed job %s: %s", member, err)
+			}
+		}
+	}
+}
+
 // PushJob will produce a new Job with the given options and enqueue the job in
 // the proper queue.
 func (b *redisBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error) {
@@ -243,18 +328,8 @@ func (b *redisBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, erro
 		return job, nil
 	}
 
-	key := redisPrefix + job.WorkerType
-	prefix := job.DBPrefix()
-	if cluster := job.DBCluster(); cluster > 0 {
-		prefix = fmt.Sprintf("%s%%%d", prefix, cluster)
-	}
-	val := prefix + "/" + job.JobID
-
-	// When the job is manual, it is being pushed in a specific prioritized
-	// queue.
-	if job.Manual {
-		key += redisHighPrioritySuffix
-	}
+	key := redisQueueKey(redisPrefix+job.WorkerType, job.Priority())
+	val := redisQueueValue(job)
 
 	if err := b.client.LPush(b.ctx, key, val).Err(); err != nil {
 		return nil, err
@@ -263,19 +338,130 @@ func (b *redisBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, erro
 	return job, nil
 }
 
+// CancelJob removes the job from its queue, or asks the stack process that
+// executes it to stop it. If no process acknowledges it, the job is no longer
+// executed (it may be a job from before a restart), and it is cancelled a few
+// seconds later.
+func (b *redisBroker) CancelJob(db prefixer.Prefixer, jobID string) (*Job, error) {
+	dequeue := func(j *Job) (bool, error) {
+		key := redisPrefix + j.WorkerType
+		val := redisQueueValue(j)
+		removed, err := b.client.ZRem(b.ctx, redisDelayedKey, redisDelayedMember(j)).Result()
+		if err != nil {
+			return false, err
+		}
+		for _, prio := range priorities {
+			n, err := b.client.LRem(b.ctx, redisQueueKey(key, prio), 0, val).Result()
+			if err != nil {
+				return false, err
+			}
+			removed += n
+		}
+		return removed > 0, nil
+	}
+	interrupt := func(j *Job) error {
+		receivers, err := b.client.Publish(b.ctx, redisCancelChannel, j.ID()).Result()
+		if err != nil {
+			return err
+		}
+		// The acknowledgement is waited in the background, to not block the
+		// request that has asked for the cancellation.
+		go b.waitCancelAck(db, j.ID(), receivers)
+		return nil
+	}
+	return cancelJob(db, jobID, dequeue, interrupt)
+}
+
+// waitCancelAck waits for the acknowledgement of the cancellation of a running
+// job by the process that executes it. Without it, the job is cancelled here.
+func (b *redisBroker) waitCancelAck(db prefixer.Prefixer, jobID string, receivers int64) {
+	// A process can receive the message without executing the job, so the
+	// number of receivers is not enough, and we wait for an ack.
+	if receivers > 0 {
+		key := redisCancelAckPrefix + jobID
+		_, err := b.client.BLPop(b.ctx, redisCancelAckTimeout, key).Result()
+		if err == nil {
+			return
+		}
+		if err != redis.Nil {
+			joblog.Warnf("Cannot wait for the cancellation of %s: %s", jobID, err)
+			return
+		}
+	}
+	j, err := Get(db, jobID)
+	if err != nil || j.State != Running {
+		return
+	}
+	if err := j.Cancel(); err != nil && !couchdb.IsConflictError(err) {
+		joblog.Warnf("Cannot cancel job %s: %s", jobID, err)
+	}
+}
+
+// requeue puts back a job that has been taken from its queue, but not
+// executed, at the head of the queue.
+func (b *redisBroker) requeue(j *Job) error {
+	key := redisQueueKey(redisPrefix+j.WorkerType, j.Priority())
+	return b.client.RPush(b.ctx, key, redisQueueValue(j)).Err()
+}
+
+// retryLater puts a job in the sorted set of the delayed jobs, to be put back
+// in its queue after the given delay.
+func (b *redisBroker) retryLater(j *Job, delay time.Duration) error {
+	return b.client.ZAdd(b.ctx, redisDelayedKey, &redis.Z{
+		Score:  float64(time.Now().Add(delay).Unix()),
+		Member: redisDelayedMember(j),
+	}).Err()
+}
+
+// redisDelayedMember returns the value used for the job in the sorted set of
+// the delayed jobs: the key of its queue and its value in this queue.
+func redisDelayedMember(j *Job) string {
+	key := redisQueueKey(redisPrefix+j.WorkerType, j.Priority())
+	return key + "|" + redisQueueValue(j)
+}
+
+// pushBack puts a job that has been taken from its queue, but not executed,
+// at the tail of the queue.
+func (b *redisBroker) pushBack(j *Job) error {
+	key := redisQueueKey(redisPrefix+j.WorkerType, j.Priority())
+	return b.client.LPush(b.ctx, key, redisQueueValue(j)).Err()
+}
+
+// redisQueueKey returns the key of the redis list for the jobs with the given
+// priority. The key for the normal priority has no suffix, for compatibility
+// with the jobs queued by the older versions of the stack.
+func redisQueueKey(key string, prio int) string {
+	switch prio {
+	case PriorityHigh:
+		return key + redisHighPrioritySuffix
+	case PriorityLow:
+		return key + redisLowPrioritySuffix
+	}
+	return key
+}
+
+// redisQueueValue returns the value used for the job in the redis queues.
+func redisQueueValue(j *Job) string {
+	prefix := j.DBPrefix()
+	if cluster := j.DBCluster(); cluster > 0 {
+		prefix = fmt.Sprintf("%s%%%d", prefix, cluster)
+	}
+	return prefix + "/" + j.JobID
+}
+
 // QueueLen returns the size of the number of elements in queue of the
 // specified worker type.
 func (b *redisBroker) WorkerQueueLen(workerType string) (int, error) {
 	key := redisPrefix + workerType
-	l1, err := b.client.LLen(b.ctx, key).Result()
-	if err != nil {
-		return 0, err
-	}
-	l2, err := b.client.LLen(b.ctx, key+redisHighPrioritySuffix).Result()
-	if err != nil {
-		return 0, err
+	total := int64(0)
+	for _, prio := range priorities {
+		n, err := b.client.LLen(b.ctx, redisQueueKey(key, prio)).Result()
+		if err != nil {
+			return 0, err
+		}
+		total += n
 	}
-	return int(l1 + l2), nil
+	return int(total), nil
 }
 
 func (b *redisBroker) WorkerIsReserved(workerType string) (bool, error) {
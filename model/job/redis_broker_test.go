@@ -14,6 +14,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const redisURL1 = "redis://localhost:6379/0"
@@ -113,6 +114,21 @@ func TestRedisJobs(t *testing.T) {
 	time.Sleep(1 * time.Second)
 }
 
+func TestRedisJobsPriorities(t *testing.T) {
+	job.SetRedisTimeoutForTest()
+	opts, _ := redis.ParseURL(redisURL1)
+	client := redis.NewClient(opts)
+
+	defer jobs.SetPriorityRandomForTest(nil)
+	for _, c := range priorityCases {
+		r := c.r
+		jobs.SetPriorityRandomForTest(func(n int) int { return r })
+		broker := jobs.NewRedisBroker(client)
+		order := runJobsWithPriorities(t, broker, "test-priority")
+		assert.Equal(t, c.expected, order, "random number %d", r)
+	}
+}
+
 func TestRedisAddJobRateLimitExceeded(t *testing.T) {
 	opts1, _ := redis.ParseURL(redisURL1)
 	client1 := redis.NewClient(opts1)
@@ -169,3 +185,85 @@ func TestRedisAddJobRateLimitExceeded(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, j)
 }
+
+func waitJobState(t *testing.T, jobID string, state jobs.State) {
+	var j *jobs.Job
+	for i := 0; i < 50; i++ {
+		var err error
+		j, err = jobs.Get(testInstance, jobID)
+		require.NoError(t, err)
+		if j.State == state {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, state, j.State)
+}
+
+func TestRedisCancelJob(t *testing.T) {
+	job.SetRedisTimeoutForTest()
+	opts, _ := redis.ParseURL(redisURL1)
+	client := redis.NewClient(opts)
+
+	started := make(chan struct{})
+	stopped := make(chan error)
+	broker := jobs.NewRedisBroker(client)
+	assert.NoError(t, broker.StartWorkers(jobs.WorkersList{
+		{
+			WorkerType:   "redis-cancel",
+			Concurrency:  1,
+			MaxExecCount: 1,
+			Timeout:      10 * time.Second,
+			WorkerFunc: func(ctx *jobs.WorkerContext) error {
+				started <- struct{}{}
+				<-ctx.Done()
+				stopped <- ctx.Err()
+				return ctx.Err()
+			},
+		},
+	}))
+
+	// The process that executes the job stops it, and the worker sets its
+	// state to cancelled
+	running, err := broker.PushJob(testInstance, &jobs.JobRequest{WorkerType: "redis-cancel"})
+	assert.NoError(t, err)
+	<-started
+	j, err := broker.CancelJob(testInstance, running.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, jobs.Running, j.State)
+	assert.Equal(t, context.Canceled, <-stopped)
+	waitJobState(t, running.ID(), jobs.Cancelled)
+
+	// A job taken from its queue, but not yet started, is cancelled and the
+	// worker will not execute it
+	taken := &jobs.Job{
+		Domain:     testInstance.Domain,
+		Prefix:     testInstance.DBPrefix(),
+		WorkerType: "redis-cancel",
+		State:      jobs.Queued,
+		QueuedAt:   time.Now(),
+	}
+	assert.NoError(t, taken.Create())
+	j, err = broker.CancelJob(testInstance, taken.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, jobs.Cancelled, j.State)
+	assert.Error(t, taken.AckConsumed())
+
+	// A running job that no process executes is cancelled after the timeout
+	// of the acknowledgement
+	orphan := &jobs.Job{
+		Domain:     testInstance.Domain,
+		Prefix:     testInstance.DBPrefix(),
+		WorkerType: "redis-cancel",
+		State:      jobs.Running,
+		QueuedAt:   time.Now(),
+		StartedAt:  time.Now(),
+	}
+	assert.NoError(t, orphan.Create())
+	j, err = broker.CancelJob(testInstance, orphan.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, jobs.Running, j.State)
+	waitJobState(t, orphan.ID(), jobs.Cancelled)
+
+	assert.NoError(t, broker.ShutdownWorkers(context.Background()))
+}
@@ -180,6 +180,9 @@ func (s *redisScheduler) eventLoop(eventsCh <-chan *realtime.Event) {
 				continue
 			}
 			et := t.(*EventTrigger)
+			if !et.MatchCondition(event) {
+				continue
+			}
 			if et.Infos().Debounce != "" {
 				var d time.Duration
 				if d, err = time.ParseDuration(et.Infos().Debounce); err == nil {
@@ -380,6 +383,12 @@ func (s *redisScheduler) addToRedis(t Trigger, prev time.Time) error {
 	case *AtTrigger:
 		timestamp = t.at
 	case *CronTrigger:
+		// The next execution is computed when the trigger is added and after
+		// each of its executions, and it is this time that is polled. The
+		// triggers don't need to be polled more often than each second, as
+		// the schedules, even moved for the daylight saving time, are on whole
+		// seconds. A change of the timezone of the instance applies after the
+		// next execution, like for the memory scheduler.
 		timestamp = t.NextExecution(prev)
 		now := time.Now()
 		if timestamp.Before(now) {
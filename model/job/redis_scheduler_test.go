@@ -52,6 +52,10 @@ func (b *mockBroker) PushJob(db prefixer.Prefixer, request *jobs.JobRequest) (*j
 	return nil, nil
 }
 
+func (b *mockBroker) CancelJob(db prefixer.Prefixer, jobID string) (*jobs.Job, error) {
+	return nil, jobs.ErrNotFoundJob
+}
+
 func (b *mockBroker) WorkerQueueLen(workerType string) (int, error) {
 	count := 0
 	for _, job := range b.jobs {
@@ -0,0 +1,143 @@
+package job
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	// RetryFixed is the strategy where the delay between two attempts is
+	// always the same.
+	RetryFixed = "fixed"
+	// RetryExponential is the strategy where the delay between two attempts
+	// is doubled after each attempt. It is the default.
+	RetryExponential = "exponential"
+
+	// ErrorClassTimeout is the class of the errors for the executions that
+	// have exceeded their timeout.
+	ErrorClassTimeout = "timeout"
+
+	// defaultRetryJitter is the part of the delay that is randomized.
+	defaultRetryJitter = 0.1
+	// maxRetryDelay is the longest delay that can be waited before an attempt.
+	maxRetryDelay = 24 * time.Hour
+)
+
+// RetryPolicy can be used in the options of a job or of a trigger to choose
+// how the job is retried when it fails. The delays are durations like "30s"
+// or "2h". The number of attempts is still given by the max_exec_count.
+type RetryPolicy struct {
+	// Strategy is fixed or exponential (the default).
+	Strategy string `json:"strategy,omitempty"`
+	// Delay is the delay before the first retry (the retry delay of the
+	// worker by default).
+	Delay string `json:"delay,omitempty"`
+	// MaxDelay is the maximal delay between two attempts.
+	MaxDelay string `json:"max_delay,omitempty"`
+	// Jitter is the part of the delay that is randomized, between 0 and 1
+	// (0.1 by default).
+	Jitter *float64 `json:"jitter,omitempty"`
+	// RetryOn is the list of the classes of errors for which the job is
+	// retried. If empty, the job is retried for all the errors.
+	RetryOn []string `json:"retry_on,omitempty"`
+}
+
+// Validate checks that the retry policy is valid.
+func (p *RetryPolicy) Validate() error {
+	switch p.Strategy {
+	case "", RetryFixed, RetryExponential:
+	default:
+		return ErrInvalidRetryPolicy
+	}
+	for _, d := range []string{p.Delay, p.MaxDelay} {
+		if d == "" {
+			continue
+		}
+		if duration, err := time.ParseDuration(d); err != nil || duration < 0 {
+			return ErrInvalidRetryPolicy
+		}
+	}
+	if p.Jitter != nil && (*p.Jitter < 0 || *p.Jitter > 1) {
+		return ErrInvalidRetryPolicy
+	}
+	for _, class := range p.RetryOn {
+		if class == "" {
+			return ErrInvalidRetryPolicy
+		}
+	}
+	return nil
+}
+
+// ValidateOptions checks that the retry policy of the options, if any, is
+// valid.
+func ValidateOptions(opts *JobOptions) error {
+	if opts == nil || opts.Retry == nil {
+		return nil
+	}
+	return opts.Retry.Validate()
+}
+
+// Retryable returns true if the job can be retried after the given error.
+func (p *RetryPolicy) Retryable(err error) bool {
+	if p == nil || len(p.RetryOn) == 0 || err == nil {
+		return true
+	}
+	for _, class := range p.RetryOn {
+		if HasErrorClass(err, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasErrorClass returns true if the error is of the given class. The class
+// of an error is "timeout" for the timeouts, and for the other errors, it is
+// their message or a prefix of it ending before a dot, like "VENDOR_DOWN" for
+// "VENDOR_DOWN.BANK_DOWN" (the konnectors use this format for their errors).
+func HasErrorClass(err error, class string) bool {
+	if err == context.DeadlineExceeded {
+		return class == ErrorClassTimeout
+	}
+	msg := err.Error()
+	return msg == class || strings.HasPrefix(msg, class+".")
+}
+
+// delay returns the delay to wait before the attempt following the given
+// number of executions.
+func (p *RetryPolicy) delay(base time.Duration, execCount int) time.Duration {
+	strategy := RetryExponential
+	jitter := defaultRetryJitter
+	maxDelay := maxRetryDelay
+	if p != nil {
+		if p.Strategy != "" {
+			strategy = p.Strategy
+		}
+		if d, err := time.ParseDuration(p.Delay); err == nil && d > 0 {
+			base = d
+		}
+		if d, err := time.ParseDuration(p.MaxDelay); err == nil && d > 0 && d < maxDelay {
+			maxDelay = d
+		}
+		if p.Jitter != nil {
+			jitter = *p.Jitter
+		}
+	}
+
+	delay := base
+	if strategy == RetryExponential {
+		for i := 1; i < execCount && delay < maxDelay; i++ {
+			delay *= 2
+		}
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	// fuzzDelay number between delay * (1 +/- jitter)
+	if fuzzDelay := int64(jitter * float64(delay)); fuzzDelay > 0 {
+		delay += time.Duration(rand.Int63n(2*fuzzDelay) - fuzzDelay)
+	}
+	return delay
+}
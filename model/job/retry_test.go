@@ -0,0 +1,42 @@
+package job_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	jitter := 0.5
+	valid := &job.RetryPolicy{
+		Strategy: job.RetryExponential,
+		Delay:    "10m",
+		MaxDelay: "6h",
+		Jitter:   &jitter,
+		RetryOn:  []string{"VENDOR_DOWN", job.ErrorClassTimeout},
+	}
+	assert.NoError(t, valid.Validate())
+	assert.NoError(t, job.ValidateOptions(&job.JobOptions{Retry: valid}))
+	assert.NoError(t, job.ValidateOptions(nil))
+
+	tooMuch := 2.0
+	for _, p := range []*job.RetryPolicy{
+		{Strategy: "linear"},
+		{Delay: "ten minutes"},
+		{MaxDelay: "-1h"},
+		{Jitter: &tooMuch},
+		{RetryOn: []string{""}},
+	} {
+		assert.Equal(t, job.ErrInvalidRetryPolicy, p.Validate())
+	}
+
+	assert.True(t, valid.Retryable(errors.New("VENDOR_DOWN")))
+	assert.True(t, valid.Retryable(errors.New("VENDOR_DOWN.BANK_DOWN")))
+	assert.True(t, valid.Retryable(context.DeadlineExceeded))
+	assert.False(t, valid.Retryable(errors.New("VENDOR_DOWNTIME")))
+	assert.False(t, valid.Retryable(errors.New("LOGIN_FAILED")))
+	assert.True(t, (&job.RetryPolicy{}).Retryable(errors.New("LOGIN_FAILED")))
+}
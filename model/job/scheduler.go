@@ -67,6 +67,8 @@ type (
 		WorkerType   string                 `json:"worker"`
 		Arguments    string                 `json:"arguments"`
 		Debounce     string                 `json:"debounce"`
+		Timezone     string                 `json:"timezone,omitempty"`
+		Condition    *EventCondition        `json:"condition,omitempty"`
 		Options      *JobOptions            `json:"options"`
 		Message      Message                `json:"message"`
 		CurrentState *TriggerState          `json:"current_state,omitempty"`
@@ -0,0 +1,174 @@
+package job
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// maxLastErrors is the number of errors kept in the statistics of a worker.
+const maxLastErrors = 5
+
+// maxNegativeOffset is the largest negative offset of a timezone. The dates of
+// the jobs are stored with the offset of the stack that has queued them, and
+// CouchDB compares them as strings: a job queued after a date in UTC can be
+// stored with a local date that is up to this offset before it.
+const maxNegativeOffset = 12 * time.Hour
+
+// WorkerStats are the statistics of the jobs of a worker for an instance
+// over a time window. The durations are in seconds, and are computed for the
+// jobs that have been executed (done or errored).
+type WorkerStats struct {
+	Worker       string          `json:"worker"`
+	Total        int             `json:"total"`
+	Queued       int             `json:"queued"`
+	Running      int             `json:"running"`
+	Done         int             `json:"done"`
+	Errored      int             `json:"errored"`
+	Cancelled    int             `json:"cancelled"`
+	SuccessRatio float64         `json:"success_ratio"`
+	FailureRatio float64         `json:"failure_ratio"`
+	DurationP50  float64         `json:"duration_p50"`
+	DurationP95  float64         `json:"duration_p95"`
+	LastErrors   []*JobLastError `json:"last_errors,omitempty"`
+	// QueueLen is the number of jobs in the queue of the worker, for all the
+	// instances, like in the workers_queues_len metric
+	QueueLen int `json:"queue_len"`
+
+	durations []time.Duration
+}
+
+// JobLastError is an error of a job in the statistics of a worker.
+type JobLastError struct {
+	JobID      string    `json:"job_id"`
+	Error      string    `json:"error"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// GetStats returns the statistics of the jobs queued since the given time,
+// by worker. If workers is not empty, only the statistics for these worker
+// types are returned.
+func GetStats(db prefixer.Prefixer, since time.Time, workers []string) ([]*WorkerStats, error) {
+	byWorker := make(map[string]*WorkerStats)
+	for _, w := range workers {
+		byWorker[w] = &WorkerStats{Worker: w}
+	}
+
+	bound := since.UTC().Add(-maxNegativeOffset).Format(time.RFC3339Nano)
+	bookmark := ""
+	for {
+		var jobs []*Job
+		req := &couchdb.FindRequest{
+			UseIndex: "by-queued-at",
+			Selector: mango.Gt("queued_at", bound),
+			Sort: mango.SortBy{
+				{Field: "queued_at", Direction: mango.Desc},
+			},
+			Limit:    1000,
+			Bookmark: bookmark,
+		}
+		res, err := couchdb.FindDocsRaw(db, consts.Jobs, req, &jobs)
+		if err != nil {
+			if couchdb.IsNoDatabaseError(err) {
+				break
+			}
+			return nil, err
+		}
+		for _, j := range jobs {
+			// The query bound has been widened for the offsets, so the jobs
+			// are filtered again on the real dates
+			if j.QueuedAt.Before(since) {
+				continue
+			}
+			s, ok := byWorker[j.WorkerType]
+			if !ok {
+				if len(workers) > 0 {
+					continue
+				}
+				s = &WorkerStats{Worker: j.WorkerType}
+				byWorker[j.WorkerType] = s
+			}
+			s.add(j)
+		}
+		if len(jobs) < req.Limit || res.Bookmark == "" {
+			break
+		}
+		bookmark = res.Bookmark
+	}
+
+	list := make([]*WorkerStats, 0, len(byWorker))
+	for _, s := range byWorker {
+		s.compute()
+		if globalJobSystem != nil {
+			s.QueueLen, _ = globalJobSystem.WorkerQueueLen(s.Worker)
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Worker < list[j].Worker })
+	return list, nil
+}
+
+// add counts a job in the statistics.
+func (s *WorkerStats) add(j *Job) {
+	s.Total++
+	switch j.State {
+	case Queued:
+		s.Queued++
+	case Running:
+		s.Running++
+	case Done:
+		s.Done++
+	case Errored:
+		s.Errored++
+		s.addLastError(&JobLastError{
+			JobID:      j.ID(),
+			Error:      j.Error,
+			FinishedAt: j.FinishedAt,
+		})
+	case Cancelled:
+		s.Cancelled++
+	}
+	if (j.State == Done || j.State == Errored) &&
+		!j.StartedAt.IsZero() && j.FinishedAt.After(j.StartedAt) {
+		s.durations = append(s.durations, j.FinishedAt.Sub(j.StartedAt))
+	}
+}
+
+// addLastError keeps the given error if it is one of the most recent ones. The
+// jobs are not sorted by their real dates when they have different offsets,
+// so the errors are sorted here.
+func (s *WorkerStats) addLastError(e *JobLastError) {
+	s.LastErrors = append(s.LastErrors, e)
+	sort.SliceStable(s.LastErrors, func(i, j int) bool {
+		return s.LastErrors[i].FinishedAt.After(s.LastErrors[j].FinishedAt)
+	})
+	if len(s.LastErrors) > maxLastErrors {
+		s.LastErrors = s.LastErrors[:maxLastErrors]
+	}
+}
+
+func (s *WorkerStats) compute() {
+	if executed := s.Done + s.Errored; executed > 0 {
+		s.SuccessRatio = float64(s.Done) / float64(executed)
+		s.FailureRatio = float64(s.Errored) / float64(executed)
+	}
+	if len(s.durations) > 0 {
+		sort.Slice(s.durations, func(i, j int) bool { return s.durations[i] < s.durations[j] })
+		s.DurationP50 = percentile(s.durations, 50).Seconds()
+		s.DurationP95 = percentile(s.durations, 95).Seconds()
+	}
+}
+
+// percentile returns the p-th percentile of the sorted durations, with the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
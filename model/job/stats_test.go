@@ -0,0 +1,78 @@
+package job_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	jobs "github.com/cozy/cozy-stack/model/job"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetStats(t *testing.T) {
+	now := time.Now().UTC()
+	// The jobs with an odd number are stored with a local date with a
+	// negative offset
+	local := time.FixedZone("UTC-10", -10*60*60)
+
+	create := func(queuedAt time.Time, state jobs.State, duration time.Duration, errMsg string) {
+		j := &jobs.Job{
+			Domain:     testInstance.Domain,
+			Prefix:     testInstance.DBPrefix(),
+			WorkerType: "stats",
+			State:      state,
+			QueuedAt:   queuedAt,
+			Error:      errMsg,
+		}
+		if state != jobs.Queued {
+			j.StartedAt = queuedAt
+			j.FinishedAt = queuedAt.Add(duration)
+		}
+		require.NoError(t, j.Create())
+	}
+
+	// 20 jobs executed in 1 to 20 seconds, and the jobs 3, 6, 9, 12, 15 and
+	// 18 have failed
+	for i := 1; i <= 20; i++ {
+		queuedAt := now.Add(-time.Duration(i) * time.Minute)
+		if i%2 == 1 {
+			queuedAt = queuedAt.In(local)
+		}
+		state, errMsg := jobs.Done, ""
+		if i%3 == 0 {
+			state, errMsg = jobs.Errored, fmt.Sprintf("error %d", i)
+		}
+		create(queuedAt, state, time.Duration(i)*time.Second, errMsg)
+	}
+	create(now.In(local), jobs.Queued, 0, "")
+	// Too old to be counted
+	create(now.Add(-2*time.Hour).In(local), jobs.Errored, time.Second, "too old")
+
+	list, err := jobs.GetStats(testInstance, now.Add(-1*time.Hour), []string{"stats", "unknown"})
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+
+	s := list[0]
+	assert.Equal(t, "stats", s.Worker)
+	assert.Equal(t, 21, s.Total)
+	assert.Equal(t, 1, s.Queued)
+	assert.Equal(t, 14, s.Done)
+	assert.Equal(t, 6, s.Errored)
+	assert.InDelta(t, 0.7, s.SuccessRatio, 0.001)
+	assert.InDelta(t, 0.3, s.FailureRatio, 0.001)
+	assert.Equal(t, 10.0, s.DurationP50)
+	assert.Equal(t, 19.0, s.DurationP95)
+	require.Len(t, s.LastErrors, 5)
+	for i, e := range s.LastErrors {
+		assert.Equal(t, fmt.Sprintf("error %d", 3*(i+1)), e.Error)
+	}
+
+	// A worker without jobs has empty statistics
+	s = list[1]
+	assert.Equal(t, "unknown", s.Worker)
+	assert.Equal(t, 0, s.Total)
+	assert.Equal(t, 0.0, s.SuccessRatio)
+	assert.Equal(t, 0.0, s.DurationP50)
+	assert.Empty(t, s.LastErrors)
+}
@@ -3,6 +3,8 @@ package job
 import (
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/robfig/cron/v3"
 )
 
@@ -11,20 +13,40 @@ import (
 type CronTrigger struct {
 	*TriggerInfos
 	sched cron.Schedule
+	loc   *time.Location // nil if the trigger has no timezone of its own
+	days  int            // for @every, the number of days if it is whole days
 	done  chan struct{}
 }
 
+// dstCheckWindow is larger than the changes of the clocks for the daylight
+// saving time.
+const dstCheckWindow = 3 * time.Hour
+
+// dstMaxSteps is the maximal number of times that the schedule is evaluated
+// to find the next execution: the second time is only needed to skip the
+// hour repeated when the clocks are turned back.
+const dstMaxSteps = 3
+
 var parser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
 
 // NewCronTrigger returns a new instance of CronTrigger given the specified options.
 func NewCronTrigger(infos *TriggerInfos) (*CronTrigger, error) {
+	loc, err := infos.location()
+	if err != nil {
+		return nil, err
+	}
 	schedule, err := parser.Parse(infos.Arguments)
 	if err != nil {
 		return nil, ErrMalformedTrigger
 	}
+	// A timezone given in the arguments with CRON_TZ= has the precedence
+	if spec, ok := schedule.(*cron.SpecSchedule); ok && spec.Location != time.Local {
+		loc = spec.Location
+	}
 	return &CronTrigger{
 		TriggerInfos: infos,
 		sched:        schedule,
+		loc:          loc,
 		done:         make(chan struct{}),
 	}, nil
 }
@@ -32,13 +54,25 @@ func NewCronTrigger(infos *TriggerInfos) (*CronTrigger, error) {
 // NewEveryTrigger returns an new instance of CronTrigger given the specified
 // options as @every.
 func NewEveryTrigger(infos *TriggerInfos) (*CronTrigger, error) {
+	loc, err := infos.location()
+	if err != nil {
+		return nil, err
+	}
 	schedule, err := parser.Parse("@every " + infos.Arguments)
 	if err != nil {
 		return nil, ErrMalformedTrigger
 	}
+	var days int
+	if every, ok := schedule.(cron.ConstantDelaySchedule); ok {
+		if every.Delay >= 24*time.Hour && every.Delay%(24*time.Hour) == 0 {
+			days = int(every.Delay / (24 * time.Hour))
+		}
+	}
 	return &CronTrigger{
 		TriggerInfos: infos,
 		sched:        schedule,
+		loc:          loc,
+		days:         days,
 		done:         make(chan struct{}),
 	}, nil
 }
@@ -48,8 +82,30 @@ func (c *CronTrigger) Type() string {
 	return c.TriggerInfos.Type
 }
 
-// NextExecution returns the next time when a job should be fired for this trigger
+// NextExecution returns the next time when a job should be fired for this
+// trigger. The schedule is evaluated in the timezone of the trigger, or else
+// in the timezone from the settings of the instance (looked up each time, to
+// follow its changes). Around the daylight saving time changes, the
+// executions planned in the skipped hour are done just after the change, and
+// those in the repeated hour are done only once. With a timezone, an @every
+// interval of whole days keeps the same hour on the wall clock.
 func (c *CronTrigger) NextExecution(last time.Time) time.Time {
+	loc := c.loc
+	if loc == nil {
+		loc = instanceLocation(c.TriggerInfos)
+	}
+	switch sched := c.sched.(type) {
+	case *cron.SpecSchedule:
+		if loc == nil {
+			loc = time.Local
+		}
+		return nextOnWallClock(sched, loc, last)
+	case cron.ConstantDelaySchedule:
+		if c.days > 0 && loc != nil {
+			next := last.In(loc).AddDate(0, 0, c.days)
+			return next.Add(-time.Duration(next.Nanosecond())).In(last.Location())
+		}
+	}
 	return c.sched.Next(last)
 }
 
@@ -88,3 +144,111 @@ func (c *CronTrigger) CombineRequest() string {
 }
 
 var _ Trigger = &CronTrigger{}
+
+// location returns the timezone of the trigger, or nil if it has none.
+func (t *TriggerInfos) location() (*time.Location, error) {
+	if t.Timezone == "" {
+		return nil, nil
+	}
+	loc, err := time.LoadLocation(t.Timezone)
+	if err != nil {
+		return nil, ErrMalformedTrigger
+	}
+	return loc, nil
+}
+
+// instanceLocation returns the timezone from the settings of the instance of
+// the trigger, or nil if there is none.
+func instanceLocation(t *TriggerInfos) *time.Location {
+	if t.Prefix == "" && t.Domain == "" {
+		return nil
+	}
+	var settings couchdb.JSONDoc
+	if err := couchdb.GetDoc(t, consts.Settings, consts.InstanceSettingsID, &settings); err != nil {
+		return nil
+	}
+	tz, _ := settings.M["tz"].(string)
+	if tz == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil
+	}
+	return loc
+}
+
+// nextOnWallClock returns the next execution of the schedule after last. The
+// schedule is evaluated on the wall clock of the timezone, expressed in UTC
+// where there is no daylight saving time, and the result is converted back
+// to an instant.
+func nextOnWallClock(spec *cron.SpecSchedule, loc *time.Location, last time.Time) time.Time {
+	onWall := *spec
+	onWall.Location = time.UTC
+	wall := wallClock(last, loc)
+	for i := 0; i < dstMaxSteps; i++ {
+		wall = onWall.Next(wall)
+		if wall.IsZero() {
+			return wall
+		}
+		next := firstInstantOf(wall, loc)
+		if next.After(last) {
+			return next.In(last.Location())
+		}
+		// This wall clock time has already been seen before the clocks were
+		// turned back: continue after the repeated hour, ie from the wall
+		// clock time just before the change.
+		wall = wallClock(zoneChange(loc, next, last).Add(-time.Nanosecond), loc)
+	}
+	return time.Time{}
+}
+
+// wallClock returns the wall clock time of t in the timezone, as a time in
+// UTC.
+func wallClock(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// firstInstantOf returns the first instant when the wall clock of the
+// timezone shows the given time (in UTC). If this time has been skipped
+// because the clocks were turned forward, it returns the instant of the
+// change.
+func firstInstantOf(wall time.Time, loc *time.Location) time.Time {
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), loc)
+	_, before := t.Add(-dstCheckWindow).Zone()
+	_, after := t.Add(dstCheckWindow).Zone()
+	// With the larger offset, the instant is the earlier one
+	candidates := []int{before, after}
+	if after > before {
+		candidates = []int{after, before}
+	}
+	for _, offset := range candidates {
+		x := wall.Add(-time.Duration(offset) * time.Second)
+		if wallClock(x, loc).Equal(wall) {
+			return x.In(loc)
+		}
+	}
+
+	// The change is between the instants where the wall clock would show
+	// this time with the offset after and with the offset before the change.
+	lo := wall.Add(-time.Duration(after) * time.Second)
+	hi := wall.Add(-time.Duration(before) * time.Second)
+	return zoneChange(loc, lo, hi)
+}
+
+// zoneChange returns the instant, between from and to, when the offset of
+// the timezone changes. It is found by dichotomy, to the second.
+func zoneChange(loc *time.Location, from, to time.Time) time.Time {
+	_, offset := from.In(loc).Zone()
+	lo, hi := from.Unix(), to.Unix()
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if _, off := time.Unix(mid, 0).In(loc).Zone(); off == offset {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return time.Unix(hi, 0).In(loc)
+}
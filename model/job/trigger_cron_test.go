@@ -0,0 +1,92 @@
+package job_test
+
+import (
+	"testing"
+	"time"
+
+	jobs "github.com/cozy/cozy-stack/model/job"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronTriggerTimezone(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+
+	_, err = jobs.NewCronTrigger(&jobs.TriggerInfos{
+		Type:      "@cron",
+		Arguments: "0 0 8 * * *",
+		Timezone:  "Mars/Olympus_Mons",
+	})
+	assert.Equal(t, jobs.ErrMalformedTrigger, err)
+
+	daily, err := jobs.NewCronTrigger(&jobs.TriggerInfos{
+		Type:      "@cron",
+		Arguments: "0 0 8 * * *",
+		Timezone:  "Europe/Paris",
+	})
+	require.NoError(t, err)
+	next := daily.NextExecution(time.Date(2021, 3, 27, 12, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2021, 3, 28, 8, 0, 0, 0, paris).Unix(), next.Unix())
+	next = daily.NextExecution(next)
+	assert.Equal(t, time.Date(2021, 3, 29, 8, 0, 0, 0, paris).Unix(), next.Unix())
+
+	// The execution in the skipped hour is done just after the change
+	night, err := jobs.NewCronTrigger(&jobs.TriggerInfos{
+		Type:      "@cron",
+		Arguments: "0 30 2 * * *",
+		Timezone:  "Europe/Paris",
+	})
+	require.NoError(t, err)
+	next = night.NextExecution(time.Date(2021, 3, 27, 12, 0, 0, 0, paris))
+	assert.Equal(t, time.Date(2021, 3, 28, 3, 0, 0, 0, paris).Unix(), next.Unix())
+	next = night.NextExecution(next)
+	assert.Equal(t, time.Date(2021, 3, 29, 2, 30, 0, 0, paris).Unix(), next.Unix())
+
+	// The execution in the repeated hour is done only once
+	next = night.NextExecution(time.Date(2021, 10, 30, 12, 0, 0, 0, paris))
+	assert.Equal(t, time.Date(2021, 10, 31, 0, 30, 0, 0, time.UTC).Unix(), next.Unix())
+	next = night.NextExecution(next)
+	assert.Equal(t, time.Date(2021, 11, 1, 2, 30, 0, 0, paris).Unix(), next.Unix())
+
+	// Several executions in the skipped hour are done only once
+	often, err := jobs.NewCronTrigger(&jobs.TriggerInfos{
+		Type:      "@cron",
+		Arguments: "0 */20 * * * *",
+		Timezone:  "Europe/Paris",
+	})
+	require.NoError(t, err)
+	next = often.NextExecution(time.Date(2021, 3, 28, 1, 50, 0, 0, paris))
+	assert.Equal(t, time.Date(2021, 3, 28, 3, 0, 0, 0, paris).Unix(), next.Unix())
+	next = often.NextExecution(next)
+	assert.Equal(t, time.Date(2021, 3, 28, 3, 20, 0, 0, paris).Unix(), next.Unix())
+
+	// And in the repeated hour, even from an instant of its second pass
+	next = often.NextExecution(time.Date(2021, 10, 31, 0, 30, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2021, 10, 31, 0, 40, 0, 0, time.UTC).Unix(), next.Unix())
+	next = often.NextExecution(next)
+	assert.Equal(t, time.Date(2021, 10, 31, 2, 0, 0, 0, time.UTC).Unix(), next.Unix())
+	next = often.NextExecution(time.Date(2021, 10, 31, 1, 10, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2021, 10, 31, 2, 0, 0, 0, time.UTC).Unix(), next.Unix())
+
+	// A timezone in the arguments has the precedence
+	ny, err := jobs.NewCronTrigger(&jobs.TriggerInfos{
+		Type:      "@cron",
+		Arguments: "CRON_TZ=America/New_York 0 0 8 * * *",
+		Timezone:  "Europe/Paris",
+	})
+	require.NoError(t, err)
+	next = ny.NextExecution(time.Date(2021, 3, 27, 12, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2021, 3, 28, 12, 0, 0, 0, time.UTC).Unix(), next.Unix())
+
+	every, err := jobs.NewEveryTrigger(&jobs.TriggerInfos{
+		Type:      "@every",
+		Arguments: "24h",
+		Timezone:  "Europe/Paris",
+	})
+	require.NoError(t, err)
+	next = every.NextExecution(time.Date(2021, 3, 27, 8, 0, 0, 0, paris))
+	assert.Equal(t, time.Date(2021, 3, 28, 8, 0, 0, 0, paris).Unix(), next.Unix())
+	next = every.NextExecution(next)
+	assert.Equal(t, time.Date(2021, 3, 29, 8, 0, 0, 0, paris).Unix(), next.Unix())
+}
@@ -1,6 +1,7 @@
 package job
 
 import (
+	"encoding/json"
 	"errors"
 	"strings"
 
@@ -8,6 +9,7 @@ import (
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 )
@@ -17,11 +19,45 @@ type EventTrigger struct {
 	*TriggerInfos
 	unscheduled chan struct{}
 	mask        []permission.Rule
+	// The selectors of the condition, compiled once for all the events
+	docMatcher *mango.Matcher
+	oldMatcher *mango.Matcher
+}
+
+// EventCondition is a condition on the content of the documents of the
+// events for an @event trigger. Doc is a mango selector for the new version
+// of the document, and Old for the old version (an event without an old
+// version doesn't match a condition on it).
+type EventCondition struct {
+	Doc mango.Map `json:"doc,omitempty"`
+	Old mango.Map `json:"old,omitempty"`
+}
+
+// Validate checks that the selectors of the condition are valid.
+func (c *EventCondition) Validate() error {
+	if err := mango.ValidateSelector(c.Doc); err != nil {
+		return err
+	}
+	return mango.ValidateSelector(c.Old)
 }
 
 // NewEventTrigger returns a new instance of EventTrigger given the specified
 // options.
 func NewEventTrigger(infos *TriggerInfos) (*EventTrigger, error) {
+	var docMatcher, oldMatcher *mango.Matcher
+	if c := infos.Condition; c != nil {
+		var err error
+		if len(c.Doc) > 0 {
+			if docMatcher, err = mango.NewMatcher(c.Doc); err != nil {
+				return nil, ErrMalformedTrigger
+			}
+		}
+		if len(c.Old) > 0 {
+			if oldMatcher, err = mango.NewMatcher(c.Old); err != nil {
+				return nil, ErrMalformedTrigger
+			}
+		}
+	}
 	args := strings.Split(infos.Arguments, " ")
 	rules := make([]permission.Rule, len(args))
 	for i, arg := range args {
@@ -35,6 +71,8 @@ func NewEventTrigger(infos *TriggerInfos) (*EventTrigger, error) {
 		TriggerInfos: infos,
 		unscheduled:  make(chan struct{}),
 		mask:         rules,
+		docMatcher:   docMatcher,
+		oldMatcher:   oldMatcher,
 	}, nil
 }
 
@@ -65,7 +103,7 @@ func (t *EventTrigger) Schedule() <-chan *JobRequest {
 						break
 					}
 				}
-				if found {
+				if found && t.MatchCondition(e) {
 					if evt, err := t.Infos().JobRequestWithEvent(e); err == nil {
 						ch <- evt
 					}
@@ -93,6 +131,42 @@ func (t *EventTrigger) CombineRequest() string {
 	return suppressPayload
 }
 
+// MatchCondition returns true if the documents of the event match the
+// condition of the trigger, or if the trigger has no condition.
+func (t *EventTrigger) MatchCondition(e *realtime.Event) bool {
+	if t.docMatcher != nil {
+		doc, ok := eventDocAsMap(e.Doc)
+		if !ok || !t.docMatcher.Match(doc) {
+			return false
+		}
+	}
+	if t.oldMatcher != nil {
+		if e.OldDoc == nil {
+			return false
+		}
+		old, ok := eventDocAsMap(e.OldDoc)
+		if !ok || !t.oldMatcher.Match(old) {
+			return false
+		}
+	}
+	return true
+}
+
+func eventDocAsMap(doc realtime.Doc) (map[string]interface{}, bool) {
+	if d, ok := doc.(*couchdb.JSONDoc); ok {
+		return d.M, true
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, false
+	}
+	return m, true
+}
+
 func eventMatchRule(e *realtime.Event, rule *permission.Rule) bool {
 	if e.Doc.DocType() != rule.Type {
 		return false
@@ -210,3 +210,40 @@ func TestTriggerEvent(t *testing.T) {
 	err := sch.ShutdownScheduler(context.Background())
 	assert.NoError(t, err)
 }
+
+func TestTriggerEventCondition(t *testing.T) {
+	infos := &jobs.TriggerInfos{
+		Type:       "@event",
+		WorkerType: "worker_event",
+		Arguments:  "io.cozy.bills:UPDATED",
+		Condition: &jobs.EventCondition{
+			Old: map[string]interface{}{"status": "pending"},
+			Doc: map[string]interface{}{"status": "paid"},
+		},
+	}
+	trigger, err := jobs.NewEventTrigger(infos)
+	assert.NoError(t, err)
+
+	bill := func(status string) *couchdb.JSONDoc {
+		return &couchdb.JSONDoc{
+			Type: "io.cozy.bills",
+			M:    map[string]interface{}{"_id": "bill-id", "status": status},
+		}
+	}
+	evt := &realtime.Event{
+		Verb:   realtime.EventUpdate,
+		Doc:    bill("paid"),
+		OldDoc: bill("pending"),
+	}
+	assert.True(t, trigger.MatchCondition(evt))
+	evt.OldDoc = bill("paid")
+	assert.False(t, trigger.MatchCondition(evt))
+	evt.OldDoc = nil
+	assert.False(t, trigger.MatchCondition(evt))
+
+	infos.Condition = &jobs.EventCondition{
+		Doc: map[string]interface{}{"status": map[string]interface{}{"$unknown": true}},
+	}
+	_, err = jobs.NewEventTrigger(infos)
+	assert.Equal(t, jobs.ErrMalformedTrigger, err)
+}
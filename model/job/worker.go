@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
 	"runtime"
 	"runtime/debug"
 	"sync/atomic"
@@ -70,6 +69,13 @@ type (
 		Reserved     bool // true when the clients must not push jobs for this worker
 		Timeout      time.Duration
 		RetryDelay   time.Duration
+		RetryPolicy  *RetryPolicy
+
+		// FairScheduling is true when the jobs of the instances are executed
+		// in a round-robin fashion, and MaxPerInstance limits the number of
+		// jobs executed in parallel for an instance (0 for no limit).
+		FairScheduling bool
+		MaxPerInstance int
 	}
 
 	// Worker is a unit of work that will consume from a queue and execute the do
@@ -80,6 +86,15 @@ type (
 		jobs    chan *Job
 		running uint32
 		closed  chan struct{}
+		fair    *fairDispatcher
+		requeue func(j *Job) error
+		// pushBack puts a job at the tail of the queue, when its instance
+		// has reached its limit of jobs executed in parallel.
+		pushBack func(j *Job) error
+		// retryLater puts a job back in the queue after the given delay. It
+		// is used for the retries scheduled by a retry policy, to not keep
+		// a worker waiting for them.
+		retryLater func(j *Job, delay time.Duration) error
 	}
 
 	// WorkerContext is a context.Context passed to the worker for each job
@@ -89,6 +104,7 @@ type (
 		Instance *instance.Instance
 		job      *Job
 		log      *logger.Entry
+		logs     *logRing
 		id       string
 		cookie   interface{}
 		noRetry  bool
@@ -129,6 +145,7 @@ func NewWorkerContext(workerID string, job *Job, inst *instance.Instance) *Worke
 		Instance: inst,
 		job:      job,
 		log:      log,
+		logs:     &logRing{},
 		id:       id,
 	}
 }
@@ -164,6 +181,7 @@ func (c *WorkerContext) clone() *WorkerContext {
 		Instance: c.Instance,
 		job:      c.job,
 		log:      c.log,
+		logs:     c.logs,
 		id:       c.id,
 		cookie:   c.cookie,
 	}
@@ -208,6 +226,24 @@ func (c *WorkerContext) TriggerID() (string, bool) {
 	return triggerID, triggerID != ""
 }
 
+// Parent returns the information about the job that has pushed this job as a
+// follow-up, if any.
+func (c *WorkerContext) Parent() (*JobParent, bool) {
+	parent := c.job.Parent
+	return parent, parent != nil
+}
+
+// SetResult sets the result of the job, that will be given to its
+// follow-ups. It must be JSON-serializable.
+func (c *WorkerContext) SetResult(v interface{}) error {
+	result, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.job.Result = result
+	return nil
+}
+
 // Cookie returns the cookie associated with the worker context.
 func (c *WorkerContext) Cookie() interface{} {
 	return c.cookie
@@ -238,10 +274,16 @@ func (w *Worker) Start(jobs chan *Job) error {
 			return fmt.Errorf("Could not start worker %s: %s", w.Type, err)
 		}
 	}
+	var queue <-chan *Job = jobs
+	if w.Conf.FairScheduling || w.Conf.MaxPerInstance > 0 {
+		w.fair = newFairDispatcher(jobs, w.Conf, w.requeue, w.pushBack)
+		queue = w.fair.out
+		go w.fair.run()
+	}
 	for i := 0; i < w.Conf.Concurrency; i++ {
 		name := fmt.Sprintf("%s/%d", w.Type, i)
 		joblog.Debugf("Start worker %s", name)
-		go w.work(name, w.closed)
+		go w.work(name, queue, w.closed)
 	}
 	return nil
 }
@@ -262,92 +304,146 @@ func (w *Worker) Shutdown(ctx context.Context) error {
 	return nil
 }
 
-func (w *Worker) work(workerID string, closed chan<- struct{}) {
-	for job := range w.jobs {
-		domain := job.Domain
-		if domain == "" {
-			joblog.Errorf("%s: missing domain from job request", workerID)
-			continue
+func (w *Worker) work(workerID string, queue <-chan *Job, closed chan<- struct{}) {
+	for job := range queue {
+		w.process(workerID, job)
+		if w.fair != nil {
+			w.fair.finished(job)
 		}
-		var inst *instance.Instance
-		if domain != prefixer.GlobalPrefixer.DomainName() {
-			var err error
-			inst, err = instance.Get(job.Domain)
-			if err != nil {
-				joblog.Errorf("Instance not found for %s: %s", job.Domain, err)
-				continue
-			}
-			// Do not execute jobs for instances with blocking not signed TOS,
-			// except for:
-			// - mails because the user may needs a mail to login and accept
-			//   the new TOS (2FA, password reset, etc.)
-			// - migrations because the old version may be no longer supported
-			//   when the user will sign the TOS
-			if w.Type != "sendmail" && w.Type != "migrations" {
-				notSigned, deadline := inst.CheckTOSNotSignedAndDeadline()
-				if notSigned && deadline == instance.TOSBlocked {
-					continue
-				}
+	}
+	joblog.Debugf("%s: worker shut down", workerID)
+	closed <- struct{}{}
+}
+
+// process executes the given job and saves its result.
+func (w *Worker) process(workerID string, job *Job) {
+	domain := job.Domain
+	if domain == "" {
+		joblog.Errorf("%s: missing domain from job request", workerID)
+		return
+	}
+	var inst *instance.Instance
+	if domain != prefixer.GlobalPrefixer.DomainName() {
+		var err error
+		inst, err = instance.Get(job.Domain)
+		if err != nil {
+			joblog.Errorf("Instance not found for %s: %s", job.Domain, err)
+			return
+		}
+		// Do not execute jobs for instances with blocking not signed TOS,
+		// except for:
+		// - mails because the user may needs a mail to login and accept
+		//   the new TOS (2FA, password reset, etc.)
+		// - migrations because the old version may be no longer supported
+		//   when the user will sign the TOS
+		if w.Type != "sendmail" && w.Type != "migrations" {
+			notSigned, deadline := inst.CheckTOSNotSignedAndDeadline()
+			if notSigned && deadline == instance.TOSBlocked {
+				return
 			}
 		}
-		parentCtx := NewWorkerContext(workerID, job, inst)
-		if err := job.AckConsumed(); err != nil {
+	}
+	if job.State == Cancelled {
+		return
+	}
+	parentCtx := NewWorkerContext(workerID, job, inst)
+	ctx, cancel := context.WithCancel(parentCtx.Context)
+	parentCtx.Context = ctx
+	registerRunningJob(job.ID(), func() bool { cancel(); return true })
+	if err := job.AckConsumed(); err != nil {
+		// The job may have been cancelled after it has been taken from its
+		// queue, and it must then not be executed.
+		if isCancelledJob(job, err) {
+			parentCtx.Logger().Infof("job cancelled before its execution")
+		} else {
 			parentCtx.Logger().Errorf("error acking consume job: %s",
 				err.Error())
-			continue
-		}
-		t := &task{
-			w:    w,
-			ctx:  parentCtx,
-			job:  job,
-			conf: w.defaultedConf(job.Options),
 		}
-		var runResultLabel string
-		var errAck error
-		errRun := t.run()
-		if errRun == ErrAbort {
-			errRun = nil
+		unregisterRunningJob(job.ID())
+		cancel()
+		return
+	}
+	t := &task{
+		w:    w,
+		ctx:  parentCtx,
+		job:  job,
+		conf: w.defaultedConf(job.Options),
+	}
+	var runResultLabel string
+	var errAck error
+	var retrying bool
+	errRun := t.run()
+	cancelled := ctx.Err() == context.Canceled
+	unregisterRunningJob(job.ID())
+	cancel()
+	if errRun == ErrAbort {
+		errRun = nil
+	}
+	if cancelled {
+		parentCtx.Logger().Infof("job cancelled")
+		runResultLabel = metrics.WorkerExecResultCancelled
+		errAck = job.Cancel()
+	} else if errRun != nil && t.retryIn > 0 {
+		parentCtx.Logger().Warnf("error while performing job: %s (retry in %s)",
+			errRun.Error(), t.retryIn)
+		runResultLabel = metrics.WorkerExecResultErrored
+		if errAck = job.Retry(t.attempts, errRun.Error()); errAck == nil {
+			errAck = w.retryLater(job, t.retryIn)
 		}
-		if errRun != nil {
-			parentCtx.Logger().Errorf("error while performing job: %s",
-				errRun.Error())
-			runResultLabel = metrics.WorkerExecResultErrored
+		if errAck != nil {
+			parentCtx.Logger().Errorf("error while scheduling the retry: %s",
+				errAck.Error())
 			errAck = job.Nack(errRun.Error())
 		} else {
-			runResultLabel = metrics.WorkerExecResultSuccess
-			errAck = job.Ack()
+			retrying = true
 		}
-
-		// Distinguish classic job execution and konnector/account deletion
-		msg := struct {
-			Account        string `json:"account"`
-			AccountRev     string `json:"account_rev"`
-			Konnector      string `json:"konnector"`
-			AccountDeleted bool   `json:"account_deleted"`
-		}{}
-		err := json.Unmarshal(job.Message, &msg)
-
-		if err == nil && w.Type == "konnector" && msg.AccountDeleted {
-			metrics.WorkerKonnectorExecDeleteCounter.WithLabelValues(w.Type, runResultLabel).Inc()
-		} else {
-			metrics.WorkerExecCounter.WithLabelValues(w.Type, runResultLabel).Inc()
+	} else if errRun != nil {
+		parentCtx.Logger().Errorf("error while performing job: %s",
+			errRun.Error())
+		runResultLabel = metrics.WorkerExecResultErrored
+		errAck = job.Nack(errRun.Error())
+		if errAck == nil && t.isDead(errRun) {
+			if err := addDeadJob(job, t.attempts); err != nil {
+				parentCtx.Logger().Errorf("error while adding job to the dead-letter queue: %s",
+					err.Error())
+			}
 		}
+	} else {
+		runResultLabel = metrics.WorkerExecResultSuccess
+		errAck = job.Ack()
+	}
 
-		if errAck != nil {
-			parentCtx.Logger().Errorf("error while acking job done: %s",
-				errAck.Error())
-		}
+	// Distinguish classic job execution and konnector/account deletion
+	msg := struct {
+		Account        string `json:"account"`
+		AccountRev     string `json:"account_rev"`
+		Konnector      string `json:"konnector"`
+		AccountDeleted bool   `json:"account_deleted"`
+	}{}
+	err := json.Unmarshal(job.Message, &msg)
+
+	if err == nil && w.Type == "konnector" && msg.AccountDeleted {
+		metrics.WorkerKonnectorExecDeleteCounter.WithLabelValues(w.Type, runResultLabel).Inc()
+	} else {
+		metrics.WorkerExecCounter.WithLabelValues(w.Type, runResultLabel).Inc()
+	}
 
-		// Delete the trigger associated with the job (if any) when we receive a
-		// ErrBadTrigger.
-		if job.TriggerID != "" && globalJobSystem != nil {
-			if _, ok := errRun.(ErrBadTrigger); ok {
-				_ = globalJobSystem.DeleteTrigger(job, job.TriggerID)
-			}
+	if errAck != nil {
+		parentCtx.Logger().Errorf("error while acking job done: %s",
+			errAck.Error())
+	} else if globalJobSystem != nil && !retrying {
+		// The follow-ups of a job waiting for a retry are pushed after its
+		// last execution
+		pushFollowUps(globalJobSystem, job)
+	}
+
+	// Delete the trigger associated with the job (if any) when we receive a
+	// ErrBadTrigger.
+	if job.TriggerID != "" && globalJobSystem != nil {
+		if _, ok := errRun.(ErrBadTrigger); ok {
+			_ = globalJobSystem.DeleteTrigger(job, job.TriggerID)
 		}
 	}
-	joblog.Debugf("%s: worker shut down", workerID)
-	closed <- struct{}{}
 }
 
 func (w *Worker) defaultedConf(opts *JobOptions) *WorkerConfig {
@@ -373,6 +469,9 @@ func (w *Worker) defaultedConf(opts *JobOptions) *WorkerConfig {
 	if opts.Timeout > 0 && opts.Timeout < c.Timeout {
 		c.Timeout = opts.Timeout
 	}
+	if opts.Retry != nil {
+		c.RetryPolicy = opts.Retry
+	}
 	return c
 }
 
@@ -385,11 +484,17 @@ type task struct {
 	startTime time.Time
 	endTime   time.Time
 	execCount int
+	noRetry   bool
+	attempts  []JobAttempt
+	retryIn   time.Duration
 }
 
 func (t *task) run() (err error) {
 	t.startTime = time.Now()
-	t.execCount = 0
+	// A job can have been executed before, if its retries are scheduled by
+	// its retry policy
+	t.attempts = append([]JobAttempt{}, t.job.Attempts...)
+	t.execCount = len(t.attempts)
 
 	if t.conf.WorkerStart != nil {
 		t.ctx, err = t.conf.WorkerStart(t.ctx)
@@ -406,8 +511,11 @@ func (t *task) run() (err error) {
 			}
 		}
 	}()
-	for {
+	for first := true; ; first = false {
 		retry, delay, timeout := t.nextDelay(err)
+		if first {
+			delay = 0
+		}
 
 		// The optional ErrorHook function allows to prevent retries depending
 		// on the previous error
@@ -422,8 +530,23 @@ func (t *task) run() (err error) {
 				err.Error(), delay)
 		}
 
+		// The delays of a retry policy can be long: the job is put back in
+		// the queue instead of keeping the worker waiting
+		if delay > 0 && t.conf.RetryPolicy != nil && t.w.retryLater != nil {
+			t.retryIn = delay
+			break
+		}
 		if delay > 0 {
-			time.Sleep(delay)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-t.ctx.Done():
+				timer.Stop()
+				err = t.ctx.Err()
+			}
+			if err == context.Canceled {
+				break
+			}
 		}
 
 		t.ctx.Logger().Debugf("Executing job (%d) (timeout set to %s)",
@@ -435,7 +558,14 @@ func (t *task) run() (err error) {
 		}))
 
 		ctx, cancel := t.ctx.WithTimeout(timeout)
+		attempt := JobAttempt{StartedAt: time.Now()}
 		err = t.exec(ctx)
+		t.ctx.saveLogs()
+		attempt.FinishedAt = time.Now()
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+		t.attempts = append(t.attempts, attempt)
 		if err == nil {
 			execResultLabel = metrics.WorkerExecResultSuccess
 			timer.ObserveDuration()
@@ -479,7 +609,9 @@ func (t *task) run() (err error) {
 		cancel()
 		t.execCount++
 
-		if ctx.NoRetry() {
+		// No retry for a cancelled job
+		if ctx.NoRetry() || t.ctx.Err() == context.Canceled {
+			t.noRetry = ctx.NoRetry()
 			break
 		}
 	}
@@ -488,6 +620,16 @@ func (t *task) run() (err error) {
 	return
 }
 
+// isDead returns true if the job has failed after all its attempts: it
+// should then be put in the dead-letter queue. The jobs stopped earlier, by
+// the ErrorHook or the no-retry flag, and the jobs failed with an error that
+// their retry policy doesn't retry (retry_on) are not put in it, as they have
+// failed for a reason that a replay won't fix.
+func (t *task) isDead(errRun error) bool {
+	return errRun != nil && !t.noRetry && t.execCount >= t.conf.MaxExecCount &&
+		t.conf.RetryPolicy.Retryable(errRun)
+}
+
 func (t *task) exec(ctx *WorkerContext) (err error) {
 	var slot struct{}
 	if slots != nil {
@@ -528,6 +670,11 @@ func (t *task) nextDelay(prevError error) (bool, time.Duration, time.Duration) {
 		return false, 0, 0
 	}
 
+	// the retry policy can restrict the retries to some classes of errors
+	if !c.RetryPolicy.Retryable(prevError) {
+		return false, 0, 0
+	}
+
 	// the worker timeout should take into account the maximum execution time
 	// allowed to the task
 	timeout := c.Timeout
@@ -537,11 +684,7 @@ func (t *task) nextDelay(prevError error) (bool, time.Duration, time.Duration) {
 		// on first execution, execute immediately
 		nextDelay = 0
 	} else {
-		nextDelay = c.RetryDelay << uint(t.execCount-1)
-
-		// fuzzDelay number between delay * (1 +/- 0.1)
-		fuzzDelay := int(0.1 * float64(nextDelay))
-		nextDelay = nextDelay + time.Duration((rand.Intn(2*fuzzDelay) - fuzzDelay))
+		nextDelay = c.RetryPolicy.delay(c.RetryDelay, t.execCount)
 	}
 
 	return true, nextDelay, timeout
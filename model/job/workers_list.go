@@ -81,6 +81,12 @@ func applyWorkerConfig(w *WorkerConfig, c config.Worker) *WorkerConfig {
 	if c.Timeout != nil {
 		w.Timeout = *c.Timeout
 	}
+	if c.FairScheduling != nil {
+		w.FairScheduling = *c.FairScheduling
+	}
+	if c.MaxPerInstance != nil {
+		w.MaxPerInstance = *c.MaxPerInstance
+	}
 	return w
 }
 
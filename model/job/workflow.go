@@ -0,0 +1,175 @@
+package job
+
+import (
+	"encoding/json"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// maxWorkflowDepth is the maximal number of levels of follow-up jobs that can
+// be declared in a workflow.
+const maxWorkflowDepth = 16
+
+// maxWorkflowFollowUps is the maximal number of follow-up jobs that can be
+// declared in a workflow, for all the levels.
+const maxWorkflowFollowUps = 64
+
+type (
+	// JobFollowUp describes a job that is pushed when another job has
+	// finished. A follow-up can have its own follow-ups, which allows to
+	// declare a whole workflow when the first job is pushed.
+	JobFollowUp struct {
+		WorkerType string         `json:"worker"`
+		Message    Message        `json:"message,omitempty"`
+		Options    *JobOptions    `json:"options,omitempty"`
+		OnSuccess  []*JobFollowUp `json:"on_success,omitempty"`
+		OnFailure  []*JobFollowUp `json:"on_failure,omitempty"`
+	}
+
+	// JobParent is the information about the job that has pushed a job as
+	// one of its follow-ups.
+	JobParent struct {
+		JobID  string          `json:"job_id"`
+		State  State           `json:"state"`
+		Error  string          `json:"error,omitempty"`
+		Result json.RawMessage `json:"result,omitempty"`
+	}
+)
+
+// ValidateFollowUps checks that the follow-ups on success and on failure of a
+// job have a worker type, and that the workflow is not too deep and has not
+// too many jobs. In case of error, the name of the invalid attribute is
+// returned with the error.
+func ValidateFollowUps(onSuccess, onFailure []*JobFollowUp) (string, error) {
+	count := 0
+	if err := validateFollowUps(onSuccess, 1, &count); err != nil {
+		return "on_success", err
+	}
+	if err := validateFollowUps(onFailure, 1, &count); err != nil {
+		return "on_failure", err
+	}
+	return "", nil
+}
+
+func validateFollowUps(followUps []*JobFollowUp, depth int, count *int) error {
+	if len(followUps) > 0 && depth > maxWorkflowDepth {
+		return ErrInvalidWorkflow
+	}
+	*count += len(followUps)
+	if *count > maxWorkflowFollowUps {
+		return ErrInvalidWorkflow
+	}
+	for _, f := range followUps {
+		if f == nil || f.WorkerType == "" {
+			return ErrInvalidWorkflow
+		}
+		if err := ValidateOptions(f.Options); err != nil {
+			return err
+		}
+		if err := validateFollowUps(f.OnSuccess, depth+1, count); err != nil {
+			return err
+		}
+		if err := validateFollowUps(f.OnFailure, depth+1, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkFollowUps calls fn for each follow-up of the list, and for their own
+// follow-ups, recursively.
+func WalkFollowUps(followUps []*JobFollowUp, fn func(f *JobFollowUp) error) error {
+	for _, f := range followUps {
+		if err := fn(f); err != nil {
+			return err
+		}
+		if err := WalkFollowUps(f.OnSuccess, fn); err != nil {
+			return err
+		}
+		if err := WalkFollowUps(f.OnFailure, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushFollowUps pushes the follow-ups of a finished job, according to its
+// state, and saves the identifiers of the pushed jobs in the job.
+func pushFollowUps(b Broker, j *Job) {
+	var followUps []*JobFollowUp
+	switch j.State {
+	case Done:
+		followUps = j.OnSuccess
+	case Errored:
+		followUps = j.OnFailure
+	}
+	if len(followUps) == 0 {
+		return
+	}
+
+	workflowID := j.WorkflowID
+	if workflowID == "" {
+		workflowID = j.ID()
+	}
+	parent := &JobParent{
+		JobID:  j.ID(),
+		State:  j.State,
+		Error:  j.Error,
+		Result: j.Result,
+	}
+	for _, f := range followUps {
+		child, err := b.PushJob(j, &JobRequest{
+			WorkerType: f.WorkerType,
+			Message:    f.Message,
+			Options:    f.Options,
+			OnSuccess:  f.OnSuccess,
+			OnFailure:  f.OnFailure,
+			Parent:     parent,
+			WorkflowID: workflowID,
+		})
+		if err != nil {
+			j.Logger().Warnf("Cannot push the follow-up %s of %s: %s",
+				f.WorkerType, j.ID(), err)
+			continue
+		}
+		j.Children = append(j.Children, child.ID())
+	}
+	if len(j.Children) > 0 {
+		if err := j.Update(); err != nil {
+			j.Logger().Warnf("Cannot save the follow-ups of %s: %s", j.ID(), err)
+		}
+	}
+}
+
+// GetWorkflow returns the jobs of the workflow of the given job: the job that
+// has started the workflow is the first, and it is followed by the jobs that
+// have been pushed as follow-ups, in breadth-first order. The follow-ups that
+// have not been pushed yet can be found in the on_success and on_failure
+// fields of the jobs.
+func GetWorkflow(db prefixer.Prefixer, jobID string) ([]*Job, error) {
+	root, err := Get(db, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if root.WorkflowID != "" && root.WorkflowID != root.ID() {
+		if root, err = Get(db, root.WorkflowID); err != nil {
+			return nil, err
+		}
+	}
+
+	jobs := []*Job{root}
+	for i := 0; i < len(jobs); i++ {
+		for _, childID := range jobs[i].Children {
+			child, err := Get(db, childID)
+			if err == ErrNotFoundJob {
+				// The job may have been purged
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, child)
+		}
+	}
+	return jobs, nil
+}
@@ -0,0 +1,80 @@
+package job_test
+
+import (
+	"testing"
+
+	jobs "github.com/cozy/cozy-stack/model/job"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateFollowUps(t *testing.T) {
+	followUps := []*jobs.JobFollowUp{
+		{WorkerType: "service", OnSuccess: []*jobs.JobFollowUp{{WorkerType: "push"}}},
+		{WorkerType: "sendmail"},
+	}
+	_, err := jobs.ValidateFollowUps(followUps, nil)
+	assert.NoError(t, err)
+
+	var workers []string
+	err = jobs.WalkFollowUps(followUps, func(f *jobs.JobFollowUp) error {
+		workers = append(workers, f.WorkerType)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"service", "push", "sendmail"}, workers)
+
+	attr, err := jobs.ValidateFollowUps(nil, []*jobs.JobFollowUp{{}})
+	assert.Equal(t, jobs.ErrInvalidWorkflow, err)
+	assert.Equal(t, "on_failure", attr)
+
+	followUps[1].OnFailure = []*jobs.JobFollowUp{{}}
+	attr, err = jobs.ValidateFollowUps(followUps, nil)
+	assert.Equal(t, jobs.ErrInvalidWorkflow, err)
+	assert.Equal(t, "on_success", attr)
+
+	deep := &jobs.JobFollowUp{WorkerType: "service"}
+	for i := 0; i < 20; i++ {
+		deep = &jobs.JobFollowUp{WorkerType: "service", OnSuccess: []*jobs.JobFollowUp{deep}}
+	}
+	_, err = jobs.ValidateFollowUps([]*jobs.JobFollowUp{deep}, nil)
+	assert.Equal(t, jobs.ErrInvalidWorkflow, err)
+
+	// The limit on the number of follow-ups is for the whole workflow
+	wide := make([]*jobs.JobFollowUp, 40)
+	for i := range wide {
+		wide[i] = &jobs.JobFollowUp{WorkerType: "service"}
+	}
+	_, err = jobs.ValidateFollowUps(wide, nil)
+	assert.NoError(t, err)
+	attr, err = jobs.ValidateFollowUps(wide, wide)
+	assert.Equal(t, jobs.ErrInvalidWorkflow, err)
+	assert.Equal(t, "on_failure", attr)
+}
+
+func TestGetWorkflow(t *testing.T) {
+	root := jobs.NewJob(testInstance, &jobs.JobRequest{
+		WorkerType: "konnector",
+		OnSuccess:  []*jobs.JobFollowUp{{WorkerType: "service"}},
+	})
+	require.NoError(t, root.Create())
+
+	parent := &jobs.JobParent{JobID: root.ID(), State: jobs.Done}
+	child := jobs.NewJob(testInstance, &jobs.JobRequest{
+		WorkerType: "service",
+		Parent:     parent,
+		WorkflowID: root.ID(),
+	})
+	require.NoError(t, child.Create())
+	root.Children = []string{child.ID(), "purged-job"}
+	require.NoError(t, root.Ack())
+
+	for _, id := range []string{root.ID(), child.ID()} {
+		workflow, err := jobs.GetWorkflow(testInstance, id)
+		require.NoError(t, err)
+		require.Len(t, workflow, 2)
+		assert.Equal(t, root.ID(), workflow[0].ID())
+		assert.Equal(t, child.ID(), workflow[1].ID())
+		assert.Equal(t, root.ID(), workflow[1].Parent.JobID)
+	}
+}
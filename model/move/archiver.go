@@ -12,6 +12,7 @@ import (
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/s3"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/ncw/swift/v2"
 	"github.com/spf13/afero"
@@ -44,6 +45,8 @@ func SystemArchiver() Archiver {
 		return newAferoArchiver(fs)
 	case config.SchemeSwift, config.SchemeSwiftSecure:
 		return newSwiftArchiver()
+	case config.SchemeS3, config.SchemeS3Insecure:
+		return newS3Archiver()
 	default:
 		panic(fmt.Errorf("exports: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -148,3 +151,50 @@ func (a *switfArchiver) RemoveArchives(exportDocs []*ExportDoc) error {
 	}
 	return nil
 }
+
+func newS3Archiver() Archiver {
+	return &s3Archiver{
+		c:   config.GetS3Client(),
+		ctx: context.Background(),
+	}
+}
+
+// s3Archiver stores the archives in the bucket of the VFS, with keys prefixed
+// by exports/. S3 has no equivalent of the X-Delete-At header of swift, so,
+// like for afero, the old archives are removed when a new export starts.
+type s3Archiver struct {
+	c   *s3.Client
+	ctx context.Context
+}
+
+func (a *s3Archiver) key(exportDoc *ExportDoc) string {
+	return "exports/" + exportDoc.Domain + "/" + exportDoc.ID()
+}
+
+func (a *s3Archiver) OpenArchive(inst *instance.Instance, exportDoc *ExportDoc) (io.ReadCloser, error) {
+	obj, err := a.c.GetObject(a.ctx, a.key(exportDoc), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return obj.Body, nil
+}
+
+func (a *s3Archiver) CreateArchive(exportDoc *ExportDoc) (io.WriteCloser, error) {
+	return a.c.NewWriter(a.ctx, a.key(exportDoc), &s3.PutOptions{
+		ContentType: "application/tar+gzip",
+		Metadata: map[string]string{
+			"created-at": exportDoc.CreatedAt.Format(time.RFC3339),
+		},
+	}), nil
+}
+
+func (a *s3Archiver) RemoveArchives(exportDocs []*ExportDoc) error {
+	keys := make([]string, 0, len(exportDocs))
+	for _, e := range exportDocs {
+		keys = append(keys, a.key(e))
+	}
+	if len(keys) > 0 {
+		return a.c.DeleteObjects(a.ctx, keys)
+	}
+	return nil
+}
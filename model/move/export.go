@@ -423,6 +423,9 @@ func exportDocuments(in *instance.Instance, doc *ExportDoc, now time.Time, tw *t
 		case consts.Files, consts.FilesVersions:
 			// we have code specific to those doctypes
 			continue
+		case consts.FilesBlobs:
+			// the reference counts are rebuilt when the files are imported
+			continue
 		}
 		dir := url.PathEscape(doctype)
 		err := couchdb.ForeachDocs(in, doctype, func(id string, doc json.RawMessage) error {
@@ -448,6 +451,11 @@ func writeInstanceDoc(in *instance.Instance, name string, now time.Time, tw *tar
 	clone.SessSecret = nil
 	clone.OAuthSecret = nil
 	clone.CLISecret = nil
+	clone.TOTPSecret = nil
+	clone.TOTPPendingSecret = nil
+	clone.TOTPLastStep = 0
+	clone.RecoveryCodes = nil
+	clone.FilesKeys = nil
 	clone.SwiftLayout = 0
 	clone.CouchCluster = 0
 	clone.IndexViewsVersion = 0
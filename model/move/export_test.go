@@ -1,6 +1,9 @@
 package move
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"os"
@@ -159,6 +162,37 @@ func TestExportFiles(t *testing.T) {
 	assert.Len(t, versionsIDs, nbVersions)
 }
 
+func TestWriteInstanceDoc(t *testing.T) {
+	in := &instance.Instance{
+		Domain:            "export.example.net",
+		SessSecret:        crypto.GenerateRandomBytes(64),
+		TOTPSecret:        []byte("JBSWY3DPEHPK3PXP"),
+		TOTPPendingSecret: []byte("KRSXG5CTMVRXEZLU"),
+		TOTPLastStep:      42,
+		RecoveryCodes:     []string{"hash1", "hash2"},
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	_, err := writeInstanceDoc(in, "instance", time.Now(), tw)
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+
+	tr := tar.NewReader(&buf)
+	_, err = tr.Next()
+	assert.NoError(t, err)
+	var doc map[string]interface{}
+	assert.NoError(t, json.NewDecoder(tr).Decode(&doc))
+	assert.Equal(t, "export.example.net", doc["domain"])
+	assert.NotContains(t, doc, "session_secret")
+	assert.NotContains(t, doc, "totp_secret")
+	assert.NotContains(t, doc, "totp_pending_secret")
+	assert.NotContains(t, doc, "totp_last_step")
+	assert.NotContains(t, doc, "recovery_codes")
+	// The instance itself is not modified
+	assert.NotEmpty(t, in.TOTPSecret)
+	assert.Len(t, in.RecoveryCodes, 2)
+}
+
 func TestMain(m *testing.M) {
 	seed := time.Now().UTC().Unix()
 	fmt.Printf("seed = %d\n", seed)
@@ -112,6 +112,9 @@ func (im *importer) importZip(zr *zip.Reader) error {
 		case consts.Sessions:
 			// We don't want to import the sessions from another instance
 			continue
+		case consts.WebAuthnCredentials:
+			// The credentials are bound to the domain of the old instance
+			continue
 		case consts.BitwardenCiphers, consts.BitwardenFolders, consts.BitwardenProfiles,
 			consts.BitwardenOrganizations, consts.BitwardenContacts:
 			// Bitwarden documents are encypted E2E, so they cannot be imported
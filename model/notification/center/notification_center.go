@@ -25,6 +25,9 @@ const (
 	// NotificationDiskQuota category for sending alert when reaching 90% of disk
 	// usage quota.
 	NotificationDiskQuota = "disk-quota"
+	// NotificationFileDrop category for warning the owner that files have
+	// been uploaded with a file drop link.
+	NotificationFileDrop = "file-drop"
 )
 
 var (
@@ -36,6 +39,11 @@ var (
 			MailTemplate: "notifications_diskquota",
 			MinInterval:  7 * 24 * time.Hour,
 		},
+		NotificationFileDrop: {
+			Description:  "Warn about files uploaded with a file drop link",
+			Collapsible:  true,
+			MailTemplate: "notifications_file_drop",
+		},
 	}
 )
 
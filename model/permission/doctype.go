@@ -21,14 +21,16 @@ var blockList = map[string]bool{
 	consts.RemoteSecrets:         none,
 
 	// Only stack can manipulate them
-	consts.Sessions:         none,
-	consts.Permissions:      none,
-	consts.Intents:          none,
-	consts.OAuthClients:     none,
-	consts.OAuthAccessCodes: none,
-	consts.Archives:         none,
-	consts.Sharings:         none,
-	consts.Shared:           none,
+	consts.Sessions:            none,
+	consts.Permissions:         none,
+	consts.Intents:             none,
+	consts.OAuthClients:        none,
+	consts.OAuthAccessCodes:    none,
+	consts.Archives:            none,
+	consts.Sharings:            none,
+	consts.Shared:              none,
+	consts.WebAuthnCredentials: none,
+	consts.AppPasswords:        none,
 
 	// Synthetic doctypes (API only)
 	consts.CertifiedCarbonCopy:     none,
@@ -64,6 +66,7 @@ var blockList = map[string]bool{
 	consts.NotesSteps:        readable,
 	consts.NotesImages:       readable,
 	consts.BitwardenContacts: readable,
+	consts.SharingsActivity:  readable,
 }
 
 // CheckReadable will abort the context and returns false if the doctype
@@ -38,4 +38,44 @@ var (
 	// ErrNotParent is used when the permissions should have a specific parent.
 	ErrNotParent = echo.NewHTTPError(http.StatusForbidden,
 		"Permissions can be updated only by its parent")
+
+	// ErrPasswordRequired is used when a share by link is protected by a
+	// password, and the password has not been given
+	ErrPasswordRequired = echo.NewHTTPError(http.StatusUnauthorized,
+		"A password is required for this sharing link")
+
+	// ErrInvalidPassword is used when the password for a share by link is not
+	// the good one
+	ErrInvalidPassword = echo.NewHTTPError(http.StatusForbidden,
+		"Invalid password")
+
+	// ErrInvalidMaxUses is used when the maximal number of uses for a share
+	// by link is negative
+	ErrInvalidMaxUses = echo.NewHTTPError(http.StatusBadRequest,
+		"The maximal number of uses must be a positive integer")
+
+	// ErrTooManyUses is used when the maximal number of views and downloads
+	// of a share by link has been reached
+	ErrTooManyUses = echo.NewHTTPError(http.StatusGone,
+		"This sharing link has reached its maximal number of uses")
+
+	// ErrInvalidFileDrop is used when a file drop is created with rules that
+	// allow more than creating files in a directory
+	ErrInvalidFileDrop = echo.NewHTTPError(http.StatusBadRequest,
+		"A file drop can only allow the POST verb on one directory")
+
+	// ErrFileDropTooManyFiles is used when the maximal number of files for a
+	// file drop has been reached
+	ErrFileDropTooManyFiles = echo.NewHTTPError(http.StatusForbidden,
+		"This file drop has reached its maximal number of files")
+
+	// ErrFileDropTooBig is used when the file would make the file drop exceed
+	// its maximal size
+	ErrFileDropTooBig = echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+		"This file drop has reached its maximal size")
+
+	// ErrFileDropLengthRequired is used when the size of the uploaded file is
+	// not known in advance, and the file drop has a maximal size
+	ErrFileDropLengthRequired = echo.NewHTTPError(http.StatusLengthRequired,
+		"The size of the file must be given for this file drop")
 )
@@ -0,0 +1,141 @@
+package permission
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// FileDropNotificationInterval is the minimal delay between two
+// notifications sent to the owner for the same file drop.
+const FileDropNotificationInterval = 15 * time.Minute
+
+// FileDrop is the configuration of a share by link that can only be used to
+// upload files in a directory, without listing or reading its content. The
+// limits are for the whole link, 0 meaning no limit.
+type FileDrop struct {
+	MaxFiles   int        `json:"max_files,omitempty"`
+	MaxSize    int64      `json:"max_size,omitempty"`
+	Files      int        `json:"files,omitempty"`
+	Size       int64      `json:"size,omitempty"`
+	NotifiedAt *time.Time `json:"notified_at,omitempty"`
+}
+
+// newFileDrop checks that the rules of a file drop only allow to create files
+// in a directory, and returns a file drop with the given limits and no files.
+func newFileDrop(set Set, opts *FileDrop) (*FileDrop, error) {
+	if opts == nil {
+		return nil, nil
+	}
+	if len(set) != 1 {
+		return nil, ErrInvalidFileDrop
+	}
+	rule := set[0]
+	if rule.Type != consts.Files || rule.Selector != "" || len(rule.Values) != 1 {
+		return nil, ErrInvalidFileDrop
+	}
+	if len(rule.Verbs) != 1 || !rule.Verbs.Contains(POST) {
+		return nil, ErrInvalidFileDrop
+	}
+	if opts.MaxFiles < 0 || opts.MaxSize < 0 {
+		return nil, ErrInvalidFileDrop
+	}
+	return &FileDrop{MaxFiles: opts.MaxFiles, MaxSize: opts.MaxSize}, nil
+}
+
+// IsFileDrop returns true if the permission is a share by link for uploading
+// files only.
+func (p *Permission) IsFileDrop() bool {
+	return p.Type == TypeShareByLink && p.FileDrop != nil
+}
+
+// FileDropDirID returns the identifier of the directory where the files are
+// dropped.
+func (p *Permission) FileDropDirID() string {
+	return p.Permissions[0].Values[0]
+}
+
+// CheckUpload returns an error if a file of the given size cannot be added
+// to the file drop.
+func (fd *FileDrop) CheckUpload(size int64) error {
+	if fd.MaxFiles > 0 && fd.Files >= fd.MaxFiles {
+		return ErrFileDropTooManyFiles
+	}
+	if fd.MaxSize > 0 {
+		if size < 0 {
+			return ErrFileDropLengthRequired
+		}
+		if fd.Size+size > fd.MaxSize {
+			return ErrFileDropTooBig
+		}
+	}
+	return nil
+}
+
+// ReserveFileDropUpload checks the limits of the file drop and counts a file
+// of the given size, before it is uploaded. The check and the update of the
+// counters are made on the same revision of the document, so that concurrent
+// uploads cannot exceed the limits. When the size is not known, only the file
+// is counted.
+func (p *Permission) ReserveFileDropUpload(db prefixer.Prefixer, size int64) error {
+	return updateWithRetry(db, p, func() error {
+		fd := p.FileDrop
+		if fd == nil {
+			return ErrInvalidFileDrop
+		}
+		if err := fd.CheckUpload(size); err != nil {
+			return err
+		}
+		fd.Files++
+		if size > 0 {
+			fd.Size += size
+		}
+		return nil
+	})
+}
+
+// CancelFileDropUpload removes from the counters a file reserved with
+// ReserveFileDropUpload, when its upload has failed.
+func (p *Permission) CancelFileDropUpload(db prefixer.Prefixer, size int64) error {
+	return updateWithRetry(db, p, func() error {
+		fd := p.FileDrop
+		if fd == nil {
+			return ErrInvalidFileDrop
+		}
+		if fd.Files > 0 {
+			fd.Files--
+		}
+		if size > 0 {
+			fd.Size -= size
+		}
+		if fd.Size < 0 {
+			fd.Size = 0
+		}
+		return nil
+	})
+}
+
+// FinishFileDropUpload is called when a reserved file has been uploaded. The
+// extra size is added to the counter, for a file with a size that was not
+// known when it was reserved. It returns true if the owner should be
+// notified.
+func (p *Permission) FinishFileDropUpload(db prefixer.Prefixer, extra int64) (bool, error) {
+	notify := false
+	err := updateWithRetry(db, p, func() error {
+		fd := p.FileDrop
+		if fd == nil {
+			return ErrInvalidFileDrop
+		}
+		if extra > 0 {
+			fd.Size += extra
+		}
+		now := time.Now()
+		notify = fd.NotifiedAt == nil || now.Sub(*fd.NotifiedAt) > FileDropNotificationInterval
+		if notify {
+			fd.NotifiedAt = &now
+		}
+		return nil
+	})
+	return notify, err
+}
@@ -31,6 +31,20 @@ type Permission struct {
 	Codes       map[string]string `json:"codes,omitempty"`
 	ShortCodes  map[string]string `json:"shortcodes,omitempty"`
 
+	// Password is the hash of the password for a share by link (or the
+	// password in clear in the request for creating it, or true in the API
+	// responses)
+	Password interface{} `json:"password,omitempty"`
+	// MaxUses is the maximal number of views of the public page, and the
+	// maximal number of downloads, allowed for a share by link. Views and
+	// Downloads are the current numbers of them.
+	MaxUses   int `json:"max_uses,omitempty"`
+	Views     int `json:"views,omitempty"`
+	Downloads int `json:"downloads,omitempty"`
+	// FileDrop is set for a share by link that only allows to upload files
+	// in a directory, without seeing its content
+	FileDrop *FileDrop `json:"file_drop,omitempty"`
+
 	Client   interface{}            `json:"-"` // Contains the *oauth.Client client pointer for Oauth permission type
 	Metadata *metadata.CozyMetadata `json:"cozyMetadata,omitempty"`
 }
@@ -81,6 +95,10 @@ func (p *Permission) Clone() couchdb.Doc {
 	if p.Metadata != nil {
 		cloned.Metadata = p.Metadata.Clone()
 	}
+	if p.FileDrop != nil {
+		fileDrop := *p.FileDrop
+		cloned.FileDrop = &fileDrop
+	}
 	for k, v := range p.Codes {
 		cloned.Codes[k] = v
 	}
@@ -485,6 +503,17 @@ func CreateShareSet(db prefixer.Prefixer, parent *Permission, sourceID string, c
 	if err := checkSetPermissions(set, parent); err != nil {
 		return nil, err
 	}
+	password, err := hashSharePassword(subdoc.Password)
+	if err != nil {
+		return nil, err
+	}
+	if subdoc.MaxUses < 0 {
+		return nil, ErrInvalidMaxUses
+	}
+	fileDrop, err := newFileDrop(set, subdoc.FileDrop)
+	if err != nil {
+		return nil, err
+	}
 	// SourceID stays the same, allow quick destruction of all children permissions
 	doc := &Permission{
 		Type:        TypeShareByLink,
@@ -493,11 +522,13 @@ func CreateShareSet(db prefixer.Prefixer, parent *Permission, sourceID string, c
 		Codes:       codes,
 		ShortCodes:  shortcodes,
 		ExpiresAt:   expiresAt,
+		Password:    password,
+		MaxUses:     subdoc.MaxUses,
+		FileDrop:    fileDrop,
 		Metadata:    subdoc.Metadata,
 	}
 
-	err := couchdb.CreateDoc(db, doc)
-	if err != nil {
+	if err := couchdb.CreateDoc(db, doc); err != nil {
 		return nil, err
 	}
 
@@ -446,3 +446,73 @@ func (t *validableFile) Fetch(field string) []string {
 	}
 	return prefixes
 }
+
+func TestShareByLinkPassword(t *testing.T) {
+	p := &Permission{Type: TypeShareByLink}
+	assert.False(t, p.HasPassword())
+	assert.True(t, p.CheckPassword(""))
+
+	assert.NoError(t, p.SetPassword("HorseBatteryStaple"))
+	assert.True(t, p.HasPassword())
+	assert.NotEqual(t, "HorseBatteryStaple", p.Password)
+	assert.True(t, p.CheckPassword("HorseBatteryStaple"))
+	assert.False(t, p.CheckPassword("horsebatterystaple"))
+	stamp := p.PasswordStamp()
+
+	assert.NoError(t, p.SetPassword("CorrectHorse"))
+	assert.NotEqual(t, stamp, p.PasswordStamp())
+
+	assert.NoError(t, p.SetPassword(""))
+	assert.False(t, p.HasPassword())
+}
+
+func TestShareByLinkExhausted(t *testing.T) {
+	p := &Permission{Type: TypeShareByLink}
+	p.Views = 100
+	p.Downloads = 100
+	assert.False(t, p.Exhausted())
+
+	assert.Equal(t, ErrInvalidMaxUses, p.SetMaxUses(-1))
+	assert.NoError(t, p.SetMaxUses(1))
+	// A visitor can open the page and download the file
+	p.Views = 1
+	p.Downloads = 1
+	assert.False(t, p.Exhausted())
+	p.Downloads = 2
+	assert.True(t, p.Exhausted())
+	p.Downloads = 0
+	p.Views = 2
+	assert.True(t, p.Exhausted())
+}
+
+func TestFileDrop(t *testing.T) {
+	rule := Rule{
+		Type:   "io.cozy.files",
+		Verbs:  Verbs(POST),
+		Values: []string{"dir-id"},
+	}
+	fd, err := newFileDrop(Set{rule}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, fd)
+
+	fd, err = newFileDrop(Set{rule}, &FileDrop{MaxFiles: 2, MaxSize: 100, Files: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fd.MaxFiles)
+	assert.Equal(t, 0, fd.Files)
+
+	readable := rule
+	readable.Verbs = Verbs(GET, POST)
+	_, err = newFileDrop(Set{readable}, &FileDrop{})
+	assert.Equal(t, ErrInvalidFileDrop, err)
+	_, err = newFileDrop(Set{rule, rule}, &FileDrop{})
+	assert.Equal(t, ErrInvalidFileDrop, err)
+
+	assert.NoError(t, fd.CheckUpload(60))
+	assert.Equal(t, ErrFileDropLengthRequired, fd.CheckUpload(-1))
+	fd.Files = 1
+	fd.Size = 60
+	assert.Equal(t, ErrFileDropTooBig, fd.CheckUpload(50))
+	assert.NoError(t, fd.CheckUpload(40))
+	fd.Files = 2
+	assert.Equal(t, ErrFileDropTooManyFiles, fd.CheckUpload(1))
+}
@@ -0,0 +1,135 @@
+package permission
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// hashSharePassword returns the hash of the password given in clear when
+// creating or updating a share by link. An empty password means no password.
+func hashSharePassword(password interface{}) (interface{}, error) {
+	clear, ok := password.(string)
+	if !ok || clear == "" {
+		return nil, nil
+	}
+	hash, err := crypto.GenerateFromPassphrase([]byte(clear))
+	if err != nil {
+		return nil, err
+	}
+	return string(hash), nil
+}
+
+// HasPassword returns true if the share by link is protected by a password.
+func (p *Permission) HasPassword() bool {
+	hash, ok := p.Password.(string)
+	return ok && hash != ""
+}
+
+// CheckPassword returns true if the given password is the password of the
+// share by link.
+func (p *Permission) CheckPassword(password string) bool {
+	hash, ok := p.Password.(string)
+	if !ok || hash == "" {
+		return true
+	}
+	_, err := crypto.CompareHashAndPassphrase([]byte(hash), []byte(password))
+	return err == nil
+}
+
+// PasswordStamp returns a short fingerprint of the password hash, that is
+// put in the unlocked codes so that they are no longer valid when the
+// password is changed.
+func (p *Permission) PasswordStamp() string {
+	hash, _ := p.Password.(string)
+	sum := sha256.Sum256([]byte(hash))
+	return hex.EncodeToString(sum[:8])
+}
+
+// SetPassword changes the password of a share by link. An empty password
+// removes the protection.
+func (p *Permission) SetPassword(password string) error {
+	hash, err := hashSharePassword(password)
+	if err != nil {
+		return err
+	}
+	p.Password = hash
+	return nil
+}
+
+// SetMaxUses changes the maximal number of uses of a share by link. 0 means
+// no limit.
+func (p *Permission) SetMaxUses(max int) error {
+	if max < 0 {
+		return ErrInvalidMaxUses
+	}
+	p.MaxUses = max
+	return nil
+}
+
+// Exhausted returns true if the public page of the share by link has been
+// viewed, or its files downloaded, more times than allowed. The last allowed
+// view makes the counter reach MaxUses, and the link is exhausted on the next
+// attempt, so that the page opened by the last visitor can still make its
+// requests.
+func (p *Permission) Exhausted() bool {
+	return p.MaxUses > 0 && (p.Views > p.MaxUses || p.Downloads > p.MaxUses)
+}
+
+// AddView increments the number of views of the public page of a share by
+// link, and returns ErrTooManyUses if the limit has been exceeded.
+func (p *Permission) AddView(db prefixer.Prefixer) error {
+	return p.addUse(db, &p.Views)
+}
+
+// AddDownload increments the number of downloads of a share by link, and
+// returns ErrTooManyUses if the limit has been exceeded.
+func (p *Permission) AddDownload(db prefixer.Prefixer) error {
+	return p.addUse(db, &p.Downloads)
+}
+
+// addUse increments the given counter of the share by link.
+func (p *Permission) addUse(db prefixer.Prefixer, counter *int) error {
+	if p.Type != TypeShareByLink || p.MaxUses == 0 {
+		return nil
+	}
+	err := updateWithRetry(db, p, func() error {
+		if p.Exhausted() {
+			return ErrTooManyUses
+		}
+		*counter++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if p.Exhausted() {
+		return ErrTooManyUses
+	}
+	return nil
+}
+
+// updateWithRetry applies the change to the permission document and saves
+// it. In case of a conflict, the document is reloaded and the change is
+// applied again.
+func updateWithRetry(db prefixer.Prefixer, p *Permission, change func() error) error {
+	var err error
+	for i := 0; i < 3; i++ {
+		if err = change(); err != nil {
+			return err
+		}
+		err = couchdb.UpdateDoc(db, p)
+		if !couchdb.IsConflictError(err) {
+			return err
+		}
+		fresh, errg := GetByID(db, p.ID())
+		if errg != nil {
+			return errg
+		}
+		*p = *fresh
+	}
+	return err
+}
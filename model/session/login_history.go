@@ -197,7 +197,7 @@ func sendLoginNotification(i *instance.Instance, l *LoginEntry) error {
 		changePassphraseLink = i.ChangePasswordURL()
 	}
 	var activateTwoFALink string
-	if !i.HasAuthMode(instance.TwoFactorMail) {
+	if !i.HasTwoFactorAuth() {
 		settingsURL := i.SubDomain(consts.SettingsSlug)
 		settingsURL.Fragment = "/profile"
 		activateTwoFALink = settingsURL.String()
@@ -0,0 +1,297 @@
+package sharing
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+const (
+	// ActivityCreated is the action for a document created by a member
+	ActivityCreated = "created"
+	// ActivityUpdated is the action for a document modified by a member
+	ActivityUpdated = "updated"
+	// ActivityDeleted is the action for a document deleted by a member
+	ActivityDeleted = "deleted"
+
+	// MaxActivities is the maximal number of entries kept in the activity
+	// log of a sharing: the oldest entries are removed.
+	MaxActivities = 1000
+	// ActivityRetention is how long the entries of the activity log of a
+	// sharing are kept.
+	ActivityRetention = 90 * 24 * time.Hour
+
+	// activityCleanBatch is the maximal number of old entries removed at once
+	activityCleanBatch = 100
+
+	// authorField is the field added by the sharer to the documents sent to
+	// the recipients, with the email of the member who has made the last
+	// change of the document. The recipients remove it before saving them.
+	authorField = "sharing_author"
+)
+
+// Activity is an entry in the log of the changes received from the other
+// members of a sharing.
+type Activity struct {
+	ActID     string `json:"_id,omitempty"`
+	ActRev    string `json:"_rev,omitempty"`
+	SharingID string `json:"sharing_id"`
+	// MemberEmail and MemberInstance identify the member who has made the
+	// change (the instance is not known for the other recipients)
+	MemberEmail    string    `json:"member_email,omitempty"`
+	MemberInstance string    `json:"member_instance,omitempty"`
+	MemberName     string    `json:"member_name,omitempty"`
+	Action         string    `json:"action"`
+	Doctype        string    `json:"doctype"`
+	DocumentID     string    `json:"document_id"`
+	DocumentRev    string    `json:"document_rev,omitempty"`
+	Name           string    `json:"name,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// ID returns the activity qualified identifier
+func (a *Activity) ID() string { return a.ActID }
+
+// Rev returns the activity revision
+func (a *Activity) Rev() string { return a.ActRev }
+
+// DocType returns the activity document type
+func (a *Activity) DocType() string { return consts.SharingsActivity }
+
+// SetID changes the activity qualified identifier
+func (a *Activity) SetID(id string) { a.ActID = id }
+
+// SetRev changes the activity revision
+func (a *Activity) SetRev(rev string) { a.ActRev = rev }
+
+// Clone implements couchdb.Doc
+func (a *Activity) Clone() couchdb.Doc {
+	cloned := *a
+	return &cloned
+}
+
+// activityLog collects the entries for the changes received from a member
+// during a replication. The member who has made a change is known from the
+// author sent by the sharer, or from the cozyMetadata for a document created
+// or uploaded. Else, the member is the one who has sent the change.
+type activityLog struct {
+	sharing *Sharing
+	from    *Member
+	entries []interface{}
+}
+
+// newActivityLog returns a log for the changes sent by the given member, or
+// nil if nothing should be recorded.
+func (s *Sharing) newActivityLog(from *Member) *activityLog {
+	if from == nil || s.Initial {
+		return nil
+	}
+	for i := range s.Members {
+		if &s.Members[i] == from {
+			return &activityLog{sharing: s, from: from}
+		}
+	}
+	return nil
+}
+
+// add adds an entry to the log. by is the email of the member who has made
+// the change, or the URL of the cozy instance where it has been made, if
+// known.
+func (l *activityLog) add(action, doctype, docID, rev, name, by string) {
+	if l == nil {
+		return
+	}
+	member := l.from
+	if m := l.sharing.findMemberByAuthor(by); m != nil {
+		member = m
+	}
+	l.entries = append(l.entries, &Activity{
+		SharingID:      l.sharing.SID,
+		MemberEmail:    member.Email,
+		MemberInstance: member.Instance,
+		MemberName:     member.PrimaryName(),
+		Action:         action,
+		Doctype:        doctype,
+		DocumentID:     docID,
+		DocumentRev:    rev,
+		Name:           name,
+		CreatedAt:      time.Now().UTC(),
+	})
+}
+
+// findMemberByAuthor returns the member with the given email or cozy instance
+// URL, or nil if there is no such member.
+func (s *Sharing) findMemberByAuthor(by string) *Member {
+	if by == "" {
+		return nil
+	}
+	instURL := strings.TrimSuffix(by, "/")
+	for i := range s.Members {
+		m := &s.Members[i]
+		if m.Email != "" && strings.EqualFold(m.Email, by) {
+			return m
+		}
+		if m.Instance != "" && strings.TrimSuffix(m.Instance, "/") == instURL {
+			return m
+		}
+	}
+	return nil
+}
+
+// addAuthors is used by the sharer to add to the documents that it sends the
+// emails of the members who have made their last changes, when they are
+// known from the activity log. The other members can't find them by
+// themselves, as they don't know the instances of the other recipients.
+func (s *Sharing) addAuthors(inst *instance.Instance, doctype string, docs []map[string]interface{}) {
+	if !s.Owner || len(docs) == 0 {
+		return
+	}
+	ids := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		if id, ok := doc["_id"].(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	var acts []*Activity
+	req := &couchdb.FindRequest{
+		UseIndex: "by-sharing-id",
+		Selector: mango.And(
+			mango.Equal("sharing_id", s.SID),
+			mango.Equal("doctype", doctype),
+			mango.In("document_id", ids),
+		),
+		Sort: mango.SortBy{
+			{Field: "sharing_id", Direction: mango.Desc},
+			{Field: "created_at", Direction: mango.Desc},
+		},
+		Limit: MaxActivities,
+	}
+	if err := couchdb.FindDocs(inst, consts.SharingsActivity, req, &acts); err != nil {
+		if !couchdb.IsNoDatabaseError(err) {
+			inst.Logger().WithNamespace("sharing").
+				Infof("Cannot find the authors for sharing %s: %s", s.SID, err)
+		}
+		return
+	}
+
+	last := make(map[string]*Activity, len(acts))
+	for _, a := range acts {
+		if _, ok := last[a.DocumentID]; !ok {
+			last[a.DocumentID] = a
+		}
+	}
+	for _, doc := range docs {
+		id, _ := doc["_id"].(string)
+		a, ok := last[id]
+		if !ok || a.MemberEmail == "" {
+			continue
+		}
+		// The deletions are made with a new revision on the cozy of the
+		// sharer, so only the action can be checked for them.
+		rev, _ := doc["_rev"].(string)
+		deleted, _ := doc["_deleted"].(bool)
+		if a.DocumentRev == rev || (deleted && a.Action == ActivityDeleted) {
+			doc[authorField] = a.MemberEmail
+		}
+	}
+}
+
+// popAuthor removes the author added by the sharer from a document, and
+// returns it.
+func popAuthor(doc map[string]interface{}) string {
+	by, _ := doc[authorField].(string)
+	delete(doc, authorField)
+	return by
+}
+
+// save persists the entries of the log (they are also sent on the realtime
+// hub), and removes the old entries of the sharing.
+func (l *activityLog) save(inst *instance.Instance) {
+	if l == nil || len(l.entries) == 0 {
+		return
+	}
+	olds := make([]interface{}, len(l.entries))
+	err := couchdb.BulkUpdateDocs(inst, consts.SharingsActivity, l.entries, olds)
+	if err != nil {
+		inst.Logger().WithNamespace("sharing").
+			Warnf("Cannot save the activity of sharing %s: %s", l.sharing.SID, err)
+		return
+	}
+	if err = cleanActivities(inst, l.sharing.SID); err != nil {
+		inst.Logger().WithNamespace("sharing").
+			Infof("Cannot clean the activity of sharing %s: %s", l.sharing.SID, err)
+	}
+}
+
+// ListActivities returns the entries of the activity log of the sharing, the
+// most recent first, with a bookmark for the next page.
+func (s *Sharing) ListActivities(inst *instance.Instance, limit int, bookmark string) ([]*Activity, string, error) {
+	acts := []*Activity{}
+	req := &couchdb.FindRequest{
+		UseIndex: "by-sharing-id",
+		Selector: mango.Equal("sharing_id", s.SID),
+		Sort: mango.SortBy{
+			{Field: "sharing_id", Direction: mango.Desc},
+			{Field: "created_at", Direction: mango.Desc},
+		},
+		Limit:    limit,
+		Bookmark: bookmark,
+	}
+	res, err := couchdb.FindDocsRaw(inst, consts.SharingsActivity, req, &acts)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return acts, "", nil
+		}
+		return nil, "", err
+	}
+	return acts, res.Bookmark, nil
+}
+
+// cleanActivities removes the entries of the activity log of a sharing that
+// are too old, or beyond the maximal number of entries.
+func cleanActivities(inst *instance.Instance, sharingID string) error {
+	var tooOld, tooMany []*Activity
+	cutoff := time.Now().UTC().Add(-ActivityRetention)
+	req := &couchdb.FindRequest{
+		UseIndex: "by-sharing-id",
+		Selector: mango.And(
+			mango.Equal("sharing_id", sharingID),
+			mango.Lt("created_at", cutoff),
+		),
+		Limit: activityCleanBatch,
+	}
+	if err := couchdb.FindDocs(inst, consts.SharingsActivity, req, &tooOld); err != nil {
+		return err
+	}
+	req = &couchdb.FindRequest{
+		UseIndex: "by-sharing-id",
+		Selector: mango.And(
+			mango.Equal("sharing_id", sharingID),
+			mango.Gte("created_at", cutoff),
+		),
+		Sort: mango.SortBy{
+			{Field: "sharing_id", Direction: mango.Desc},
+			{Field: "created_at", Direction: mango.Desc},
+		},
+		Skip:  MaxActivities,
+		Limit: activityCleanBatch,
+	}
+	if err := couchdb.FindDocs(inst, consts.SharingsActivity, req, &tooMany); err != nil {
+		return err
+	}
+
+	docs := make([]couchdb.Doc, 0, len(tooOld)+len(tooMany))
+	for _, a := range tooOld {
+		docs = append(docs, a)
+	}
+	for _, a := range tooMany {
+		docs = append(docs, a)
+	}
+	return couchdb.BulkDeleteDocs(inst, consts.SharingsActivity, docs)
+}
+
+var _ couchdb.Doc = &Activity{}
@@ -0,0 +1,59 @@
+package sharing
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivityLog(t *testing.T) {
+	s := Sharing{
+		SID: "ce8835a061d0ef68947afe69a0046722",
+		Members: []Member{
+			{Status: MemberStatusOwner, PublicName: "Alice", Email: "alice@example.net", Instance: "https://alice.example.net"},
+			{Status: MemberStatusReady, Name: "Bob", Email: "bob@example.net"},
+			{Status: MemberStatusReady, Name: "Carol", Email: "carol@example.net", Instance: "https://carol.example.net"},
+		},
+	}
+	assert.Nil(t, s.newActivityLog(nil))
+	other := Member{Name: "Bob", Instance: "https://bob.example.net"}
+	assert.Nil(t, s.newActivityLog(&other))
+
+	activity := s.newActivityLog(&s.Members[0])
+	if assert.NotNil(t, activity) {
+		activity.add(ActivityDeleted, consts.Files, "id1", "2-aaa", "foo.txt", "")
+		activity.add(ActivityCreated, consts.Files, "id2", "1-bbb", "bar.txt", "https://carol.example.net/")
+		activity.add(ActivityUpdated, consts.Files, "id3", "3-ccc", "baz.txt", "Bob@Example.net")
+		activity.add(ActivityUpdated, consts.Files, "id4", "4-ddd", "qux.txt", "https://dave.example.net/")
+		if assert.Len(t, activity.entries, 4) {
+			first := activity.entries[0].(*Activity)
+			assert.Equal(t, s.SID, first.SharingID)
+			assert.Equal(t, "alice@example.net", first.MemberEmail)
+			assert.Equal(t, "https://alice.example.net", first.MemberInstance)
+			assert.Equal(t, "Alice", first.MemberName)
+			assert.Equal(t, ActivityDeleted, first.Action)
+			assert.Equal(t, "2-aaa", first.DocumentRev)
+			assert.Equal(t, "foo.txt", first.Name)
+			second := activity.entries[1].(*Activity)
+			assert.Equal(t, "carol@example.net", second.MemberEmail)
+			assert.Equal(t, "Carol", second.MemberName)
+			third := activity.entries[2].(*Activity)
+			assert.Equal(t, "bob@example.net", third.MemberEmail)
+			assert.Empty(t, third.MemberInstance)
+			assert.Equal(t, "Bob", third.MemberName)
+			fourth := activity.entries[3].(*Activity)
+			assert.Equal(t, "alice@example.net", fourth.MemberEmail)
+		}
+	}
+
+	doc := map[string]interface{}{"_id": "id5", authorField: "bob@example.net"}
+	assert.Equal(t, "bob@example.net", popAuthor(doc))
+	assert.NotContains(t, doc, authorField)
+	assert.Empty(t, popAuthor(doc))
+
+	s.Initial = true
+	assert.Nil(t, s.newActivityLog(&s.Members[0]))
+	var nilLog *activityLog
+	nilLog.add(ActivityCreated, consts.Files, "id6", "1-eee", "qux.txt", "")
+}
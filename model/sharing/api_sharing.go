@@ -22,8 +22,10 @@ func InfoByDocTypeData(c echo.Context, statusCode int, sharings []*APISharing) e
 type APISharing struct {
 	*Sharing
 	// XXX Hide the credentials
-	Credentials *interface{}           `json:"credentials,omitempty"`
-	SharedDocs  []couchdb.DocReference `json:"-"`
+	Credentials *interface{} `json:"credentials,omitempty"`
+	// XXX Hide the credentials of a pending transfer of ownership
+	PendingTransfer *interface{}           `json:"pending_transfer,omitempty"`
+	SharedDocs      []couchdb.DocReference `json:"-"`
 }
 
 // Included is part of jsonapi.Object interface
@@ -138,3 +140,20 @@ func (m *APIMoved) Relationships() jsonapi.RelationshipMap { return nil }
 func (m *APIMoved) Links() *jsonapi.LinksList { return nil }
 
 var _ jsonapi.Object = (*APIMoved)(nil)
+
+// APIActivity is used to serialize an entry of the activity log of a sharing
+// to JSON-API
+type APIActivity struct {
+	*Activity
+}
+
+// Included is part of jsonapi.Object interface
+func (a *APIActivity) Included() []jsonapi.Object { return nil }
+
+// Relationships is part of jsonapi.Object interface
+func (a *APIActivity) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Links is part of jsonapi.Object interface
+func (a *APIActivity) Links() *jsonapi.LinksList { return nil }
+
+var _ jsonapi.Object = (*APIActivity)(nil)
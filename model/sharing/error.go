@@ -49,6 +49,12 @@ var (
 	// ErrAlreadyAccepted is used when someone tries to accept twice a sharing
 	// on the same cozy instance
 	ErrAlreadyAccepted = errors.New("Sharing already accepted by this recipient")
+	// ErrInvalidExpiration is used when the expiration date of a sharing, or
+	// of a member, is not in the future
+	ErrInvalidExpiration = errors.New("The expiration date must be in the future")
+	// ErrDeltaOutdated is used when a delta for the content of a file has been
+	// computed from another version than the current one
+	ErrDeltaOutdated = errors.New("The delta is for another version of the file")
 	// ErrCannotOpenFile is used when opening a file fails
 	ErrCannotOpenFile = errors.New("The file cannot be opened")
 )
@@ -0,0 +1,213 @@
+package sharing
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/mail"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// ExpirationNoticeDelay is how long before the expiration of a sharing, or of
+// the access of a member, the owner and the recipients are warned by mail.
+const ExpirationNoticeDelay = 3 * 24 * time.Hour
+
+// ExpirationMessage is used for jobs on the share-expire worker.
+type ExpirationMessage struct {
+	SharingID string `json:"sharing_id"`
+	// MemberIndex is the index of the member whose access expires, or 0 for
+	// the whole sharing
+	MemberIndex int       `json:"member_index,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	// Notice is true for the warning sent before the expiration
+	Notice bool `json:"notice,omitempty"`
+}
+
+// expirationOf returns the expiration date of the sharing if index is 0, or
+// the expiration date of the access of the member at this index.
+func (s *Sharing) expirationOf(index int) *time.Time {
+	if index == 0 {
+		return s.ExpiresAt
+	}
+	return s.Members[index].ExpiresAt
+}
+
+// SetExpiration changes the expiration date of the sharing if index is 0, or
+// the expiration date of the access of the member at this index. A nil date
+// removes the expiration.
+func (s *Sharing) SetExpiration(inst *instance.Instance, index int, expiresAt *time.Time) error {
+	if !s.Owner || !s.Active {
+		return ErrInvalidSharing
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return ErrInvalidExpiration
+	}
+	if index == 0 {
+		s.ExpiresAt = expiresAt
+	} else {
+		if s.Members[index].Status == MemberStatusRevoked {
+			return ErrInvalidSharing
+		}
+		s.Members[index].ExpiresAt = expiresAt
+	}
+	if err := couchdb.UpdateDoc(inst, s); err != nil {
+		return err
+	}
+	return s.ScheduleExpiration(inst, index)
+}
+
+// ScheduleExpiration adds the triggers for the notice and for the revocation
+// when the sharing (index = 0), or the access of a member, expires. The jobs
+// check that the expiration date has not been changed since, so the triggers
+// for an old date can be left as is.
+func (s *Sharing) ScheduleExpiration(inst *instance.Instance, index int) error {
+	expiresAt := s.expirationOf(index)
+	if expiresAt == nil {
+		return nil
+	}
+	msg := ExpirationMessage{
+		SharingID:   s.SID,
+		MemberIndex: index,
+		ExpiresAt:   *expiresAt,
+	}
+	if notice := expiresAt.Add(-ExpirationNoticeDelay); notice.After(time.Now()) {
+		msg.Notice = true
+		if err := addExpirationTrigger(inst, msg, notice); err != nil {
+			return err
+		}
+		msg.Notice = false
+	}
+	return addExpirationTrigger(inst, msg, *expiresAt)
+}
+
+func addExpirationTrigger(inst *instance.Instance, msg ExpirationMessage, at time.Time) error {
+	m, err := job.NewMessage(&msg)
+	if err != nil {
+		return err
+	}
+	t, err := job.NewTrigger(inst, job.TriggerInfos{
+		Type:       "@at",
+		WorkerType: "share-expire",
+		Arguments:  at.UTC().Format(time.RFC3339),
+	}, m)
+	if err != nil {
+		return err
+	}
+	return job.System().AddTrigger(t)
+}
+
+// Expire is called by the share-expire worker: it sends the notice before
+// the expiration, or revokes the sharing (or the member) when it expires. In
+// both cases, the owner and the recipients are informed by mail.
+func Expire(inst *instance.Instance, msg ExpirationMessage) error {
+	s, err := FindSharing(inst, msg.SharingID)
+	if err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	index := msg.MemberIndex
+	if !s.Owner || !s.Active || index < 0 || index >= len(s.Members) {
+		return nil
+	}
+	if index > 0 && s.Members[index].Status == MemberStatusRevoked {
+		return nil
+	}
+	// The expiration date may have been changed since the job was scheduled
+	expiresAt := s.expirationOf(index)
+	if expiresAt == nil || !expiresAt.Equal(msg.ExpiresAt) {
+		return nil
+	}
+
+	recipients := s.expirationRecipients(index)
+	if !msg.Notice {
+		if index == 0 {
+			err = s.Revoke(inst)
+		} else if err = s.RevokeRecipient(inst, index); err == nil {
+			go s.NotifyRecipients(inst, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.sendExpirationMails(inst, msg, recipients)
+}
+
+// expirationRecipients returns the recipients that should be informed of the
+// expiration of the sharing (index = 0), or of the access of a member.
+func (s *Sharing) expirationRecipients(index int) []Member {
+	var recipients []Member
+	for i, m := range s.Members {
+		if i == 0 || (index > 0 && i != index) || m.Email == "" {
+			continue
+		}
+		switch m.Status {
+		case MemberStatusPendingInvitation, MemberStatusSeen, MemberStatusReady:
+			recipients = append(recipients, m)
+		}
+	}
+	return recipients
+}
+
+func (s *Sharing) sendExpirationMails(inst *instance.Instance, msg ExpirationMessage, recipients []Member) error {
+	template := "sharing_expired"
+	if msg.Notice {
+		template = "sharing_expiring"
+	}
+	sharer, description := s.getSharerAndDescription(inst)
+	date := msg.ExpiresAt.Format("2006-01-02")
+
+	memberName := ""
+	if msg.MemberIndex > 0 {
+		memberName = s.Members[msg.MemberIndex].PrimaryName()
+	}
+	opts := []*mail.Options{
+		{
+			Mode:         mail.ModeFromStack,
+			TemplateName: template,
+			TemplateValues: map[string]interface{}{
+				"Owner":       true,
+				"MemberName":  memberName,
+				"Description": description,
+				"Date":        date,
+				"Link":        inst.SubDomain(s.AppSlug).String(),
+			},
+		},
+	}
+	for _, m := range recipients {
+		addr := &mail.Address{
+			Email: m.Email,
+			Name:  m.PrimaryName(),
+		}
+		opts = append(opts, &mail.Options{
+			Mode:         mail.ModeFromUser,
+			To:           []*mail.Address{addr},
+			TemplateName: template,
+			TemplateValues: map[string]interface{}{
+				"SharerPublicName": sharer,
+				"Description":      description,
+				"Date":             date,
+			},
+			RecipientName: addr.Name,
+			Layout:        mail.CozyCloudLayout,
+		})
+	}
+
+	var errm error
+	for _, opt := range opts {
+		m, err := job.NewMessage(opt)
+		if err == nil {
+			_, err = job.System().PushJob(inst, &job.JobRequest{
+				WorkerType: "sendmail",
+				Message:    m,
+			})
+		}
+		if err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+	return errm
+}
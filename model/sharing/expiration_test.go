@@ -0,0 +1,37 @@
+package sharing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpirationRecipients(t *testing.T) {
+	expiresAt := time.Now().Add(24 * time.Hour)
+	s := Sharing{
+		ExpiresAt: &expiresAt,
+		Members: []Member{
+			{Status: MemberStatusOwner, Email: "alice@example.net"},
+			{Status: MemberStatusReady, Email: "bob@example.net", ExpiresAt: &expiresAt},
+			{Status: MemberStatusMailNotSent, Email: "carol@example.net"},
+			{Status: MemberStatusSeen, Email: "dave@example.net"},
+			{Status: MemberStatusRevoked, Email: "eve@example.net"},
+			{Status: MemberStatusReady, Instance: "https://frank.example.net/"},
+		},
+	}
+	assert.Equal(t, &expiresAt, s.expirationOf(0))
+	assert.Equal(t, &expiresAt, s.expirationOf(1))
+	assert.Nil(t, s.expirationOf(2))
+
+	recipients := s.expirationRecipients(0)
+	if assert.Len(t, recipients, 2) {
+		assert.Equal(t, "bob@example.net", recipients[0].Email)
+		assert.Equal(t, "dave@example.net", recipients[1].Email)
+	}
+	recipients = s.expirationRecipients(3)
+	if assert.Len(t, recipients, 1) {
+		assert.Equal(t, "dave@example.net", recipients[0].Email)
+	}
+	assert.Empty(t, s.expirationRecipients(2))
+}
@@ -110,6 +110,7 @@ func (s *Sharing) SortFilesToSent(files []map[string]interface{}) {
 // - its dir_id is XORed or removed
 // - the referenced_by are XORed or removed
 // - the path is removed (directory only)
+// - the encryption at rest is removed, as it is specific to the instance
 //
 // ruleIndexes is a map of "doctype-docid" -> rule index
 func (s *Sharing) TransformFileToSent(doc map[string]interface{}, xorKey []byte, ruleIndex int) {
@@ -117,6 +118,7 @@ func (s *Sharing) TransformFileToSent(doc map[string]interface{}, xorKey []byte,
 		delete(doc, "path")
 		delete(doc, "not_synchronized_on")
 	}
+	delete(doc, "encrypted_at_rest")
 	id := doc["_id"].(string)
 	doc["_id"] = XorID(id, xorKey)
 	dir, ok := doc["dir_id"].(string)
@@ -483,17 +485,21 @@ func (s *Sharing) GetFolder(inst *instance.Instance, m *Member, xoredID string)
 }
 
 // ApplyBulkFiles takes a list of documents for the io.cozy.files doctype and
-// will apply changes to the VFS according to those documents.
-func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
+// will apply changes to the VFS according to those documents. The changes are
+// recorded in the activity log of the sharing, as made by the from member.
+func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList, from *Member) error {
 	type retryOp struct {
 		target map[string]interface{}
 		dir    *vfs.DirDoc
 		ref    *SharedRef
+		by     string
 	}
 
 	var errm error
 	var retries []retryOp
 	fs := inst.VFS()
+	activity := s.newActivityLog(from)
+	defer activity.save(inst)
 
 	for _, target := range docs {
 		id, ok := target["_id"].(string)
@@ -501,6 +507,7 @@ func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
 			errm = multierror.Append(errm, ErrMissingID)
 			continue
 		}
+		by := popAuthor(target)
 		ref := &SharedRef{}
 		err := couchdb.GetDoc(inst, consts.Shared, consts.Files+"/"+id, ref)
 		if err != nil {
@@ -536,8 +543,14 @@ func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
 			}
 			if dir != nil {
 				err = s.TrashDir(inst, dir)
+				if err == nil {
+					activity.add(ActivityDeleted, consts.Files, id, targetRev(target), dir.DocName, by)
+				}
 			} else {
 				err = s.TrashFile(inst, file, &s.Rules[infos.Rule])
+				if err == nil {
+					activity.add(ActivityDeleted, consts.Files, id, targetRev(target), file.DocName, by)
+				}
 			}
 		} else if target["type"] != consts.DirType {
 			// Let the upload worker manages this file
@@ -549,8 +562,11 @@ func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
 			if err == os.ErrExist {
 				retries = append(retries, retryOp{
 					target: target,
+					by:     by,
 				})
 				err = nil
+			} else if err == nil {
+				activity.add(ActivityCreated, consts.Files, id, targetRev(target), targetName(target), targetCreatedBy(target, by))
 			}
 		} else if ref == nil || infos.Dissociated {
 			// If it is a file: let the upload worker manages this file
@@ -567,8 +583,11 @@ func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
 					target: target,
 					dir:    cloned,
 					ref:    ref,
+					by:     by,
 				})
 				err = nil
+			} else if err == nil {
+				activity.add(ActivityUpdated, consts.Files, id, targetRev(target), targetName(target), by)
 			}
 		}
 		if err != nil {
@@ -580,10 +599,17 @@ func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
 
 	for _, op := range retries {
 		var err error
+		id, _ := op.target["_id"].(string)
 		if op.dir == nil {
 			err = s.CreateDir(inst, op.target, resolveResolution)
+			if err == nil {
+				activity.add(ActivityCreated, consts.Files, id, targetRev(op.target), targetName(op.target), targetCreatedBy(op.target, op.by))
+			}
 		} else {
 			err = s.UpdateDir(inst, op.target, op.dir, op.ref, resolveResolution)
+			if err == nil {
+				activity.add(ActivityUpdated, consts.Files, id, targetRev(op.target), targetName(op.target), op.by)
+			}
 		}
 		if err != nil {
 			inst.Logger().WithNamespace("replicator").
@@ -599,6 +625,30 @@ func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
 	return errm
 }
 
+// targetName returns the name of a file or directory sent by a member.
+func targetName(target map[string]interface{}) string {
+	name, _ := target["name"].(string)
+	return name
+}
+
+// targetRev returns the revision of a file or directory sent by a member.
+func targetRev(target map[string]interface{}) string {
+	rev, _ := target["_rev"].(string)
+	return rev
+}
+
+// targetCreatedBy returns the author of a file or directory sent by a member:
+// the one given by the sharer, or else the URL of the cozy instance where it
+// has been created.
+func targetCreatedBy(target map[string]interface{}, by string) string {
+	if by != "" {
+		return by
+	}
+	meta, _ := target["cozyMetadata"].(map[string]interface{})
+	on, _ := meta["createdOn"].(string)
+	return on
+}
+
 func removeReferencesFromRule(file *vfs.FileDoc, rule *Rule) {
 	if rule.Selector != couchdb.SelectorReferencedBy {
 		return
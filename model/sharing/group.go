@@ -0,0 +1,501 @@
+package sharing
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/model/contact"
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// Group contains the information about a group of contacts that has been
+// added as a recipient of a sharing. The members of the sharing are kept in
+// sync with the contacts of the group.
+type Group struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+	Revoked  bool   `json:"revoked,omitempty"`
+	// Members are the indexes of the members of the sharing for the contacts
+	// of this group
+	Members []int `json:"members"`
+}
+
+// ShareGroupMessage is used for jobs on the share-group worker, when a
+// contact has been added to or removed from some groups.
+type ShareGroupMessage struct {
+	ContactID     string   `json:"contact_id"`
+	Name          string   `json:"name,omitempty"`
+	Email         string   `json:"email,omitempty"`
+	Instance      string   `json:"instance,omitempty"`
+	GroupsAdded   []string `json:"groups_added,omitempty"`
+	GroupsRemoved []string `json:"groups_removed,omitempty"`
+
+	// Rev is set when the contact has been written without its previous
+	// revision (via _bulk_docs): the worker fetches it from CouchDB to find
+	// the groups that have been added and removed.
+	Rev string `json:"rev,omitempty"`
+
+	// GroupDeleted is the identifier of a group of contacts that has been
+	// deleted, and must be revoked from the sharings.
+	GroupDeleted string `json:"group_deleted,omitempty"`
+}
+
+// AddGroupsAndContacts adds a list of groups of contacts and a list of
+// contacts on the sharer cozy, and sends the invitations.
+func (s *Sharing) AddGroupsAndContacts(inst *instance.Instance, groupIDs, contactIDs map[string]bool) error {
+	for id, ro := range groupIDs {
+		if err := s.AddGroup(inst, id, ro); err != nil {
+			return err
+		}
+	}
+	for id, ro := range contactIDs {
+		if err := s.AddContact(inst, id, ro); err != nil {
+			return err
+		}
+	}
+	return s.inviteNewMembers(inst)
+}
+
+// AddGroup adds the contacts of the group with the given identifier as
+// members of the sharing. Later, the contacts added to the group will be
+// invited, and the members for the contacts removed from the group will be
+// revoked.
+func (s *Sharing) AddGroup(inst *instance.Instance, groupID string, readOnly bool) error {
+	if !s.Owner {
+		return ErrInvalidSharing
+	}
+	for _, g := range s.Groups {
+		if g.ID == groupID && !g.Revoked {
+			return nil
+		}
+	}
+	group, err := contact.FindGroup(inst, groupID)
+	if err != nil {
+		return err
+	}
+	contacts, err := group.ListContacts(inst)
+	if err != nil {
+		return err
+	}
+
+	s.Groups = append(s.Groups, Group{
+		ID:       groupID,
+		Name:     group.Name(),
+		ReadOnly: readOnly,
+		Members:  []int{},
+	})
+	groupIndex := len(s.Groups) - 1
+	for _, c := range contacts {
+		if !canBeInvitedFromGroup(c) {
+			continue
+		}
+		m, err := memberFromContact(c, readOnly)
+		if err != nil {
+			continue // A contact without email address nor cozy can't be invited
+		}
+		if _, err := s.addMemberToGroup(inst, groupIndex, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMemberToGroup adds the member to the group at the given index. If the
+// member is not already in the sharing, it is added (and should be invited).
+// It returns false if the member was already in the group.
+func (s *Sharing) addMemberToGroup(inst *instance.Instance, groupIndex int, m Member) (bool, error) {
+	idx := s.findMemberIndex(m)
+	if idx < 1 || s.Members[idx].Status == MemberStatusRevoked {
+		m.OnlyInGroups = true
+		if _, err := s.addMember(inst, m); err != nil {
+			return false, err
+		}
+		idx = s.findMemberIndex(m)
+		s.Members[idx].OnlyInGroups = true
+	}
+	group := &s.Groups[groupIndex]
+	for _, i := range group.Members {
+		if i == idx {
+			return false, nil
+		}
+	}
+	group.Members = append(group.Members, idx)
+	return true, nil
+}
+
+// removeMemberFromGroup removes the member from the group at the given
+// index. If the member was only in this group, it is revoked.
+func (s *Sharing) removeMemberFromGroup(inst *instance.Instance, groupIndex int, m Member) error {
+	idx := s.findMemberIndex(m)
+	if idx < 1 {
+		return nil
+	}
+	group := &s.Groups[groupIndex]
+	found := false
+	for i, member := range group.Members {
+		if member == idx {
+			group.Members = append(group.Members[:i], group.Members[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+	if err := couchdb.UpdateDoc(inst, s); err != nil {
+		return err
+	}
+	if !s.shouldRevokeFromGroups(idx) {
+		return nil
+	}
+	if err := s.RevokeRecipient(inst, idx); err != nil {
+		return err
+	}
+	go s.NotifyRecipients(inst, nil)
+	return nil
+}
+
+// shouldRevokeFromGroups returns true if the member at the given index has
+// been added only via groups and is no longer in a group of the sharing.
+func (s *Sharing) shouldRevokeFromGroups(idx int) bool {
+	m := s.Members[idx]
+	if !m.OnlyInGroups || m.Status == MemberStatusRevoked {
+		return false
+	}
+	for _, g := range s.Groups {
+		if g.Revoked {
+			continue
+		}
+		for _, i := range g.Members {
+			if i == idx {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// RevokeGroup revokes the group at the given index: the members of this group
+// are revoked, except if they have been added directly or via another group.
+func (s *Sharing) RevokeGroup(inst *instance.Instance, index int) error {
+	if !s.Owner {
+		return ErrInvalidSharing
+	}
+	group := &s.Groups[index]
+	members := group.Members
+	group.Members = []int{}
+	group.Revoked = true
+	if err := couchdb.UpdateDoc(inst, s); err != nil {
+		return err
+	}
+
+	var errm error
+	for _, idx := range members {
+		if !s.shouldRevokeFromGroups(idx) {
+			continue
+		}
+		if err := s.RevokeRecipient(inst, idx); err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+	return errm
+}
+
+// inviteNewMembers sends the invitations to the members that have just been
+// added, and informs the other recipients of the new members list.
+func (s *Sharing) inviteNewMembers(inst *instance.Instance) error {
+	var err error
+	var perms *permission.Permission
+	if s.PreviewPath != "" {
+		if perms, err = s.CreatePreviewPermissions(inst); err != nil {
+			return err
+		}
+	}
+	_ = couchdb.UpdateDoc(inst, s)
+	if err = s.SendInvitations(inst, perms); err != nil {
+		return err
+	}
+	cloned := s.Clone().(*Sharing)
+	go cloned.NotifyRecipients(inst, nil)
+	return nil
+}
+
+// sharingWithGroup is a sharing, with the index of a group in its groups.
+type sharingWithGroup struct {
+	sharing *Sharing
+	index   int
+}
+
+// findSharingsByGroup returns the sharings where the given group of contacts
+// is a recipient (and not revoked).
+func findSharingsByGroup(inst *instance.Instance, groupID string) ([]sharingWithGroup, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(inst, couchdb.SharingsByGroupView, &couchdb.ViewRequest{
+		Key:         groupID,
+		IncludeDocs: true,
+	}, &res)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sharings := make([]sharingWithGroup, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		var doc Sharing
+		if err := json.Unmarshal(row.Doc, &doc); err != nil {
+			return nil, err
+		}
+		index, ok := row.Value.(float64)
+		if !ok || int(index) >= len(doc.Groups) {
+			continue
+		}
+		sharings = append(sharings, sharingWithGroup{&doc, int(index)})
+	}
+	return sharings, nil
+}
+
+// UpdateGroups is called when a contact has been added to or removed from some
+// groups: the contact is invited to the sharings of the added groups, and
+// revoked from the sharings of the removed groups if it was only in them.
+func UpdateGroups(inst *instance.Instance, msg ShareGroupMessage) error {
+	if msg.GroupDeleted != "" {
+		return revokeDeletedGroup(inst, msg.GroupDeleted)
+	}
+	if msg.Rev != "" {
+		resolved, err := resolveGroupsChanges(inst, msg.ContactID, msg.Rev)
+		if err != nil || resolved == nil {
+			return err
+		}
+		msg = *resolved
+	}
+
+	m := Member{
+		Status:   MemberStatusMailNotSent,
+		Name:     msg.Name,
+		Email:    msg.Email,
+		Instance: msg.Instance,
+	}
+
+	var errm error
+	for _, groupID := range msg.GroupsAdded {
+		sharings, err := findSharingsByGroup(inst, groupID)
+		if err != nil {
+			return err
+		}
+		for _, sg := range sharings {
+			s := sg.sharing
+			if !s.Owner || !s.Active {
+				continue
+			}
+			m.ReadOnly = s.Groups[sg.index].ReadOnly
+			added, err := s.addMemberToGroup(inst, sg.index, m)
+			if err != nil {
+				errm = multierror.Append(errm, err)
+				continue
+			}
+			if !added {
+				continue
+			}
+			if err := s.inviteNewMembers(inst); err != nil {
+				errm = multierror.Append(errm, err)
+			}
+		}
+	}
+
+	for _, groupID := range msg.GroupsRemoved {
+		sharings, err := findSharingsByGroup(inst, groupID)
+		if err != nil {
+			return err
+		}
+		for _, sg := range sharings {
+			s := sg.sharing
+			if !s.Owner || !s.Active {
+				continue
+			}
+			if err := s.removeMemberFromGroup(inst, sg.index, m); err != nil {
+				errm = multierror.Append(errm, err)
+			}
+		}
+	}
+	return errm
+}
+
+// resolveGroupsChanges fetches the given revision of a contact and the
+// revision before it, to find the groups that have been added and removed.
+func resolveGroupsChanges(inst *instance.Instance, contactID, rev string) (*ShareGroupMessage, error) {
+	doc := &couchdb.JSONDoc{}
+	err := couchdb.GetDocRevWithRevs(inst, consts.Contacts, contactID, rev, doc)
+	if err != nil {
+		return nil, err
+	}
+	doc.Type = consts.Contacts
+	deleted, _ := doc.Get("_deleted").(bool)
+	current := &contact.Contact{JSONDoc: *doc}
+
+	var previous *contact.Contact
+	revs := revsMapToStruct(doc.Get("_revisions"))
+	if revs != nil && len(revs.IDs) > 1 {
+		prevRev := strconv.Itoa(revs.Start-1) + "-" + revs.IDs[1]
+		prev := &contact.Contact{}
+		err := couchdb.GetDocRev(inst, consts.Contacts, contactID, prevRev, prev)
+		if err == nil {
+			previous = prev
+		} else {
+			inst.Logger().WithNamespace("sharing").
+				Warnf("Cannot fetch the revision %s of the contact %s: %s", prevRev, contactID, err)
+		}
+	}
+	return groupsChanges(deleted, current, previous), nil
+}
+
+// revokeDeletedGroup revokes a group of contacts that has been deleted from
+// the sharings where it was a recipient.
+func revokeDeletedGroup(inst *instance.Instance, groupID string) error {
+	sharings, err := findSharingsByGroup(inst, groupID)
+	if err != nil {
+		return err
+	}
+	var errm error
+	for _, sg := range sharings {
+		s := sg.sharing
+		if !s.Owner || !s.Active {
+			continue
+		}
+		if err := s.RevokeGroup(inst, sg.index); err != nil {
+			errm = multierror.Append(errm, err)
+			continue
+		}
+		go s.NotifyRecipients(inst, nil)
+	}
+	return errm
+}
+
+// canBeInvitedFromGroup returns false for the contacts in the trash, and for
+// the contact of the owner.
+func canBeInvitedFromGroup(c *contact.Contact) bool {
+	if trashed, _ := c.Get("trashed").(bool); trashed {
+		return false
+	}
+	if me, _ := c.Get("me").(bool); me {
+		return false
+	}
+	return true
+}
+
+func asContact(doc couchdb.Doc) *contact.Contact {
+	switch v := doc.(type) {
+	case *contact.Contact:
+		return v
+	case *couchdb.JSONDoc:
+		return &contact.Contact{JSONDoc: *v}
+	}
+	return nil
+}
+
+// groupsChanges returns the message for the share-group worker when the
+// groups of a contact have changed, or nil if they are the same. previous is
+// nil for a new contact.
+func groupsChanges(deleted bool, current, previous *contact.Contact) *ShareGroupMessage {
+	var before, after []string
+	if !deleted && canBeInvitedFromGroup(current) {
+		after = current.GroupIDs()
+	}
+	if previous != nil && canBeInvitedFromGroup(previous) {
+		before = previous.GroupIDs()
+	}
+
+	added := diffGroupIDs(after, before)
+	removed := diffGroupIDs(before, after)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	m, err := memberFromContact(current, false)
+	if err != nil && previous != nil {
+		m, err = memberFromContact(previous, false)
+	}
+	if err != nil {
+		return nil
+	}
+	return &ShareGroupMessage{
+		ContactID:     current.ID(),
+		Name:          m.Name,
+		Email:         m.Email,
+		Instance:      m.Instance,
+		GroupsAdded:   added,
+		GroupsRemoved: removed,
+	}
+}
+
+// pushShareGroupJob pushes a job for the share-group worker when the groups of
+// a contact have changed.
+func pushShareGroupJob(db prefixer.Prefixer, event string, doc, old couchdb.Doc) error {
+	c := asContact(doc)
+	if c == nil {
+		return nil
+	}
+	var msg *ShareGroupMessage
+	if o := asContact(old); o == nil && event != couchdb.EventCreate {
+		// The hooks for the documents written via _bulk_docs don't have the
+		// previous revision: the worker will fetch it.
+		msg = &ShareGroupMessage{ContactID: c.ID(), Rev: c.Rev()}
+	} else {
+		msg = groupsChanges(event == couchdb.EventDelete, c, o)
+	}
+	if msg == nil {
+		return nil
+	}
+	return pushShareGroupMessage(db, msg)
+}
+
+// pushShareGroupMessage pushes a job for the share-group worker.
+func pushShareGroupMessage(db prefixer.Prefixer, m *ShareGroupMessage) error {
+	msg, err := job.NewMessage(m)
+	if err != nil {
+		return err
+	}
+	_, err = job.System().PushJob(db, &job.JobRequest{
+		WorkerType: "share-group",
+		Message:    msg,
+	})
+	return err
+}
+
+// diffGroupIDs returns the identifiers that are in a but not in b.
+func diffGroupIDs(a, b []string) []string {
+	var diff []string
+	for _, id := range a {
+		found := false
+		for _, other := range b {
+			if id == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diff = append(diff, id)
+		}
+	}
+	return diff
+}
+
+func init() {
+	for _, event := range []string{couchdb.EventCreate, couchdb.EventUpdate, couchdb.EventDelete} {
+		event := event
+		couchdb.AddHook(consts.Contacts, event,
+			func(db prefixer.Prefixer, doc couchdb.Doc, old couchdb.Doc) error {
+				return pushShareGroupJob(db, event, doc, old)
+			})
+	}
+	couchdb.AddHook(consts.Groups, couchdb.EventDelete,
+		func(db prefixer.Prefixer, doc couchdb.Doc, old couchdb.Doc) error {
+			return pushShareGroupMessage(db, &ShareGroupMessage{GroupDeleted: doc.ID()})
+		})
+}
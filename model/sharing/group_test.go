@@ -0,0 +1,78 @@
+package sharing
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/contact"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffGroupIDs(t *testing.T) {
+	assert.Empty(t, diffGroupIDs(nil, []string{"a"}))
+	assert.Equal(t, []string{"b", "c"}, diffGroupIDs([]string{"a", "b", "c"}, []string{"a"}))
+	assert.Equal(t, []string{"a"}, diffGroupIDs([]string{"a"}, nil))
+}
+
+func TestShouldRevokeFromGroups(t *testing.T) {
+	s := Sharing{
+		Members: []Member{
+			{Status: MemberStatusOwner},
+			{Status: MemberStatusReady, Email: "bob@example.net"},
+			{Status: MemberStatusReady, Email: "carol@example.net", OnlyInGroups: true},
+			{Status: MemberStatusReady, Email: "dave@example.net", OnlyInGroups: true},
+			{Status: MemberStatusRevoked, Email: "eve@example.net", OnlyInGroups: true},
+		},
+		Groups: []Group{
+			{ID: "friends", Members: []int{1, 2}},
+			{ID: "family", Members: []int{3}, Revoked: true},
+		},
+	}
+	assert.False(t, s.shouldRevokeFromGroups(1))
+	assert.False(t, s.shouldRevokeFromGroups(2))
+	assert.True(t, s.shouldRevokeFromGroups(3))
+	assert.False(t, s.shouldRevokeFromGroups(4))
+}
+
+func TestGroupsChanges(t *testing.T) {
+	newContact := func(email string, groups ...string) *contact.Contact {
+		data := make([]interface{}, len(groups))
+		for i, id := range groups {
+			data[i] = map[string]interface{}{"_id": id, "_type": consts.Groups}
+		}
+		c := contact.New()
+		c.M["_id"] = "contact-id"
+		c.M["email"] = []interface{}{map[string]interface{}{"address": email}}
+		c.M["relationships"] = map[string]interface{}{
+			"groups": map[string]interface{}{"data": data},
+		}
+		return c
+	}
+
+	msg := groupsChanges(false, newContact("bob@example.net", "friends"), nil)
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, "bob@example.net", msg.Email)
+		assert.Equal(t, []string{"friends"}, msg.GroupsAdded)
+		assert.Empty(t, msg.GroupsRemoved)
+	}
+
+	before := newContact("bob@example.net", "friends", "family")
+	after := newContact("bob@example.net", "family", "work")
+	msg = groupsChanges(false, after, before)
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, []string{"work"}, msg.GroupsAdded)
+		assert.Equal(t, []string{"friends"}, msg.GroupsRemoved)
+	}
+
+	assert.Nil(t, groupsChanges(false, after, after))
+
+	// A tombstone from _bulk_docs has no email: the previous revision is used
+	tombstone := contact.New()
+	tombstone.M["_id"] = "contact-id"
+	msg = groupsChanges(true, tombstone, before)
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, "bob@example.net", msg.Email)
+		assert.Empty(t, msg.GroupsAdded)
+		assert.Equal(t, []string{"friends", "family"}, msg.GroupsRemoved)
+	}
+}
@@ -266,6 +266,9 @@ func (s *sharingIndexer) bulkForceUpdateDoc(olddoc, doc *vfs.FileDoc) error {
 	if doc.InternalID != "" {
 		docs[0]["internal_vfs_id"] = doc.InternalID
 	}
+	if doc.EncryptedAtRest {
+		docs[0]["encrypted_at_rest"] = true
+	}
 	doc.SetRev(s.bulkRevs.Rev)
 	s.setDirOrFileRevisions(nil, olddoc, docs[0])
 
@@ -413,6 +416,26 @@ func (s *sharingIndexer) BatchDeleteVersions(versions []*vfs.Version) error {
 	return s.indexer.BatchDeleteVersions(versions)
 }
 
+func (s *sharingIndexer) AddBlobRef(hash string, size int64, encrypted bool) (*vfs.BlobRef, error) {
+	return s.indexer.AddBlobRef(hash, size, encrypted)
+}
+
+func (s *sharingIndexer) GetBlobRef(hash string) (*vfs.BlobRef, error) {
+	return s.indexer.GetBlobRef(hash)
+}
+
+func (s *sharingIndexer) SetBlobEncrypted(hash string, encrypted bool) error {
+	return s.indexer.SetBlobEncrypted(hash, encrypted)
+}
+
+func (s *sharingIndexer) RemoveBlobRef(hash string) (bool, error) {
+	return s.indexer.RemoveBlobRef(hash)
+}
+
+func (s *sharingIndexer) BlobsSavedSpace() (int64, error) {
+	return s.indexer.BlobsSavedSpace()
+}
+
 func (s *sharingIndexer) ListNotSynchronizedOn(clientID string) ([]vfs.DirDoc, error) {
 	return s.indexer.ListNotSynchronizedOn(clientID)
 }
@@ -65,6 +65,13 @@ type Member struct {
 	Email      string `json:"email,omitempty"`
 	Instance   string `json:"instance,omitempty"`
 	ReadOnly   bool   `json:"read_only,omitempty"`
+
+	// ExpiresAt is the date when the access of this member is revoked
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// OnlyInGroups is true if the member has been added only via groups of
+	// contacts: it is revoked when it leaves its last group.
+	OnlyInGroups bool `json:"only_in_groups,omitempty"`
 }
 
 // PrimaryName returns the main name of this member
@@ -98,25 +105,7 @@ type Credentials struct {
 
 // AddContacts adds a list of contacts on the sharer cozy
 func (s *Sharing) AddContacts(inst *instance.Instance, contactIDs map[string]bool) error {
-	for id, ro := range contactIDs {
-		if err := s.AddContact(inst, id, ro); err != nil {
-			return err
-		}
-	}
-	var err error
-	var perms *permission.Permission
-	if s.PreviewPath != "" {
-		if perms, err = s.CreatePreviewPermissions(inst); err != nil {
-			return err
-		}
-	}
-	_ = couchdb.UpdateDoc(inst, s)
-	if err = s.SendInvitations(inst, perms); err != nil {
-		return err
-	}
-	cloned := s.Clone().(*Sharing)
-	go cloned.NotifyRecipients(inst, nil)
-	return nil
+	return s.AddGroupsAndContacts(inst, nil, contactIDs)
 }
 
 // AddContact adds the contact with the given identifier
@@ -125,6 +114,17 @@ func (s *Sharing) AddContact(inst *instance.Instance, contactID string, readOnly
 	if err != nil {
 		return err
 	}
+	m, err := memberFromContact(c, readOnly)
+	if err != nil {
+		return err
+	}
+	_, err = s.addMember(inst, m)
+	return err
+}
+
+// memberFromContact returns a member, that has not been invited yet, for the
+// given contact.
+func memberFromContact(c *contact.Contact, readOnly bool) (Member, error) {
 	var name, email string
 	cozyURL := c.PrimaryCozyURL()
 	addr, err := c.ToMailAddress()
@@ -133,45 +133,53 @@ func (s *Sharing) AddContact(inst *instance.Instance, contactID string, readOnly
 		email = addr.Email
 	} else {
 		if cozyURL == "" {
-			return err
+			return Member{}, err
 		}
 		name = c.PrimaryName()
 	}
-	m := Member{
+	return Member{
 		Status:   MemberStatusMailNotSent,
 		Name:     name,
 		Email:    email,
 		Instance: cozyURL,
 		ReadOnly: readOnly,
-	}
-	_, err = s.addMember(inst, m)
-	return err
+	}, nil
 }
 
-func (s *Sharing) addMember(inst *instance.Instance, m Member) (string, error) {
-	idx := -1
+// findMemberIndex returns the index in the members of the sharing of the
+// recipient with the same email address (or the same instance if the member
+// has no email address), or -1 if there is no such recipient.
+func (s *Sharing) findMemberIndex(m Member) int {
 	for i, member := range s.Members {
 		if i == 0 {
 			continue // Skip the owner
 		}
-		var found bool
 		if m.Email == "" {
-			found = m.Instance == member.Instance
-		} else {
-			found = m.Email == member.Email
+			if m.Instance == member.Instance {
+				return i
+			}
+		} else if m.Email == member.Email {
+			return i
 		}
-		if !found {
-			continue
+	}
+	return -1
+}
+
+func (s *Sharing) addMember(inst *instance.Instance, m Member) (string, error) {
+	idx := s.findMemberIndex(m)
+	if idx > 0 {
+		// A member added directly must not be revoked when it leaves its
+		// groups
+		if !m.OnlyInGroups {
+			s.Members[idx].OnlyInGroups = false
 		}
-		if member.Status == MemberStatusReady {
+		if s.Members[idx].Status == MemberStatusReady {
 			return "", nil
 		}
-		idx = i
-		s.Members[i].Status = m.Status
-		s.Members[i].Name = m.Name
-		s.Members[i].Instance = m.Instance
-		s.Members[i].ReadOnly = m.ReadOnly
-		break
+		s.Members[idx].Status = m.Status
+		s.Members[idx].Name = m.Name
+		s.Members[idx].Instance = m.Instance
+		s.Members[idx].ReadOnly = m.ReadOnly
 	}
 	if idx < 1 {
 		if len(s.Members) >= maxNumberOfMembers(inst) {
@@ -247,24 +255,9 @@ func (s *Sharing) DelegateAddContacts(inst *instance.Instance, contactIDs map[st
 		if err != nil {
 			return err
 		}
-		var name, email string
-		cozyURL := c.PrimaryCozyURL()
-		addr, err := c.ToMailAddress()
-		if err == nil {
-			name = addr.Name
-			email = addr.Email
-		} else {
-			if cozyURL == "" {
-				return err
-			}
-			name = c.PrimaryName()
-		}
-		m := Member{
-			Status:   MemberStatusMailNotSent,
-			Name:     name,
-			Email:    email,
-			Instance: cozyURL,
-			ReadOnly: ro,
+		m, err := memberFromContact(c, ro)
+		if err != nil {
+			return err
 		}
 		api.members = append(api.members, m)
 	}
@@ -436,6 +429,7 @@ func (s *Sharing) UpdateRecipients(inst *instance.Instance, members []Member) er
 		s.Members[i].PublicName = m.PublicName
 		s.Members[i].Status = m.Status
 		s.Members[i].ReadOnly = m.ReadOnly
+		s.Members[i].ExpiresAt = m.ExpiresAt
 	}
 	return couchdb.UpdateDoc(inst, s)
 }
@@ -1016,6 +1010,9 @@ func (s *Sharing) NotifyRecipients(inst *instance.Instance, except *Member) {
 
 	var members struct {
 		Members []Member `json:"data"`
+		Meta    struct {
+			ExpiresAt *time.Time `json:"expires_at,omitempty"`
+		} `json:"meta"`
 	}
 	members.Members = make([]Member, len(s.Members))
 	for i, m := range s.Members {
@@ -1024,9 +1021,11 @@ func (s *Sharing) NotifyRecipients(inst *instance.Instance, except *Member) {
 			PublicName: m.PublicName,
 			Email:      m.Email,
 			ReadOnly:   m.ReadOnly,
+			ExpiresAt:  m.ExpiresAt,
 			// Instance and name are private
 		}
 	}
+	members.Meta.ExpiresAt = s.ExpiresAt
 	body, err := json.Marshal(members)
 	if err != nil {
 		inst.Logger().WithNamespace("sharing").
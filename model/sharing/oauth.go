@@ -89,6 +89,7 @@ func (m *Member) CreateSharingRequest(inst *instance.Instance, s *Sharing, c *Cr
 		},
 		nil,
 		nil,
+		nil,
 	}
 	data, err := jsonapi.MarshalObject(&sh)
 	if err != nil {
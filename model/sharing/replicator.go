@@ -584,6 +584,7 @@ func (s *Sharing) sendBulkDocs(inst *instance.Instance, m *Member, creds *Creden
 		return err
 	}
 	for doctype, docs := range *docsByDoctype {
+		s.addAuthors(inst, doctype, docs)
 		switch doctype {
 		case consts.Files:
 			s.SortFilesToSent(docs)
@@ -637,8 +638,10 @@ func (s *Sharing) sendBulkDocs(inst *instance.Instance, m *Member, creds *Creden
 	return nil
 }
 
-// ApplyBulkDocs is a multi-doctypes version of the POST _bulk_docs endpoint of CouchDB
-func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype) error {
+// ApplyBulkDocs is a multi-doctypes version of the POST _bulk_docs endpoint of
+// CouchDB. The changes are recorded in the activity log of the sharing, as
+// made by the from member.
+func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype, from *Member) error {
 	mu := lock.ReadWrite(inst, "sharings/"+s.SID+"/_bulk_docs")
 	if err := mu.Lock(); err != nil {
 		return err
@@ -646,19 +649,29 @@ func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype)
 	defer mu.Unlock()
 
 	var refs []*SharedRef
+	activity := s.newActivityLog(from)
+	defer activity.save(inst)
 
 	for doctype, docs := range payload {
 		inst.Logger().WithNamespace("replicator").
 			Debugf("Apply bulk docs %s: %#v", doctype, docs)
 		if doctype == consts.Files {
-			err := s.ApplyBulkFiles(inst, docs)
+			err := s.ApplyBulkFiles(inst, docs, from)
 			if err != nil {
 				return err
 			}
 			continue
 		}
+		authors := make(map[string]string)
+		for _, doc := range docs {
+			if by := popAuthor(doc); by != "" {
+				id, _ := doc["_id"].(string)
+				authors[id] = by
+			}
+		}
 		var okDocs, docsToUpdate DocsList
 		var newRefs, existingRefs []*SharedRef
+		var nbNew int
 		newDocs, existingDocs, err := partitionDocsPayload(inst, doctype, docs)
 		if err == nil {
 			okDocs, newRefs = s.filterDocsToAdd(inst, doctype, newDocs)
@@ -666,9 +679,11 @@ func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype)
 			if err != nil {
 				return err
 			}
+			nbNew = len(okDocs)
 			okDocs = append(okDocs, docsToUpdate...)
 		} else {
 			okDocs, newRefs = s.filterDocsToAdd(inst, doctype, docs)
+			nbNew = len(okDocs)
 			if len(okDocs) > 0 {
 				if err = couchdb.CreateDB(inst, doctype); err != nil {
 					return err
@@ -679,13 +694,18 @@ func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype)
 			if err = couchdb.BulkForceUpdateDocs(inst, doctype, okDocs); err != nil {
 				return err
 			}
-			for _, doc := range okDocs {
+			for i, doc := range okDocs {
 				d := couchdb.JSONDoc{M: doc, Type: doctype}
 				event := realtime.EventUpdate
+				action := ActivityUpdated
 				if doc["_deleted"] != nil {
 					event = realtime.EventDelete
+					action = ActivityDeleted
+				} else if i < nbNew {
+					action = ActivityCreated
 				}
 				couchdb.RTEvent(inst, event, &d, nil)
+				activity.add(action, doctype, d.ID(), d.Rev(), "", authors[d.ID()])
 			}
 			refs = append(refs, newRefs...)
 			refs = append(refs, existingRefs...)
@@ -517,7 +517,7 @@ func TestApplyBulkDocs(t *testing.T) {
 			},
 		},
 	}
-	err := s.ApplyBulkDocs(inst, payload)
+	err := s.ApplyBulkDocs(inst, payload, nil)
 	assert.NoError(t, err)
 	nbShared := 1
 	assertNbSharedRef(t, nbShared)
@@ -544,7 +544,7 @@ func TestApplyBulkDocs(t *testing.T) {
 			},
 		},
 	}
-	err = s.ApplyBulkDocs(inst, payload)
+	err = s.ApplyBulkDocs(inst, payload, nil)
 	assert.NoError(t, err)
 	assertNbSharedRef(t, nbShared)
 	doc = getDoc(t, foos, fooOneID)
@@ -577,7 +577,7 @@ func TestApplyBulkDocs(t *testing.T) {
 			},
 		},
 	}
-	err = s2.ApplyBulkDocs(inst, payload)
+	err = s2.ApplyBulkDocs(inst, payload, nil)
 	assert.NoError(t, err)
 	nbShared++
 	assertNbSharedRef(t, nbShared)
@@ -629,7 +629,7 @@ func TestApplyBulkDocs(t *testing.T) {
 			},
 		},
 	}
-	err = s.ApplyBulkDocs(inst, payload)
+	err = s.ApplyBulkDocs(inst, payload, nil)
 	assert.NoError(t, err)
 	nbShared += 3
 	assertNbSharedRef(t, nbShared)
@@ -749,7 +749,7 @@ func TestApplyBulkDocs(t *testing.T) {
 			},
 		},
 	}
-	err = s.ApplyBulkDocs(inst, payload)
+	err = s.ApplyBulkDocs(inst, payload, nil)
 	assert.NoError(t, err)
 	nbShared += 2 // fooFiveID and barSixID
 	assertNbSharedRef(t, nbShared)
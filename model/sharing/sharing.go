@@ -62,14 +62,25 @@ type Sharing struct {
 	ShortcutID  string    `json:"shortcut_id,omitempty"`
 	MovedFrom   string    `json:"moved_from,omitempty"`
 
+	// ExpiresAt is the date when the sharing is revoked for all the members
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
 	Rules []Rule `json:"rules"`
 
 	// Members[0] is the owner, Members[1...] are the recipients
 	Members []Member `json:"members"`
 
+	// Groups are the groups of contacts that have been added as recipients
+	// of the sharing (owner only)
+	Groups []Group `json:"groups,omitempty"`
+
 	// On the owner, credentials[i] is associated to members[i+1]
 	// On a recipient, there is only credentials[0] (for the owner)
 	Credentials []Credentials `json:"credentials,omitempty"`
+
+	// PendingTransfer is set on the old owner when a transfer of ownership
+	// has been accepted by the recipients but not yet by the new owner
+	PendingTransfer *PendingTransfer `json:"pending_transfer,omitempty"`
 }
 
 // ID returns the sharing qualified identifier
@@ -98,6 +109,14 @@ func (s *Sharing) Clone() couchdb.Doc {
 	}
 	cloned.Members = make([]Member, len(s.Members))
 	copy(cloned.Members, s.Members)
+	if s.Groups != nil {
+		cloned.Groups = make([]Group, len(s.Groups))
+		copy(cloned.Groups, s.Groups)
+		for i := range s.Groups {
+			cloned.Groups[i].Members = make([]int, len(s.Groups[i].Members))
+			copy(cloned.Groups[i].Members, s.Groups[i].Members)
+		}
+	}
 	cloned.Credentials = make([]Credentials, len(s.Credentials))
 	copy(cloned.Credentials, s.Credentials)
 	for i := range s.Credentials {
@@ -314,10 +333,18 @@ func (s *Sharing) Create(inst *instance.Instance) (*permission.Permission, error
 	if len(s.Members) < 2 {
 		return nil, ErrNoRecipients
 	}
+	if s.ExpiresAt != nil && !s.ExpiresAt.After(time.Now()) {
+		return nil, ErrInvalidExpiration
+	}
 
 	if err := couchdb.CreateDoc(inst, s); err != nil {
 		return nil, err
 	}
+	if s.Owner {
+		if err := s.ScheduleExpiration(inst, 0); err != nil {
+			return nil, err
+		}
+	}
 
 	if s.Owner && s.PreviewPath != "" {
 		return s.CreatePreviewPermissions(inst)
@@ -0,0 +1,518 @@
+package sharing
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/client/auth"
+	"github.com/cozy/cozy-stack/client/request"
+	"github.com/cozy/cozy-stack/model/contact"
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/labstack/echo/v4"
+)
+
+// The ownership of a sharing can be transferred to another member. The cozy
+// of the current owner drives the transfer, as it is the only one trusted by
+// all the recipients:
+//
+// 1. the new owner creates the OAuth clients for the other recipients
+// 2. each other recipient creates an OAuth client for the new owner, and
+//    replaces the old owner by the new one
+// 3. the new owner takes over the sharing with the new credentials
+// 4. the old owner becomes a recipient of the new owner.
+//
+// After the step 2, the recipients only trust the new owner, so there is no
+// way back. The request of the step 3 is saved in the sharing of the old
+// owner before being sent, and it is retried by a share-transfer job if it
+// fails. The new owner accepts it again if it has already taken over the
+// sharing, so the steps 3 and 4 can be replayed safely.
+//
+// The members are in the same order, except that the new owner is moved to
+// the first place. The XorKey between the new owner and a recipient is the
+// XOR of their keys with the old owner, so the identifiers of the files don't
+// change on any cozy.
+
+// TransferMember is a recipient for which the new owner of a sharing creates
+// an OAuth client.
+type TransferMember struct {
+	Index      int    `json:"index"`
+	Instance   string `json:"instance"`
+	PublicName string `json:"public_name,omitempty"`
+	ReadOnly   bool   `json:"read_only,omitempty"`
+}
+
+// TransferCredentials are the credentials created by the new owner, or by a
+// recipient, during a transfer of ownership.
+type TransferCredentials struct {
+	Index       int               `json:"index,omitempty"`
+	Client      *auth.Client      `json:"client"`
+	AccessToken *auth.AccessToken `json:"access_token"`
+}
+
+// TransferClients is the body of the requests to the new owner for creating
+// the OAuth clients, and of its response.
+type TransferClients struct {
+	Members     []TransferMember      `json:"members,omitempty"`
+	Credentials []TransferCredentials `json:"credentials,omitempty"`
+}
+
+// TransferRecipient is sent by the owner to the other recipients to tell
+// them who is the new owner, with the credentials to use for it.
+type TransferRecipient struct {
+	NewOwner    int               `json:"new_owner"`
+	Instance    string            `json:"instance"`
+	Client      *auth.Client      `json:"client"`
+	AccessToken *auth.AccessToken `json:"access_token"`
+	XorKey      []byte            `json:"xor_key"`
+}
+
+// TransferOwner is sent by the owner to the new owner, with the members and
+// the credentials in their new order.
+type TransferOwner struct {
+	Members     []Member      `json:"members"`
+	Credentials []Credentials `json:"credentials"`
+}
+
+// PendingTransfer is the state saved on the cozy of the old owner between
+// the steps 2 and 4 of a transfer of ownership.
+type PendingTransfer struct {
+	NewOwner int           `json:"new_owner"`
+	Members  []Member      `json:"members"`
+	Owner    TransferOwner `json:"owner"`
+}
+
+// TransferOwnership hands the role of owner of the sharing to the member at
+// the given index, who must be an active recipient without the read-only
+// flag. The recipients that can't be reached are revoked.
+func (s *Sharing) TransferOwnership(inst *instance.Instance, index int) error {
+	if !s.Owner || !s.Active || len(s.Members) != len(s.Credentials)+1 {
+		return ErrInvalidSharing
+	}
+	if s.PendingTransfer != nil {
+		if s.PendingTransfer.NewOwner != index {
+			return ErrInvalidSharing
+		}
+		return s.FinishTransfer(inst, 0)
+	}
+	if index < 1 || index >= len(s.Members) {
+		return ErrMemberNotFound
+	}
+	newOwner := s.Members[index]
+	if newOwner.Status != MemberStatusReady || newOwner.ReadOnly || newOwner.Instance == "" {
+		return ErrInvalidSharing
+	}
+	if s.FirstBitwardenOrganizationRule() != nil {
+		return ErrInvalidSharing
+	}
+	log := inst.Logger().WithNamespace("sharing")
+
+	// 1. The new owner creates the OAuth clients for the other recipients
+	var req TransferClients
+	for i, m := range s.Members {
+		if i == 0 || i == index || m.Status != MemberStatusReady {
+			continue
+		}
+		req.Members = append(req.Members, TransferMember{
+			Index:      i,
+			Instance:   m.Instance,
+			PublicName: m.PublicName,
+			ReadOnly:   m.ReadOnly,
+		})
+	}
+	var clients TransferClients
+	if err := s.sendTransferRequest(inst, index, "/transfer/clients", &req, &clients); err != nil {
+		return err
+	}
+	byIndex := make(map[int]TransferCredentials)
+	for _, c := range clients.Credentials {
+		byIndex[c.Index] = c
+	}
+
+	// 2. The other recipients exchange credentials with the new owner
+	members := s.membersForNewOwner(index)
+	creds := make([]Credentials, len(s.Credentials))
+	ownerKey := s.Credentials[index-1].XorKey
+	for i, m := range s.Members {
+		if i == 0 || i == index || m.Status != MemberStatusReady {
+			continue
+		}
+		j := newMemberIndex(i, index)
+		c, ok := byIndex[i]
+		if !ok || c.Client == nil {
+			log.Warnf("No credentials from the new owner for %s", m.Instance)
+			members[j].Status = MemberStatusRevoked
+			_ = s.NotifyMemberRevocation(inst, &s.Members[i], &s.Credentials[i-1])
+			continue
+		}
+		creds[j-1].InboundClientID = c.Client.ClientID
+		msg := TransferRecipient{
+			NewOwner:    index,
+			Instance:    newOwner.Instance,
+			Client:      c.Client,
+			AccessToken: c.AccessToken,
+			XorKey:      xorKeys(ownerKey, s.Credentials[i-1].XorKey),
+		}
+		var res TransferCredentials
+		if err := s.sendTransferRequest(inst, i, "/transfer/recipient", &msg, &res); err != nil {
+			log.Warnf("Cannot transfer the ownership to %s: %s", m.Instance, err)
+			members[j].Status = MemberStatusRevoked
+			_ = s.NotifyMemberRevocation(inst, &s.Members[i], &s.Credentials[i-1])
+			continue
+		}
+		creds[j-1].Client = res.Client
+		creds[j-1].AccessToken = res.AccessToken
+		creds[j-1].XorKey = msg.XorKey
+	}
+
+	// 3. The new owner takes over the sharing
+	owner := TransferOwner{
+		Members:     make([]Member, len(members)),
+		Credentials: creds,
+	}
+	for i, m := range members {
+		owner.Members[i] = m
+		owner.Members[i].Name = "" // The name is private
+	}
+	s.PendingTransfer = &PendingTransfer{
+		NewOwner: index,
+		Members:  members,
+		Owner:    owner,
+	}
+	if err := couchdb.UpdateDoc(inst, s); err != nil {
+		return err
+	}
+	return s.FinishTransfer(inst, 0)
+}
+
+// FinishTransfer sends the pending request of a transfer of ownership to the
+// new owner, and makes this cozy a recipient of the new owner when it has
+// been accepted. If it fails, a job is added to retry it later.
+func (s *Sharing) FinishTransfer(inst *instance.Instance, errors int) error {
+	t := s.PendingTransfer
+	if t == nil || !s.Owner {
+		return nil
+	}
+
+	// 3. The new owner takes over the sharing
+	if err := s.sendTransferRequest(inst, t.NewOwner, "/transfer/owner", &t.Owner, nil); err != nil {
+		inst.Logger().WithNamespace("sharing").
+			Warnf("Cannot finish the transfer of ownership of %s: %s", s.SID, err)
+		s.retryWorker(inst, "share-transfer", errors)
+		return err
+	}
+
+	// 4. This cozy becomes a recipient of the new owner
+	s.PendingTransfer = nil
+	return s.becomeRecipient(inst, t.NewOwner, t.Members)
+}
+
+// becomeRecipient is called on the cozy of the old owner at the end of a
+// transfer of ownership.
+func (s *Sharing) becomeRecipient(inst *instance.Instance, index int, members []Member) error {
+	for i := range s.Credentials {
+		m := &s.Members[i+1]
+		if err := s.ClearLastSequenceNumbers(inst, m); err != nil {
+			return err
+		}
+		if i+1 == index {
+			continue
+		}
+		if err := DeleteOAuthClient(inst, m, &s.Credentials[i]); err != nil {
+			inst.Logger().WithNamespace("sharing").
+				Warnf("Cannot delete the OAuth client for %s: %s", m.Instance, err)
+		}
+	}
+	if s.PreviewPath != "" {
+		if err := s.RevokePreviewPermissions(inst); err != nil {
+			inst.Logger().WithNamespace("sharing").
+				Warnf("Cannot revoke the preview permissions: %s", err)
+		}
+	}
+
+	creds := s.Credentials[index-1]
+	s.Owner = false
+	s.Groups = nil
+	s.UpdatedAt = time.Now()
+	s.Members = members
+	for i := 2; i < len(s.Members); i++ {
+		s.Members[i].Instance = "" // Only known by the owner
+	}
+	s.Credentials = []Credentials{creds}
+	if s.ReadOnlyRules() {
+		if err := removeSharingTrigger(inst, s.Triggers.ReplicateID); err != nil {
+			return err
+		}
+		s.Triggers.ReplicateID = ""
+		if err := removeSharingTrigger(inst, s.Triggers.UploadID); err != nil {
+			return err
+		}
+		s.Triggers.UploadID = ""
+	}
+	if err := couchdb.UpdateDoc(inst, s); err != nil {
+		return err
+	}
+	s.pushReplicationJobs(inst)
+	return nil
+}
+
+// CreateTransferClients is called on the cozy of the new owner, during a
+// transfer of ownership, to create the OAuth clients for the other
+// recipients.
+func (s *Sharing) CreateTransferClients(inst *instance.Instance, members []TransferMember) (*TransferClients, error) {
+	if s.Owner || !s.Active {
+		return nil, ErrInvalidSharing
+	}
+	res := &TransferClients{Credentials: make([]TransferCredentials, 0, len(members))}
+	for _, tm := range members {
+		m := Member{Instance: tm.Instance, PublicName: tm.PublicName}
+		cli, err := CreateOAuthClient(inst, &m)
+		if err != nil {
+			return nil, err
+		}
+		verb := permission.ALL
+		if s.ReadOnlyRules() || tm.ReadOnly {
+			verb = permission.Verbs(permission.GET)
+		}
+		token, err := CreateAccessToken(inst, cli, s.SID, verb)
+		if err != nil {
+			return nil, err
+		}
+		res.Credentials = append(res.Credentials, TransferCredentials{
+			Index:       tm.Index,
+			Client:      ConvertOAuthClient(cli),
+			AccessToken: token,
+		})
+	}
+	return res, nil
+}
+
+// ChangeOwner is called on the cozy of a recipient, during a transfer of
+// ownership, to replace the old owner by the new one.
+func (s *Sharing) ChangeOwner(inst *instance.Instance, msg *TransferRecipient) (*TransferCredentials, error) {
+	if s.Owner || !s.Active || len(s.Credentials) != 1 {
+		return nil, ErrInvalidSharing
+	}
+	if msg.NewOwner < 1 || msg.NewOwner >= len(s.Members) || msg.Instance == "" {
+		return nil, ErrInvalidSharing
+	}
+	newOwner := Member{
+		Instance:   msg.Instance,
+		PublicName: s.Members[msg.NewOwner].PublicName,
+	}
+	cli, err := CreateOAuthClient(inst, &newOwner)
+	if err != nil {
+		return nil, err
+	}
+	token, err := CreateAccessToken(inst, cli, s.SID, permission.ALL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.ClearLastSequenceNumbers(inst, &s.Members[0]); err != nil {
+		return nil, err
+	}
+	if err := DeleteOAuthClient(inst, &s.Members[0], &s.Credentials[0]); err != nil {
+		inst.Logger().WithNamespace("sharing").
+			Warnf("Cannot delete the OAuth client for the old owner: %s", err)
+	}
+	s.Members = s.membersForNewOwner(msg.NewOwner)
+	s.Members[0].Instance = msg.Instance
+	s.Members[1].Instance = "" // The old owner is now a recipient
+	s.Credentials[0] = Credentials{
+		Client:          msg.Client,
+		AccessToken:     msg.AccessToken,
+		XorKey:          msg.XorKey,
+		InboundClientID: cli.ClientID,
+	}
+	s.UpdatedAt = time.Now()
+	if err := couchdb.UpdateDoc(inst, s); err != nil {
+		return nil, err
+	}
+	if !s.ReadOnly() {
+		s.pushReplicationJobs(inst)
+	}
+	return &TransferCredentials{
+		Client:      ConvertOAuthClient(cli),
+		AccessToken: token,
+	}, nil
+}
+
+// TakeOverOwnership is called on the cozy of the new owner, at the end of a
+// transfer of ownership. The members that have not yet accepted the sharing
+// are invited again.
+func (s *Sharing) TakeOverOwnership(inst *instance.Instance, msg *TransferOwner) error {
+	if s.Owner || !s.Active || len(s.Credentials) != 1 {
+		return ErrInvalidSharing
+	}
+	if len(msg.Members) < 2 || len(msg.Members) != len(msg.Credentials)+1 {
+		return ErrInvalidSharing
+	}
+	if err := s.ClearLastSequenceNumbers(inst, &s.Members[0]); err != nil {
+		return err
+	}
+
+	members := msg.Members
+	creds := msg.Credentials
+	// The old owner is the first recipient, and we already have the
+	// credentials for it
+	creds[0] = s.Credentials[0]
+	invite := false
+	for i := range members {
+		if members[i].Email != "" {
+			if c, err := contact.FindByEmail(inst, members[i].Email); err == nil {
+				members[i].Name = c.PrimaryName()
+			}
+		}
+		if i < 2 {
+			continue
+		}
+		switch members[i].Status {
+		case MemberStatusReady:
+		case MemberStatusRevoked:
+			if creds[i-1].InboundClientID != "" {
+				_ = DeleteOAuthClient(inst, &members[i], &creds[i-1])
+			}
+			creds[i-1] = Credentials{}
+		default:
+			members[i].Status = MemberStatusMailNotSent
+			state := crypto.Base64Encode(crypto.GenerateRandomBytes(StateLen))
+			creds[i-1] = Credentials{
+				State:  string(state),
+				XorKey: MakeXorKey(),
+			}
+			invite = true
+		}
+	}
+
+	s.Owner = true
+	s.Members = members
+	s.Credentials = creds
+	s.UpdatedAt = time.Now()
+	if err := couchdb.UpdateDoc(inst, s); err != nil {
+		return err
+	}
+	if err := s.AddReplicateTrigger(inst); err != nil {
+		return err
+	}
+	if s.FirstFilesRule() != nil {
+		if err := s.AddUploadTrigger(inst); err != nil {
+			return err
+		}
+	}
+	for i := range s.Members {
+		if err := s.ScheduleExpiration(inst, i); err != nil {
+			inst.Logger().WithNamespace("sharing").
+				Warnf("Cannot schedule the expiration: %s", err)
+		}
+	}
+	s.pushReplicationJobs(inst)
+
+	if invite {
+		return s.inviteNewMembers(inst)
+	}
+	cloned := s.Clone().(*Sharing)
+	go cloned.NotifyRecipients(inst, nil)
+	return nil
+}
+
+// membersForNewOwner returns the members of the sharing, with the member at
+// the given index as the owner.
+func (s *Sharing) membersForNewOwner(index int) []Member {
+	members := make([]Member, len(s.Members))
+	for i, m := range s.Members {
+		j := newMemberIndex(i, index)
+		members[j] = m
+		switch j {
+		case 0:
+			members[j].Status = MemberStatusOwner
+			members[j].ReadOnly = false
+			members[j].ExpiresAt = nil
+		case 1:
+			members[j].Status = MemberStatusReady
+		}
+	}
+	return members
+}
+
+// newMemberIndex returns the index of a member after the transfer of the
+// ownership to the member at newOwner.
+func newMemberIndex(i, newOwner int) int {
+	switch {
+	case i == newOwner:
+		return 0
+	case i < newOwner:
+		return i + 1
+	default:
+		return i
+	}
+}
+
+// xorKeys returns the key for transforming the identifiers from a cozy to
+// another, when a and b are the keys for the transformations from the owner
+// to these cozy.
+func xorKeys(a, b []byte) []byte {
+	key := make([]byte, len(a))
+	for i := range a {
+		key[i] = a[i] ^ b[i%len(b)]
+	}
+	return key
+}
+
+func (s *Sharing) pushReplicationJobs(inst *instance.Instance) {
+	s.pushJob(inst, "share-replicate")
+	if s.FirstFilesRule() != nil {
+		s.pushJob(inst, "share-upload")
+	}
+}
+
+// sendTransferRequest sends a request for the transfer of ownership to the
+// member at the given index, and decodes the response in out (if not nil).
+func (s *Sharing) sendTransferRequest(inst *instance.Instance, index int, path string, body, out interface{}) error {
+	m := &s.Members[index]
+	c := &s.Credentials[index-1]
+	u, err := url.Parse(m.Instance)
+	if m.Instance == "" || err != nil {
+		return ErrInvalidURL
+	}
+	if c.AccessToken == nil {
+		return ErrNoOAuthClient
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	opts := &request.Options{
+		Method: http.MethodPost,
+		Scheme: u.Scheme,
+		Domain: u.Host,
+		Path:   "/sharings/" + s.SID + path,
+		Headers: request.Headers{
+			echo.HeaderAccept:        echo.MIMEApplicationJSON,
+			echo.HeaderContentType:   echo.MIMEApplicationJSON,
+			echo.HeaderAuthorization: "Bearer " + c.AccessToken.AccessToken,
+		},
+		Body:       bytes.NewReader(buf),
+		ParseError: ParseRequestError,
+	}
+	res, err := request.Req(opts)
+	if res != nil && res.StatusCode/100 == 4 {
+		res, err = RefreshToken(inst, err, s, m, c, opts, buf)
+	}
+	if err != nil {
+		if res != nil && res.StatusCode/100 == 5 {
+			return ErrInternalServerError
+		}
+		return err
+	}
+	defer res.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
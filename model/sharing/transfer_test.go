@@ -0,0 +1,39 @@
+package sharing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMembersForNewOwner(t *testing.T) {
+	s := Sharing{
+		Members: []Member{
+			{Status: MemberStatusOwner, Email: "alice@example.net"},
+			{Status: MemberStatusReady, Email: "bob@example.net"},
+			{Status: MemberStatusReady, Email: "carol@example.net", ReadOnly: true},
+			{Status: MemberStatusSeen, Email: "dave@example.net"},
+		},
+	}
+	members := s.membersForNewOwner(2)
+	if assert.Len(t, members, 4) {
+		assert.Equal(t, "carol@example.net", members[0].Email)
+		assert.Equal(t, MemberStatusOwner, members[0].Status)
+		assert.False(t, members[0].ReadOnly)
+		assert.Equal(t, "alice@example.net", members[1].Email)
+		assert.Equal(t, MemberStatusReady, members[1].Status)
+		assert.Equal(t, "bob@example.net", members[2].Email)
+		assert.Equal(t, "dave@example.net", members[3].Email)
+		assert.Equal(t, MemberStatusSeen, members[3].Status)
+	}
+}
+
+func TestXorKeys(t *testing.T) {
+	id := "4ab2155707bb6613a8b9463daf00381b"
+	a := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	b := []byte{15, 3, 7, 1, 0, 12, 9, 2, 4, 11, 8, 6, 5, 14, 13, 10}
+	key := xorKeys(a, b)
+	// From the cozy A to the cozy B, via the identifiers on the owner cozy
+	assert.Equal(t, XorID(XorID(id, a), key), XorID(id, b))
+	assert.Equal(t, XorID(XorID(id, b), key), XorID(id, a))
+}
@@ -2,19 +2,25 @@ package sharing
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/client/request"
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/delta"
 	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 	multierror "github.com/hashicorp/go-multierror"
@@ -239,6 +245,7 @@ func (s *Sharing) uploadFile(inst *instance.Instance, m *Member, file map[string
 		return err
 	}
 	origFileID := file["_id"].(string)
+	s.addAuthors(inst, consts.Files, []map[string]interface{}{file})
 	s.TransformFileToSent(file, creds.XorKey, ruleIndex)
 	xoredFileID := file["_id"].(string)
 	body, err := json.Marshal(file)
@@ -285,6 +292,12 @@ func (s *Sharing) uploadFile(inst *instance.Instance, m *Member, file map[string
 	if err != nil {
 		return err
 	}
+	if resBody.Delta {
+		sent, err := s.uploadDelta(inst, m, u, creds, resBody.Key, fileDoc)
+		if sent || err != nil {
+			return err
+		}
+	}
 	content, err := fs.OpenFile(fileDoc)
 	if err != nil {
 		return err
@@ -314,10 +327,132 @@ func (s *Sharing) uploadFile(inst *instance.Instance, m *Member, file map[string
 	return nil
 }
 
+// uploadDelta sends to a member only the changes in the content of a file,
+// from the signature of the version on the cozy of this member. It returns
+// false if the member has not accepted the delta, and the whole content must
+// be sent.
+func (s *Sharing) uploadDelta(inst *instance.Instance, m *Member, u *url.URL, creds *Credentials, key string, fileDoc *vfs.FileDoc) (bool, error) {
+	sig, err := s.fetchSignature(inst, m, u, creds, key)
+	if err != nil {
+		inst.Logger().WithNamespace("upload").
+			Infof("Cannot fetch the signature of %s: %s", fileDoc.DocID, err)
+		return false, nil
+	}
+	body, err := newDeltaBody(inst, sig, fileDoc)
+	if err != nil {
+		return false, err
+	}
+	opts := &request.Options{
+		Method:  http.MethodPut,
+		Scheme:  u.Scheme,
+		Domain:  u.Host,
+		Path:    "/sharings/" + s.SID + "/io.cozy.files/" + key,
+		Queries: url.Values{"from": {inst.ContextualDomain()}},
+		Headers: request.Headers{
+			echo.HeaderContentType:   delta.ContentType,
+			echo.HeaderAuthorization: "Bearer " + creds.AccessToken.AccessToken,
+		},
+		Body:       body,
+		ParseError: ParseRequestError,
+		Client:     http.DefaultClient,
+	}
+	res, err := request.Req(opts)
+	body.wait()
+	if res != nil && (res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusGone) {
+		// The delta is computed again, as the body is streamed
+		if body, err = newDeltaBody(inst, sig, fileDoc); err != nil {
+			return false, err
+		}
+		opts.Body = body
+		res, err = RefreshToken(inst, err, s, m, creds, opts, nil)
+		body.wait()
+	}
+	if err != nil {
+		if res != nil && res.StatusCode/100 == 4 {
+			inst.Logger().WithNamespace("upload").
+				Infof("Delta rejected for %s: %s", fileDoc.DocID, err)
+			return false, nil
+		}
+		if res != nil && res.StatusCode/100 == 5 {
+			return false, ErrInternalServerError
+		}
+		return false, err
+	}
+	res.Body.Close()
+	return true, nil
+}
+
+// fetchSignature asks a member for the signature of the current content of a
+// file on its cozy, to compute a delta.
+func (s *Sharing) fetchSignature(inst *instance.Instance, m *Member, u *url.URL, creds *Credentials, key string) (*delta.Signature, error) {
+	opts := &request.Options{
+		Method:  http.MethodGet,
+		Scheme:  u.Scheme,
+		Domain:  u.Host,
+		Path:    "/sharings/" + s.SID + "/io.cozy.files/" + key + "/signature",
+		Queries: url.Values{"from": {inst.ContextualDomain()}},
+		Headers: request.Headers{
+			echo.HeaderAccept:        echo.MIMEApplicationJSON,
+			echo.HeaderAuthorization: "Bearer " + creds.AccessToken.AccessToken,
+		},
+		ParseError: ParseRequestError,
+		// The member may have to read a large file to compute the signature
+		Client: http.DefaultClient,
+	}
+	res, err := request.Req(opts)
+	if res != nil && (res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusGone) {
+		res, err = RefreshToken(inst, err, s, m, creds, opts, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var sig delta.Signature
+	if err = json.NewDecoder(res.Body).Decode(&sig); err != nil {
+		return nil, err
+	}
+	if err = sig.Validate(); err != nil {
+		return nil, err
+	}
+	return &sig, nil
+}
+
+// deltaBody is the body of a request for uploading a delta: the delta is
+// computed on the fly from the content of the file, and streamed.
+type deltaBody struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func newDeltaBody(inst *instance.Instance, sig *delta.Signature, fileDoc *vfs.FileDoc) (*deltaBody, error) {
+	content, err := inst.VFS().OpenFile(fileDoc)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer content.Close()
+		pw.CloseWithError(delta.Compute(pw, sig, content))
+	}()
+	return &deltaBody{PipeReader: pr, done: done}, nil
+}
+
+// wait stops the computation of the delta if the request has not read all of
+// it, and waits for the goroutine to finish.
+func (b *deltaBody) wait() {
+	b.PipeReader.Close()
+	<-b.done
+}
+
 // FileDocWithRevisions is the struct of the payload for synchronizing a file
 type FileDocWithRevisions struct {
 	*vfs.FileDoc
 	Revisions RevsStruct `json:"_revisions"`
+	// Author is the email of the member who has made the change, as sent by
+	// the sharer
+	Author string `json:"sharing_author,omitempty"`
 }
 
 // Clone is part of the couchdb.Doc interface
@@ -326,9 +461,12 @@ func (f *FileDocWithRevisions) Clone() couchdb.Doc {
 }
 
 // KeyToUpload contains the key for uploading a file (when syncing metadata is
-// not enough)
+// not enough). When the file already exists, Delta tells that the content can
+// be uploaded as a delta from the signature of the current content, that is
+// fetched with another request.
 type KeyToUpload struct {
-	Key string `json:"key"`
+	Key   string `json:"key"`
+	Delta bool   `json:"delta,omitempty"`
 }
 
 func (s *Sharing) createUploadKey(inst *instance.Instance, target *FileDocWithRevisions) (*KeyToUpload, error) {
@@ -339,9 +477,70 @@ func (s *Sharing) createUploadKey(inst *instance.Instance, target *FileDocWithRe
 	return &KeyToUpload{Key: key}, nil
 }
 
+// signatureCacheTTL is how long the signature of a content is kept in cache,
+// so that an upload tried again doesn't read the whole file another time.
+const signatureCacheTTL = 1 * time.Hour
+
+// canUploadDelta returns true if the files are large enough to gain something
+// by sending a delta.
+func canUploadDelta(current *vfs.FileDoc, target *FileDocWithRevisions) bool {
+	return current.ByteSize >= delta.MinSize && target.ByteSize >= delta.MinSize
+}
+
+// FileSignature returns the signature of the current content of the file to
+// upload with the given key, for the sender to compute a delta. It is not
+// sent with the key, as reading a large file can take some time, and the
+// signatures are kept in cache by md5sum.
+func (s *Sharing) FileSignature(inst *instance.Instance, key string) (*delta.Signature, error) {
+	target, err := getStore().Get(inst, key)
+	if err != nil {
+		return nil, err
+	}
+	if target == nil {
+		return nil, ErrMissingFileMetadata
+	}
+	current, err := inst.VFS().FileByID(target.DocID)
+	if err != nil {
+		if err == os.ErrNotExist {
+			return nil, ErrDeltaOutdated
+		}
+		return nil, err
+	}
+	if !canUploadDelta(current, target) {
+		return nil, ErrDeltaOutdated
+	}
+
+	cache := config.GetConfig().CacheStorage
+	cacheKey := "sharing-signature:" + hex.EncodeToString(current.MD5Sum) +
+		":" + strconv.FormatInt(current.ByteSize, 10)
+	if r, ok := cache.GetCompressed(cacheKey); ok {
+		var sig delta.Signature
+		if err := json.NewDecoder(r).Decode(&sig); err == nil {
+			return &sig, nil
+		}
+	}
+
+	content, err := inst.VFS().OpenFile(current)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	blockSize := delta.BlockSizeFor(current.ByteSize)
+	sig, err := delta.NewSignature(content, blockSize, current.MD5Sum)
+	if err != nil {
+		return nil, err
+	}
+	if buf, err := json.Marshal(sig); err == nil {
+		cache.SetCompressed(cacheKey, buf, signatureCacheTTL)
+	}
+	return sig, nil
+}
+
 // SyncFile tries to synchronize a file with just the metadata. If it can't,
-// it will return a key to upload the content.
-func (s *Sharing) SyncFile(inst *instance.Instance, target *FileDocWithRevisions) (*KeyToUpload, error) {
+// it will return a key to upload the content. A change of the metadata is
+// recorded in the activity log of the sharing, as made by the author sent by
+// the sharer (or by the from member if it is not known).
+func (s *Sharing) SyncFile(inst *instance.Instance, target *FileDocWithRevisions, from *Member) (*KeyToUpload, error) {
 	inst.Logger().WithNamespace("upload").Debugf("SyncFile %#v", target)
 
 	if len(target.MD5Sum) == 0 {
@@ -379,9 +578,20 @@ func (s *Sharing) SyncFile(inst *instance.Instance, target *FileDocWithRevisions
 		return nil, nil
 	}
 	if !bytes.Equal(target.MD5Sum, current.MD5Sum) {
-		return s.createUploadKey(inst, target)
+		key, err := s.createUploadKey(inst, target)
+		if err != nil {
+			return nil, err
+		}
+		key.Delta = canUploadDelta(current, target)
+		return key, nil
+	}
+	if err = s.updateFileMetadata(inst, target, current, &ref); err != nil {
+		return nil, err
 	}
-	return nil, s.updateFileMetadata(inst, target, current, &ref)
+	activity := s.newActivityLog(from)
+	activity.add(ActivityUpdated, consts.Files, target.DocID, target.DocRev, target.DocName, target.Author)
+	activity.save(inst)
+	return nil, nil
 }
 
 // prepareFileWithAncestors find the parent directory for file, and recreates it
@@ -470,8 +680,12 @@ func (s *Sharing) updateFileMetadata(inst *instance.Instance, target *FileDocWit
 }
 
 // HandleFileUpload is used to receive a file upload when synchronizing just
-// the metadata was not enough.
-func (s *Sharing) HandleFileUpload(inst *instance.Instance, key string, body io.ReadCloser) error {
+// the metadata was not enough. If withDelta is true, the body is a delta from
+// the current content of the file. The upload is recorded in the activity log
+// of the sharing, as made by the author sent by the sharer, or by the member
+// on whose cozy the content was uploaded (or by the from member if it is not
+// known).
+func (s *Sharing) HandleFileUpload(inst *instance.Instance, key string, body io.ReadCloser, from *Member, withDelta bool) error {
 	defer body.Close()
 	target, err := getStore().Get(inst, key)
 	inst.Logger().WithNamespace("upload").Debugf("HandleFileUpload %#v %#v", target.FileDoc, target.Revisions)
@@ -495,10 +709,46 @@ func (s *Sharing) HandleFileUpload(inst *instance.Instance, key string, body io.
 		return err
 	}
 
+	if withDelta {
+		if current == nil {
+			return ErrDeltaOutdated
+		}
+		content, err := inst.VFS().OpenFile(current)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		patcher, err := delta.NewPatcher(content, current.ByteSize, body)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(patcher.BaseMD5Sum(), current.MD5Sum) {
+			return ErrDeltaOutdated
+		}
+		body = ioutil.NopCloser(patcher)
+	}
+
+	action := ActivityUpdated
 	if current == nil {
-		return s.UploadNewFile(inst, target, body)
+		action = ActivityCreated
+		err = s.UploadNewFile(inst, target, body)
+	} else {
+		err = s.UploadExistingFile(inst, target, current, body)
+	}
+	if err != nil {
+		return err
 	}
-	return s.UploadExistingFile(inst, target, current, body)
+	by := target.Author
+	if meta := target.CozyMetadata; by == "" && meta != nil {
+		by = meta.UploadedOn
+		if by == "" {
+			by = meta.CreatedOn
+		}
+	}
+	activity := s.newActivityLog(from)
+	activity.add(action, consts.Files, target.DocID, target.DocRev, target.DocName, by)
+	activity.save(inst)
+	return nil
 }
 
 // UploadNewFile is used to receive a new file.
@@ -729,6 +979,7 @@ func (s *Sharing) UploadExistingFile(inst *instance.Instance, target *FileDocWit
 	indexer.UnstashRevision(stash)
 	newdoc.DocRev = tmpdoc.DocRev
 	newdoc.InternalID = tmpdoc.InternalID
+	newdoc.EncryptedAtRest = tmpdoc.EncryptedAtRest
 	err = fs.UpdateFileDoc(tmpdoc, newdoc)
 	if err == os.ErrExist {
 		pth, errp := newdoc.Path(fs)
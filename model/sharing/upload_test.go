@@ -0,0 +1,105 @@
+package sharing
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/client/auth"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/delta"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadDeltaRejected(t *testing.T) {
+	// A file large enough to be sent as a delta
+	content := bytes.Repeat([]byte("0123456789abcdef"), delta.MinSize/16+64)
+	fs := inst.VFS()
+	dir, err := vfs.Mkdir(fs, "/delta-rejected", nil)
+	require.NoError(t, err)
+	doc, err := vfs.NewFileDoc("file.bin", dir.ID(), int64(len(content)), nil,
+		"application/octet-stream", "binary", time.Now(), false, false, false, nil)
+	require.NoError(t, err)
+	f, err := fs.CreateFile(doc, nil)
+	require.NoError(t, err)
+	_, err = f.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// The member has an older version of the file, and rejects the delta
+	old := content[:len(content)-delta.MinBlockSize]
+	oldSum := md5.Sum(old)
+	var mu sync.Mutex
+	var calls []string
+	var uploaded []byte
+	member := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		switch {
+		case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/metadata"):
+			w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			_ = json.NewEncoder(w).Encode(KeyToUpload{Key: "thekey", Delta: true})
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/thekey/signature"):
+			blockSize := delta.BlockSizeFor(int64(len(old)))
+			sig, _ := delta.NewSignature(bytes.NewReader(old), blockSize, oldSum[:])
+			w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			_ = json.NewEncoder(w).Encode(sig)
+		case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/thekey"):
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Header.Get(echo.HeaderContentType) == delta.ContentType {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			uploaded = body
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer member.Close()
+
+	s := &Sharing{
+		SID:   "delta-rejected-sharing",
+		Owner: false,
+		Rules: []Rule{
+			{Title: "delta", DocType: consts.Files, Values: []string{dir.ID()}},
+		},
+		Members: []Member{
+			{Status: MemberStatusOwner, Instance: member.URL},
+			{Status: MemberStatusReady, Instance: "https://" + inst.Domain},
+		},
+		Credentials: []Credentials{
+			{
+				AccessToken: &auth.AccessToken{AccessToken: "token"},
+				XorKey:      MakeXorKey(),
+			},
+		},
+	}
+	raw, err := json.Marshal(doc)
+	require.NoError(t, err)
+	var file map[string]interface{}
+	require.NoError(t, json.Unmarshal(raw, &file))
+
+	err = s.uploadFile(inst, &s.Members[0], file, 0)
+	assert.NoError(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, calls, 4) {
+		assert.True(t, strings.HasSuffix(calls[0], "/metadata"))
+		assert.True(t, strings.HasSuffix(calls[1], "/signature"))
+		assert.True(t, strings.HasSuffix(calls[2], "/thekey"))
+		assert.True(t, strings.HasSuffix(calls[3], "/thekey"))
+	}
+	assert.Equal(t, content, uploaded)
+}
@@ -96,6 +96,11 @@ security features. Please do not use this binary as your production server.
 		return
 	}
 
+	// Init the global client for the S3-compatible object storage
+	if err = config.InitDefaultS3Client(); err != nil {
+		return
+	}
+
 	workersList, err := job.GetWorkersList()
 	if err != nil {
 		return
@@ -0,0 +1,47 @@
+package stack_test
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/stack"
+	"github.com/cozy/cozy-stack/pkg/assets/dynamic"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/previewfs"
+	"github.com/cozy/cozy-stack/pkg/s3/s3test"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartWithS3(t *testing.T) {
+	server := s3test.NewServer()
+	defer server.Close()
+
+	fsURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	fsURL.Scheme = config.SchemeS3Insecure
+	fsURL.User = url.UserPassword("access", "secret")
+	fsURL.Path = "/cozy"
+	fsURL.RawQuery = "PathStyle=true"
+	config.GetConfig().Fs.URL = fsURL
+
+	processes, err := stack.Start(stack.NoGops)
+	require.NoError(t, err)
+	defer func() { _ = processes.Shutdown(context.Background()) }()
+
+	_, err = dynamic.ListAssets()
+	assert.NoError(t, err)
+
+	cache := previewfs.SystemCache()
+	_, err = cache.GetPreview([]byte("md5"))
+	assert.Error(t, err)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	os.Exit(m.Run())
+}
@@ -0,0 +1,128 @@
+package vfs
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
+// CopyName returns the default name for a copy of a file or directory in the
+// same directory as the original: "foo.txt" gives "foo (copy).txt".
+func CopyName(name string, isFile bool) string {
+	ext := ""
+	if isFile {
+		ext = path.Ext(name)
+		if ext == name {
+			ext = ""
+		}
+	}
+	base := strings.TrimSuffix(name, ext)
+	return base + " (copy)" + ext
+}
+
+// NewFileDocCopy returns the document for a copy of the src file, with the
+// given name and parent directory. The tags, metadata and dates are only kept
+// if keepMetadata is true. The references are never copied.
+func NewFileDocCopy(src *FileDoc, dirID, name string, keepMetadata bool) (*FileDoc, error) {
+	if err := checkFileName(name); err != nil {
+		return nil, err
+	}
+	if dirID == "" {
+		dirID = consts.RootDirID
+	}
+
+	now := time.Now()
+	doc := &FileDoc{
+		Type:    consts.FileType,
+		DocName: name,
+		DirID:   dirID,
+
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		ByteSize:   src.ByteSize,
+		Mime:       src.Mime,
+		Class:      src.Class,
+		Executable: src.Executable,
+		Encrypted:  src.Encrypted,
+	}
+	doc.MD5Sum = make([]byte, len(src.MD5Sum))
+	copy(doc.MD5Sum, src.MD5Sum)
+
+	if keepMetadata {
+		cloned := src.Clone().(*FileDoc)
+		doc.CreatedAt = src.CreatedAt
+		doc.UpdatedAt = src.UpdatedAt
+		doc.Tags = cloned.Tags
+		doc.Metadata = cloned.Metadata
+	}
+	return doc, nil
+}
+
+// NewDirDocCopy returns the document for a copy of the src directory, with the
+// given name and parent directory. The tags and dates are only kept if
+// keepMetadata is true.
+func NewDirDocCopy(src, parent *DirDoc, name string, keepMetadata bool) (*DirDoc, error) {
+	if parent.Fullpath == src.Fullpath || strings.HasPrefix(parent.Fullpath, src.Fullpath+"/") {
+		return nil, ErrForbiddenDocCopy
+	}
+	var tags []string
+	if keepMetadata {
+		tags = src.Tags
+	}
+	doc, err := NewDirDocWithParent(name, parent, tags)
+	if err != nil {
+		return nil, err
+	}
+	if keepMetadata {
+		doc.CreatedAt = src.CreatedAt
+		doc.UpdatedAt = src.UpdatedAt
+	}
+	return doc, nil
+}
+
+// CopyDirContent copies recursively the content of the src directory inside
+// the dst directory, that must have already been created. The files are
+// copied inside the storage, and their cozyMetadata are the same as the dst
+// directory.
+func CopyDirContent(fs VFS, src, dst *DirDoc, keepMetadata bool) error {
+	iter := fs.DirIterator(src, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == ErrIteratorDone {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if f != nil {
+			newdoc, err := NewFileDocCopy(f, dst.DocID, f.DocName, keepMetadata)
+			if err != nil {
+				return err
+			}
+			if dst.CozyMetadata != nil {
+				newdoc.CozyMetadata = dst.CozyMetadata.Clone()
+			}
+			if err = fs.CopyFile(f, newdoc); err != nil {
+				return err
+			}
+			continue
+		}
+
+		newdir, err := NewDirDocCopy(d, dst, d.DocName, keepMetadata)
+		if err != nil {
+			return err
+		}
+		if dst.CozyMetadata != nil {
+			newdir.CozyMetadata = dst.CozyMetadata.Clone()
+		}
+		if err = fs.CreateDir(newdir); err != nil {
+			return err
+		}
+		if err = CopyDirContent(fs, d, newdir, keepMetadata); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package vfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createFileWithContent(t *testing.T, dirID, name string, content []byte) *vfs.FileDoc {
+	doc, err := vfs.NewFileDoc(name, dirID, int64(len(content)), nil,
+		"application/octet-stream", "binary", time.Now(), false, false, false, []string{"foo"})
+	require.NoError(t, err)
+	f, err := fs.CreateFile(doc, nil)
+	require.NoError(t, err)
+	_, err = f.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return doc
+}
+
+func TestCopyName(t *testing.T) {
+	assert.Equal(t, "foo (copy).txt", vfs.CopyName("foo.txt", true))
+	assert.Equal(t, "foo.tar (copy).gz", vfs.CopyName("foo.tar.gz", true))
+	assert.Equal(t, "foo (copy)", vfs.CopyName("foo", true))
+	assert.Equal(t, ".bashrc (copy)", vfs.CopyName(".bashrc", true))
+	assert.Equal(t, "foo.d (copy)", vfs.CopyName("foo.d", false))
+}
+
+func TestCopyDirContent(t *testing.T) {
+	src, err := createTree(H{
+		"copysrc/": H{
+			"a/": H{
+				"aa/": H{
+					"aaa.txt": nil,
+				},
+				"ab.txt": nil,
+			},
+			"b/":    H{},
+			"c.txt": nil,
+		},
+	}, consts.RootDirID)
+	require.NoError(t, err)
+	createFileWithContent(t, src.ID(), "d.bin", []byte("content of d"))
+
+	dst, err := vfs.NewDirDocCopy(src, src, "copydst", false)
+	assert.Equal(t, vfs.ErrForbiddenDocCopy, err)
+	assert.Nil(t, dst)
+
+	root, err := fs.DirByID(consts.RootDirID)
+	require.NoError(t, err)
+	dst, err = vfs.NewDirDocCopy(src, root, "copydst", false)
+	require.NoError(t, err)
+	require.NoError(t, fs.CreateDir(dst))
+	require.NoError(t, vfs.CopyDirContent(fs, src, dst, false))
+
+	tree, err := fetchTree("/copydst")
+	require.NoError(t, err)
+	assert.EqualValues(t, H{
+		"copydst/": H{
+			"a/": H{
+				"aa/": H{
+					"aaa.txt": nil,
+				},
+				"ab.txt": nil,
+			},
+			"b/":    H{},
+			"c.txt": nil,
+			"d.bin": nil,
+		},
+	}, tree)
+
+	// The copies are new documents, with the same content but without the
+	// tags of the original files
+	orig, err := fs.FileByPath("/copysrc/d.bin")
+	require.NoError(t, err)
+	copied, err := fs.FileByPath("/copydst/d.bin")
+	require.NoError(t, err)
+	assert.NotEqual(t, orig.ID(), copied.ID())
+	assert.Equal(t, orig.MD5Sum, copied.MD5Sum)
+	assert.Equal(t, orig.ByteSize, copied.ByteSize)
+	assert.Empty(t, copied.Tags)
+	f, err := fs.OpenFile(copied)
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, "content of d", string(buf))
+
+	// With keepMetadata, the tags are kept
+	kept, err := vfs.NewDirDocCopy(src, root, "copykept", true)
+	require.NoError(t, err)
+	require.NoError(t, fs.CreateDir(kept))
+	require.NoError(t, vfs.CopyDirContent(fs, src, kept, true))
+	copied, err = fs.FileByPath("/copykept/d.bin")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, copied.Tags)
+
+	// The original directory has not been modified
+	tree, err = fetchTree("/copysrc")
+	require.NoError(t, err)
+	assert.Len(t, tree["copysrc/"], 4)
+
+	for _, name := range []string{"/copysrc", "/copydst", "/copykept"} {
+		dir, err := fs.DirByPath(name)
+		require.NoError(t, err)
+		assert.NoError(t, fs.DestroyDirAndContent(dir, fs.EnsureErased))
+	}
+}
+
+func TestCopyDirContentConflict(t *testing.T) {
+	src, err := createTree(H{
+		"conflictsrc/": H{
+			"sub/":    H{},
+			"one.txt": nil,
+			"two.txt": nil,
+		},
+	}, consts.RootDirID)
+	require.NoError(t, err)
+	dst, err := createTree(H{
+		"conflictdst/": H{
+			"two.txt": nil,
+		},
+	}, consts.RootDirID)
+	require.NoError(t, err)
+
+	// A file that already exists in the destination is not overwritten, and
+	// the copy is stopped
+	err = vfs.CopyDirContent(fs, src, dst, false)
+	assert.True(t, os.IsExist(err), err)
+	two, err := fs.FileByPath("/conflictdst/two.txt")
+	require.NoError(t, err)
+	orig, err := fs.FileByPath("/conflictsrc/two.txt")
+	require.NoError(t, err)
+	assert.NotEqual(t, orig.ID(), two.ID())
+
+	for _, dir := range []*vfs.DirDoc{src, dst} {
+		assert.NoError(t, fs.DestroyDirAndContent(dir, fs.EnsureErased))
+	}
+}
+
+func TestCopyDirContentQuota(t *testing.T) {
+	src, err := createTree(H{"quotasrc/": H{}}, consts.RootDirID)
+	require.NoError(t, err)
+	content := make([]byte, 600)
+	createFileWithContent(t, src.ID(), "one.bin", content)
+	createFileWithContent(t, src.ID(), "two.bin", content)
+	dst, err := createTree(H{"quotadst/": H{}}, consts.RootDirID)
+	require.NoError(t, err)
+
+	// The quota is exceeded in the middle of the copy: the first file is
+	// copied, but not the second one
+	usage, err := fs.DiskUsage()
+	require.NoError(t, err)
+	diskQuota = usage + 1000
+	defer func() { diskQuota = 0 }()
+
+	err = vfs.CopyDirContent(fs, src, dst, false)
+	assert.Equal(t, vfs.ErrFileTooBig, err)
+	tree, err := fetchTree("/quotadst")
+	require.NoError(t, err)
+	assert.Len(t, tree["quotadst/"], 1)
+	usage2, err := fs.DiskUsage()
+	require.NoError(t, err)
+	assert.Equal(t, usage+600, usage2)
+
+	diskQuota = 0
+	for _, dir := range []*vfs.DirDoc{src, dst} {
+		assert.NoError(t, fs.DestroyDirAndContent(dir, fs.EnsureErased))
+	}
+}
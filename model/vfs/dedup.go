@@ -0,0 +1,353 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// When the deduplication is enabled, the content of a file is stored in a
+// blob addressed by its SHA-256 checksum, and the files and the old versions
+// with the same content share the same blob. The internal ID of such a
+// content is made of a random part, that keeps the identifiers of the
+// versions unique, followed by the checksum of the blob. A reference count is
+// kept for each blob by the indexer, and the blob is removed when it is no
+// longer referenced.
+//
+// The deduplication is a layer between the VFS and the storage: the Blobs
+// struct keeps the reference counts, and the backends (afero, Swift and S3)
+// only implement the BlobStorage interface.
+
+const blobSeparator = "-"
+
+// BlobInternalID returns the internal ID for a content stored in the blob
+// with the given hex-encoded SHA-256 checksum.
+func BlobInternalID(random, hash string) string {
+	return random + blobSeparator + hash
+}
+
+// BlobOf returns the hex-encoded checksum of the blob used for the content
+// with the given internal ID, or an empty string if this content is not
+// deduplicated.
+func BlobOf(internalID string) string {
+	idx := strings.LastIndex(internalID, blobSeparator)
+	if idx < 0 || len(internalID)-idx-1 != 2*sha256.Size {
+		return ""
+	}
+	return internalID[idx+1:]
+}
+
+// NewBlobHash returns the hash used to address the blobs.
+func NewBlobHash() hash.Hash {
+	return sha256.New()
+}
+
+// BlobHash returns the hex-encoded checksum of a hash returned by NewBlobHash.
+func BlobHash(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// BlobRef is the document used for counting the references to a blob, ie the
+// number of files and versions that use it as content.
+type BlobRef struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+	Refs   int    `json:"refs"`
+	Size   int64  `json:"size,string"`
+
+	// Encrypted is true if the content of the blob is encrypted at rest. The
+	// files and versions that use the blob follow it, whatever the state of
+	// the encryption was when their content has been written.
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// ID returns the blob reference identifier
+func (b *BlobRef) ID() string { return b.DocID }
+
+// Rev returns the blob reference revision
+func (b *BlobRef) Rev() string { return b.DocRev }
+
+// DocType returns the blob reference document type
+func (b *BlobRef) DocType() string { return consts.FilesBlobs }
+
+// Clone implements couchdb.Doc
+func (b *BlobRef) Clone() couchdb.Doc {
+	cloned := *b
+	return &cloned
+}
+
+// SetID changes the blob reference qualified identifier
+func (b *BlobRef) SetID(id string) { b.DocID = id }
+
+// SetRev changes the blob reference revision
+func (b *BlobRef) SetRev(rev string) { b.DocRev = rev }
+
+// BlobStorage is implemented by the backends to store the blobs. A location
+// is the name of an object, or the path of a file, where the backend has
+// written a content.
+type BlobStorage interface {
+	// BlobExists returns true if the content of the blob is stored.
+	BlobExists(hash string) (bool, error)
+	// CreateBlob makes the content written at the location the content of a
+	// new blob.
+	CreateBlob(location, hash string) error
+	// UseBlob replaces the content written at the location by the blob,
+	// which is already stored.
+	UseBlob(location, hash string) error
+	// DeleteBlob removes the content of a blob that is no longer referenced.
+	DeleteBlob(hash string) error
+}
+
+// Blobs is the layer of the VFS that deduplicates the contents. It is the
+// same for all the backends: the reference counts are kept by the indexer,
+// and the backends only have to store the blobs. The lock serializes the
+// changes of the reference counts with the operations on the blobs.
+type Blobs struct {
+	index   Indexer
+	storage BlobStorage
+	mu      lock.ErrorLocker
+}
+
+// NewBlobs returns the deduplication layer for the given indexer and
+// storage.
+func NewBlobs(index Indexer, storage BlobStorage, mu lock.ErrorLocker) *Blobs {
+	return &Blobs{index: index, storage: storage, mu: mu}
+}
+
+// Store adds a reference to the blob for a content that has been written at
+// the given location, encrypted or not. If the blob was not known, this
+// content becomes the content of the blob. Else, it is replaced by the blob.
+// It returns true if the content at the location is now encrypted, which is
+// not the case when it has been replaced by a blob written in clear before
+// the encryption was enabled.
+func (b *Blobs) Store(location, hash string, size int64, encrypted bool) (bool, error) {
+	if lockerr := b.mu.Lock(); lockerr != nil {
+		return false, lockerr
+	}
+	defer b.mu.Unlock()
+
+	ref, err := b.index.AddBlobRef(hash, size, encrypted)
+	if err != nil {
+		return false, err
+	}
+	existed := ref.Refs > 1
+	if existed {
+		// Be safe if the reference count is not in sync with the storage
+		existed, err = b.storage.BlobExists(hash)
+		if err != nil {
+			_, _ = b.index.RemoveBlobRef(hash)
+			return false, err
+		}
+	}
+	if existed {
+		err = b.storage.UseBlob(location, hash)
+	} else {
+		err = b.storage.CreateBlob(location, hash)
+		if err == nil && ref.Encrypted != encrypted {
+			err = b.index.SetBlobEncrypted(hash, encrypted)
+		}
+		ref.Encrypted = encrypted
+	}
+	if err != nil {
+		_, _ = b.index.RemoveBlobRef(hash)
+		return false, err
+	}
+	return ref.Encrypted, nil
+}
+
+// AddRef adds a reference to a blob that is already stored.
+func (b *Blobs) AddRef(hash string, size int64, encrypted bool) error {
+	if lockerr := b.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer b.mu.Unlock()
+	_, err := b.index.AddBlobRef(hash, size, encrypted)
+	return err
+}
+
+// ContentEncrypted returns true if the content is encrypted, where hash is
+// the checksum of its blob (empty if not deduplicated), and encrypted is the
+// EncryptedAtRest field of its file or version. A deduplicated content may
+// have been encrypted again via another file that shares its blob, and it is
+// the blob that tells.
+func (b *Blobs) ContentEncrypted(hash string, encrypted bool) (bool, error) {
+	if hash == "" {
+		return encrypted, nil
+	}
+	ref, err := b.index.GetBlobRef(hash)
+	if err != nil {
+		return false, err
+	}
+	return ref.Encrypted, nil
+}
+
+// MarkEncrypted records that the content of the blob has been encrypted.
+func (b *Blobs) MarkEncrypted(hash string) error {
+	if lockerr := b.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer b.mu.Unlock()
+	return b.index.SetBlobEncrypted(hash, true)
+}
+
+// Release removes a reference to each of the given blobs, and deletes the
+// blobs that are no longer referenced.
+func (b *Blobs) Release(hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	if lockerr := b.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer b.mu.Unlock()
+
+	var errm error
+	for _, hash := range hashes {
+		last, err := b.index.RemoveBlobRef(hash)
+		if err == nil && last {
+			err = b.storage.DeleteBlob(hash)
+		}
+		if err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+	return errm
+}
+
+// BlobsOfVersions returns the checksums of the blobs used by the given
+// versions.
+func BlobsOfVersions(versions []*Version) []string {
+	var hashes []string
+	for _, v := range versions {
+		if hash := BlobOf(v.DocID); hash != "" {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+func (c *couchdbIndexer) AddBlobRef(hash string, size int64, encrypted bool) (*BlobRef, error) {
+	ref := &BlobRef{}
+	err := couchdb.GetDoc(c.db, consts.FilesBlobs, hash, ref)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		ref = &BlobRef{DocID: hash, Refs: 1, Size: size, Encrypted: encrypted}
+		return ref, couchdb.CreateNamedDocWithDB(c.db, ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ref.Refs++
+	return ref, couchdb.UpdateDoc(c.db, ref)
+}
+
+func (c *couchdbIndexer) GetBlobRef(hash string) (*BlobRef, error) {
+	ref := &BlobRef{}
+	if err := couchdb.GetDoc(c.db, consts.FilesBlobs, hash, ref); err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+func (c *couchdbIndexer) SetBlobEncrypted(hash string, encrypted bool) error {
+	ref, err := c.GetBlobRef(hash)
+	if err != nil {
+		return err
+	}
+	if ref.Encrypted == encrypted {
+		return nil
+	}
+	ref.Encrypted = encrypted
+	return couchdb.UpdateDoc(c.db, ref)
+}
+
+func (c *couchdbIndexer) RemoveBlobRef(hash string) (bool, error) {
+	ref := &BlobRef{}
+	err := couchdb.GetDoc(c.db, consts.FilesBlobs, hash, ref)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	ref.Refs--
+	if ref.Refs > 0 {
+		return false, couchdb.UpdateDoc(c.db, ref)
+	}
+	return true, couchdb.DeleteDoc(c.db, ref)
+}
+
+func (c *couchdbIndexer) BlobsSavedSpace() (int64, error) {
+	var doc couchdb.ViewResponse
+	req := &couchdb.ViewRequest{Reduce: true}
+	err := couchdb.ExecView(c.db, couchdb.BlobsSavedSpaceView, req, &doc)
+	if couchdb.IsNoDatabaseError(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(doc.Rows) == 0 {
+		return 0, nil
+	}
+	// Reduce of _sum should give us a number value
+	saved, ok := doc.Rows[0].Value.(float64)
+	if !ok {
+		return 0, ErrWrongCouchdbState
+	}
+	return int64(saved), nil
+}
+
+// PhysicalUsage returns the number of bytes really used on the storage by the
+// files and their old versions, where a blob shared by several of them is
+// counted only once.
+func PhysicalUsage(index Indexer) (int64, error) {
+	used, err := index.DiskUsage()
+	if err != nil {
+		return 0, err
+	}
+	saved, err := index.BlobsSavedSpace()
+	if err != nil {
+		return 0, err
+	}
+	return used - saved, nil
+}
+
+// Deduplicator is implemented by the VFS that can store only once a content
+// shared by several files. The DiskUsage method still returns the logical
+// usage, and it is this usage that is compared to the quota, while
+// PhysicalDiskUsage counts only once the blobs shared by several files.
+type Deduplicator interface {
+	// Deduplicates returns true if the deduplication is enabled for the
+	// instance of this VFS.
+	Deduplicates() bool
+	PhysicalDiskUsage() (int64, error)
+}
+
+// DeduplicatorOf returns the Deduplicator of the given VFS, if the
+// deduplication is enabled for it.
+func DeduplicatorOf(fs VFS) (Deduplicator, bool) {
+	dedup, ok := fs.(Deduplicator)
+	if !ok || !dedup.Deduplicates() {
+		return nil, false
+	}
+	return dedup, true
+}
+
+// IsDeduplicationEnabled returns true if the contents of the instances in the
+// given context must be deduplicated. It can be enabled in the configuration
+// for all the instances, and overridden for a context.
+func IsDeduplicationEnabled(contextName string) bool {
+	cfg := config.GetConfig()
+	context, _ := cfg.Fs.Contexts[contextName].(map[string]interface{})
+	if enabled, ok := context["deduplication"].(bool); ok {
+		return enabled
+	}
+	return cfg.Fs.Deduplication
+}
@@ -0,0 +1,646 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+)
+
+// The content of the files (and of their old versions) can be encrypted at
+// rest, with keys specific to the instance (see Keyring). The format allows
+// random accesses: the content is split in segments of 64KiB, and each
+// segment is sealed with AES-256-GCM. An encrypted content starts with a
+// header made of:
+//
+//   - the magic string "COZYENC" followed by a version byte
+//   - the identifier of the key of the instance (uint32, big endian)
+//   - a random salt of 16 bytes.
+//
+// The key for the segments is derived from the key of the instance and the
+// salt with HMAC-SHA256. The nonce of a segment is its index (uint64, big
+// endian), followed by a flag for the last segment: it prevents reordering
+// and truncation of the segments. The header is authenticated as additional
+// data of each segment.
+//
+// The content written before the encryption has been enabled for an instance
+// has no header, and is still readable. The VFS records in the FileDoc and in
+// the Version if their content is encrypted (EncryptedAtRest), and it is this
+// field that tells if the content must be decrypted: a plain content that
+// starts with the magic string is not mistaken for an encrypted one, and the
+// magic string is only checked for consistency.
+const (
+	encryptionMagic       = "COZYENC\x01"
+	encryptionSaltLen     = 16
+	encryptionHeaderLen   = len(encryptionMagic) + 4 + encryptionSaltLen
+	encryptionSegmentSize = 64 << 10
+	encryptionTagSize     = 16
+	encryptionSealedSize  = encryptionSegmentSize + encryptionTagSize
+)
+
+// Keyring gives the keys used to encrypt the content of the files of an
+// instance. The keys are identified by a number, written in the header of the
+// encrypted content, so that a content can still be read after a rotation.
+type Keyring interface {
+	// CurrentFilesKey returns the identifier and the value of the key to use
+	// for encrypting new content.
+	CurrentFilesKey() (uint32, []byte, error)
+	// FilesKey returns the value of the key with the given identifier.
+	FilesKey(id uint32) ([]byte, error)
+}
+
+// Reencrypter is implemented by the VFS that can replace the content of a
+// file by the same content encrypted with the current key of the instance.
+type Reencrypter interface {
+	// ReencryptContent encrypts again the content of a file, or the content
+	// of one of its old versions if version is not nil. It returns false if
+	// the content was already encrypted with the current key. The
+	// EncryptedAtRest field of the document is set when the content is
+	// encrypted, and it is up to the caller to save it.
+	ReencryptContent(doc *FileDoc, version *Version) (bool, error)
+}
+
+// EncryptedSize returns the size of the encrypted content for a plain content
+// of the given size.
+func EncryptedSize(size int64) int64 {
+	segments := size / encryptionSegmentSize
+	if size == 0 || size%encryptionSegmentSize != 0 {
+		segments++
+	}
+	return int64(encryptionHeaderLen) + size + segments*encryptionTagSize
+}
+
+func plainSize(encrypted int64) (int64, error) {
+	body := encrypted - int64(encryptionHeaderLen)
+	if body < encryptionTagSize {
+		return 0, ErrInvalidEncryptedContent
+	}
+	segments := body / encryptionSealedSize
+	if rest := body % encryptionSealedSize; rest != 0 {
+		if rest < encryptionTagSize {
+			return 0, ErrInvalidEncryptedContent
+		}
+		segments++
+	}
+	return body - segments*encryptionTagSize, nil
+}
+
+func segmentCipher(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(nonce []byte, index int64, last bool) []byte {
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	nonce[8], nonce[9], nonce[10], nonce[11] = 0, 0, 0, 0
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// EncryptedWriter encrypts the data written to it before passing it to the
+// underlying writer. It also computes the size and the MD5 checksum of the
+// plain content. The Close method must be called to write the last segment,
+// but it does not close the underlying writer.
+type EncryptedWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	buf     []byte
+	sealed  []byte
+	index   int64
+	written int64
+	hash    hash.Hash
+	started bool
+	closed  bool
+	err     error
+}
+
+// NewEncryptedWriter returns a writer that encrypts the content with the
+// current key of the keyring.
+func NewEncryptedWriter(w io.Writer, keys Keyring) (*EncryptedWriter, error) {
+	id, key, err := keys.CurrentFilesKey()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptionHeaderLen)
+	copy(header, encryptionMagic)
+	binary.BigEndian.PutUint32(header[len(encryptionMagic):], id)
+	salt := header[len(encryptionMagic)+4:]
+	if _, err := io.ReadFull(cryptorand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := segmentCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		nonce:  make([]byte, aead.NonceSize()),
+		buf:    make([]byte, 0, encryptionSegmentSize),
+		sealed: make([]byte, 0, encryptionSealedSize),
+		hash:   md5.New(),
+	}, nil
+}
+
+// Write implements the io.Writer interface.
+func (e *EncryptedWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	if e.closed {
+		return 0, os.ErrClosed
+	}
+	n := 0
+	for len(p) > 0 {
+		// A full segment is sealed only when we know that it is not the last
+		// one.
+		if len(e.buf) == encryptionSegmentSize {
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(e.buf[len(e.buf):encryptionSegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+k]
+		_, _ = e.hash.Write(p[:k])
+		e.written += int64(k)
+		n += k
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// Close writes the last segment.
+func (e *EncryptedWriter) Close() error {
+	if e.closed {
+		return e.err
+	}
+	e.closed = true
+	if e.err != nil {
+		return e.err
+	}
+	return e.flush(true)
+}
+
+// Written returns the number of bytes of plain content written.
+func (e *EncryptedWriter) Written() int64 {
+	return e.written
+}
+
+// MD5Sum returns the MD5 checksum of the plain content written.
+func (e *EncryptedWriter) MD5Sum() []byte {
+	return e.hash.Sum(nil)
+}
+
+func (e *EncryptedWriter) flush(last bool) error {
+	if !e.started {
+		e.started = true
+		if _, err := e.w.Write(e.header); err != nil {
+			e.err = err
+			return err
+		}
+	}
+	nonce := segmentNonce(e.nonce, e.index, last)
+	e.sealed = e.aead.Seal(e.sealed[:0], nonce, e.buf, e.header)
+	e.buf = e.buf[:0]
+	e.index++
+	if _, err := e.w.Write(e.sealed); err != nil {
+		e.err = err
+		return err
+	}
+	return nil
+}
+
+type encryptedWriteCloser struct {
+	*EncryptedWriter
+	closer io.Closer
+}
+
+func (e *encryptedWriteCloser) Close() error {
+	err := e.EncryptedWriter.Close()
+	if errc := e.closer.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+// EncryptWriteCloser returns a writer that encrypts the content with the
+// current key of the keyring, and closes w when it is closed. If keys is nil,
+// w is returned as is.
+func EncryptWriteCloser(w io.WriteCloser, keys Keyring) (io.WriteCloser, error) {
+	if keys == nil {
+		return w, nil
+	}
+	e, err := NewEncryptedWriter(w, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedWriteCloser{EncryptedWriter: e, closer: w}, nil
+}
+
+// decryptedFile is a File for reading the plain content of an encrypted
+// content. The underlying reader must implement io.Seeker for seeking, and
+// io.ReaderAt for ReadAt.
+type decryptedFile struct {
+	r        io.Reader
+	closer   io.Closer
+	aead     cipher.AEAD
+	header   []byte
+	nonce    []byte
+	pos      int64 // position in the plain content
+	rpos     int64 // position in the encrypted content
+	size     int64 // size of the plain content, -1 if not known yet
+	seg      []byte
+	segIndex int64
+	segLast  bool
+	sealed   []byte
+}
+
+// readHeader reads the header of an encrypted content. It returns
+// ErrInvalidEncryptedContent if the content has no header.
+func readHeader(r io.Reader, keys Keyring) (*decryptedFile, error) {
+	if keys == nil {
+		return nil, ErrMissingFilesKey
+	}
+	header := make([]byte, encryptionHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalidEncryptedContent
+		}
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(encryptionMagic)) {
+		return nil, ErrInvalidEncryptedContent
+	}
+	id := binary.BigEndian.Uint32(header[len(encryptionMagic):])
+	key, err := keys.FilesKey(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := segmentCipher(key, header[len(encryptionMagic)+4:])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptedFile{
+		r:        r,
+		aead:     aead,
+		header:   header,
+		nonce:    make([]byte, aead.NonceSize()),
+		rpos:     int64(encryptionHeaderLen),
+		size:     -1,
+		segIndex: -1,
+		sealed:   make([]byte, encryptionSealedSize),
+	}, nil
+}
+
+// DecryptFile returns a File for reading the plain content of f. If the
+// content is not encrypted, f is returned as is. f is closed if an error
+// occurs.
+func DecryptFile(f File, keys Keyring, encrypted bool) (File, error) {
+	if !encrypted {
+		return f, nil
+	}
+	d, err := readHeader(f, keys)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	d.closer = f
+	return d, nil
+}
+
+// DecryptReader is like DecryptFile, but for a reader that can only be read
+// sequentially.
+func DecryptReader(r io.ReadCloser, keys Keyring, encrypted bool) (io.ReadCloser, error) {
+	if !encrypted {
+		return r, nil
+	}
+	d, err := readHeader(r, keys)
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	d.closer = r
+	return d, nil
+}
+
+// PlainChecksum reads the content from r, and returns the MD5 checksum and
+// the size of the plain content. It is used by fsck for the contents that
+// are encrypted.
+func PlainChecksum(r io.Reader, keys Keyring, encrypted bool) ([]byte, int64, error) {
+	if encrypted {
+		d, err := readHeader(r, keys)
+		if err != nil {
+			return nil, 0, err
+		}
+		r = d
+	}
+	h := md5.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h.Sum(nil), n, nil
+}
+
+// ReencryptionNeeded reads the header of the content from r, and tells if the
+// content must be encrypted again with the current key. The returned reader
+// gives the whole content, including the header.
+func ReencryptionNeeded(r io.Reader, keys Keyring, encrypted bool) (bool, io.Reader, error) {
+	if !encrypted {
+		return true, r, nil
+	}
+	header := make([]byte, encryptionHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil, ErrInvalidEncryptedContent
+		}
+		return false, nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(encryptionMagic)) {
+		return false, nil, ErrInvalidEncryptedContent
+	}
+	r = io.MultiReader(bytes.NewReader(header), r)
+	current, _, err := keys.CurrentFilesKey()
+	if err != nil {
+		return false, nil, err
+	}
+	id := binary.BigEndian.Uint32(header[len(encryptionMagic):])
+	return id != current, r, nil
+}
+
+// Reencrypt reads the content from r, decrypts it if needed, and writes it to
+// w encrypted with the current key. It returns the MD5 checksum of the plain
+// content, that the caller should check before replacing the old content.
+func Reencrypt(w io.Writer, r io.Reader, keys Keyring, encrypted bool) ([]byte, error) {
+	if encrypted {
+		d, err := readHeader(r, keys)
+		if err != nil {
+			return nil, err
+		}
+		r = d
+	}
+	e, err := NewEncryptedWriter(w, keys)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(e, r); err != nil {
+		return nil, err
+	}
+	if err = e.Close(); err != nil {
+		return nil, err
+	}
+	return e.MD5Sum(), nil
+}
+
+// ReencryptContents encrypts again the content of all the files and of their
+// old versions with the current key of the instance. It returns the number of
+// contents that have been rewritten. The contents that are missing or that do
+// not match their checksum in the index are skipped (they are reported by
+// fsck).
+func ReencryptContents(fs VFS) (int, error) {
+	re, ok := fs.(Reencrypter)
+	if !ok {
+		return 0, ErrEncryptionNotSupported
+	}
+	log := logger.WithDomain(fs.DomainName()).WithNamespace("vfs")
+	count := 0
+	reencrypt := func(doc *FileDoc, version *Version) error {
+		olddoc := doc.Clone().(*FileDoc)
+		wasEncrypted := doc.EncryptedAtRest
+		if version != nil {
+			wasEncrypted = version.EncryptedAtRest
+		}
+		done, err := re.ReencryptContent(doc, version)
+		if err == ErrInvalidHash || os.IsNotExist(err) {
+			log.Warnf("Cannot reencrypt the content of %s: %s", doc.ID(), err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if done {
+			count++
+		}
+		// A deduplicated content can have been encrypted via another file
+		// that shares its blob: the flag is saved even if done is false.
+		if version != nil && version.EncryptedAtRest && !wasEncrypted {
+			return couchdb.UpdateDoc(fs, version)
+		}
+		if version == nil && doc.EncryptedAtRest && !wasEncrypted {
+			return fs.UpdateFileDoc(olddoc, doc)
+		}
+		return nil
+	}
+
+	err := couchdb.ForeachDocs(fs, consts.Files, func(_ string, data json.RawMessage) error {
+		doc := &FileDoc{}
+		if err := json.Unmarshal(data, doc); err != nil {
+			return err
+		}
+		if doc.Type != consts.FileType {
+			return nil
+		}
+		return reencrypt(doc, nil)
+	})
+	if err != nil {
+		return count, err
+	}
+	err = couchdb.ForeachDocs(fs, consts.FilesVersions, func(_ string, data json.RawMessage) error {
+		v := &Version{}
+		if err := json.Unmarshal(data, v); err != nil {
+			return err
+		}
+		doc, err := fs.FileByID(v.Rels.File.Data.ID)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return reencrypt(doc, v)
+	})
+	if couchdb.IsNoDatabaseError(err) {
+		err = nil
+	}
+	return count, err
+}
+
+func (d *decryptedFile) openSegment(dst, sealed []byte, index int64, partial bool) ([]byte, bool, error) {
+	if !partial {
+		nonce := segmentNonce(d.nonce, index, false)
+		if plain, err := d.aead.Open(dst, nonce, sealed, d.header); err == nil {
+			return plain, false, nil
+		}
+	}
+	nonce := segmentNonce(d.nonce, index, true)
+	plain, err := d.aead.Open(dst, nonce, sealed, d.header)
+	if err != nil {
+		return nil, false, ErrInvalidEncryptedContent
+	}
+	return plain, true, nil
+}
+
+func (d *decryptedFile) load(index int64) error {
+	start := int64(encryptionHeaderLen) + index*encryptionSealedSize
+	if d.rpos != start {
+		seeker, ok := d.r.(io.Seeker)
+		if !ok {
+			return os.ErrInvalid
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		d.rpos = start
+	}
+	n, err := io.ReadFull(d.r, d.sealed)
+	d.rpos += int64(n)
+	if err == io.EOF {
+		// Either we are past the end, or the content has been truncated
+		if index == 0 || (d.segIndex == index-1 && !d.segLast) {
+			return ErrInvalidEncryptedContent
+		}
+		return io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	seg, last, err := d.openSegment(d.seg[:0], d.sealed[:n], index, n < len(d.sealed))
+	if err != nil {
+		return err
+	}
+	d.seg, d.segIndex, d.segLast = seg, index, last
+	if last {
+		d.size = index*encryptionSegmentSize + int64(len(seg))
+	}
+	return nil
+}
+
+func (d *decryptedFile) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if d.size >= 0 && d.pos >= d.size {
+		return 0, io.EOF
+	}
+	index := d.pos / encryptionSegmentSize
+	if index != d.segIndex {
+		if err := d.load(index); err != nil {
+			return 0, err
+		}
+	}
+	off := d.pos - index*encryptionSegmentSize
+	if off >= int64(len(d.seg)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.seg[off:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	ra, ok := d.r.(io.ReaderAt)
+	if !ok || off < 0 {
+		return 0, os.ErrInvalid
+	}
+	sealed := make([]byte, encryptionSealedSize)
+	var plain []byte
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		index := pos / encryptionSegmentSize
+		start := int64(encryptionHeaderLen) + index*encryptionSealedSize
+		m, err := ra.ReadAt(sealed, start)
+		if m == 0 {
+			if err == nil || err == io.EOF {
+				err = io.EOF
+			}
+			return n, err
+		}
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		var last bool
+		plain, last, err = d.openSegment(plain[:0], sealed[:m], index, m < len(sealed))
+		if err != nil {
+			return n, err
+		}
+		o := pos - index*encryptionSegmentSize
+		if o >= int64(len(plain)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], plain[o:])
+		if last && n < len(p) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+func (d *decryptedFile) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = d.pos + offset
+	case io.SeekEnd:
+		if d.size < 0 {
+			seeker, ok := d.r.(io.Seeker)
+			if !ok {
+				return 0, os.ErrInvalid
+			}
+			end, err := seeker.Seek(0, io.SeekEnd)
+			if err != nil {
+				return 0, err
+			}
+			d.rpos = end
+			if d.size, err = plainSize(end); err != nil {
+				d.size = -1
+				return 0, err
+			}
+		}
+		abs = d.size + offset
+	default:
+		return 0, os.ErrInvalid
+	}
+	if abs < 0 {
+		return 0, os.ErrInvalid
+	}
+	d.pos = abs
+	return abs, nil
+}
+
+func (d *decryptedFile) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *decryptedFile) Close() error {
+	if d.closer == nil {
+		return nil
+	}
+	return d.closer.Close()
+}
+
+var _ File = &decryptedFile{}
@@ -0,0 +1,201 @@
+package vfs_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testKeyring struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+func newTestKeyring() *testKeyring {
+	kr := &testKeyring{keys: make(map[uint32][]byte)}
+	kr.rotate()
+	return kr
+}
+
+func (kr *testKeyring) rotate() {
+	kr.current++
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	kr.keys[kr.current] = key
+}
+
+func (kr *testKeyring) CurrentFilesKey() (uint32, []byte, error) {
+	return kr.current, kr.keys[kr.current], nil
+}
+
+func (kr *testKeyring) FilesKey(id uint32) ([]byte, error) {
+	key, ok := kr.keys[id]
+	if !ok {
+		return nil, vfs.ErrUnknownEncryptionKey
+	}
+	return key, nil
+}
+
+// memFile is a vfs.File for reading a content in memory
+type memFile struct {
+	*bytes.Reader
+}
+
+func (f memFile) Write(p []byte) (int, error) { return 0, errors.New("read-only") }
+func (f memFile) Close() error                { return nil }
+
+func encrypt(t *testing.T, keys vfs.Keyring, plain []byte) []byte {
+	buf := &bytes.Buffer{}
+	w, err := vfs.NewEncryptedWriter(buf, keys)
+	require.NoError(t, err)
+	// Write in small pieces to cross the segment boundaries
+	for p := plain; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		_, err = w.Write(p[:n])
+		require.NoError(t, err)
+		p = p[n:]
+	}
+	require.NoError(t, w.Close())
+	assert.EqualValues(t, len(plain), w.Written())
+	sum := md5.Sum(plain)
+	assert.Equal(t, sum[:], w.MD5Sum())
+	return buf.Bytes()
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	keys := newTestKeyring()
+	segment := 64 << 10
+	for _, size := range []int{0, 1, segment - 1, segment, segment + 1, 3*segment + 5} {
+		plain := make([]byte, size)
+		_, _ = rand.Read(plain)
+		sealed := encrypt(t, keys, plain)
+		assert.EqualValues(t, vfs.EncryptedSize(int64(size)), len(sealed))
+
+		f, err := vfs.DecryptFile(memFile{bytes.NewReader(sealed)}, keys, true)
+		require.NoError(t, err)
+		got, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(plain, got), "size %d", size)
+
+		end, err := f.Seek(0, io.SeekEnd)
+		require.NoError(t, err)
+		assert.EqualValues(t, size, end)
+
+		if size > 10 {
+			// Range reads, across the segments
+			off := int64(size / 2)
+			_, err = f.Seek(off, io.SeekStart)
+			require.NoError(t, err)
+			p := make([]byte, 10)
+			_, err = io.ReadFull(f, p)
+			require.NoError(t, err)
+			assert.Equal(t, plain[off:off+10], p)
+
+			p = make([]byte, size-7)
+			n, err := f.ReadAt(p, 7)
+			require.NoError(t, err)
+			assert.Equal(t, size-7, n)
+			assert.True(t, bytes.Equal(plain[7:], p))
+			n, err = f.ReadAt(make([]byte, 20), int64(size-10))
+			assert.Equal(t, io.EOF, err)
+			assert.Equal(t, 10, n)
+		}
+
+		sum, n, err := vfs.PlainChecksum(bytes.NewReader(sealed), keys, true)
+		require.NoError(t, err)
+		expected := md5.Sum(plain)
+		assert.Equal(t, expected[:], sum)
+		assert.EqualValues(t, size, n)
+	}
+}
+
+func TestEncryptionIntegrity(t *testing.T) {
+	keys := newTestKeyring()
+	plain := make([]byte, 2*(64<<10))
+	_, _ = rand.Read(plain)
+	sealed := encrypt(t, keys, plain)
+
+	// Altered content
+	altered := append([]byte{}, sealed...)
+	altered[len(altered)/2] ^= 1
+	f, err := vfs.DecryptFile(memFile{bytes.NewReader(altered)}, keys, true)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(f)
+	assert.Equal(t, vfs.ErrInvalidEncryptedContent, err)
+
+	// Truncated on a segment boundary
+	truncated := sealed[:vfs.EncryptedSize(64<<10)]
+	f, err = vfs.DecryptFile(memFile{bytes.NewReader(truncated)}, keys, true)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(f)
+	assert.Equal(t, vfs.ErrInvalidEncryptedContent, err)
+
+	// Unknown key
+	_, err = vfs.DecryptFile(memFile{bytes.NewReader(sealed)}, newTestKeyring(), true)
+	assert.NoError(t, err)
+	other := &testKeyring{keys: map[uint32][]byte{}}
+	_, err = vfs.DecryptFile(memFile{bytes.NewReader(sealed)}, other, true)
+	assert.Equal(t, vfs.ErrUnknownEncryptionKey, err)
+}
+
+func TestEncryptionClearContent(t *testing.T) {
+	keys := newTestKeyring()
+	plain := []byte("This content was written before the encryption was enabled")
+	f, err := vfs.DecryptFile(memFile{bytes.NewReader(plain)}, keys, false)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, plain, content)
+
+	// A clear content that looks like an encrypted one is read as is
+	lookalike := append([]byte("COZYENC\x01"), plain...)
+	f, err = vfs.DecryptFile(memFile{bytes.NewReader(lookalike)}, keys, false)
+	require.NoError(t, err)
+	content, err = ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, lookalike, content)
+
+	// And a content marked as encrypted must have the header
+	_, err = vfs.DecryptFile(memFile{bytes.NewReader(plain)}, keys, true)
+	assert.Equal(t, vfs.ErrInvalidEncryptedContent, err)
+	_, _, err = vfs.ReencryptionNeeded(bytes.NewReader(plain), keys, true)
+	assert.Equal(t, vfs.ErrInvalidEncryptedContent, err)
+
+	needed, r, err := vfs.ReencryptionNeeded(bytes.NewReader(plain), keys, false)
+	require.NoError(t, err)
+	assert.True(t, needed)
+	buf := &bytes.Buffer{}
+	sum, err := vfs.Reencrypt(buf, r, keys, false)
+	require.NoError(t, err)
+	expected := md5.Sum(plain)
+	assert.Equal(t, expected[:], sum)
+
+	// After a rotation, the content is encrypted with the new key
+	needed, _, err = vfs.ReencryptionNeeded(bytes.NewReader(buf.Bytes()), keys, true)
+	require.NoError(t, err)
+	assert.False(t, needed)
+	keys.rotate()
+	needed, r, err = vfs.ReencryptionNeeded(bytes.NewReader(buf.Bytes()), keys, true)
+	require.NoError(t, err)
+	assert.True(t, needed)
+	reencrypted := &bytes.Buffer{}
+	_, err = vfs.Reencrypt(reencrypted, r, keys, true)
+	require.NoError(t, err)
+	delete(keys.keys, 1)
+	got, err := vfs.DecryptReader(ioutil.NopCloser(reencrypted), keys, true)
+	require.NoError(t, err)
+	content, err = ioutil.ReadAll(got)
+	require.NoError(t, err)
+	assert.Equal(t, plain, content)
+}
@@ -9,6 +9,9 @@ var (
 	// ErrForbiddenDocMove is used when trying to move a document in an
 	// illicit destination
 	ErrForbiddenDocMove = errors.New("Forbidden document move")
+	// ErrForbiddenDocCopy is used when trying to copy a directory inside
+	// itself
+	ErrForbiddenDocCopy = errors.New("Forbidden document copy")
 	// ErrIllegalFilename is used when the given filename is not allowed
 	ErrIllegalFilename = errors.New("Invalid filename: empty or contains an illegal character")
 	// ErrIllegalPath is used when the path has too many levels
@@ -48,4 +51,31 @@ var (
 	ErrFsckFailFast = errors.New("FSCK has been stopped on first failure")
 	// ErrWrongToken is used when a key is not found on the store
 	ErrWrongToken = errors.New("Wrong download token")
+	// ErrChunkedUploadNotSupported is used when the storage backend does not
+	// support resumable uploads
+	ErrChunkedUploadNotSupported = errors.New("Resumable uploads are not supported")
+	// ErrChunkedUploadSwiftLayout is used for the resumable uploads on the
+	// older layouts of Swift (v1 and v2), that have no place for the chunks
+	ErrChunkedUploadSwiftLayout = errors.New("Resumable uploads are not supported by the Swift layouts v1 and v2")
+	// ErrUploadSessionNotFound is used when an upload session does not exist
+	// or has expired
+	ErrUploadSessionNotFound = errors.New("Upload session not found")
+	// ErrUploadOffsetMismatch is used when the offset of a chunk is not the
+	// number of bytes already received for the upload session
+	ErrUploadOffsetMismatch = errors.New("Upload offset does not match")
+	// ErrUploadNotCompleted is used when trying to commit an upload session
+	// before all the bytes have been received
+	ErrUploadNotCompleted = errors.New("Upload is not completed")
+	// ErrInvalidEncryptedContent is used when an encrypted content cannot be
+	// decrypted, because it has been altered or truncated
+	ErrInvalidEncryptedContent = errors.New("Invalid encrypted content")
+	// ErrMissingFilesKey is used when an encrypted content is read, but the
+	// encryption is no longer enabled for the instance
+	ErrMissingFilesKey = errors.New("Missing key for the encrypted content")
+	// ErrUnknownEncryptionKey is used when the key used to encrypt a content
+	// is not known
+	ErrUnknownEncryptionKey = errors.New("Unknown encryption key")
+	// ErrEncryptionNotSupported is used when the storage backend does not
+	// support the encryption at rest of the content of the files
+	ErrEncryptionNotSupported = errors.New("Encryption at rest is not supported")
 )
@@ -53,6 +53,11 @@ type FileDoc struct {
 	// Swift of a file.
 	InternalID string `json:"internal_vfs_id,omitempty"`
 
+	// EncryptedAtRest is true if the content is encrypted by the VFS with the
+	// keys of the instance. It is not the same as Encrypted, which is for the
+	// contents encrypted by the clients.
+	EncryptedAtRest bool `json:"encrypted_at_rest,omitempty"`
+
 	// Cache of the fullpath of the file. Should not have to be invalidated
 	// since we use FileDoc as immutable data-structures.
 	fullpath string
@@ -315,6 +320,7 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 	newdoc.ReferencedBy = olddoc.ReferencedBy
 	newdoc.CozyMetadata = olddoc.CozyMetadata
 	newdoc.InternalID = olddoc.InternalID
+	newdoc.EncryptedAtRest = olddoc.EncryptedAtRest
 
 	if err = fs.UpdateFileDoc(olddoc, newdoc); err != nil {
 		return nil, err
@@ -381,6 +387,21 @@ func RestoreFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 	return newdoc, err
 }
 
+// CreateFileWithoutConflict creates a new file, like fs.CreateFile, but adds
+// a suffix to its name if the directory already has a child with the same
+// name.
+func CreateFileWithoutConflict(fs VFS, newdoc *FileDoc) (File, error) {
+	var file File
+	err := tryOrUseSuffix(newdoc.DocName, conflictFormat, func(name string) error {
+		newdoc.DocName = name
+		newdoc.ResetFullpath()
+		var err error
+		file, err = fs.CreateFile(newdoc, nil)
+		return err
+	})
+	return file, err
+}
+
 func getFileMode(executable bool) os.FileMode {
 	if executable {
 		return 0755 // -rwxr-xr-x
@@ -0,0 +1,412 @@
+package vfs
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// UploadSessionTTL is the duration after which an upload session that has not
+// been committed is considered as abandoned.
+const UploadSessionTTL = 7 * 24 * time.Hour
+
+// ChunkedUploader is an interface that the VFS backends can implement to
+// support resumable uploads: the content of a file is sent in several chunks,
+// that are kept by the storage until the upload session is committed.
+type ChunkedUploader interface {
+	// CheckChunkedUpload returns an error if the storage can't keep the
+	// chunks of the upload sessions, like the older layouts of Swift.
+	CheckChunkedUpload() error
+	// CreateUploadChunk returns a writer for storing a chunk of an upload
+	// session.
+	CreateUploadChunk(sessionID, chunkName string) (io.WriteCloser, error)
+	// OpenUploadChunk returns a reader on a chunk of an upload session.
+	OpenUploadChunk(sessionID, chunkName string) (io.ReadCloser, error)
+	// DeleteUploadChunk removes a chunk of an upload session.
+	DeleteUploadChunk(sessionID, chunkName string) error
+	// DeleteUploadChunks removes all the chunks of an upload session.
+	DeleteUploadChunks(sessionID string) error
+}
+
+// UploadChunk is a part of the content of a file, sent in an upload session.
+type UploadChunk struct {
+	Name string `json:"name"`
+	Size int64  `json:"size,string"`
+}
+
+// UploadSession is used for resumable uploads: it keeps the metadata of the
+// file to create, and the list of the chunks already received.
+type UploadSession struct {
+	DocID      string        `json:"_id,omitempty"`
+	DocRev     string        `json:"_rev,omitempty"`
+	DocName    string        `json:"name"`
+	DirID      string        `json:"dir_id,omitempty"`
+	FileID     string        `json:"file_id,omitempty"`
+	ByteSize   int64         `json:"size,string"`
+	MD5Sum     []byte        `json:"md5sum"`
+	Mime       string        `json:"mime,omitempty"`
+	Class      string        `json:"class,omitempty"`
+	Executable bool          `json:"executable,omitempty"`
+	Tags       []string      `json:"tags,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+	ExpiresAt  time.Time     `json:"expires_at"`
+	Chunks     []UploadChunk `json:"chunks"`
+}
+
+// ID returns the upload session identifier
+func (u *UploadSession) ID() string { return u.DocID }
+
+// Rev returns the upload session revision
+func (u *UploadSession) Rev() string { return u.DocRev }
+
+// DocType returns the upload session document type
+func (u *UploadSession) DocType() string { return consts.FilesUploads }
+
+// Clone implements couchdb.Doc
+func (u *UploadSession) Clone() couchdb.Doc {
+	cloned := *u
+	cloned.MD5Sum = make([]byte, len(u.MD5Sum))
+	copy(cloned.MD5Sum, u.MD5Sum)
+	cloned.Tags = make([]string, len(u.Tags))
+	copy(cloned.Tags, u.Tags)
+	cloned.Chunks = make([]UploadChunk, len(u.Chunks))
+	copy(cloned.Chunks, u.Chunks)
+	return &cloned
+}
+
+// SetID changes the upload session identifier
+func (u *UploadSession) SetID(id string) { u.DocID = id }
+
+// SetRev changes the upload session revision
+func (u *UploadSession) SetRev(rev string) { u.DocRev = rev }
+
+// Included is part of jsonapi.Object interface
+func (u *UploadSession) Included() []jsonapi.Object { return nil }
+
+// Relationships is part of jsonapi.Object interface
+func (u *UploadSession) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Links is part of jsonapi.Object interface
+func (u *UploadSession) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/upload/sessions/" + u.DocID}
+}
+
+// Offset returns the number of bytes already received for this session.
+func (u *UploadSession) Offset() int64 {
+	var offset int64
+	for _, chunk := range u.Chunks {
+		offset += chunk.Size
+	}
+	return offset
+}
+
+// Completed returns true if all the bytes of the file have been received.
+func (u *UploadSession) Completed() bool {
+	return u.Offset() == u.ByteSize
+}
+
+// Expired returns true if the session has been abandoned.
+func (u *UploadSession) Expired() bool {
+	return time.Now().After(u.ExpiresAt)
+}
+
+// FileDoc returns the file document that will be created when the session
+// will be committed. The olddoc is the document of the file for a session
+// that overwrites the content of an existing file.
+func (u *UploadSession) FileDoc(olddoc *FileDoc) (*FileDoc, error) {
+	dirID := u.DirID
+	if olddoc != nil {
+		dirID = olddoc.DirID
+	}
+	doc, err := NewFileDoc(u.DocName, dirID, u.ByteSize, u.MD5Sum, u.Mime,
+		u.Class, u.CreatedAt, u.Executable, false, false, u.Tags)
+	if err != nil {
+		return nil, err
+	}
+	doc.UpdatedAt = u.UpdatedAt
+	if olddoc != nil {
+		doc.SetID(olddoc.ID())
+		doc.ReferencedBy = olddoc.ReferencedBy
+	}
+	return doc, nil
+}
+
+// NewUploadSession checks that a file can be created from the given document,
+// and then persists an upload session for it.
+func NewUploadSession(fs VFS, newdoc, olddoc *FileDoc) (*UploadSession, error) {
+	uploader, ok := fs.(ChunkedUploader)
+	if !ok {
+		return nil, ErrChunkedUploadNotSupported
+	}
+	if err := uploader.CheckChunkedUpload(); err != nil {
+		return nil, err
+	}
+	if newdoc.ByteSize < 0 {
+		return nil, ErrContentLengthMismatch
+	}
+	if len(newdoc.MD5Sum) == 0 {
+		return nil, ErrInvalidHash
+	}
+	available, limited, err := availableForUploads(fs)
+	if err != nil {
+		return nil, err
+	}
+	if limited && newdoc.ByteSize > available {
+		return nil, ErrFileTooBig
+	}
+	if olddoc == nil {
+		if _, err := fs.DirByID(newdoc.DirID); err != nil {
+			return nil, err
+		}
+		exists, err := fs.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, os.ErrExist
+		}
+	}
+
+	now := time.Now()
+	session := &UploadSession{
+		DocName:    newdoc.DocName,
+		DirID:      newdoc.DirID,
+		ByteSize:   newdoc.ByteSize,
+		MD5Sum:     newdoc.MD5Sum,
+		Mime:       newdoc.Mime,
+		Class:      newdoc.Class,
+		Executable: newdoc.Executable,
+		Tags:       newdoc.Tags,
+		CreatedAt:  newdoc.CreatedAt,
+		UpdatedAt:  newdoc.UpdatedAt,
+		ExpiresAt:  now.Add(UploadSessionTTL),
+		Chunks:     []UploadChunk{},
+	}
+	if olddoc != nil {
+		session.DirID = ""
+		session.FileID = olddoc.ID()
+	}
+	if err := couchdb.CreateDoc(fs, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// FindUploadSession returns the upload session with the given identifier.
+func FindUploadSession(fs VFS, id string) (*UploadSession, error) {
+	session := &UploadSession{}
+	if err := couchdb.GetDoc(fs, consts.FilesUploads, id, session); err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return nil, ErrUploadSessionNotFound
+		}
+		return nil, err
+	}
+	if session.Expired() {
+		return nil, ErrUploadSessionNotFound
+	}
+	return session, nil
+}
+
+// AppendChunk writes a new chunk for the upload session. The offset must be
+// the number of bytes already received for the session. If the chunk can't be
+// written in full, it is discarded and the client will have to send it again.
+func (u *UploadSession) AppendChunk(fs VFS, offset int64, content io.Reader) error {
+	uploader, ok := fs.(ChunkedUploader)
+	if !ok {
+		return ErrChunkedUploadNotSupported
+	}
+	if offset != u.Offset() {
+		return ErrUploadOffsetMismatch
+	}
+
+	// The chunks use the storage until the session is committed or purged,
+	// so they count against the quota.
+	max := u.ByteSize - offset
+	available, limited, err := availableForUploads(fs)
+	if err != nil {
+		return err
+	}
+	if available < 0 {
+		available = 0
+	}
+	tooBig := limited && available < max
+	if tooBig {
+		max = available
+	}
+
+	// The random name ensures that two concurrent requests for the same
+	// offset won't write the same chunk.
+	name := utils.RandomString(8)
+	w, err := uploader.CreateUploadChunk(u.DocID, name)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, io.LimitReader(content, max+1))
+	if errc := w.Close(); err == nil {
+		err = errc
+	}
+	if err == nil && n > max {
+		if tooBig {
+			err = ErrFileTooBig
+		} else {
+			err = ErrContentLengthMismatch
+		}
+	}
+	if err == nil && n == 0 {
+		return nil
+	}
+	if err != nil {
+		_ = uploader.DeleteUploadChunk(u.DocID, name)
+		return err
+	}
+
+	u.Chunks = append(u.Chunks, UploadChunk{Name: name, Size: n})
+	u.ExpiresAt = time.Now().Add(UploadSessionTTL)
+	if err := couchdb.UpdateDoc(fs, u); err != nil {
+		_ = uploader.DeleteUploadChunk(u.DocID, name)
+		if couchdb.IsConflictError(err) {
+			return ErrUploadOffsetMismatch
+		}
+		return err
+	}
+	return nil
+}
+
+// Commit creates the file from the chunks of the upload session. The MD5 sum
+// and the size of the content are checked by the VFS. The session is deleted
+// after the file has been created.
+//
+// When the encryption at rest is enabled, the chunks are stored encrypted.
+// The content is copied in a single pass: each chunk is decrypted once while
+// it is read, and the whole content is encrypted once by the VFS while it is
+// written to the file. It is not possible to skip this step by concatenating
+// the encrypted chunks, as the file has its own salt and its segments don't
+// match the chunks.
+func (u *UploadSession) Commit(fs VFS, newdoc, olddoc *FileDoc) error {
+	uploader, ok := fs.(ChunkedUploader)
+	if !ok {
+		return ErrChunkedUploadNotSupported
+	}
+	if !u.Completed() {
+		return ErrUploadNotCompleted
+	}
+
+	// The quota is checked again, as other files may have been added since
+	// the creation of the session. The chunks of this session will be
+	// removed, so only the chunks of the other sessions are counted.
+	available, limited, err := availableForUploads(fs)
+	if err != nil {
+		return err
+	}
+	newsize := newdoc.ByteSize
+	if olddoc != nil {
+		newsize -= olddoc.ByteSize
+	}
+	if limited && newsize > available+u.Offset() {
+		return ErrFileTooBig
+	}
+
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range u.Chunks {
+		var r io.ReadCloser
+		r, err = uploader.OpenUploadChunk(u.DocID, chunk.Name)
+		if err != nil {
+			break
+		}
+		_, err = io.Copy(file, r)
+		if errc := r.Close(); err == nil {
+			err = errc
+		}
+		if err != nil {
+			break
+		}
+	}
+	if errc := file.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+	return u.Abort(fs)
+}
+
+// Abort removes the chunks and the upload session.
+func (u *UploadSession) Abort(fs VFS) error {
+	if uploader, ok := fs.(ChunkedUploader); ok {
+		if err := uploader.DeleteUploadChunks(u.DocID); err != nil {
+			return err
+		}
+	}
+	return couchdb.DeleteDoc(fs, u)
+}
+
+// availableForUploads returns the number of bytes that can still be used on
+// the instance, when it has a quota. The chunks received for the upload
+// sessions that have not expired are counted, as they use the storage like
+// the files.
+func availableForUploads(fs VFS) (int64, bool, error) {
+	diskQuota := fs.DiskQuota()
+	if diskQuota <= 0 {
+		return 0, false, nil
+	}
+	diskUsage, err := fs.DiskUsage()
+	if err != nil {
+		return 0, false, err
+	}
+	var chunks int64
+	err = couchdb.ForeachDocs(fs, consts.FilesUploads, func(_ string, raw json.RawMessage) error {
+		var session UploadSession
+		if err := json.Unmarshal(raw, &session); err != nil {
+			return err
+		}
+		if !session.Expired() {
+			chunks += session.Offset()
+		}
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return 0, false, err
+	}
+	return diskQuota - diskUsage - chunks, true, nil
+}
+
+// PurgeExpiredUploadSessions removes the upload sessions that have expired,
+// with their chunks. It is called by a periodic job, as it looks at all the
+// upload sessions of the instance.
+func PurgeExpiredUploadSessions(fs VFS) error {
+	var expired []*UploadSession
+	err := couchdb.ForeachDocs(fs, consts.FilesUploads, func(_ string, raw json.RawMessage) error {
+		var session UploadSession
+		if err := json.Unmarshal(raw, &session); err != nil {
+			return err
+		}
+		if session.Expired() {
+			expired = append(expired, &session)
+		}
+		return nil
+	})
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil
+		}
+		return err
+	}
+	var errm error
+	for _, session := range expired {
+		if err := session.Abort(fs); err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+	return errm
+}
@@ -31,6 +31,10 @@ type Version struct {
 			} `json:"data"`
 		} `json:"file"`
 	} `json:"relationships"`
+
+	// EncryptedAtRest is true if the content of the version is encrypted by
+	// the VFS (see FileDoc)
+	EncryptedAtRest bool `json:"encrypted_at_rest,omitempty"`
 }
 
 // ID returns the version identifier
@@ -95,6 +99,8 @@ func NewVersion(file *FileDoc) *Version {
 		Tags:         file.Tags,
 		Metadata:     file.Metadata,
 		CozyMetadata: *fcm,
+
+		EncryptedAtRest: file.EncryptedAtRest,
 	}
 	v.Rels.File.Data.ID = file.ID()
 	v.Rels.File.Data.Type = consts.Files
@@ -119,6 +125,7 @@ func SetMetaFromVersion(file *FileDoc, version *Version) {
 	file.MD5Sum = version.MD5Sum
 	file.Tags = version.Tags
 	file.Metadata = version.Metadata
+	file.EncryptedAtRest = version.EncryptedAtRest
 	if file.CozyMetadata == nil {
 		file.CozyMetadata = NewCozyMetadata("")
 		file.CozyMetadata.CreatedAt = file.CreatedAt
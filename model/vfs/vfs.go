@@ -39,6 +39,12 @@ const (
 	// VersionsDirName is the path of the directory where old versions of files
 	// are persisted.
 	VersionsDirName = "/.cozy_versions"
+	// UploadsDirName is the path of the directory where the chunks of the
+	// resumable uploads are persisted.
+	UploadsDirName = "/.cozy_uploads"
+	// BlobsDirName is the path of the directory where the deduplicated
+	// contents are persisted on a local filesystem.
+	BlobsDirName = "/.cozy_blobs"
 )
 
 const conflictFormat = "%s (%s)"
@@ -93,6 +99,10 @@ type Fs interface {
 	DissociateFile(src, dst *FileDoc) error
 	// DissociateDir is like DissociateFile but for directories.
 	DissociateDir(src, dst *DirDoc) error
+	// CopyFile creates a new file with the content of the olddoc file, and
+	// the name and directory of the newdoc. The content is copied inside the
+	// storage, without being sent to the stack.
+	CopyFile(olddoc, newdoc *FileDoc) error
 
 	// DestroyDirContent destroys all directories and files contained in a
 	// directory.
@@ -235,6 +245,21 @@ type Indexer interface {
 
 	ListNotSynchronizedOn(clientID string) ([]DirDoc, error)
 
+	// AddBlobRef adds a reference to the blob with the given checksum, for
+	// the deduplication. If the blob was unknown, it is recorded as encrypted
+	// or not. It returns the reference, with the updated count.
+	AddBlobRef(hash string, size int64, encrypted bool) (*BlobRef, error)
+	// GetBlobRef returns the reference to the blob with the given checksum.
+	GetBlobRef(hash string) (*BlobRef, error)
+	// SetBlobEncrypted records if the content of the blob is encrypted.
+	SetBlobEncrypted(hash string, encrypted bool) error
+	// RemoveBlobRef removes a reference to the blob with the given checksum.
+	// It returns true if it was the last reference.
+	RemoveBlobRef(hash string) (bool, error)
+	// BlobsSavedSpace returns the number of bytes that have been saved by
+	// the deduplication.
+	BlobsSavedSpace() (int64, error)
+
 	CheckIndexIntegrity(func(*FsckLog), bool) error
 	CheckTreeIntegrity(*Tree, func(*FsckLog), bool) error
 	BuildTree(each ...func(*TreeFile)) (tree *Tree, err error)
@@ -340,6 +365,8 @@ type DirOrFileDoc struct {
 	Encrypted  bool     `json:"encrypted,omitempty"`
 	Metadata   Metadata `json:"metadata,omitempty"`
 	InternalID string   `json:"internal_vfs_id,omitempty"`
+
+	EncryptedAtRest bool `json:"encrypted_at_rest,omitempty"`
 }
 
 // Clone is part of the couchdb.Doc interface
@@ -375,6 +402,8 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			ReferencedBy: fd.ReferencedBy,
 			CozyMetadata: fd.CozyMetadata,
 			InternalID:   fd.InternalID,
+
+			EncryptedAtRest: fd.EncryptedAtRest,
 		}
 	}
 	return nil, nil
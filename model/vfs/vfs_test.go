@@ -18,12 +18,14 @@ import (
 
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/model/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/model/vfs/vfss3"
 	"github.com/cozy/cozy-stack/model/vfs/vfsswift"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/s3/s3test"
 	"github.com/ncw/swift/v2/swifttest"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/sync/errgroup"
@@ -714,7 +716,15 @@ func TestMain(m *testing.M) {
 	res4 := m.Run()
 	rollback()
 
-	os.Exit(res1 + res2 + res3 + res4)
+	fs, rollback, err = makeS3FS()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res5 := m.Run()
+	rollback()
+
+	os.Exit(res1 + res2 + res3 + res4 + res5)
 }
 
 type contexter struct {
@@ -738,7 +748,7 @@ func makeAferoFS() (vfs.VFS, func(), error) {
 	db := &contexter{0, "io.cozy.vfs.test", "io.cozy.vfs.test", "cozy_beta"}
 	index := vfs.NewCouchdbIndexer(db)
 	mutex = lock.ReadWrite(db, "vfs-afero-test")
-	aferoFs, err := vfsafero.New(db, index, &diskImpl{}, mutex,
+	aferoFs, err := vfsafero.New(db, index, &diskImpl{}, nil, mutex,
 		&url.URL{Scheme: "file", Host: "localhost", Path: tempdir}, "io.cozy.vfs.test")
 	if err != nil {
 		return nil, nil, err
@@ -796,7 +806,7 @@ func makeSwiftFS(layout int) (vfs.VFS, func(), error) {
 		swiftFs, err = vfsswift.NewV2(db, index, &diskImpl{}, mutex)
 	case 2:
 		mutex = lock.ReadWrite(db, "vfs-swiftv3-test")
-		swiftFs, err = vfsswift.NewV3(db, index, &diskImpl{}, mutex)
+		swiftFs, err = vfsswift.NewV3(db, index, &diskImpl{}, nil, mutex)
 	}
 	if err != nil {
 		return nil, nil, err
@@ -826,3 +836,53 @@ func makeSwiftFS(layout int) (vfs.VFS, func(), error) {
 		}
 	}, nil
 }
+
+func makeS3FS() (vfs.VFS, func(), error) {
+	db := &contexter{0, "io.cozy.vfs.test", "io.cozy.vfs.test", "cozy_beta"}
+	index := vfs.NewCouchdbIndexer(db)
+	s3Srv := s3test.NewServer()
+	srvURL, _ := url.Parse(s3Srv.URL)
+
+	err := config.InitS3Client(config.Fs{
+		URL: &url.URL{
+			Scheme:   config.SchemeS3Insecure,
+			User:     url.UserPassword("access", "secret"),
+			Host:     srvURL.Host,
+			Path:     "/cozy-test",
+			RawQuery: "PathStyle=true",
+		},
+	})
+	if err != nil {
+		s3Srv.Close()
+		return nil, nil, err
+	}
+
+	mutex = lock.ReadWrite(db, "vfs-s3-test")
+	s3Fs, err := vfss3.New(db, index, &diskImpl{}, nil, mutex)
+	if err != nil {
+		s3Srv.Close()
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.Files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	g, _ := errgroup.WithContext(context.Background())
+	couchdb.DefineIndexes(g, db, couchdb.IndexesByDoctype(consts.Files))
+	couchdb.DefineViews(g, db, couchdb.ViewsByDoctype(consts.Files))
+	if err = g.Wait(); err != nil {
+		return nil, nil, err
+	}
+
+	err = s3Fs.InitFs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s3Fs, func() {
+		_ = couchdb.DeleteDB(db, consts.Files)
+		s3Srv.Close()
+	}, nil
+}
@@ -0,0 +1,105 @@
+package vfsafero
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+)
+
+// On a local filesystem, a deduplicated content is stored in a blob file, in
+// the BlobsDirName directory, and the files and versions that use it are hard
+// links to this blob. A content must then not be modified in place, as it can
+// be shared: it is replaced by a rename (except for the reencryption, which is
+// the same for all the links).
+
+// errBlobsNotOSFS is returned when the blobs are used on a filesystem that is
+// not backed by the OS, like mem://, as the hard links are not available.
+var errBlobsNotOSFS = errors.New("vfsafero: the blobs need a local filesystem")
+
+func blobPath(hash string) string {
+	return path.Join(vfs.BlobsDirName, hash[:2], hash)
+}
+
+// osPath returns the path on the OS filesystem for the given name.
+func (afs *aferoVFS) osPath(name string) string {
+	return path.Join(afs.pth, name)
+}
+
+// BlobExists is part of the vfs.BlobStorage interface
+func (afs *aferoVFS) BlobExists(hash string) (bool, error) {
+	_, err := afs.fs.Stat(blobPath(hash))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CreateBlob is part of the vfs.BlobStorage interface. The blob is a hard link
+// to the written content.
+func (afs *aferoVFS) CreateBlob(name, hash string) error {
+	if !afs.osFS {
+		return errBlobsNotOSFS
+	}
+	blob := blobPath(hash)
+	if err := afs.fs.MkdirAll(path.Dir(blob), 0755); err != nil {
+		return err
+	}
+	return os.Link(afs.osPath(name), afs.osPath(blob))
+}
+
+// UseBlob is part of the vfs.BlobStorage interface. The written content is
+// replaced by a hard link to the blob.
+func (afs *aferoVFS) UseBlob(name, hash string) error {
+	if !afs.osFS {
+		return errBlobsNotOSFS
+	}
+	tmp := name + ".blob"
+	if err := os.Link(afs.osPath(blobPath(hash)), afs.osPath(tmp)); err != nil {
+		return err
+	}
+	if err := afs.fs.Rename(tmp, name); err != nil {
+		_ = afs.fs.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// DeleteBlob is part of the vfs.BlobStorage interface. The content is removed
+// from the disk when the last link to it is removed.
+func (afs *aferoVFS) DeleteBlob(hash string) error {
+	err := afs.fs.Remove(blobPath(hash))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// blobsOf returns the checksums of the blobs used by the given files and
+// versions.
+func blobsOf(files []*vfs.FileDoc, versions []*vfs.Version) []string {
+	hashes := vfs.BlobsOfVersions(versions)
+	for _, file := range files {
+		if hash := vfs.BlobOf(file.InternalID); hash != "" {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// PhysicalDiskUsage returns the size of the files and versions, where the
+// blobs are counted only once.
+func (afs *aferoVFS) PhysicalDiskUsage() (int64, error) {
+	return vfs.PhysicalUsage(afs.Indexer)
+}
+
+// Deduplicates returns true if the deduplication is enabled for this VFS.
+func (afs *aferoVFS) Deduplicates() bool {
+	return afs.dedup
+}
+
+var (
+	_ vfs.Deduplicator = (*aferoVFS)(nil)
+	_ vfs.BlobStorage  = (*aferoVFS)(nil)
+)
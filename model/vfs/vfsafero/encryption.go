@@ -0,0 +1,127 @@
+package vfsafero
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/spf13/afero"
+)
+
+// writeContent writes the content in the file with the given name. The
+// content is encrypted if the encryption at rest is enabled.
+func (afs *aferoVFS) writeContent(name string, content io.Reader) error {
+	if afs.keys == nil {
+		return afero.WriteReader(afs.fs, name, content)
+	}
+	f, err := afs.fs.Create(name)
+	if err != nil {
+		return err
+	}
+	w, err := vfs.EncryptWriteCloser(f, afs.keys)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	_, err = io.Copy(w, content)
+	if errc := w.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+func (afs *aferoVFS) ReencryptContent(doc *vfs.FileDoc, version *vfs.Version) (bool, error) {
+	if afs.keys == nil {
+		return false, nil
+	}
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return false, lockerr
+	}
+	defer afs.mu.Unlock()
+
+	var name, blob string
+	var md5sum []byte
+	var encrypted *bool
+	var err error
+	if version != nil {
+		name = pathForVersion(version)
+		md5sum = version.MD5Sum
+		blob = vfs.BlobOf(version.DocID)
+		encrypted = &version.EncryptedAtRest
+	} else {
+		if name, err = afs.Indexer.FilePath(doc); err != nil {
+			return false, err
+		}
+		md5sum = doc.MD5Sum
+		blob = vfs.BlobOf(doc.InternalID)
+		encrypted = &doc.EncryptedAtRest
+	}
+	if *encrypted, err = afs.blobs.ContentEncrypted(blob, *encrypted); err != nil {
+		return false, err
+	}
+
+	src, err := afs.fs.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	needed, r, err := vfs.ReencryptionNeeded(src, afs.keys, *encrypted)
+	if err != nil || !needed {
+		return false, err
+	}
+
+	// The new content is written in a temporary file, that replaces the old
+	// one only if everything went well.
+	tmp, err := afero.TempFile(afs.fs, "/", path.Base(name))
+	if err != nil {
+		return false, err
+	}
+	tmppath := path.Join("/", tmp.Name())
+	sum, err := vfs.Reencrypt(tmp, r, afs.keys, *encrypted)
+	if errc := tmp.Close(); err == nil {
+		err = errc
+	}
+	if err == nil && len(md5sum) > 0 && !bytes.Equal(sum, md5sum) {
+		err = vfs.ErrInvalidHash
+	}
+	if err == nil && blob != "" {
+		// A deduplicated content is rewritten in place, to keep it shared
+		// with the other links to its blob.
+		err = afs.overwriteContent(tmppath, name)
+		if err == nil {
+			_ = afs.fs.Remove(tmppath)
+			err = afs.blobs.MarkEncrypted(blob)
+		}
+	} else if err == nil {
+		err = afs.fs.Rename(tmppath, name)
+	}
+	if err != nil {
+		_ = afs.fs.Remove(tmppath)
+		return false, err
+	}
+	*encrypted = true
+	return true, nil
+}
+
+// overwriteContent copies the content of the src file in the dst file,
+// without changing the inode of dst.
+func (afs *aferoVFS) overwriteContent(src, dst string) error {
+	r, err := afs.fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := afs.fs.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if errc := w.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+var _ vfs.Reencrypter = (*aferoVFS)(nil)
@@ -2,10 +2,8 @@ package vfsafero
 
 import (
 	"bytes"
-	"crypto/md5"
 	"encoding/json"
 	"errors"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -75,7 +73,9 @@ func (afs *aferoVFS) checkFiles(
 
 		if fullpath == vfs.WebappsDirName ||
 			fullpath == vfs.KonnectorsDirName ||
-			fullpath == vfs.ThumbsDirName {
+			fullpath == vfs.ThumbsDirName ||
+			fullpath == vfs.UploadsDirName ||
+			fullpath == vfs.BlobsDirName {
 			return filepath.SkipDir
 		}
 
@@ -130,22 +130,31 @@ func (afs *aferoVFS) checkFiles(
 			if err != nil {
 				return err
 			}
-			h := md5.New()
-			if _, err = io.Copy(h, fd); err != nil {
+			// The content may be encrypted: the checksum and the size are
+			// computed on the plain content.
+			var encrypted bool
+			encrypted, err = afs.blobs.ContentEncrypted(vfs.BlobOf(f.InternalID), f.EncryptedAtRest)
+			if err != nil {
+				fd.Close()
+				return err
+			}
+			var md5sum []byte
+			var size int64
+			md5sum, size, err = vfs.PlainChecksum(fd, afs.keys, encrypted)
+			if err != nil {
 				fd.Close()
 				return err
 			}
 			if err = fd.Close(); err != nil {
 				return err
 			}
-			md5sum := h.Sum(nil)
-			if !bytes.Equal(md5sum, f.MD5Sum) || f.ByteSize != info.Size() {
+			if !bytes.Equal(md5sum, f.MD5Sum) || f.ByteSize != size {
 				accumulate(&vfs.FsckLog{
 					Type:    vfs.ContentMismatch,
 					IsFile:  true,
 					FileDoc: f,
 					ContentMismatch: &vfs.FsckContentMismatch{
-						SizeFile:    info.Size(),
+						SizeFile:    size,
 						SizeIndex:   f.ByteSize,
 						MD5SumFile:  md5sum,
 						MD5SumIndex: f.MD5Sum,
@@ -18,6 +18,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/filetype"
 	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/utils"
 
 	"github.com/spf13/afero"
 )
@@ -36,6 +37,9 @@ type aferoVFS struct {
 	prefix  string
 	context string
 	fs      afero.Fs
+	keys    vfs.Keyring
+	blobs   *vfs.Blobs
+	dedup   bool
 	mu      lock.ErrorRWLocker
 	pth     string
 
@@ -58,7 +62,11 @@ func GetMemFS(key string) afero.Fs {
 //
 // The supported scheme of the storage url are file://, for an OS-FS store, and
 // mem:// for an in-memory store. The backend used is the afero package.
-func New(db vfs.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsURL *url.URL, pathSegment string) (vfs.VFS, error) {
+//
+// If keys is not nil, the content of the files is encrypted at rest with the
+// keys of this keyring. And the contents are deduplicated if it is enabled in
+// the configuration, but only for an OS-FS store (it uses hard links).
+func New(db vfs.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, keys vfs.Keyring, mu lock.ErrorRWLocker, fsURL *url.URL, pathSegment string) (vfs.VFS, error) {
 	if fsURL.Scheme != "mem" && fsURL.Path == "" {
 		return nil, fmt.Errorf("vfsafero: please check the supplied fs url: %s",
 			fsURL.String())
@@ -76,7 +84,7 @@ func New(db vfs.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.E
 	default:
 		return nil, fmt.Errorf("vfsafero: non supported scheme %s", fsURL.Scheme)
 	}
-	return &aferoVFS{
+	afs := &aferoVFS{
 		Indexer:         index,
 		DiskThresholder: disk,
 
@@ -85,12 +93,16 @@ func New(db vfs.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.E
 		prefix:  db.DBPrefix(),
 		context: db.GetContextName(),
 		fs:      fs,
+		keys:    keys,
+		dedup:   fsURL.Scheme == "file" && vfs.IsDeduplicationEnabled(db.GetContextName()),
 		mu:      mu,
 		pth:     pth,
 		// for now, only the file:// scheme needs a specific initialisation of its
 		// root directory.
 		osFS: fsURL.Scheme == "file",
-	}, nil
+	}
+	afs.blobs = vfs.NewBlobs(index, afs, lock.ReadWrite(db, "vfs-blobs"))
+	return afs, nil
 }
 
 func (afs *aferoVFS) DBCluster() int {
@@ -120,6 +132,9 @@ func (afs *aferoVFS) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
 		domain:          afs.domain,
 		prefix:          afs.prefix,
 		fs:              afs.fs,
+		keys:            afs.keys,
+		blobs:           afs.blobs,
+		dedup:           afs.dedup,
 		mu:              afs.mu,
 		pth:             afs.pth,
 		osFS:            afs.osFS,
@@ -237,12 +252,28 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc, opts ...vfs.CreateO
 	}
 	tmppath := path.Join("/", f.Name())
 
+	var enc *vfs.EncryptedWriter
+	if afs.keys != nil {
+		if enc, err = vfs.NewEncryptedWriter(f, afs.keys); err != nil {
+			_ = f.Close()
+			_ = afs.fs.Remove(tmppath)
+			return nil, err
+		}
+	}
+
+	var sha hash.Hash
 	hash := md5.New()
 	extractor := vfs.NewMetaExtractor(newdoc)
+	if afs.dedup {
+		sha = vfs.NewBlobHash()
+		// The internal ID is set when the content has been deduplicated
+		newdoc.InternalID = ""
+	}
 
 	return &aferoFileCreation{
 		afs:     afs,
 		f:       f,
+		enc:     enc,
 		newdoc:  newdoc,
 		olddoc:  olddoc,
 		tmppath: tmppath,
@@ -251,6 +282,7 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc, opts ...vfs.CreateO
 		maxsize: maxsize,
 		capsize: capsize,
 		hash:    hash,
+		sha:     sha,
 		meta:    extractor,
 	}, nil
 }
@@ -282,6 +314,7 @@ func (afs *aferoVFS) DissociateFile(src, dst *vfs.FileDoc) error {
 			return err
 		}
 	}
+	dst.EncryptedAtRest = src.EncryptedAtRest
 	if err = afs.Indexer.CreateFileDoc(dst); err != nil {
 		if needRename {
 			_ = afs.fs.Rename(to, from)
@@ -299,7 +332,9 @@ func (afs *aferoVFS) DissociateFile(src, dst *vfs.FileDoc) error {
 		return nil
 	}
 	if from != to {
-		_ = afs.Indexer.BatchDeleteVersions(versions)
+		if err = afs.Indexer.BatchDeleteVersions(versions); err == nil {
+			_ = afs.blobs.Release(vfs.BlobsOfVersions(versions))
+		}
 	}
 	return nil
 }
@@ -332,6 +367,96 @@ func (afs *aferoVFS) DissociateDir(src, dst *vfs.DirDoc) error {
 	return afs.Indexer.DeleteDirDoc(src)
 }
 
+func (afs *aferoVFS) CopyFile(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+
+	if diskQuota := afs.DiskQuota(); diskQuota > 0 {
+		diskUsage, err := afs.DiskUsage()
+		if err != nil {
+			return err
+		}
+		if olddoc.ByteSize > diskQuota-diskUsage {
+			return vfs.ErrFileTooBig
+		}
+	}
+
+	exists, err := afs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+
+	oldpath, err := afs.Indexer.FilePath(olddoc)
+	if err != nil {
+		return err
+	}
+	newpath, err := afs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return vfs.ErrParentInTrash
+	}
+
+	// Copy the content in a temporary file, and then move it to its final
+	// location, like for an upload
+	tmp, err := afero.TempFile(afs.fs, "/", newdoc.DocName)
+	if err != nil {
+		return err
+	}
+	tmppath := path.Join("/", tmp.Name())
+
+	// The content is copied as is, encrypted or not. And a deduplicated
+	// content is not copied: the new file is a link to its blob
+	newdoc.EncryptedAtRest = olddoc.EncryptedAtRest
+	var blobs []string
+	if hash := vfs.BlobOf(olddoc.InternalID); hash != "" {
+		_ = tmp.Close()
+		newdoc.InternalID = vfs.BlobInternalID(utils.RandomString(16), hash)
+		if err = afs.blobs.AddRef(hash, olddoc.ByteSize, olddoc.EncryptedAtRest); err != nil {
+			_ = afs.fs.Remove(tmppath)
+			return err
+		}
+		blobs = []string{hash}
+		err = afs.UseBlob(tmppath, hash)
+	} else {
+		var content afero.File
+		content, err = afs.fs.Open(oldpath)
+		if err != nil {
+			_ = tmp.Close()
+			_ = afs.fs.Remove(tmppath)
+			return err
+		}
+		_, err = io.Copy(tmp, content)
+		if errc := content.Close(); err == nil {
+			err = errc
+		}
+		if errc := tmp.Close(); err == nil {
+			err = errc
+		}
+	}
+	if err == nil {
+		err = safeRenameFile(afs.fs, tmppath, newpath)
+	}
+	if err != nil {
+		_ = afs.fs.Remove(tmppath)
+		_ = afs.blobs.Release(blobs)
+		return err
+	}
+
+	if err = afs.Indexer.CreateFileDoc(newdoc); err != nil {
+		_ = afs.fs.Remove(newpath)
+		_ = afs.blobs.Release(blobs)
+		return err
+	}
+	return nil
+}
+
 func (afs *aferoVFS) DestroyDirContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
 	if lockerr := afs.mu.Lock(); lockerr != nil {
 		return lockerr
@@ -365,7 +490,10 @@ func (afs *aferoVFS) DestroyDirContent(doc *vfs.DirDoc, push func(vfs.TrashJourn
 			allVersions = append(allVersions, versions...)
 		}
 	}
-	return afs.Indexer.BatchDeleteVersions(allVersions)
+	if err = afs.Indexer.BatchDeleteVersions(allVersions); err != nil {
+		return err
+	}
+	return afs.blobs.Release(blobsOf(files, allVersions))
 }
 
 func (afs *aferoVFS) DestroyDirAndContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
@@ -389,7 +517,10 @@ func (afs *aferoVFS) DestroyDirAndContent(doc *vfs.DirDoc, push func(vfs.TrashJo
 			allVersions = append(allVersions, versions...)
 		}
 	}
-	return afs.Indexer.BatchDeleteVersions(allVersions)
+	if err = afs.Indexer.BatchDeleteVersions(allVersions); err != nil {
+		return err
+	}
+	return afs.blobs.Release(blobsOf(files, allVersions))
 }
 
 func (afs *aferoVFS) DestroyFile(doc *vfs.FileDoc) error {
@@ -415,7 +546,10 @@ func (afs *aferoVFS) DestroyFile(doc *vfs.FileDoc) error {
 		return err
 	}
 	_ = afs.fs.RemoveAll(pathForVersions(doc.DocID))
-	return afs.Indexer.BatchDeleteVersions(versions)
+	if err = afs.Indexer.BatchDeleteVersions(versions); err != nil {
+		return err
+	}
+	return afs.blobs.Release(blobsOf([]*vfs.FileDoc{doc}, versions))
 }
 
 func (afs *aferoVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
@@ -427,11 +561,15 @@ func (afs *aferoVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if err != nil {
 		return nil, err
 	}
+	encrypted, err := afs.blobs.ContentEncrypted(vfs.BlobOf(doc.InternalID), doc.EncryptedAtRest)
+	if err != nil {
+		return nil, err
+	}
 	f, err := afs.fs.Open(name)
 	if err != nil {
 		return nil, err
 	}
-	return &aferoFileOpen{f}, nil
+	return vfs.DecryptFile(&aferoFileOpen{f}, afs.keys, encrypted)
 }
 
 func (afs *aferoVFS) EnsureErased(journal vfs.TrashJournal) error {
@@ -443,11 +581,15 @@ func (afs *aferoVFS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vf
 		return nil, lockerr
 	}
 	defer afs.mu.RUnlock()
+	encrypted, err := afs.blobs.ContentEncrypted(vfs.BlobOf(version.DocID), version.EncryptedAtRest)
+	if err != nil {
+		return nil, err
+	}
 	f, err := afs.fs.Open(pathForVersion(version))
 	if err != nil {
 		return nil, err
 	}
-	return &aferoFileOpen{f}, nil
+	return vfs.DecryptFile(&aferoFileOpen{f}, afs.keys, encrypted)
 }
 
 func (afs *aferoVFS) ImportFileVersion(version *vfs.Version, content io.ReadCloser) error {
@@ -467,19 +609,42 @@ func (afs *aferoVFS) ImportFileVersion(version *vfs.Version, content io.ReadClos
 		}
 	}
 
+	// The checksum of a deduplicated content is checked before it is linked
+	// to its blob.
+	blob := vfs.BlobOf(version.DocID)
+	var sha hash.Hash
+	var r io.Reader = content
+	if blob != "" {
+		sha = vfs.NewBlobHash()
+		r = io.TeeReader(content, sha)
+	}
+
 	vPath := pathForVersion(version)
 	_ = afs.fs.MkdirAll(filepath.Dir(vPath), 0755)
-	err := afero.WriteReader(afs.fs, vPath, content)
+	err := afs.writeContent(vPath, r)
 	if errc := content.Close(); err == nil {
 		err = errc
 	}
+	version.EncryptedAtRest = afs.keys != nil
+	if err == nil && blob != "" {
+		if vfs.BlobHash(sha) != blob {
+			err = vfs.ErrInvalidHash
+		} else {
+			version.EncryptedAtRest, err = afs.blobs.Store(vPath, blob, version.ByteSize, version.EncryptedAtRest)
+		}
+	}
 	if err != nil {
 		// remove the temporary file if an error occurred
 		_ = afs.fs.Remove(vPath)
 		return err
 	}
 
-	return afs.Indexer.CreateVersion(version)
+	if err = afs.Indexer.CreateVersion(version); err != nil {
+		_ = afs.fs.Remove(vPath)
+		_ = afs.blobs.Release(vfs.BlobsOfVersions([]*vfs.Version{version}))
+		return err
+	}
+	return nil
 }
 
 func (afs *aferoVFS) RevertFileVersion(doc *vfs.FileDoc, version *vfs.Version) error {
@@ -508,6 +673,15 @@ func (afs *aferoVFS) RevertFileVersion(doc *vfs.FileDoc, version *vfs.Version) e
 
 	newdoc := doc.Clone().(*vfs.FileDoc)
 	vfs.SetMetaFromVersion(newdoc, version)
+	// The references to the blobs go with the contents: the current content is
+	// now used by the saved version, and the restored one by the file.
+	versionID := versionInternalID(version)
+	if vfs.BlobOf(doc.InternalID) != "" || vfs.BlobOf(versionID) != "" {
+		newdoc.InternalID = ""
+		if vfs.BlobOf(versionID) != "" {
+			newdoc.InternalID = versionID
+		}
+	}
 	if err = afs.Indexer.UpdateFileDoc(doc, newdoc); err != nil {
 		_ = afs.fs.Rename(mainpath, frompath)
 		_ = afs.fs.Rename(savepath, mainpath)
@@ -547,7 +721,8 @@ func (afs *aferoVFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
 			return err
 		}
 	}
-	if newdoc.Executable != olddoc.Executable {
+	// The mode of a deduplicated content is shared by all the links to its blob
+	if newdoc.Executable != olddoc.Executable && vfs.BlobOf(newdoc.InternalID) == "" {
 		newpath, err := afs.Indexer.FilePath(newdoc)
 		if err != nil {
 			return err
@@ -664,18 +839,20 @@ func (f *aferoFileOpen) Close() error {
 //
 // aferoFileCreation implements io.WriteCloser.
 type aferoFileCreation struct {
-	afs     *aferoVFS          // parent vfs
-	f       afero.File         // file handle
-	newdoc  *vfs.FileDoc       // new document
-	olddoc  *vfs.FileDoc       // old document
-	tmppath string             // temporary file path for uploading a new version of this file
-	w       int64              // total size written
-	size    int64              // total file size, -1 if unknown
-	maxsize int64              // maximum size allowed for the file
-	capsize int64              // size cap from which we send a notification to the user
-	hash    hash.Hash          // hash we build up along the file
-	meta    *vfs.MetaExtractor // extracts metadata from the content
-	err     error              // write error
+	afs     *aferoVFS            // parent vfs
+	f       afero.File           // file handle
+	enc     *vfs.EncryptedWriter // encrypts the content, if enabled
+	newdoc  *vfs.FileDoc         // new document
+	olddoc  *vfs.FileDoc         // old document
+	tmppath string               // temporary file path for uploading a new version of this file
+	w       int64                // total size written
+	size    int64                // total file size, -1 if unknown
+	maxsize int64                // maximum size allowed for the file
+	capsize int64                // size cap from which we send a notification to the user
+	hash    hash.Hash            // hash we build up along the file
+	sha     hash.Hash            // checksum for the deduplication, if enabled
+	meta    *vfs.MetaExtractor   // extracts metadata from the content
+	err     error                // write error
 }
 
 func (f *aferoFileCreation) Read(p []byte) (int, error) {
@@ -698,7 +875,13 @@ func (f *aferoFileCreation) Write(p []byte) (int, error) {
 		}
 	}
 
-	n, err := f.f.Write(p)
+	var n int
+	var err error
+	if f.enc != nil {
+		n, err = f.enc.Write(p)
+	} else {
+		n, err = f.f.Write(p)
+	}
 	if err != nil {
 		f.err = err
 		return n, err
@@ -715,6 +898,9 @@ func (f *aferoFileCreation) Write(p []byte) (int, error) {
 		return n, f.err
 	}
 
+	if f.sha != nil {
+		_, _ = f.sha.Write(p)
+	}
 	_, err = f.hash.Write(p)
 	return n, err
 }
@@ -734,6 +920,10 @@ func (f *aferoFileCreation) Close() (err error) {
 		}
 	}()
 
+	if f.enc != nil && f.err == nil {
+		f.err = f.enc.Close()
+	}
+
 	if err = f.f.Close(); err != nil {
 		if f.meta != nil {
 			(*f.meta).Abort(err)
@@ -799,6 +989,16 @@ func (f *aferoFileCreation) Close() (err error) {
 		return vfs.ErrParentInTrash
 	}
 
+	// If the deduplication fails, the content is kept in its own file
+	newdoc.EncryptedAtRest = f.enc != nil
+	if f.sha != nil {
+		hash := vfs.BlobHash(f.sha)
+		if encrypted, errb := f.afs.blobs.Store(f.tmppath, hash, written, newdoc.EncryptedAtRest); errb == nil {
+			newdoc.InternalID = vfs.BlobInternalID(utils.RandomString(16), hash)
+			newdoc.EncryptedAtRest = encrypted
+		}
+	}
+
 	var v *vfs.Version
 	if olddoc != nil {
 		v = vfs.NewVersion(olddoc)
@@ -809,6 +1009,7 @@ func (f *aferoFileCreation) Close() (err error) {
 		err = f.afs.Indexer.CreateNamedFileDoc(newdoc)
 	}
 	if err != nil {
+		_ = f.afs.blobs.Release(blobsOf([]*vfs.FileDoc{newdoc}, nil))
 		return err
 	}
 
@@ -828,6 +1029,7 @@ func (f *aferoFileCreation) Close() (err error) {
 			vPath := pathForVersion(v)
 			_ = f.afs.fs.Rename(vPath, newpath)
 		}
+		_ = f.afs.blobs.Release(blobsOf([]*vfs.FileDoc{newdoc}, nil))
 		return err
 	}
 
@@ -841,6 +1043,7 @@ func (f *aferoFileCreation) Close() (err error) {
 		if cleanV {
 			vPath := pathForVersion(v)
 			_ = f.afs.fs.Remove(vPath)
+			_ = f.afs.blobs.Release(vfs.BlobsOfVersions([]*vfs.Version{v}))
 		}
 		for _, old := range toClean {
 			_ = cleanOldVersion(f.afs, old)
@@ -925,7 +1128,10 @@ func cleanOldVersion(afs *aferoVFS, version *vfs.Version) error {
 		return err
 	}
 	vPath := pathForVersion(version)
-	return afs.fs.Remove(vPath)
+	if err := afs.fs.Remove(vPath); err != nil {
+		return err
+	}
+	return afs.blobs.Release(vfs.BlobsOfVersions([]*vfs.Version{version}))
 }
 
 func pathForVersion(v *vfs.Version) string {
@@ -938,6 +1144,13 @@ func pathForVersion(v *vfs.Version) string {
 	return path.Join(pathForVersions(fileID), versionID)
 }
 
+func versionInternalID(v *vfs.Version) string {
+	if parts := strings.SplitN(v.DocID, "/", 2); len(parts) > 1 {
+		return parts[1]
+	}
+	return v.DocID
+}
+
 func pathForVersions(fileID string) string {
 	// Avoid too many files in the same directory by using some sub-directories
 	return path.Join(vfs.VersionsDirName, fileID[:4], fileID[4:])
@@ -955,7 +1168,10 @@ func (afs *aferoVFS) ClearOldVersions() error {
 	if err := afs.Indexer.BatchDeleteVersions(versions); err != nil {
 		return err
 	}
-	return afs.fs.RemoveAll(vfs.VersionsDirName)
+	if err := afs.fs.RemoveAll(vfs.VersionsDirName); err != nil {
+		return err
+	}
+	return afs.blobs.Release(vfs.BlobsOfVersions(versions))
 }
 
 var (
@@ -0,0 +1,53 @@
+package vfsafero
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+)
+
+func pathForUploadChunk(sessionID, chunkName string) string {
+	return path.Join(vfs.UploadsDirName, sessionID, chunkName)
+}
+
+// CheckChunkedUpload is part of the vfs.ChunkedUploader interface
+func (afs *aferoVFS) CheckChunkedUpload() error {
+	return nil
+}
+
+func (afs *aferoVFS) CreateUploadChunk(sessionID, chunkName string) (io.WriteCloser, error) {
+	dir := path.Join(vfs.UploadsDirName, sessionID)
+	if err := afs.fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := afs.fs.OpenFile(pathForUploadChunk(sessionID, chunkName),
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return vfs.EncryptWriteCloser(f, afs.keys)
+}
+
+func (afs *aferoVFS) OpenUploadChunk(sessionID, chunkName string) (io.ReadCloser, error) {
+	f, err := afs.fs.Open(pathForUploadChunk(sessionID, chunkName))
+	if err != nil {
+		return nil, err
+	}
+	return vfs.DecryptReader(f, afs.keys, afs.keys != nil)
+}
+
+func (afs *aferoVFS) DeleteUploadChunk(sessionID, chunkName string) error {
+	err := afs.fs.Remove(pathForUploadChunk(sessionID, chunkName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (afs *aferoVFS) DeleteUploadChunks(sessionID string) error {
+	return afs.fs.RemoveAll(path.Join(vfs.UploadsDirName, sessionID))
+}
+
+var _ vfs.ChunkedUploader = (*aferoVFS)(nil)
@@ -0,0 +1,99 @@
+package vfss3
+
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/s3"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// blobsPrefix is the prefix of the keys for the contents shared by several
+// files and versions, when the deduplication is enabled. They are followed
+// by the SHA-256 checksum of the content.
+const blobsPrefix = "blobs/"
+
+func (sfs *s3VFS) blobKey(hash string) string {
+	return sfs.root + blobsPrefix + hash
+}
+
+// blobOfKey returns the checksum of the blob for the given key, or an empty
+// string if the key is not the one of a blob.
+func (sfs *s3VFS) blobOfKey(key string) string {
+	if !strings.HasPrefix(key, sfs.root+blobsPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(key, sfs.root+blobsPrefix)
+}
+
+// BlobExists is part of the vfs.BlobStorage interface
+func (sfs *s3VFS) BlobExists(hash string) (bool, error) {
+	_, err := sfs.c.HeadObject(sfs.ctx, sfs.blobKey(hash))
+	if s3.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CreateBlob is part of the vfs.BlobStorage interface. The content is copied
+// to the key of the blob, as S3 has no rename.
+func (sfs *s3VFS) CreateBlob(tmpKey, hash string) error {
+	if err := sfs.c.CopyObject(sfs.ctx, tmpKey, sfs.blobKey(hash), nil); err != nil {
+		return err
+	}
+	return sfs.UseBlob(tmpKey, hash)
+}
+
+// UseBlob is part of the vfs.BlobStorage interface. The key of a
+// deduplicated content is the key of its blob, so the uploaded content is
+// just removed.
+func (sfs *s3VFS) UseBlob(tmpKey, hash string) error {
+	if err := sfs.c.DeleteObject(sfs.ctx, tmpKey); err != nil {
+		sfs.log.Infof("Cannot delete %s after storing its blob: %s", tmpKey, err)
+	}
+	return nil
+}
+
+// DeleteBlob is part of the vfs.BlobStorage interface
+func (sfs *s3VFS) DeleteBlob(hash string) error {
+	return sfs.c.DeleteObject(sfs.ctx, sfs.blobKey(hash))
+}
+
+// deleteObjects deletes the objects for the given keys. For a blob, a
+// reference is removed, and the object is deleted only if it was the last
+// reference.
+func (sfs *s3VFS) deleteObjects(keys []string) error {
+	var errm error
+	var hashes []string
+	toDelete := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if hash := sfs.blobOfKey(key); hash != "" {
+			hashes = append(hashes, hash)
+		} else {
+			toDelete = append(toDelete, key)
+		}
+	}
+	if err := sfs.blobs.Release(hashes); err != nil {
+		errm = multierror.Append(errm, err)
+	}
+	if err := sfs.c.DeleteObjects(sfs.ctx, toDelete); err != nil {
+		errm = multierror.Append(errm, err)
+	}
+	return errm
+}
+
+// PhysicalDiskUsage returns the size of the files and versions, where the
+// blobs are counted only once.
+func (sfs *s3VFS) PhysicalDiskUsage() (int64, error) {
+	return vfs.PhysicalUsage(sfs.Indexer)
+}
+
+// Deduplicates returns true if the deduplication is enabled for this VFS.
+func (sfs *s3VFS) Deduplicates() bool {
+	return sfs.dedup
+}
+
+var (
+	_ vfs.Deduplicator = (*s3VFS)(nil)
+	_ vfs.BlobStorage  = (*s3VFS)(nil)
+)
@@ -0,0 +1,73 @@
+package vfss3
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/s3"
+)
+
+func (sfs *s3VFS) ReencryptContent(doc *vfs.FileDoc, version *vfs.Version) (bool, error) {
+	if sfs.keys == nil {
+		return false, nil
+	}
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return false, lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	internalID := doc.InternalID
+	md5sum := doc.MD5Sum
+	contentType := doc.Mime
+	encrypted := &doc.EncryptedAtRest
+	if version != nil {
+		internalID = versionInternalID(version)
+		md5sum = version.MD5Sum
+		contentType = "application/octet-stream"
+		encrypted = &version.EncryptedAtRest
+	}
+	key := sfs.key(doc.DocID, internalID)
+	blob := vfs.BlobOf(internalID)
+	var err error
+	if *encrypted, err = sfs.blobs.ContentEncrypted(blob, *encrypted); err != nil {
+		return false, err
+	}
+
+	src, err := sfs.c.GetObject(sfs.ctx, key, 0, 0)
+	if s3.IsNotFound(err) {
+		return false, os.ErrNotExist
+	}
+	if err != nil {
+		return false, err
+	}
+	defer src.Body.Close()
+	needed, r, err := vfs.ReencryptionNeeded(src.Body, sfs.keys, *encrypted)
+	if err != nil || !needed {
+		return false, err
+	}
+
+	// The object is replaced only when the writer is closed: it is aborted on
+	// errors.
+	w := sfs.c.NewWriter(sfs.ctx, key, &s3.PutOptions{ContentType: contentType})
+	sum, err := vfs.Reencrypt(w, r, sfs.keys, *encrypted)
+	if err == nil && len(md5sum) > 0 && !bytes.Equal(sum, md5sum) {
+		err = vfs.ErrInvalidHash
+	}
+	if err != nil {
+		_ = w.Abort()
+		return false, err
+	}
+	if err = w.Close(); err != nil {
+		return false, err
+	}
+	if blob != "" {
+		if err = sfs.blobs.MarkEncrypted(blob); err != nil {
+			return false, err
+		}
+	}
+	*encrypted = true
+	return true, nil
+}
+
+var _ vfs.Reencrypter = (*s3VFS)(nil)
@@ -0,0 +1,376 @@
+package vfss3
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/s3"
+)
+
+var errFailFast = errors.New("fail fast")
+
+func (sfs *s3VFS) Fsck(accumulate func(log *vfs.FsckLog), failFast bool) error {
+	entries := make(map[string]*vfs.TreeFile, 1024)
+	tree, err := sfs.BuildTree(func(f *vfs.TreeFile) {
+		if !f.IsDir {
+			entries[f.DocID+"/"+f.InternalID] = f
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err = sfs.CheckTreeIntegrity(tree, accumulate, failFast); err != nil {
+		if err == vfs.ErrFsckFailFast {
+			return nil
+		}
+		return err
+	}
+	return sfs.checkFiles(entries, accumulate, failFast)
+}
+
+func (sfs *s3VFS) CheckFilesConsistency(accumulate func(log *vfs.FsckLog), failFast bool) error {
+	entries := make(map[string]*vfs.TreeFile, 1024)
+	_, err := sfs.BuildTree(func(f *vfs.TreeFile) {
+		if !f.IsDir {
+			entries[f.DocID+"/"+f.InternalID] = f
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sfs.checkFiles(entries, accumulate, failFast)
+}
+
+func (sfs *s3VFS) checkFiles(
+	entries map[string]*vfs.TreeFile,
+	accumulate func(log *vfs.FsckLog),
+	failFast bool,
+) error {
+	versions := make(map[string]*vfs.Version, 1024)
+	err := couchdb.ForeachDocs(sfs, consts.FilesVersions, func(_ string, data json.RawMessage) error {
+		v := &vfs.Version{}
+		if erru := json.Unmarshal(data, v); erru != nil {
+			return erru
+		}
+		versions[v.DocID] = v
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	images := make(map[string]struct{})
+	err = couchdb.ForeachDocs(sfs, consts.NotesImages, func(_ string, data json.RawMessage) error {
+		img := make(map[string]interface{})
+		if erru := json.Unmarshal(data, &img); erru != nil {
+			return erru
+		}
+		id, _ := img["_id"].(string)
+		images[id] = struct{}{}
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return err
+	}
+
+	fileIDs := make(map[string]struct{}, len(entries))
+	for _, f := range entries {
+		fileIDs[f.DocID] = struct{}{}
+	}
+
+	// The deduplicated contents are shared by several files and versions
+	blobFiles := make(map[string][]*vfs.TreeFile)
+	for _, f := range entries {
+		if hash := vfs.BlobOf(f.InternalID); hash != "" {
+			blobFiles[hash] = append(blobFiles[hash], f)
+		}
+	}
+	blobVersions := make(map[string][]*vfs.Version)
+	for _, v := range versions {
+		if hash := vfs.BlobOf(v.DocID); hash != "" {
+			blobVersions[hash] = append(blobVersions[hash], v)
+		}
+	}
+
+	err = sfs.c.ListObjects(sfs.ctx, sfs.root, func(obj *s3.ObjectInfo) error {
+		objName := strings.TrimPrefix(obj.Key, sfs.root)
+		if strings.HasPrefix(objName, uploadsPrefix) {
+			return nil
+		}
+		if strings.HasPrefix(objName, thumbsPrefix) {
+			name := strings.TrimPrefix(objName, thumbsPrefix)
+			fileID := name
+			if idx := strings.LastIndex(name, "-"); idx >= 0 {
+				fileID = name[:idx] // Remove -format suffix
+			}
+			if _, ok := fileIDs[fileID]; ok {
+				return nil
+			}
+			if _, ok := images[fileID]; ok {
+				return nil
+			}
+			accumulate(&vfs.FsckLog{
+				Type:   vfs.ThumbnailWithNoFile,
+				IsFile: true,
+				FileDoc: &vfs.TreeFile{
+					DirOrFileDoc: vfs.DirOrFileDoc{
+						DirDoc: &vfs.DirDoc{
+							Type:    consts.FileType,
+							DocID:   fileID,
+							DocName: objName,
+						},
+					},
+				},
+			})
+			if failFast {
+				return errFailFast
+			}
+			return nil
+		}
+		if strings.HasPrefix(objName, blobsPrefix) {
+			hash := strings.TrimPrefix(objName, blobsPrefix)
+			return sfs.checkBlob(obj, objName, blobFiles[hash], blobVersions[hash],
+				entries, versions, accumulate, failFast)
+		}
+
+		docID, internalID := makeDocID(objName)
+		if v, ok := versions[docID+"/"+internalID]; ok {
+			md5sum, size, err := sfs.objectChecksum(obj, v.EncryptedAtRest)
+			if err != nil {
+				return err
+			}
+			if !sameContent(md5sum, v.MD5Sum, size, v.ByteSize) {
+				accumulate(&vfs.FsckLog{
+					Type:       vfs.ContentMismatch,
+					IsVersion:  true,
+					VersionDoc: v,
+					ContentMismatch: &vfs.FsckContentMismatch{
+						SizeFile:    size,
+						SizeIndex:   v.ByteSize,
+						MD5SumFile:  md5sum,
+						MD5SumIndex: v.MD5Sum,
+					},
+				})
+				if failFast {
+					return errFailFast
+				}
+			}
+			delete(versions, v.DocID)
+			return nil
+		}
+
+		f, ok := entries[docID+"/"+internalID]
+		if !ok {
+			accumulate(&vfs.FsckLog{
+				Type:    vfs.IndexMissing,
+				IsFile:  true,
+				FileDoc: objectToFileDoc(obj, objName),
+			})
+			if failFast {
+				return errFailFast
+			}
+			return nil
+		}
+		md5sum, size, err := sfs.objectChecksum(obj, f.EncryptedAtRest)
+		if err != nil {
+			return err
+		}
+		if !sameContent(md5sum, f.MD5Sum, size, f.ByteSize) {
+			accumulate(&vfs.FsckLog{
+				Type:    vfs.ContentMismatch,
+				IsFile:  true,
+				FileDoc: f,
+				ContentMismatch: &vfs.FsckContentMismatch{
+					SizeFile:    size,
+					SizeIndex:   f.ByteSize,
+					MD5SumFile:  md5sum,
+					MD5SumIndex: f.MD5Sum,
+				},
+			})
+			if failFast {
+				return errFailFast
+			}
+		}
+		delete(entries, docID+"/"+internalID)
+		return nil
+	})
+	if err != nil {
+		if err == errFailFast {
+			return nil
+		}
+		return err
+	}
+
+	// entries should contain only data that does not contain an associated
+	// index.
+	for _, f := range entries {
+		accumulate(&vfs.FsckLog{
+			Type:    vfs.FSMissing,
+			IsFile:  true,
+			FileDoc: f,
+		})
+		if failFast {
+			return nil
+		}
+	}
+
+	for _, v := range versions {
+		accumulate(&vfs.FsckLog{
+			Type:       vfs.FSMissing,
+			IsVersion:  true,
+			VersionDoc: v,
+		})
+		if failFast {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// checkBlob checks the content of a blob against the files and versions that
+// use it.
+func (sfs *s3VFS) checkBlob(
+	obj *s3.ObjectInfo,
+	objName string,
+	files []*vfs.TreeFile,
+	versions []*vfs.Version,
+	allEntries map[string]*vfs.TreeFile,
+	allVersions map[string]*vfs.Version,
+	accumulate func(log *vfs.FsckLog),
+	failFast bool,
+) error {
+	if len(files) == 0 && len(versions) == 0 {
+		accumulate(&vfs.FsckLog{
+			Type:    vfs.IndexMissing,
+			IsFile:  true,
+			FileDoc: objectToFileDoc(obj, objName),
+		})
+		if failFast {
+			return errFailFast
+		}
+		return nil
+	}
+
+	// The blob reference tells if the content is encrypted
+	hash := strings.TrimPrefix(objName, blobsPrefix)
+	encrypted, err := sfs.blobs.ContentEncrypted(hash, false)
+	if err != nil {
+		return err
+	}
+	md5sum, size, err := sfs.objectChecksum(obj, encrypted)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !sameContent(md5sum, f.MD5Sum, size, f.ByteSize) {
+			accumulate(&vfs.FsckLog{
+				Type:    vfs.ContentMismatch,
+				IsFile:  true,
+				FileDoc: f,
+				ContentMismatch: &vfs.FsckContentMismatch{
+					SizeFile:    size,
+					SizeIndex:   f.ByteSize,
+					MD5SumFile:  md5sum,
+					MD5SumIndex: f.MD5Sum,
+				},
+			})
+			if failFast {
+				return errFailFast
+			}
+		}
+		delete(allEntries, f.DocID+"/"+f.InternalID)
+	}
+	for _, v := range versions {
+		if !sameContent(md5sum, v.MD5Sum, size, v.ByteSize) {
+			accumulate(&vfs.FsckLog{
+				Type:       vfs.ContentMismatch,
+				IsVersion:  true,
+				VersionDoc: v,
+				ContentMismatch: &vfs.FsckContentMismatch{
+					SizeFile:    size,
+					SizeIndex:   v.ByteSize,
+					MD5SumFile:  md5sum,
+					MD5SumIndex: v.MD5Sum,
+				},
+			})
+			if failFast {
+				return errFailFast
+			}
+		}
+		delete(allVersions, v.DocID)
+	}
+	return nil
+}
+
+// objectChecksum returns the MD5 checksum and the size of the content of an
+// object. For an encrypted content, the object is read to compute them for
+// the plain content.
+func (sfs *s3VFS) objectChecksum(obj *s3.ObjectInfo, encrypted bool) ([]byte, int64, error) {
+	if !encrypted {
+		md5sum, err := sfs.objectMD5Sum(obj)
+		return md5sum, obj.Size, err
+	}
+	o, err := sfs.c.GetObject(sfs.ctx, obj.Key, 0, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer o.Body.Close()
+	return vfs.PlainChecksum(o.Body, sfs.keys, true)
+}
+
+// objectMD5Sum returns the MD5 checksum of the content of an object. For the
+// objects uploaded in several parts, the ETag is not the MD5 checksum, and we
+// look at the metadata. It can return nil if the checksum is not known.
+func (sfs *s3VFS) objectMD5Sum(obj *s3.ObjectInfo) ([]byte, error) {
+	if md5sum, ok := obj.MD5Sum(); ok {
+		return md5sum, nil
+	}
+	head, err := sfs.c.HeadObject(sfs.ctx, obj.Key)
+	if err != nil {
+		return nil, err
+	}
+	if md5 := head.Metadata["md5"]; md5 != "" {
+		return hex.DecodeString(md5)
+	}
+	return nil, nil
+}
+
+func sameContent(md5File, md5Index []byte, sizeFile, sizeIndex int64) bool {
+	if sizeFile != sizeIndex {
+		return false
+	}
+	return md5File == nil || bytes.Equal(md5File, md5Index)
+}
+
+func objectToFileDoc(obj *s3.ObjectInfo, objName string) *vfs.TreeFile {
+	md5sum, _ := obj.MD5Sum()
+	name := "unknown"
+	mime, class := vfs.ExtractMimeAndClass(obj.ContentType)
+	fileID, internalID := makeDocID(objName)
+	return &vfs.TreeFile{
+		DirOrFileDoc: vfs.DirOrFileDoc{
+			DirDoc: &vfs.DirDoc{
+				Type:      consts.FileType,
+				DocID:     fileID,
+				DocName:   name,
+				DirID:     "",
+				CreatedAt: obj.LastModified,
+				UpdatedAt: obj.LastModified,
+				Fullpath:  path.Join(vfs.OrphansDirName, name),
+			},
+			ByteSize:   obj.Size,
+			Mime:       mime,
+			Class:      class,
+			MD5Sum:     md5sum,
+			InternalID: internalID,
+		},
+	}
+}
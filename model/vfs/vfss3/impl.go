@@ -0,0 +1,1097 @@
+// Package vfss3 is the implementation of the VFS with an S3-compatible object
+// storage (AWS S3, MinIO, Ceph RGW, etc.) for the content of the files.
+//
+// All the instances share the same bucket, and the objects of an instance
+// have keys prefixed by vfs/<db prefix>/. The layout inside this prefix is the
+// same as the swift layout v3: the files and their old versions, the
+// thumbnails in thumbs/, and the chunks of the resumable uploads in uploads/.
+package vfss3
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/s3"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// maxFileSize is the maximal size of a file. It is the limit of S3 for a
+// CopyObject in a single operation.
+const maxFileSize = 5 << (3 * 10) // 5 GiB
+
+// vfsPrefix is the prefix of the keys for the objects of the VFS of the
+// instances.
+const vfsPrefix = "vfs/"
+
+type s3VFS struct {
+	vfs.Indexer
+	vfs.DiskThresholder
+	c       *s3.Client
+	cluster int
+	domain  string
+	prefix  string
+	context string
+	root    string
+	keys    vfs.Keyring
+	blobs   *vfs.Blobs
+	dedup   bool
+	mu      lock.ErrorRWLocker
+	ctx     context.Context
+	log     *logger.Entry
+}
+
+// New returns a vfs.VFS instance associated with the specified indexer and
+// the S3 client from the configuration. If keys is not nil, the content of
+// the files is encrypted at rest with the keys of this keyring. The new
+// contents are deduplicated if it is enabled in the configuration.
+func New(db vfs.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, keys vfs.Keyring, mu lock.ErrorRWLocker) (vfs.VFS, error) {
+	fs, err := NewWithClient(config.GetS3Client(), db, index, disk, keys, mu)
+	if err != nil {
+		return nil, err
+	}
+	sfs := fs.(*s3VFS)
+	sfs.dedup = vfs.IsDeduplicationEnabled(db.GetContextName())
+	// The blobs have their own lock, as they can be removed by EnsureErased
+	// while the VFS is locked by DestroyDirAndContent.
+	sfs.blobs = vfs.NewBlobs(index, sfs, lock.ReadWrite(db, "vfs-blobs"))
+	return sfs, nil
+}
+
+// NewWithClient is like New, but with an explicit S3 client.
+func NewWithClient(c *s3.Client, db vfs.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, keys vfs.Keyring, mu lock.ErrorRWLocker) (vfs.VFS, error) {
+	return &s3VFS{
+		Indexer:         index,
+		DiskThresholder: disk,
+
+		c:       c,
+		cluster: db.DBCluster(),
+		domain:  db.DomainName(),
+		prefix:  db.DBPrefix(),
+		context: db.GetContextName(),
+		root:    rootKey(db.DBPrefix()),
+		keys:    keys,
+		mu:      mu,
+		ctx:     context.Background(),
+		log:     logger.WithDomain(db.DomainName()).WithNamespace("vfss3"),
+	}, nil
+}
+
+func rootKey(dbPrefix string) string {
+	return vfsPrefix + dbPrefix + "/"
+}
+
+// NewInternalID returns a random string that can be used as an internal_vfs_id.
+func NewInternalID() string {
+	return utils.RandomString(16)
+}
+
+// MakeObjectName builds the name of the object (inside the prefix of the
+// instance) for a given file document. Like for the swift layout v3, it
+// creates virtual subfolders by splitting the document ID, and appends the
+// internalID at the end to regroup all the versions of a file.
+func MakeObjectName(docID, internalID string) string {
+	if len(docID) != 32 || len(internalID) != 16 {
+		return docID + "/" + internalID
+	}
+	return docID[:22] + "/" + docID[22:27] + "/" + docID[27:] + "/" + internalID
+}
+
+func makeDocID(objName string) (string, string) {
+	if len(objName) != 51 {
+		parts := strings.SplitN(objName, "/", 2)
+		if len(parts) < 2 {
+			return objName, ""
+		}
+		return parts[0], parts[1]
+	}
+	return objName[:22] + objName[23:28] + objName[29:34], objName[35:]
+}
+
+// versionInternalID returns the internal ID of the content of a version,
+// whose ID is <file id>/<internal id>.
+func versionInternalID(v *vfs.Version) string {
+	if parts := strings.SplitN(v.DocID, "/", 2); len(parts) > 1 {
+		return parts[1]
+	}
+	return v.DocID
+}
+
+func (sfs *s3VFS) key(docID, internalID string) string {
+	if hash := vfs.BlobOf(internalID); hash != "" {
+		return sfs.blobKey(hash)
+	}
+	return sfs.root + MakeObjectName(docID, internalID)
+}
+
+func (sfs *s3VFS) DBCluster() int {
+	return sfs.cluster
+}
+
+func (sfs *s3VFS) DBPrefix() string {
+	return sfs.prefix
+}
+
+func (sfs *s3VFS) DomainName() string {
+	return sfs.domain
+}
+
+func (sfs *s3VFS) GetContextName() string {
+	return sfs.context
+}
+
+func (sfs *s3VFS) GetIndexer() vfs.Indexer {
+	return sfs.Indexer
+}
+
+func (sfs *s3VFS) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
+	return &s3VFS{
+		Indexer:         index,
+		DiskThresholder: sfs.DiskThresholder,
+		c:               sfs.c,
+		cluster:         sfs.cluster,
+		domain:          sfs.domain,
+		prefix:          sfs.prefix,
+		context:         sfs.context,
+		root:            sfs.root,
+		keys:            sfs.keys,
+		blobs:           sfs.blobs,
+		dedup:           sfs.dedup,
+		mu:              sfs.mu,
+		ctx:             context.Background(),
+		log:             sfs.log,
+	}
+}
+
+// ContainerNames returns the bucket and the prefix of the keys used for this
+// instance.
+func (sfs *s3VFS) ContainerNames() map[string]string {
+	return map[string]string{"bucket": sfs.c.Bucket(), "prefix": sfs.root}
+}
+
+func (sfs *s3VFS) InitFs() error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	// The bucket is shared by all the instances and is created when the stack
+	// starts, so there is nothing to do for the objects.
+	return sfs.Indexer.InitIndex()
+}
+
+func (sfs *s3VFS) Delete() error {
+	sfs.log.Infof("Deleting the objects with prefix %q", sfs.root)
+	return sfs.c.DeletePrefix(sfs.ctx, sfs.root)
+}
+
+func (sfs *s3VFS) CreateDir(doc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	exists, err := sfs.Indexer.DirChildExists(doc.DirID, doc.DocName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	if doc.ID() == "" {
+		return sfs.Indexer.CreateDirDoc(doc)
+	}
+	return sfs.Indexer.CreateNamedDirDoc(doc)
+}
+
+func (sfs *s3VFS) CreateFile(newdoc, olddoc *vfs.FileDoc, opts ...vfs.CreateOptions) (vfs.File, error) {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	diskQuota := sfs.DiskQuota()
+
+	var maxsize, newsize, capsize int64
+	maxsize = maxFileSize
+	newsize = newdoc.ByteSize
+	if diskQuota > 0 {
+		diskUsage, err := sfs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+		maxsize = diskQuota - diskUsage
+		if maxsize > maxFileSize {
+			maxsize = maxFileSize
+		}
+		if quotaBytes := int64(9.0 / 10.0 * float64(diskQuota)); diskUsage <= quotaBytes {
+			capsize = quotaBytes - diskUsage
+		}
+	}
+	if newsize > maxsize {
+		return nil, vfs.ErrFileTooBig
+	}
+
+	if olddoc != nil {
+		newdoc.SetID(olddoc.ID())
+		newdoc.SetRev(olddoc.Rev())
+		newdoc.CreatedAt = olddoc.CreatedAt
+	}
+
+	newpath, err := sfs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		if !vfs.OptionsAllowCreationInTrash(opts) {
+			return nil, vfs.ErrParentInTrash
+		}
+	}
+
+	if olddoc == nil {
+		var exists bool
+		exists, err = sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, os.ErrExist
+		}
+	}
+
+	if newdoc.DocID == "" {
+		if newdoc.DocID, err = couchdb.UUID(sfs); err != nil {
+			return nil, err
+		}
+	}
+
+	newdoc.InternalID = NewInternalID()
+	key := sfs.key(newdoc.DocID, newdoc.InternalID)
+	putOpts := &s3.PutOptions{ContentType: newdoc.Mime}
+	if sfs.keys == nil {
+		putOpts.ContentMD5 = newdoc.MD5Sum
+		if len(newdoc.MD5Sum) > 0 {
+			// The ETag of an object uploaded in several parts is not its MD5
+			// checksum, so we keep it in the metadata for fsck.
+			putOpts.Metadata = map[string]string{"md5": hex.EncodeToString(newdoc.MD5Sum)}
+		}
+	}
+	w := sfs.c.NewWriter(sfs.ctx, key, putOpts)
+	var enc *vfs.EncryptedWriter
+	if sfs.keys != nil {
+		if enc, err = vfs.NewEncryptedWriter(w, sfs.keys); err != nil {
+			_ = w.Abort()
+			return nil, err
+		}
+	}
+	extractor := vfs.NewMetaExtractor(newdoc)
+	var sha hash.Hash
+	if sfs.dedup {
+		sha = vfs.NewBlobHash()
+	}
+
+	return &s3FileCreation{
+		fs:      sfs,
+		w:       w,
+		enc:     enc,
+		sha:     sha,
+		newdoc:  newdoc,
+		olddoc:  olddoc,
+		key:     key,
+		size:    newsize,
+		maxsize: maxsize,
+		capsize: capsize,
+		meta:    extractor,
+	}, nil
+}
+
+func (sfs *s3VFS) DissociateFile(src, dst *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	if src.DirID != dst.DirID || src.DocName != dst.DocName {
+		exists, err := sfs.Indexer.DirChildExists(dst.DirID, dst.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+
+	uuid, err := couchdb.UUID(sfs)
+	if err != nil {
+		return err
+	}
+	dst.DocID = uuid
+
+	// Copy the file (or just add a reference to its blob), as is
+	srcKey := sfs.key(src.DocID, src.InternalID)
+	dstKey := sfs.key(dst.DocID, dst.InternalID)
+	dst.EncryptedAtRest = src.EncryptedAtRest
+	if hash := vfs.BlobOf(dst.InternalID); hash != "" {
+		if err := sfs.blobs.AddRef(hash, src.ByteSize, src.EncryptedAtRest); err != nil {
+			return err
+		}
+	} else {
+		opts := &s3.PutOptions{
+			ContentType: src.Mime,
+			Metadata: map[string]string{
+				"creation-name":  src.Name(),
+				"created-at":     src.CreatedAt.Format(time.RFC3339),
+				"dissociated-of": src.ID(),
+				"md5":            hex.EncodeToString(src.MD5Sum),
+			},
+		}
+		if err := sfs.c.CopyObject(sfs.ctx, srcKey, dstKey, opts); err != nil {
+			return err
+		}
+	}
+	if err := sfs.Indexer.CreateNamedFileDoc(dst); err != nil {
+		_ = sfs.deleteObjects([]string{dstKey})
+		return err
+	}
+
+	// Remove the source
+	thumbsFS := &thumbs{c: sfs.c, root: sfs.root, ctx: sfs.ctx}
+	if err := thumbsFS.RemoveThumbs(src, vfs.ThumbnailFormatNames); err != nil {
+		sfs.log.Infof("Cleaning thumbnails in DissociateFile %s has failed: %s", src.ID(), err)
+	}
+	return sfs.destroyFileLocked(src)
+}
+
+func (sfs *s3VFS) DissociateDir(src, dst *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	if dst.DirID != src.DirID || dst.DocName != src.DocName {
+		exists, err := sfs.Indexer.DirChildExists(dst.DirID, dst.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+
+	if err := sfs.Indexer.CreateDirDoc(dst); err != nil {
+		return err
+	}
+	return sfs.Indexer.DeleteDirDoc(src)
+}
+
+func (sfs *s3VFS) CopyFile(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	if diskQuota := sfs.DiskQuota(); diskQuota > 0 {
+		diskUsage, err := sfs.DiskUsage()
+		if err != nil {
+			return err
+		}
+		if olddoc.ByteSize > diskQuota-diskUsage {
+			return vfs.ErrFileTooBig
+		}
+	}
+
+	exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	newpath, err := sfs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return vfs.ErrParentInTrash
+	}
+
+	if newdoc.DocID, err = couchdb.UUID(sfs); err != nil {
+		return err
+	}
+	newdoc.InternalID = NewInternalID()
+
+	// The content is copied as is, encrypted or not. And a deduplicated
+	// content is not copied: the new file shares its blob
+	newdoc.EncryptedAtRest = olddoc.EncryptedAtRest
+	if hash := vfs.BlobOf(olddoc.InternalID); hash != "" {
+		newdoc.InternalID = vfs.BlobInternalID(newdoc.InternalID, hash)
+		if err := sfs.blobs.AddRef(hash, olddoc.ByteSize, olddoc.EncryptedAtRest); err != nil {
+			return err
+		}
+		if err := sfs.Indexer.CreateNamedFileDoc(newdoc); err != nil {
+			_ = sfs.deleteObjects([]string{sfs.blobKey(hash)})
+			return err
+		}
+		return nil
+	}
+
+	// Copy the file
+	srcKey := sfs.key(olddoc.DocID, olddoc.InternalID)
+	dstKey := sfs.key(newdoc.DocID, newdoc.InternalID)
+	opts := &s3.PutOptions{
+		ContentType: olddoc.Mime,
+		Metadata: map[string]string{
+			"creation-name": newdoc.Name(),
+			"created-at":    newdoc.CreatedAt.Format(time.RFC3339),
+			"copy-of":       olddoc.ID(),
+			"md5":           hex.EncodeToString(olddoc.MD5Sum),
+		},
+	}
+	if err := sfs.c.CopyObject(sfs.ctx, srcKey, dstKey, opts); err != nil {
+		return err
+	}
+	if err := sfs.Indexer.CreateNamedFileDoc(newdoc); err != nil {
+		_ = sfs.c.DeleteObject(sfs.ctx, dstKey)
+		return err
+	}
+	return nil
+}
+
+func (sfs *s3VFS) destroyDir(doc *vfs.DirDoc, push func(vfs.TrashJournal) error, onlyContent bool) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	files, destroyed, err := sfs.Indexer.DeleteDirDocAndContent(doc, onlyContent)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	ids := make([]string, len(files))
+	keys := make([]string, len(files))
+	for i, file := range files {
+		ids[i] = file.DocID
+		keys[i] = sfs.key(file.DocID, file.InternalID)
+	}
+	return push(vfs.TrashJournal{
+		FileIDs:     ids,
+		ObjectNames: keys,
+	})
+}
+
+func (sfs *s3VFS) DestroyDirContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
+	return sfs.destroyDir(doc, push, true)
+}
+
+func (sfs *s3VFS) DestroyDirAndContent(doc *vfs.DirDoc, push func(vfs.TrashJournal) error) error {
+	return sfs.destroyDir(doc, push, false)
+}
+
+func (sfs *s3VFS) DestroyFile(doc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.destroyFileLocked(doc)
+}
+
+func (sfs *s3VFS) destroyFileLocked(doc *vfs.FileDoc) error {
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	keys := []string{sfs.key(doc.DocID, doc.InternalID)}
+	if err := sfs.Indexer.DeleteFileDoc(doc); err != nil {
+		return err
+	}
+	destroyed := doc.ByteSize
+	if versions, errv := vfs.VersionsFor(sfs, doc.DocID); errv == nil {
+		for _, v := range versions {
+			keys = append(keys, sfs.key(doc.DocID, versionInternalID(v)))
+			destroyed += v.ByteSize
+		}
+		if err := sfs.Indexer.BatchDeleteVersions(versions); err != nil {
+			sfs.log.Warnf("DestroyFile failed on BatchDeleteVersions: %s", err)
+		}
+	}
+	if err := sfs.deleteObjects(keys); err != nil {
+		sfs.log.Warnf("DestroyFile failed on DeleteObjects: %s", err)
+	}
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	return nil
+}
+
+func (sfs *s3VFS) EnsureErased(journal vfs.TrashJournal) error {
+	// No lock needed (the blobs have their own lock)
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	keys := journal.ObjectNames
+	var errm error
+	var destroyed int64
+	var allVersions []*vfs.Version
+	for _, fileID := range journal.FileIDs {
+		versions, err := vfs.VersionsFor(sfs, fileID)
+		if err != nil {
+			if !couchdb.IsNoDatabaseError(err) {
+				sfs.log.Warnf("EnsureErased failed on VersionsFor(%s): %s", fileID, err)
+				errm = multierror.Append(errm, err)
+			}
+			continue
+		}
+		for _, v := range versions {
+			keys = append(keys, sfs.key(fileID, versionInternalID(v)))
+			destroyed += v.ByteSize
+		}
+		allVersions = append(allVersions, versions...)
+	}
+	if err := sfs.Indexer.BatchDeleteVersions(allVersions); err != nil {
+		sfs.log.Warnf("EnsureErased failed on BatchDeleteVersions: %s", err)
+		errm = multierror.Append(errm, err)
+	}
+	if err := sfs.deleteObjects(keys); err != nil {
+		sfs.log.Warnf("EnsureErased failed on DeleteObjects: %s", err)
+		errm = multierror.Append(errm, err)
+	}
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	return errm
+}
+
+// openObject opens the object for the content with the given internal ID.
+// encrypted is the EncryptedAtRest field of its file or version.
+func (sfs *s3VFS) openObject(docID, internalID string, encrypted bool) (vfs.File, error) {
+	encrypted, err := sfs.blobs.ContentEncrypted(vfs.BlobOf(internalID), encrypted)
+	if err != nil {
+		return nil, err
+	}
+	r, err := sfs.c.OpenReader(sfs.ctx, sfs.key(docID, internalID))
+	if s3.IsNotFound(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return vfs.DecryptFile(&s3FileOpen{r}, sfs.keys, encrypted)
+}
+
+func (sfs *s3VFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.openObject(doc.DocID, doc.InternalID, doc.EncryptedAtRest)
+}
+
+func (sfs *s3VFS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.openObject(doc.DocID, versionInternalID(version), version.EncryptedAtRest)
+}
+
+func (sfs *s3VFS) ImportFileVersion(version *vfs.Version, content io.ReadCloser) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	diskQuota := sfs.DiskQuota()
+	if diskQuota > 0 {
+		diskUsage, err := sfs.DiskUsage()
+		if err != nil {
+			return err
+		}
+		if diskUsage+version.ByteSize > diskQuota {
+			return vfs.ErrFileTooBig
+		}
+	}
+
+	parts := strings.SplitN(version.DocID, "/", 2)
+	if len(parts) != 2 {
+		return vfs.ErrIllegalFilename
+	}
+	key := sfs.key(parts[0], parts[1])
+
+	// A deduplicated content is uploaded first in its own object, and then
+	// moved to its blob, which can already exist.
+	blob := vfs.BlobOf(parts[1])
+	var sha hash.Hash
+	if blob != "" {
+		key = sfs.key(parts[0], NewInternalID())
+		sha = vfs.NewBlobHash()
+		content = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(content, sha), content}
+	}
+
+	putOpts := &s3.PutOptions{ContentType: "application/octet-stream"}
+	if sfs.keys == nil {
+		putOpts.ContentMD5 = version.MD5Sum
+		putOpts.Metadata = map[string]string{"md5": hex.EncodeToString(version.MD5Sum)}
+	}
+	w := sfs.c.NewWriter(sfs.ctx, key, putOpts)
+	var err error
+	if sfs.keys != nil {
+		var enc *vfs.EncryptedWriter
+		if enc, err = vfs.NewEncryptedWriter(w, sfs.keys); err == nil {
+			_, err = io.Copy(enc, content)
+			if errc := enc.Close(); err == nil {
+				err = errc
+			}
+			if err == nil && !bytes.Equal(enc.MD5Sum(), version.MD5Sum) {
+				err = vfs.ErrInvalidHash
+			}
+		}
+	} else {
+		_, err = io.Copy(w, content)
+	}
+	if errc := content.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		_ = w.Abort()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		if err == s3.ErrBadDigest {
+			err = vfs.ErrInvalidHash
+		}
+		return err
+	}
+
+	version.EncryptedAtRest = sfs.keys != nil
+	if blob != "" {
+		if vfs.BlobHash(sha) != blob {
+			err = vfs.ErrInvalidHash
+		} else {
+			version.EncryptedAtRest, err = sfs.blobs.Store(key, blob, version.ByteSize, version.EncryptedAtRest)
+		}
+		if err != nil {
+			_ = sfs.c.DeleteObject(sfs.ctx, key)
+			return err
+		}
+		key = sfs.blobKey(blob)
+	}
+
+	if err = sfs.Indexer.CreateVersion(version); err != nil {
+		_ = sfs.deleteObjects([]string{key})
+		return err
+	}
+	return nil
+}
+
+func (sfs *s3VFS) RevertFileVersion(doc *vfs.FileDoc, version *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	save := vfs.NewVersion(doc)
+	if err := sfs.Indexer.CreateVersion(save); err != nil {
+		return err
+	}
+
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	newdoc.InternalID = versionInternalID(version)
+	vfs.SetMetaFromVersion(newdoc, version)
+	if err := sfs.Indexer.UpdateFileDoc(doc, newdoc); err != nil {
+		_ = sfs.Indexer.DeleteVersion(save)
+		return err
+	}
+
+	return sfs.Indexer.DeleteVersion(version)
+}
+
+// UpdateFileDoc calls the indexer UpdateFileDoc function and adds a few checks
+// before actually calling this method:
+//   - locks the filesystem for writing
+//   - checks in case we have a move operation that the new path is available
+//
+// @override Indexer.UpdateFileDoc
+func (sfs *s3VFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+	return sfs.Indexer.UpdateFileDoc(olddoc, newdoc)
+}
+
+// UdpdateDirDoc calls the indexer UdpdateDirDoc function and adds a few checks
+// before actually calling this method:
+//   - locks the filesystem for writing
+//   - checks in case we have a move operation that the new path is available
+//
+// @override Indexer.UpdateDirDoc
+func (sfs *s3VFS) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+	return sfs.Indexer.UpdateDirDoc(olddoc, newdoc)
+}
+
+func (sfs *s3VFS) DirByID(fileID string) (*vfs.DirDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirByID(fileID)
+}
+
+func (sfs *s3VFS) DirByPath(name string) (*vfs.DirDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirByPath(name)
+}
+
+func (sfs *s3VFS) FileByID(fileID string) (*vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FileByID(fileID)
+}
+
+func (sfs *s3VFS) FileByPath(name string) (*vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FileByPath(name)
+}
+
+func (sfs *s3VFS) FilePath(doc *vfs.FileDoc) (string, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return "", lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FilePath(doc)
+}
+
+func (sfs *s3VFS) DirOrFileByID(fileID string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirOrFileByID(fileID)
+}
+
+func (sfs *s3VFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirOrFileByPath(name)
+}
+
+// s3FileCreation represents a file open for writing. It is used to create a
+// file or to modify the content of a file.
+//
+// s3FileCreation implements io.WriteCloser.
+type s3FileCreation struct {
+	fs      *s3VFS
+	w       *s3.Writer
+	enc     *vfs.EncryptedWriter
+	sha     hash.Hash
+	newdoc  *vfs.FileDoc
+	olddoc  *vfs.FileDoc
+	key     string
+	size    int64
+	maxsize int64
+	capsize int64
+	meta    *vfs.MetaExtractor
+	err     error
+}
+
+func (f *s3FileCreation) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) ReadAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	if f.meta != nil {
+		if _, err := (*f.meta).Write(p); err != nil && err != io.ErrClosedPipe {
+			(*f.meta).Abort(err)
+			f.meta = nil
+		}
+	}
+
+	var n int
+	var err error
+	if f.enc != nil {
+		n, err = f.enc.Write(p)
+	} else {
+		n, err = f.w.Write(p)
+	}
+	if f.sha != nil {
+		_, _ = f.sha.Write(p[:n])
+	}
+	if err != nil {
+		f.err = err
+		return n, err
+	}
+
+	written := f.written()
+	if f.maxsize >= 0 && written > f.maxsize {
+		f.err = vfs.ErrFileTooBig
+		return n, f.err
+	}
+
+	if f.size >= 0 && written > f.size {
+		f.err = vfs.ErrContentLengthMismatch
+		return n, f.err
+	}
+
+	return n, nil
+}
+
+// written returns the number of bytes of the plain content written.
+func (f *s3FileCreation) written() int64 {
+	if f.enc != nil {
+		return f.enc.Written()
+	}
+	return f.w.Written()
+}
+
+func (f *s3FileCreation) Close() (err error) {
+	defer func() {
+		if err != nil {
+			// remove the object if an error occurred
+			_ = f.fs.c.DeleteObject(f.fs.ctx, f.key)
+			// If an error has occurred that is not due to the index update, we should
+			// delete the file from the index.
+			_, isCouchErr := couchdb.IsCouchError(err)
+			if !isCouchErr && f.olddoc == nil {
+				_ = f.fs.Indexer.DeleteFileDoc(f.newdoc)
+			}
+		}
+	}()
+
+	newdoc, olddoc, written := f.newdoc, f.olddoc, f.written()
+	if f.err == nil && f.size >= 0 && written != f.size {
+		f.err = vfs.ErrContentLengthMismatch
+	}
+	if f.enc != nil && f.err == nil {
+		f.err = f.enc.Close()
+		if f.err == nil && newdoc.MD5Sum != nil && !bytes.Equal(newdoc.MD5Sum, f.enc.MD5Sum()) {
+			f.err = vfs.ErrInvalidHash
+		}
+	}
+
+	if f.err != nil {
+		_ = f.w.Abort()
+	} else if err = f.w.Close(); err != nil {
+		if err == s3.ErrBadDigest {
+			err = vfs.ErrInvalidHash
+		}
+		f.err = err
+	}
+
+	if f.meta != nil {
+		if f.err != nil {
+			(*f.meta).Abort(f.err)
+		} else if errc := (*f.meta).Close(); errc == nil {
+			vfs.MergeMetadata(newdoc, (*f.meta).Result())
+		}
+		f.meta = nil
+	}
+
+	if f.err != nil {
+		return f.err
+	}
+
+	if newdoc.MD5Sum == nil && f.enc != nil {
+		newdoc.MD5Sum = f.enc.MD5Sum()
+	} else if newdoc.MD5Sum == nil {
+		newdoc.MD5Sum = f.w.MD5Sum()
+	}
+
+	if f.size < 0 {
+		newdoc.ByteSize = written
+	}
+
+	lockerr := f.fs.mu.Lock()
+	if lockerr != nil {
+		return lockerr
+	}
+	defer f.fs.mu.Unlock()
+
+	// Check again that a file with the same path does not exist. It can happen
+	// when the same file is uploaded twice in parallel.
+	if olddoc == nil {
+		exists, err := f.fs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+
+	var newpath string
+	newpath, err = f.fs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return err
+	}
+	newdoc.Trashed = strings.HasPrefix(newpath, vfs.TrashDirName+"/")
+
+	// If the deduplication fails, the content is kept in its own object
+	newdoc.EncryptedAtRest = f.enc != nil
+	if f.sha != nil {
+		hash := vfs.BlobHash(f.sha)
+		if encrypted, errb := f.fs.blobs.Store(f.key, hash, written, newdoc.EncryptedAtRest); errb != nil {
+			f.fs.log.Warnf("Cannot deduplicate %s: %s", newdoc.DocID, errb)
+		} else {
+			newdoc.InternalID = vfs.BlobInternalID(newdoc.InternalID, hash)
+			newdoc.EncryptedAtRest = encrypted
+		}
+	}
+
+	var v *vfs.Version
+	if olddoc != nil {
+		v = vfs.NewVersion(olddoc)
+		err = f.fs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	} else if newdoc.ID() == "" {
+		err = f.fs.Indexer.CreateFileDoc(newdoc)
+	} else {
+		err = f.fs.Indexer.CreateNamedFileDoc(newdoc)
+	}
+	if err != nil {
+		if hash := vfs.BlobOf(newdoc.InternalID); hash != "" {
+			_ = f.fs.deleteObjects([]string{f.fs.blobKey(hash)})
+		}
+		return err
+	}
+
+	if v != nil {
+		cleanV, toClean, _ := vfs.FindVersionsToClean(f.fs, newdoc.DocID, v)
+		if !cleanV {
+			if errv := f.fs.Indexer.CreateVersion(v); errv != nil {
+				cleanV = true
+			}
+		}
+		if cleanV {
+			_ = f.fs.deleteObjects([]string{f.fs.key(newdoc.DocID, versionInternalID(v))})
+		}
+		for _, old := range toClean {
+			_ = cleanOldVersion(f.fs, newdoc.DocID, old)
+		}
+	}
+
+	if f.capsize > 0 && f.size >= f.capsize {
+		vfs.PushDiskQuotaAlert(f.fs, true)
+	}
+
+	return nil
+}
+
+func (sfs *s3VFS) CleanOldVersion(fileID string, v *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return cleanOldVersion(sfs, fileID, v)
+}
+
+func cleanOldVersion(sfs *s3VFS, fileID string, v *vfs.Version) error {
+	if err := sfs.Indexer.DeleteVersion(v); err != nil {
+		return err
+	}
+	return sfs.deleteObjects([]string{sfs.key(fileID, versionInternalID(v))})
+}
+
+func (sfs *s3VFS) ClearOldVersions() error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	versions, err := sfs.Indexer.AllVersions()
+	if err != nil {
+		return err
+	}
+	var keys []string
+	var destroyed int64
+	for _, v := range versions {
+		if parts := strings.SplitN(v.DocID, "/", 2); len(parts) > 1 {
+			keys = append(keys, sfs.key(parts[0], parts[1]))
+		}
+		destroyed += v.ByteSize
+	}
+	if err := sfs.Indexer.BatchDeleteVersions(versions); err != nil {
+		return err
+	}
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	return sfs.deleteObjects(keys)
+}
+
+type s3FileOpen struct {
+	r *s3.Reader
+}
+
+func (f *s3FileOpen) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *s3FileOpen) ReadAt(p []byte, off int64) (int, error) {
+	return f.r.ReadAt(p, off)
+}
+
+func (f *s3FileOpen) Seek(offset int64, whence int) (int64, error) {
+	return f.r.Seek(offset, whence)
+}
+
+func (f *s3FileOpen) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileOpen) Close() error {
+	return f.r.Close()
+}
+
+var (
+	_ vfs.VFS  = &s3VFS{}
+	_ vfs.File = &s3FileCreation{}
+	_ vfs.File = &s3FileOpen{}
+)
@@ -0,0 +1,177 @@
+package vfss3
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/s3"
+	"github.com/labstack/echo/v4"
+)
+
+const thumbsPrefix = "thumbs/"
+
+var unixEpochZero = time.Time{}
+
+// NewThumbsFs creates a new thumb filesystem based on S3. The thumbnails are
+// stored with the other objects of the instance.
+func NewThumbsFs(db prefixer.Prefixer) vfs.Thumbser {
+	return NewThumbsFsWithClient(config.GetS3Client(), db)
+}
+
+// NewThumbsFsWithClient is like NewThumbsFs, but with an explicit S3 client.
+func NewThumbsFsWithClient(c *s3.Client, db prefixer.Prefixer) vfs.Thumbser {
+	return &thumbs{
+		c:    c,
+		root: rootKey(db.DBPrefix()),
+		ctx:  context.Background(),
+	}
+}
+
+type thumbs struct {
+	c    *s3.Client
+	root string
+	ctx  context.Context
+}
+
+type thumb struct {
+	*s3.Writer
+	c   *s3.Client
+	key string
+}
+
+func (t *thumb) Abort() error {
+	ctx := context.Background()
+	erra := t.Writer.Abort()
+	// Create an empty file that indicates that the thumbnail generation has failed
+	_, errp := t.c.PutObject(ctx, t.key, bytes.NewReader(nil), 0, &s3.PutOptions{
+		ContentType: echo.MIMEOctetStream,
+	})
+	if erra != nil {
+		return erra
+	}
+	return errp
+}
+
+func (t *thumb) Commit() error {
+	return t.Writer.Close()
+}
+
+func (t *thumbs) CreateThumb(img *vfs.FileDoc, format string) (vfs.ThumbFiler, error) {
+	key := t.makeKey(img.ID(), format)
+	w := t.c.NewWriter(t.ctx, key, &s3.PutOptions{
+		ContentType: "image/jpeg",
+		Metadata:    map[string]string{"file-md5": hex.EncodeToString(img.MD5Sum)},
+	})
+	return &thumb{Writer: w, c: t.c, key: key}, nil
+}
+
+func (t *thumbs) ThumbExists(img *vfs.FileDoc, format string) (bool, error) {
+	key := t.makeKey(img.ID(), format)
+	info, err := t.c.HeadObject(t.ctx, key)
+	if s3.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Size == 0 {
+		return false, nil
+	}
+	if md5 := info.Metadata["file-md5"]; md5 != "" {
+		md5sum, err := hex.DecodeString(md5)
+		if err == nil && !bytes.Equal(md5sum, img.MD5Sum) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (t *thumbs) RemoveThumbs(img *vfs.FileDoc, formats []string) error {
+	keys := make([]string, len(formats))
+	for i, format := range formats {
+		keys[i] = t.makeKey(img.ID(), format)
+	}
+	return t.c.DeleteObjects(t.ctx, keys)
+}
+
+func (t *thumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request, img *vfs.FileDoc, format string) error {
+	key := t.makeKey(img.ID(), format)
+	r, err := t.c.OpenReader(t.ctx, key)
+	if err != nil {
+		return wrapS3Err(err)
+	}
+	defer r.Close()
+
+	info := r.Info()
+	if info.ContentType == echo.MIMEOctetStream {
+		return os.ErrInvalid
+	}
+
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, info.ETag))
+	w.Header().Set("Content-Type", info.ContentType)
+	http.ServeContent(w, req, key, unixEpochZero, r)
+	return nil
+}
+
+func (t *thumbs) CreateNoteThumb(id, mime, format string) (vfs.ThumbFiler, error) {
+	key := t.makeKey(id, format)
+	w := t.c.NewWriter(t.ctx, key, &s3.PutOptions{ContentType: mime})
+	return &thumb{Writer: w, c: t.c, key: key}, nil
+}
+
+func (t *thumbs) OpenNoteThumb(id, format string) (io.ReadCloser, error) {
+	key := t.makeKey(id, format)
+	obj, err := t.c.GetObject(t.ctx, key, 0, 0)
+	if err != nil {
+		return nil, wrapS3Err(err)
+	}
+	return obj.Body, nil
+}
+
+func (t *thumbs) RemoveNoteThumb(id string, formats []string) error {
+	keys := make([]string, len(formats))
+	for i, format := range formats {
+		keys[i] = t.makeKey(id, format)
+	}
+	return t.c.DeleteObjects(t.ctx, keys)
+}
+
+func (t *thumbs) ServeNoteThumbContent(w http.ResponseWriter, req *http.Request, id string) error {
+	key := t.makeKey(id, consts.NoteImageThumbFormat)
+	r, err := t.c.OpenReader(t.ctx, key)
+	if err != nil {
+		key = t.makeKey(id, consts.NoteImageOriginalFormat)
+		r, err = t.c.OpenReader(t.ctx, key)
+		if err != nil {
+			return wrapS3Err(err)
+		}
+	}
+	defer r.Close()
+
+	info := r.Info()
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, info.ETag))
+	w.Header().Set("Content-Type", info.ContentType)
+	http.ServeContent(w, req, key, unixEpochZero, r)
+	return nil
+}
+
+func (t *thumbs) makeKey(imgID string, format string) string {
+	return fmt.Sprintf("%s%s%s-%s", t.root, thumbsPrefix, imgID, format)
+}
+
+func wrapS3Err(err error) error {
+	if s3.IsNotFound(err) {
+		return os.ErrNotExist
+	}
+	return err
+}
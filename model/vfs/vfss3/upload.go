@@ -0,0 +1,50 @@
+package vfss3
+
+import (
+	"io"
+	"os"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/s3"
+)
+
+const uploadsPrefix = "uploads/"
+
+func (sfs *s3VFS) uploadChunkKey(sessionID, chunkName string) string {
+	return sfs.root + uploadsPrefix + sessionID + "/" + chunkName
+}
+
+// CheckChunkedUpload is part of the vfs.ChunkedUploader interface
+func (sfs *s3VFS) CheckChunkedUpload() error {
+	return nil
+}
+
+func (sfs *s3VFS) CreateUploadChunk(sessionID, chunkName string) (io.WriteCloser, error) {
+	key := sfs.uploadChunkKey(sessionID, chunkName)
+	w := sfs.c.NewWriter(sfs.ctx, key, &s3.PutOptions{
+		ContentType: "application/octet-stream",
+	})
+	return vfs.EncryptWriteCloser(w, sfs.keys)
+}
+
+func (sfs *s3VFS) OpenUploadChunk(sessionID, chunkName string) (io.ReadCloser, error) {
+	key := sfs.uploadChunkKey(sessionID, chunkName)
+	obj, err := sfs.c.GetObject(sfs.ctx, key, 0, 0)
+	if s3.IsNotFound(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return vfs.DecryptReader(obj.Body, sfs.keys, sfs.keys != nil)
+}
+
+func (sfs *s3VFS) DeleteUploadChunk(sessionID, chunkName string) error {
+	return sfs.c.DeleteObject(sfs.ctx, sfs.uploadChunkKey(sessionID, chunkName))
+}
+
+func (sfs *s3VFS) DeleteUploadChunks(sessionID string) error {
+	return sfs.c.DeletePrefix(sfs.ctx, sfs.root+uploadsPrefix+sessionID+"/")
+}
+
+var _ vfs.ChunkedUploader = (*s3VFS)(nil)
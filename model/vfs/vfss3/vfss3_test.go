@@ -0,0 +1,349 @@
+package vfss3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/s3"
+	"github.com/cozy/cozy-stack/pkg/s3/s3test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type contexter struct{}
+
+func (c *contexter) DBCluster() int         { return 0 }
+func (c *contexter) DomainName() string     { return "alice.cozy.localhost" }
+func (c *contexter) DBPrefix() string       { return "alice-prefix" }
+func (c *contexter) GetContextName() string { return "default" }
+
+type noopLocker struct{}
+
+func (l noopLocker) Lock() error  { return nil }
+func (l noopLocker) Unlock()      {}
+func (l noopLocker) RLock() error { return nil }
+func (l noopLocker) RUnlock()     {}
+
+func newTestClient(t *testing.T) (*s3.Client, *s3test.Server) {
+	server := s3test.NewServer()
+	t.Cleanup(server.Close)
+	c, err := s3.NewClient(s3.Options{
+		Endpoint:  server.URL,
+		Bucket:    "cozy",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.CreateBucket(context.Background()))
+	return c, server
+}
+
+func TestObjectName(t *testing.T) {
+	docID := "a6a7d8f9d6d7e8f0a1b2c3d4e5f6a7b8"
+	internalID := "qwertyuiopasdfgh"
+	name := MakeObjectName(docID, internalID)
+	assert.Equal(t, "a6a7d8f9d6d7e8f0a1b2c3/d4e5f/6a7b8/qwertyuiopasdfgh", name)
+	id, internal := makeDocID(name)
+	assert.Equal(t, docID, id)
+	assert.Equal(t, internalID, internal)
+
+	id, internal = makeDocID(MakeObjectName("io.cozy.files.root-dir", "foo"))
+	assert.Equal(t, "io.cozy.files.root-dir", id)
+	assert.Equal(t, "foo", internal)
+}
+
+func TestOpenFile(t *testing.T) {
+	c, _ := newTestClient(t)
+	fs, err := NewWithClient(c, &contexter{}, nil, nil, nil, noopLocker{})
+	require.NoError(t, err)
+	sfs := fs.(*s3VFS)
+
+	doc := &vfs.FileDoc{DocID: "a6a7d8f9d6d7e8f0a1b2c3d4e5f6a7b8", InternalID: "qwertyuiopasdfgh"}
+	_, err = fs.OpenFile(doc)
+	assert.Equal(t, os.ErrNotExist, err)
+
+	content := []byte("Hello, world!")
+	key := sfs.key(doc.DocID, doc.InternalID)
+	assert.Equal(t, "vfs/alice-prefix/a6a7d8f9d6d7e8f0a1b2c3/d4e5f/6a7b8/qwertyuiopasdfgh", key)
+	_, err = c.PutObject(context.Background(), key, bytes.NewReader(content), int64(len(content)), nil)
+	require.NoError(t, err)
+
+	f, err := fs.OpenFile(doc)
+	require.NoError(t, err)
+	defer f.Close()
+	p := make([]byte, 5)
+	n, err := f.ReadAt(p, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(p[:n]))
+	_, err = f.Seek(7, io.SeekStart)
+	assert.NoError(t, err)
+	buf, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "world!", string(buf))
+	_, err = f.Write(p)
+	assert.Equal(t, os.ErrInvalid, err)
+}
+
+type testKeyring struct {
+	key []byte
+}
+
+func (kr *testKeyring) CurrentFilesKey() (uint32, []byte, error) { return 1, kr.key, nil }
+
+func (kr *testKeyring) FilesKey(id uint32) ([]byte, error) {
+	if id != 1 {
+		return nil, vfs.ErrUnknownEncryptionKey
+	}
+	return kr.key, nil
+}
+
+func TestEncryptedContent(t *testing.T) {
+	c, server := newTestClient(t)
+	keys := &testKeyring{key: bytes.Repeat([]byte{42}, 32)}
+	fs, err := NewWithClient(c, &contexter{}, nil, nil, keys, noopLocker{})
+	require.NoError(t, err)
+	sfs := fs.(*s3VFS)
+
+	// A content written before the encryption was enabled
+	content := []byte("Hello, world!")
+	sum := md5.Sum(content)
+	doc := &vfs.FileDoc{DocID: "a6a7d8f9d6d7e8f0a1b2c3d4e5f6a7b8", InternalID: "qwertyuiopasdfgh", MD5Sum: sum[:]}
+	key := sfs.key(doc.DocID, doc.InternalID)
+	_, err = c.PutObject(context.Background(), key, bytes.NewReader(content), int64(len(content)), nil)
+	require.NoError(t, err)
+
+	done, err := sfs.ReencryptContent(doc, nil)
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.True(t, doc.EncryptedAtRest)
+	stored := server.Content("cozy", key)
+	assert.EqualValues(t, vfs.EncryptedSize(int64(len(content))), len(stored))
+	assert.NotContains(t, string(stored), "world")
+	done, err = sfs.ReencryptContent(doc, nil)
+	require.NoError(t, err)
+	assert.False(t, done)
+
+	f, err := fs.OpenFile(doc)
+	require.NoError(t, err)
+	defer f.Close()
+	p := make([]byte, 5)
+	n, err := f.ReadAt(p, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(p[:n]))
+	size, err := f.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(content), size)
+	_, err = f.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	buf, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, content, buf)
+
+	checksum, size, err := sfs.objectChecksum(&s3.ObjectInfo{Key: key, Size: int64(len(stored))}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, sum[:], checksum)
+	assert.EqualValues(t, len(content), size)
+}
+
+func TestUploadChunks(t *testing.T) {
+	c, server := newTestClient(t)
+	fs, err := NewWithClient(c, &contexter{}, nil, nil, nil, noopLocker{})
+	require.NoError(t, err)
+	uploader := fs.(vfs.ChunkedUploader)
+	assert.NoError(t, uploader.CheckChunkedUpload())
+
+	for _, name := range []string{"a", "b"} {
+		w, err := uploader.CreateUploadChunk("session", name)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, "chunk "+name)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+	r, err := uploader.OpenUploadChunk("session", "b")
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "chunk b", string(buf))
+
+	_, err = uploader.OpenUploadChunk("session", "c")
+	assert.Equal(t, os.ErrNotExist, err)
+
+	require.NoError(t, uploader.DeleteUploadChunk("session", "a"))
+	assert.Equal(t, []string{"vfs/alice-prefix/uploads/session/b"}, server.Keys("cozy"))
+	require.NoError(t, uploader.DeleteUploadChunks("session"))
+	assert.Empty(t, server.Keys("cozy"))
+}
+
+func TestThumbs(t *testing.T) {
+	c, server := newTestClient(t)
+	thumbsFS := NewThumbsFsWithClient(c, &contexter{})
+
+	jpeg := []byte("not really a JPEG")
+	sum := md5.Sum([]byte("the original image"))
+	img := &vfs.FileDoc{DocID: "image-id", MD5Sum: sum[:]}
+
+	ok, err := thumbsFS.ThumbExists(img, "small")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	th, err := thumbsFS.CreateThumb(img, "small")
+	require.NoError(t, err)
+	_, err = th.Write(jpeg)
+	require.NoError(t, err)
+	require.NoError(t, th.Commit())
+	assert.Equal(t, jpeg, server.Content("cozy", "vfs/alice-prefix/thumbs/image-id-small"))
+
+	ok, err = thumbsFS.ThumbExists(img, "small")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// The thumbnail is outdated if the content of the image has changed
+	other := md5.Sum([]byte("another image"))
+	ok, err = thumbsFS.ThumbExists(&vfs.FileDoc{DocID: "image-id", MD5Sum: other[:]}, "small")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	require.NoError(t, thumbsFS.ServeThumbContent(rec, req, img, "small"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "image/jpeg", rec.Header().Get("Content-Type"))
+	assert.Equal(t, jpeg, rec.Body.Bytes())
+
+	// A failed generation leaves an empty object
+	th, err = thumbsFS.CreateThumb(img, "large")
+	require.NoError(t, err)
+	require.NoError(t, th.Abort())
+	ok, err = thumbsFS.ThumbExists(img, "large")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	err = thumbsFS.ServeThumbContent(httptest.NewRecorder(), req, img, "large")
+	assert.Equal(t, os.ErrInvalid, err)
+
+	require.NoError(t, thumbsFS.RemoveThumbs(img, []string{"small", "large"}))
+	assert.Empty(t, server.Keys("cozy"))
+}
+
+// memBlobIndexer keeps the reference counts of the blobs in memory
+type memBlobIndexer struct {
+	vfs.Indexer
+	refs      map[string]int
+	size      map[string]int64
+	encrypted map[string]bool
+}
+
+func (m *memBlobIndexer) AddBlobRef(hash string, size int64, encrypted bool) (*vfs.BlobRef, error) {
+	m.refs[hash]++
+	m.size[hash] = size
+	if m.refs[hash] == 1 {
+		m.encrypted[hash] = encrypted
+	}
+	return m.GetBlobRef(hash)
+}
+
+func (m *memBlobIndexer) GetBlobRef(hash string) (*vfs.BlobRef, error) {
+	return &vfs.BlobRef{
+		DocID:     hash,
+		Refs:      m.refs[hash],
+		Size:      m.size[hash],
+		Encrypted: m.encrypted[hash],
+	}, nil
+}
+
+func (m *memBlobIndexer) SetBlobEncrypted(hash string, encrypted bool) error {
+	m.encrypted[hash] = encrypted
+	return nil
+}
+
+func (m *memBlobIndexer) RemoveBlobRef(hash string) (bool, error) {
+	m.refs[hash]--
+	if m.refs[hash] > 0 {
+		return false, nil
+	}
+	delete(m.refs, hash)
+	delete(m.size, hash)
+	delete(m.encrypted, hash)
+	return true, nil
+}
+
+func (m *memBlobIndexer) BlobsSavedSpace() (int64, error) {
+	var saved int64
+	for hash, refs := range m.refs {
+		saved += int64(refs-1) * m.size[hash]
+	}
+	return saved, nil
+}
+
+func TestBlobs(t *testing.T) {
+	c, server := newTestClient(t)
+	fs, err := NewWithClient(c, &contexter{}, nil, nil, nil, noopLocker{})
+	require.NoError(t, err)
+	sfs := fs.(*s3VFS)
+	blobs := &memBlobIndexer{
+		refs:      make(map[string]int),
+		size:      make(map[string]int64),
+		encrypted: make(map[string]bool),
+	}
+	sfs.blobs = vfs.NewBlobs(blobs, sfs, noopLocker{})
+
+	content := []byte("Hello, world!")
+	sha := vfs.NewBlobHash()
+	_, _ = sha.Write(content)
+	hash := vfs.BlobHash(sha)
+	internalID := vfs.BlobInternalID("qwertyuiopasdfgh", hash)
+	assert.Equal(t, hash, vfs.BlobOf(internalID))
+	assert.Equal(t, "", vfs.BlobOf("qwertyuiopasdfgh"))
+
+	// The key of a deduplicated content is the one of its blob
+	docID := "a6a7d8f9d6d7e8f0a1b2c3d4e5f6a7b8"
+	blobKey := sfs.key(docID, internalID)
+	assert.Equal(t, "vfs/alice-prefix/blobs/"+hash, blobKey)
+	assert.Equal(t, blobKey, sfs.key("another-id", vfs.BlobInternalID("azertyuiopqsdfgh", hash)))
+
+	// Two uploads with the same content share the same blob. The blob has
+	// been written in clear, and stays so even if the second upload was
+	// encrypted.
+	for i, tmp := range []string{"tmp1", "tmp2"} {
+		tmpKey := sfs.key(docID, tmp)
+		_, err = c.PutObject(context.Background(), tmpKey, bytes.NewReader(content), int64(len(content)), nil)
+		require.NoError(t, err)
+		encrypted, err := sfs.blobs.Store(tmpKey, hash, int64(len(content)), i == 1)
+		require.NoError(t, err)
+		assert.False(t, encrypted)
+		assert.Nil(t, server.Content("cozy", tmpKey))
+	}
+	assert.Equal(t, content, server.Content("cozy", blobKey))
+	assert.Equal(t, 2, blobs.refs[hash])
+	saved, err := blobs.BlobsSavedSpace()
+	require.NoError(t, err)
+	assert.EqualValues(t, len(content), saved)
+
+	f, err := fs.OpenFile(&vfs.FileDoc{DocID: docID, InternalID: internalID})
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, content, buf)
+	require.NoError(t, f.Close())
+
+	// The blob is deleted only with its last reference
+	other := sfs.key(docID, "qwertyuiopasdfgh")
+	_, err = c.PutObject(context.Background(), other, bytes.NewReader(content), int64(len(content)), nil)
+	require.NoError(t, err)
+	require.NoError(t, sfs.deleteObjects([]string{blobKey, other}))
+	assert.Nil(t, server.Content("cozy", other))
+	assert.Equal(t, content, server.Content("cozy", blobKey))
+	assert.Equal(t, 1, blobs.refs[hash])
+	require.NoError(t, sfs.deleteObjects([]string{blobKey}))
+	assert.Nil(t, server.Content("cozy", blobKey))
+	assert.Empty(t, blobs.refs)
+}
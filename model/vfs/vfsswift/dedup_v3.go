@@ -0,0 +1,121 @@
+package vfsswift
+
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/ncw/swift/v2"
+)
+
+// blobsPrefixV3 is the prefix of the objects for the contents shared by
+// several files and versions, when the deduplication is enabled. They are
+// followed by the SHA-256 checksum of the content.
+const blobsPrefixV3 = "blobs/"
+
+func makeBlobNameV3(hash string) string {
+	return blobsPrefixV3 + hash
+}
+
+// objectName returns the name of the object for the given content: a
+// deduplicated content is stored in its blob.
+func (sfs *swiftVFSV3) objectName(docID, internalID string) string {
+	if hash := vfs.BlobOf(internalID); hash != "" {
+		return makeBlobNameV3(hash)
+	}
+	return MakeObjectNameV3(docID, internalID)
+}
+
+// BlobExists is part of the vfs.BlobStorage interface
+func (sfs *swiftVFSV3) BlobExists(hash string) (bool, error) {
+	_, _, err := sfs.c.Object(sfs.ctx, sfs.container, makeBlobNameV3(hash))
+	if err == swift.ObjectNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CreateBlob is part of the vfs.BlobStorage interface. The content is copied
+// to the object of the blob, as Swift has no rename.
+func (sfs *swiftVFSV3) CreateBlob(tmpName, hash string) error {
+	_, err := sfs.c.ObjectCopy(sfs.ctx, sfs.container, tmpName, sfs.container, makeBlobNameV3(hash), nil)
+	if err != nil {
+		return err
+	}
+	return sfs.UseBlob(tmpName, hash)
+}
+
+// UseBlob is part of the vfs.BlobStorage interface. The object of a
+// deduplicated content is the object of its blob, so the uploaded content is
+// just removed.
+func (sfs *swiftVFSV3) UseBlob(tmpName, hash string) error {
+	if err := sfs.c.ObjectDelete(sfs.ctx, sfs.container, tmpName); err != nil {
+		sfs.log.Infof("Cannot delete %s after storing its blob: %s", tmpName, err)
+	}
+	return nil
+}
+
+// DeleteBlob is part of the vfs.BlobStorage interface
+func (sfs *swiftVFSV3) DeleteBlob(hash string) error {
+	err := sfs.c.ObjectDelete(sfs.ctx, sfs.container, makeBlobNameV3(hash))
+	if err == swift.ObjectNotFound {
+		return nil
+	}
+	return err
+}
+
+// releaseBlobs removes a reference to the blobs in the given object names, and
+// returns the names of the other objects.
+func (sfs *swiftVFSV3) releaseBlobs(objNames []string) ([]string, error) {
+	var hashes []string
+	others := make([]string, 0, len(objNames))
+	for _, objName := range objNames {
+		if strings.HasPrefix(objName, blobsPrefixV3) {
+			hashes = append(hashes, strings.TrimPrefix(objName, blobsPrefixV3))
+		} else {
+			others = append(others, objName)
+		}
+	}
+	return others, sfs.blobs.Release(hashes)
+}
+
+// deleteObjects deletes the objects with the given names. For a blob, a
+// reference is removed, and the object is deleted only if it was the last
+// reference.
+func (sfs *swiftVFSV3) deleteObjects(objNames []string) error {
+	var errm error
+	objNames, err := sfs.releaseBlobs(objNames)
+	if err != nil {
+		errm = multierror.Append(errm, err)
+	}
+	if len(objNames) > 0 {
+		if err := deleteContainerFiles(sfs.ctx, sfs.c, sfs.container, objNames); err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+	return errm
+}
+
+// deleteObject is like deleteObjects for a single object.
+func (sfs *swiftVFSV3) deleteObject(objName string) error {
+	if hash := strings.TrimPrefix(objName, blobsPrefixV3); hash != objName {
+		return sfs.blobs.Release([]string{hash})
+	}
+	return sfs.c.ObjectDelete(sfs.ctx, sfs.container, objName)
+}
+
+// PhysicalDiskUsage returns the size of the files and versions, where the
+// blobs are counted only once.
+func (sfs *swiftVFSV3) PhysicalDiskUsage() (int64, error) {
+	return vfs.PhysicalUsage(sfs.Indexer)
+}
+
+// Deduplicates returns true if the deduplication is enabled for this VFS.
+func (sfs *swiftVFSV3) Deduplicates() bool {
+	return sfs.dedup
+}
+
+var (
+	_ vfs.Deduplicator = (*swiftVFSV3)(nil)
+	_ vfs.BlobStorage  = (*swiftVFSV3)(nil)
+)
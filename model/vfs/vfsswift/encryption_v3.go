@@ -0,0 +1,84 @@
+package vfsswift
+
+import (
+	"bytes"
+	"os"
+	"strings"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/ncw/swift/v2"
+)
+
+func (sfs *swiftVFSV3) ReencryptContent(doc *vfs.FileDoc, version *vfs.Version) (bool, error) {
+	if sfs.keys == nil {
+		return false, nil
+	}
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return false, lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	internalID := doc.InternalID
+	md5sum := doc.MD5Sum
+	contentType := doc.Mime
+	encrypted := &doc.EncryptedAtRest
+	if version != nil {
+		internalID = versionInternalIDV3(version)
+		md5sum = version.MD5Sum
+		contentType = "application/octet-stream"
+		encrypted = &version.EncryptedAtRest
+	}
+	objName := sfs.objectName(doc.DocID, internalID)
+	blob := vfs.BlobOf(internalID)
+	var err error
+	if *encrypted, err = sfs.blobs.ContentEncrypted(blob, *encrypted); err != nil {
+		return false, err
+	}
+
+	src, _, err := sfs.c.ObjectOpen(sfs.ctx, sfs.container, objName, false, nil)
+	if err == swift.ObjectNotFound {
+		return false, os.ErrNotExist
+	}
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	needed, r, err := vfs.ReencryptionNeeded(src, sfs.keys, *encrypted)
+	if err != nil || !needed {
+		return false, err
+	}
+
+	// The object is replaced only when the new content has been fully
+	// uploaded: the upload is aborted on errors.
+	dst, err := sfs.c.ObjectCreate(sfs.ctx, sfs.container, objName, true, "", contentType, nil)
+	if err != nil {
+		return false, err
+	}
+	sum, err := vfs.Reencrypt(dst, r, sfs.keys, *encrypted)
+	if err == nil && len(md5sum) > 0 && !bytes.Equal(sum, md5sum) {
+		err = vfs.ErrInvalidHash
+	}
+	if err != nil {
+		_ = dst.CloseWithError(err)
+		return false, err
+	}
+	if err = dst.Close(); err != nil {
+		return false, err
+	}
+	if blob != "" {
+		if err = sfs.blobs.MarkEncrypted(blob); err != nil {
+			return false, err
+		}
+	}
+	*encrypted = true
+	return true, nil
+}
+
+func versionInternalIDV3(v *vfs.Version) string {
+	if parts := strings.SplitN(v.DocID, "/", 2); len(parts) > 1 {
+		return parts[1]
+	}
+	return v.DocID
+}
+
+var _ vfs.Reencrypter = (*swiftVFSV3)(nil)
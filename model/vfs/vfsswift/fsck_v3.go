@@ -83,12 +83,29 @@ func (sfs *swiftVFSV3) checkFiles(
 		fileIDs[f.DocID] = struct{}{}
 	}
 
+	// The deduplicated contents are shared by several files and versions
+	blobFiles := make(map[string][]*vfs.TreeFile)
+	for _, f := range entries {
+		if hash := vfs.BlobOf(f.InternalID); hash != "" {
+			blobFiles[hash] = append(blobFiles[hash], f)
+		}
+	}
+	blobVersions := make(map[string][]*vfs.Version)
+	for _, v := range versions {
+		if hash := vfs.BlobOf(v.DocID); hash != "" {
+			blobVersions[hash] = append(blobVersions[hash], v)
+		}
+	}
+
 	err = sfs.c.ObjectsWalk(sfs.ctx, sfs.container, nil, func(ctx context.Context, opts *swift.ObjectsOpts) (interface{}, error) {
 		objs, err := sfs.c.Objects(sfs.ctx, sfs.container, opts)
 		if err != nil {
 			return nil, err
 		}
 		for _, obj := range objs {
+			if strings.HasPrefix(obj.Name, uploadsPrefixV3) {
+				continue
+			}
 			if strings.HasPrefix(obj.Name, "thumbs/") {
 				objName := strings.TrimPrefix(obj.Name, "thumbs/")
 				idx := strings.LastIndex(objName, "-")
@@ -116,20 +133,28 @@ func (sfs *swiftVFSV3) checkFiles(
 				}
 				continue
 			}
+			if strings.HasPrefix(obj.Name, blobsPrefixV3) {
+				hash := strings.TrimPrefix(obj.Name, blobsPrefixV3)
+				err := sfs.checkBlob(obj, blobFiles[hash], blobVersions[hash],
+					entries, versions, accumulate, failFast)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
 			docID, internalID := makeDocIDV3(obj.Name)
 			if v, ok := versions[docID+"/"+internalID]; ok {
-				var md5sum []byte
-				md5sum, err = hex.DecodeString(obj.Hash)
+				md5sum, size, err := sfs.objectChecksum(obj, v.EncryptedAtRest)
 				if err != nil {
 					return nil, err
 				}
-				if !bytes.Equal(md5sum, v.MD5Sum) || v.ByteSize != obj.Bytes {
+				if !bytes.Equal(md5sum, v.MD5Sum) || v.ByteSize != size {
 					accumulate(&vfs.FsckLog{
 						Type:       vfs.ContentMismatch,
 						IsVersion:  true,
 						VersionDoc: v,
 						ContentMismatch: &vfs.FsckContentMismatch{
-							SizeFile:    obj.Bytes,
+							SizeFile:    size,
 							SizeIndex:   v.ByteSize,
 							MD5SumFile:  md5sum,
 							MD5SumIndex: v.MD5Sum,
@@ -153,18 +178,17 @@ func (sfs *swiftVFSV3) checkFiles(
 					return nil, errFailFast
 				}
 			} else {
-				var md5sum []byte
-				md5sum, err = hex.DecodeString(obj.Hash)
+				md5sum, size, err := sfs.objectChecksum(obj, f.EncryptedAtRest)
 				if err != nil {
 					return nil, err
 				}
-				if !bytes.Equal(md5sum, f.MD5Sum) || f.ByteSize != obj.Bytes {
+				if !bytes.Equal(md5sum, f.MD5Sum) || f.ByteSize != size {
 					accumulate(&vfs.FsckLog{
 						Type:    vfs.ContentMismatch,
 						IsFile:  true,
 						FileDoc: f,
 						ContentMismatch: &vfs.FsckContentMismatch{
-							SizeFile:    obj.Bytes,
+							SizeFile:    size,
 							SizeIndex:   f.ByteSize,
 							MD5SumFile:  md5sum,
 							MD5SumIndex: f.MD5Sum,
@@ -213,6 +237,97 @@ func (sfs *swiftVFSV3) checkFiles(
 	return nil
 }
 
+// checkBlob checks the content of a blob against the files and versions that
+// use it.
+func (sfs *swiftVFSV3) checkBlob(
+	obj swift.Object,
+	files []*vfs.TreeFile,
+	versions []*vfs.Version,
+	allEntries map[string]*vfs.TreeFile,
+	allVersions map[string]*vfs.Version,
+	accumulate func(log *vfs.FsckLog),
+	failFast bool,
+) error {
+	if len(files) == 0 && len(versions) == 0 {
+		accumulate(&vfs.FsckLog{
+			Type:    vfs.IndexMissing,
+			IsFile:  true,
+			FileDoc: objectToFileDocV3(sfs.container, obj),
+		})
+		if failFast {
+			return errFailFast
+		}
+		return nil
+	}
+
+	// The blob reference tells if the content is encrypted
+	hash := strings.TrimPrefix(obj.Name, blobsPrefixV3)
+	encrypted, err := sfs.blobs.ContentEncrypted(hash, false)
+	if err != nil {
+		return err
+	}
+	md5sum, size, err := sfs.objectChecksum(obj, encrypted)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !bytes.Equal(md5sum, f.MD5Sum) || f.ByteSize != size {
+			accumulate(&vfs.FsckLog{
+				Type:    vfs.ContentMismatch,
+				IsFile:  true,
+				FileDoc: f,
+				ContentMismatch: &vfs.FsckContentMismatch{
+					SizeFile:    size,
+					SizeIndex:   f.ByteSize,
+					MD5SumFile:  md5sum,
+					MD5SumIndex: f.MD5Sum,
+				},
+			})
+			if failFast {
+				return errFailFast
+			}
+		}
+		delete(allEntries, f.DocID+"/"+f.InternalID)
+	}
+	for _, v := range versions {
+		if !bytes.Equal(md5sum, v.MD5Sum) || v.ByteSize != size {
+			accumulate(&vfs.FsckLog{
+				Type:       vfs.ContentMismatch,
+				IsVersion:  true,
+				VersionDoc: v,
+				ContentMismatch: &vfs.FsckContentMismatch{
+					SizeFile:    size,
+					SizeIndex:   v.ByteSize,
+					MD5SumFile:  md5sum,
+					MD5SumIndex: v.MD5Sum,
+				},
+			})
+			if failFast {
+				return errFailFast
+			}
+		}
+		delete(allVersions, v.DocID)
+	}
+	return nil
+}
+
+// objectChecksum returns the MD5 checksum and the size of the content of an
+// object. For an encrypted content, the listing gives the checksum and the
+// size of the encrypted content, and the object is read to compute them for
+// the plain content.
+func (sfs *swiftVFSV3) objectChecksum(obj swift.Object, encrypted bool) ([]byte, int64, error) {
+	if !encrypted {
+		md5sum, err := hex.DecodeString(obj.Hash)
+		return md5sum, obj.Bytes, err
+	}
+	f, _, err := sfs.c.ObjectOpen(sfs.ctx, sfs.container, obj.Name, false, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	return vfs.PlainChecksum(f, sfs.keys, true)
+}
+
 func objectToFileDocV3(container string, object swift.Object) *vfs.TreeFile {
 	md5sum, _ := hex.DecodeString(object.Hash)
 	name := "unknown"
@@ -464,6 +464,59 @@ func (sfs *swiftVFSV2) DissociateDir(src, dst *vfs.DirDoc) error {
 	return os.ErrNotExist
 }
 
+func (sfs *swiftVFSV2) CopyFile(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	if diskQuota := sfs.DiskQuota(); diskQuota > 0 {
+		diskUsage, err := sfs.DiskUsage()
+		if err != nil {
+			return err
+		}
+		if olddoc.ByteSize > diskQuota-diskUsage {
+			return vfs.ErrFileTooBig
+		}
+	}
+
+	exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	newpath, err := sfs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return vfs.ErrParentInTrash
+	}
+
+	if newdoc.DocID, err = couchdb.UUID(sfs); err != nil {
+		return err
+	}
+
+	// Copy the file
+	srcName := MakeObjectName(olddoc.DocID)
+	dstName := MakeObjectName(newdoc.DocID)
+	headers := swift.Metadata{
+		"creation-name": newdoc.Name(),
+		"created-at":    newdoc.CreatedAt.Format(time.RFC3339),
+		"copy-of":       olddoc.ID(),
+	}.ObjectHeaders()
+	if _, err := sfs.c.ObjectCopy(sfs.ctx, sfs.container, srcName, sfs.container, dstName, headers); err != nil {
+		return err
+	}
+	if err := sfs.Indexer.CreateNamedFileDoc(newdoc); err != nil {
+		_ = sfs.c.ObjectDelete(sfs.ctx, sfs.container, dstName)
+		return err
+	}
+	return nil
+}
+
 func (sfs *swiftVFSV2) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
 	// The versioning is not implemented in Swift layout v2
 	return nil, os.ErrNotExist
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -29,6 +30,9 @@ type swiftVFSV3 struct {
 	prefix    string
 	context   string
 	container string
+	keys      vfs.Keyring
+	blobs     *vfs.Blobs
+	dedup     bool
 	mu        lock.ErrorRWLocker
 	ctx       context.Context
 	log       *logger.Entry
@@ -46,8 +50,12 @@ const swiftV3ContainerPrefix = "cozy-v3-"
 // in the name), and it is poor in features (for example, we want to swap an
 // old version with the current version without having to download/upload
 // contents, and it is not supported).
-func NewV3(db vfs.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker) (vfs.VFS, error) {
-	return &swiftVFSV3{
+//
+// If keys is not nil, the content of the files is encrypted at rest with the
+// keys of this keyring. And the contents are deduplicated if it is enabled in
+// the configuration.
+func NewV3(db vfs.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, keys vfs.Keyring, mu lock.ErrorRWLocker) (vfs.VFS, error) {
+	sfs := &swiftVFSV3{
 		Indexer:         index,
 		DiskThresholder: disk,
 
@@ -57,10 +65,16 @@ func NewV3(db vfs.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock
 		prefix:    db.DBPrefix(),
 		context:   db.GetContextName(),
 		container: swiftV3ContainerPrefix + db.DBPrefix(),
+		keys:      keys,
+		dedup:     vfs.IsDeduplicationEnabled(db.GetContextName()),
 		mu:        mu,
 		ctx:       context.Background(),
 		log:       logger.WithDomain(db.DomainName()).WithNamespace("vfsswift"),
-	}, nil
+	}
+	// The blobs have their own lock, as they can be removed by EnsureErased
+	// while the VFS is locked by DestroyDirAndContent.
+	sfs.blobs = vfs.NewBlobs(index, sfs, lock.ReadWrite(db, "vfs-blobs"))
+	return sfs, nil
 }
 
 // NewInternalID returns a random string that can be used as an internal_vfs_id.
@@ -119,6 +133,9 @@ func (sfs *swiftVFSV3) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
 		domain:          sfs.domain,
 		prefix:          sfs.prefix,
 		container:       sfs.container,
+		keys:            sfs.keys,
+		blobs:           sfs.blobs,
+		dedup:           sfs.dedup,
 		mu:              sfs.mu,
 		ctx:             context.Background(),
 		log:             sfs.log,
@@ -238,16 +255,34 @@ func (sfs *swiftVFSV3) CreateFile(newdoc, olddoc *vfs.FileDoc, opts ...vfs.Creat
 
 	newdoc.InternalID = NewInternalID()
 	objName := MakeObjectNameV3(newdoc.DocID, newdoc.InternalID)
-	hash := hex.EncodeToString(newdoc.MD5Sum)
-	f, err := sfs.c.ObjectCreate(sfs.ctx, sfs.container, objName, true, hash, newdoc.Mime, nil)
+	// When the content is encrypted, the checksum of the object is not the
+	// checksum of the file, and it is checked by the stack.
+	checkHash := hex.EncodeToString(newdoc.MD5Sum)
+	if sfs.keys != nil {
+		checkHash = ""
+	}
+	f, err := sfs.c.ObjectCreate(sfs.ctx, sfs.container, objName, true, checkHash, newdoc.Mime, nil)
 	if err != nil {
 		return nil, err
 	}
+	var enc *vfs.EncryptedWriter
+	if sfs.keys != nil {
+		if enc, err = vfs.NewEncryptedWriter(f, sfs.keys); err != nil {
+			_ = f.CloseWithError(err)
+			return nil, err
+		}
+	}
 	extractor := vfs.NewMetaExtractor(newdoc)
+	var sha hash.Hash
+	if sfs.dedup {
+		sha = vfs.NewBlobHash()
+	}
 
 	return &swiftFileCreationV3{
 		fs:      sfs,
 		f:       f,
+		enc:     enc,
+		sha:     sha,
 		newdoc:  newdoc,
 		olddoc:  olddoc,
 		name:    objName,
@@ -281,19 +316,26 @@ func (sfs *swiftVFSV3) DissociateFile(src, dst *vfs.FileDoc) error {
 	}
 	dst.DocID = uuid
 
-	// Copy the file
-	srcName := MakeObjectNameV3(src.DocID, src.InternalID)
-	dstName := MakeObjectNameV3(dst.DocID, dst.InternalID)
-	headers := swift.Metadata{
-		"creation-name":  src.Name(),
-		"created-at":     src.CreatedAt.Format(time.RFC3339),
-		"dissociated-of": src.ID(),
-	}.ObjectHeaders()
-	if _, err := sfs.c.ObjectCopy(sfs.ctx, sfs.container, srcName, sfs.container, dstName, headers); err != nil {
-		return err
+	// Copy the file (or just add a reference to its blob), as is
+	srcName := sfs.objectName(src.DocID, src.InternalID)
+	dstName := sfs.objectName(dst.DocID, dst.InternalID)
+	dst.EncryptedAtRest = src.EncryptedAtRest
+	if hash := vfs.BlobOf(dst.InternalID); hash != "" {
+		if err := sfs.blobs.AddRef(hash, src.ByteSize, src.EncryptedAtRest); err != nil {
+			return err
+		}
+	} else {
+		headers := swift.Metadata{
+			"creation-name":  src.Name(),
+			"created-at":     src.CreatedAt.Format(time.RFC3339),
+			"dissociated-of": src.ID(),
+		}.ObjectHeaders()
+		if _, err := sfs.c.ObjectCopy(sfs.ctx, sfs.container, srcName, sfs.container, dstName, headers); err != nil {
+			return err
+		}
 	}
 	if err := sfs.Indexer.CreateNamedFileDoc(dst); err != nil {
-		_ = sfs.c.ObjectDelete(sfs.ctx, sfs.container, dstName)
+		_ = sfs.deleteObject(dstName)
 		return err
 	}
 
@@ -327,6 +369,75 @@ func (sfs *swiftVFSV3) DissociateDir(src, dst *vfs.DirDoc) error {
 	return sfs.Indexer.DeleteDirDoc(src)
 }
 
+func (sfs *swiftVFSV3) CopyFile(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	if diskQuota := sfs.DiskQuota(); diskQuota > 0 {
+		diskUsage, err := sfs.DiskUsage()
+		if err != nil {
+			return err
+		}
+		if olddoc.ByteSize > diskQuota-diskUsage {
+			return vfs.ErrFileTooBig
+		}
+	}
+
+	exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	newpath, err := sfs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return vfs.ErrParentInTrash
+	}
+
+	if newdoc.DocID, err = couchdb.UUID(sfs); err != nil {
+		return err
+	}
+	newdoc.InternalID = NewInternalID()
+
+	// The content is copied as is, encrypted or not. And a deduplicated
+	// content is not copied: the new file shares its blob
+	newdoc.EncryptedAtRest = olddoc.EncryptedAtRest
+	if hash := vfs.BlobOf(olddoc.InternalID); hash != "" {
+		newdoc.InternalID = vfs.BlobInternalID(newdoc.InternalID, hash)
+		if err := sfs.blobs.AddRef(hash, olddoc.ByteSize, olddoc.EncryptedAtRest); err != nil {
+			return err
+		}
+		if err := sfs.Indexer.CreateNamedFileDoc(newdoc); err != nil {
+			_ = sfs.deleteObject(makeBlobNameV3(hash))
+			return err
+		}
+		return nil
+	}
+
+	// Copy the file
+	srcName := MakeObjectNameV3(olddoc.DocID, olddoc.InternalID)
+	dstName := MakeObjectNameV3(newdoc.DocID, newdoc.InternalID)
+	headers := swift.Metadata{
+		"creation-name": newdoc.Name(),
+		"created-at":    newdoc.CreatedAt.Format(time.RFC3339),
+		"copy-of":       olddoc.ID(),
+	}.ObjectHeaders()
+	if _, err := sfs.c.ObjectCopy(sfs.ctx, sfs.container, srcName, sfs.container, dstName, headers); err != nil {
+		return err
+	}
+	if err := sfs.Indexer.CreateNamedFileDoc(newdoc); err != nil {
+		_ = sfs.c.ObjectDelete(sfs.ctx, sfs.container, dstName)
+		return err
+	}
+	return nil
+}
+
 func (sfs *swiftVFSV3) destroyDir(doc *vfs.DirDoc, push func(vfs.TrashJournal) error, onlyContent bool) error {
 	if lockerr := sfs.mu.Lock(); lockerr != nil {
 		return lockerr
@@ -345,7 +456,7 @@ func (sfs *swiftVFSV3) destroyDir(doc *vfs.DirDoc, push func(vfs.TrashJournal) e
 	objNames := make([]string, len(files))
 	for i, file := range files {
 		ids[i] = file.DocID
-		objNames[i] = MakeObjectNameV3(file.DocID, file.InternalID)
+		objNames[i] = sfs.objectName(file.DocID, file.InternalID)
 	}
 	err = push(vfs.TrashJournal{
 		FileIDs:     ids,
@@ -373,7 +484,7 @@ func (sfs *swiftVFSV3) DestroyFile(doc *vfs.FileDoc) error {
 func (sfs *swiftVFSV3) destroyFileLocked(doc *vfs.FileDoc) error {
 	diskUsage, _ := sfs.Indexer.DiskUsage()
 	objNames := []string{
-		MakeObjectNameV3(doc.DocID, doc.InternalID),
+		sfs.objectName(doc.DocID, doc.InternalID),
 	}
 	if err := sfs.Indexer.DeleteFileDoc(doc); err != nil {
 		return err
@@ -385,7 +496,7 @@ func (sfs *swiftVFSV3) destroyFileLocked(doc *vfs.FileDoc) error {
 			if parts := strings.SplitN(v.DocID, "/", 2); len(parts) > 1 {
 				internalID = parts[1]
 			}
-			objNames = append(objNames, MakeObjectNameV3(doc.DocID, internalID))
+			objNames = append(objNames, sfs.objectName(doc.DocID, internalID))
 			destroyed += v.ByteSize
 		}
 		err := sfs.Indexer.BatchDeleteVersions(versions)
@@ -393,6 +504,14 @@ func (sfs *swiftVFSV3) destroyFileLocked(doc *vfs.FileDoc) error {
 			sfs.log.Warnf("DestroyFile failed on BatchDeleteVersions: %s", err)
 		}
 	}
+	objNames, err := sfs.releaseBlobs(objNames)
+	if err != nil {
+		sfs.log.Warnf("DestroyFile failed on releasing the blobs: %s", err)
+	}
+	if len(objNames) == 0 {
+		vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+		return nil
+	}
 	_, errb := sfs.c.BulkDelete(sfs.ctx, sfs.container, objNames)
 	if errb == swift.Forbidden {
 		for _, objName := range objNames {
@@ -429,7 +548,7 @@ func (sfs *swiftVFSV3) EnsureErased(journal vfs.TrashJournal) error {
 			if parts := strings.SplitN(v.DocID, "/", 2); len(parts) > 1 {
 				internalID = parts[1]
 			}
-			objNames = append(objNames, MakeObjectNameV3(fileID, internalID))
+			objNames = append(objNames, sfs.objectName(fileID, internalID))
 			destroyed += v.ByteSize
 		}
 		allVersions = append(allVersions, versions...)
@@ -438,8 +557,8 @@ func (sfs *swiftVFSV3) EnsureErased(journal vfs.TrashJournal) error {
 		sfs.log.Warnf("EnsureErased failed on BatchDeleteVersions: %s", err)
 		errm = multierror.Append(errm, err)
 	}
-	if err := deleteContainerFiles(sfs.ctx, sfs.c, sfs.container, objNames); err != nil {
-		sfs.log.Warnf("EnsureErased failed on deleteContainerFiles: %s", err)
+	if err := sfs.deleteObjects(objNames); err != nil {
+		sfs.log.Warnf("EnsureErased failed on deleteObjects: %s", err)
 		errm = multierror.Append(errm, err)
 	}
 	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
@@ -451,7 +570,11 @@ func (sfs *swiftVFSV3) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 		return nil, lockerr
 	}
 	defer sfs.mu.RUnlock()
-	objName := MakeObjectNameV3(doc.DocID, doc.InternalID)
+	encrypted, err := sfs.blobs.ContentEncrypted(vfs.BlobOf(doc.InternalID), doc.EncryptedAtRest)
+	if err != nil {
+		return nil, err
+	}
+	objName := sfs.objectName(doc.DocID, doc.InternalID)
 	f, _, err := sfs.c.ObjectOpen(sfs.ctx, sfs.container, objName, false, nil)
 	if err == swift.ObjectNotFound {
 		return nil, os.ErrNotExist
@@ -459,7 +582,7 @@ func (sfs *swiftVFSV3) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &swiftFileOpenV3{f, nil}, nil
+	return vfs.DecryptFile(&swiftFileOpenV3{f, nil}, sfs.keys, encrypted)
 }
 
 func (sfs *swiftVFSV3) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
@@ -471,7 +594,11 @@ func (sfs *swiftVFSV3) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (
 	if parts := strings.SplitN(version.DocID, "/", 2); len(parts) > 1 {
 		internalID = parts[1]
 	}
-	objName := MakeObjectNameV3(doc.DocID, internalID)
+	encrypted, err := sfs.blobs.ContentEncrypted(vfs.BlobOf(internalID), version.EncryptedAtRest)
+	if err != nil {
+		return nil, err
+	}
+	objName := sfs.objectName(doc.DocID, internalID)
 	f, _, err := sfs.c.ObjectOpen(sfs.ctx, sfs.container, objName, false, nil)
 	if err == swift.ObjectNotFound {
 		return nil, os.ErrNotExist
@@ -479,7 +606,7 @@ func (sfs *swiftVFSV3) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (
 	if err != nil {
 		return nil, err
 	}
-	return &swiftFileOpenV3{f, nil}, nil
+	return vfs.DecryptFile(&swiftFileOpenV3{f, nil}, sfs.keys, encrypted)
 }
 
 func (sfs *swiftVFSV3) ImportFileVersion(version *vfs.Version, content io.ReadCloser) error {
@@ -505,13 +632,45 @@ func (sfs *swiftVFSV3) ImportFileVersion(version *vfs.Version, content io.ReadCl
 	}
 	objName := MakeObjectNameV3(parts[0], parts[1])
 
-	hash := hex.EncodeToString(version.MD5Sum)
-	f, err := sfs.c.ObjectCreate(sfs.ctx, sfs.container, objName, true, hash, "application/octet-stream", nil)
+	// A deduplicated content is uploaded first in its own object, and then
+	// moved to its blob, which can already exist.
+	blob := vfs.BlobOf(parts[1])
+	var sha hash.Hash
+	if blob != "" {
+		objName = MakeObjectNameV3(parts[0], NewInternalID())
+		sha = vfs.NewBlobHash()
+		content = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(content, sha), content}
+	}
+
+	checkHash := hex.EncodeToString(version.MD5Sum)
+	if sfs.keys != nil {
+		checkHash = ""
+	}
+	f, err := sfs.c.ObjectCreate(sfs.ctx, sfs.container, objName, true, checkHash, "application/octet-stream", nil)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(f, content)
+	if sfs.keys != nil {
+		var enc *vfs.EncryptedWriter
+		if enc, err = vfs.NewEncryptedWriter(f, sfs.keys); err == nil {
+			_, err = io.Copy(enc, content)
+			if errc := enc.Close(); err == nil {
+				err = errc
+			}
+			if err == nil && !bytes.Equal(enc.MD5Sum(), version.MD5Sum) {
+				err = vfs.ErrInvalidHash
+			}
+		}
+		if err != nil {
+			_ = f.CloseWithError(err)
+		}
+	} else {
+		_, err = io.Copy(f, content)
+	}
 	if errc := content.Close(); err == nil {
 		err = errc
 	}
@@ -525,7 +684,25 @@ func (sfs *swiftVFSV3) ImportFileVersion(version *vfs.Version, content io.ReadCl
 		return err
 	}
 
-	return sfs.Indexer.CreateVersion(version)
+	version.EncryptedAtRest = sfs.keys != nil
+	if blob != "" {
+		if vfs.BlobHash(sha) != blob {
+			err = vfs.ErrInvalidHash
+		} else {
+			version.EncryptedAtRest, err = sfs.blobs.Store(objName, blob, version.ByteSize, version.EncryptedAtRest)
+		}
+		if err != nil {
+			_ = sfs.c.ObjectDelete(sfs.ctx, sfs.container, objName)
+			return err
+		}
+		objName = makeBlobNameV3(blob)
+	}
+
+	if err = sfs.Indexer.CreateVersion(version); err != nil {
+		_ = sfs.deleteObject(objName)
+		return err
+	}
+	return nil
 }
 
 func (sfs *swiftVFSV3) RevertFileVersion(doc *vfs.FileDoc, version *vfs.Version) error {
@@ -661,6 +838,8 @@ func (sfs *swiftVFSV3) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc,
 type swiftFileCreationV3 struct {
 	fs      *swiftVFSV3
 	f       *swift.ObjectCreateFile
+	enc     *vfs.EncryptedWriter
+	sha     hash.Hash
 	newdoc  *vfs.FileDoc
 	olddoc  *vfs.FileDoc
 	name    string
@@ -692,7 +871,16 @@ func (f *swiftFileCreationV3) Write(p []byte) (int, error) {
 		}
 	}
 
-	n, err := f.f.Write(p)
+	var n int
+	var err error
+	if f.enc != nil {
+		n, err = f.enc.Write(p)
+	} else {
+		n, err = f.f.Write(p)
+	}
+	if f.sha != nil {
+		_, _ = f.sha.Write(p[:n])
+	}
 	if err != nil {
 		f.err = err
 		return n, err
@@ -726,6 +914,19 @@ func (f *swiftFileCreationV3) Close() (err error) {
 		}
 	}()
 
+	if f.enc != nil {
+		if f.err == nil {
+			f.err = f.enc.Close()
+		}
+		if f.err == nil && f.newdoc.MD5Sum != nil && !bytes.Equal(f.newdoc.MD5Sum, f.enc.MD5Sum()) {
+			f.err = vfs.ErrInvalidHash
+		}
+		if f.err != nil {
+			// Abort the upload of the object
+			_ = f.f.CloseWithError(f.err)
+		}
+	}
+
 	if err = f.f.Close(); err != nil {
 		if err == swift.ObjectCorrupted {
 			err = vfs.ErrInvalidHash
@@ -752,8 +953,10 @@ func (f *swiftFileCreationV3) Close() (err error) {
 	}
 
 	// The actual check of the optionally given md5 hash is handled by the swift
-	// library.
-	if newdoc.MD5Sum == nil {
+	// library, or above for an encrypted content.
+	if newdoc.MD5Sum == nil && f.enc != nil {
+		newdoc.MD5Sum = f.enc.MD5Sum()
+	} else if newdoc.MD5Sum == nil {
 		var headers swift.Headers
 		var md5sum []byte
 		headers, err = f.f.Headers()
@@ -810,6 +1013,18 @@ func (f *swiftFileCreationV3) Close() (err error) {
 	}
 	newdoc.Trashed = strings.HasPrefix(newpath, vfs.TrashDirName+"/")
 
+	// If the deduplication fails, the content is kept in its own object
+	newdoc.EncryptedAtRest = f.enc != nil
+	if f.sha != nil {
+		hash := vfs.BlobHash(f.sha)
+		if encrypted, errb := f.fs.blobs.Store(f.name, hash, written, newdoc.EncryptedAtRest); errb != nil {
+			f.fs.log.Warnf("Cannot deduplicate %s: %s", newdoc.DocID, errb)
+		} else {
+			newdoc.InternalID = vfs.BlobInternalID(newdoc.InternalID, hash)
+			newdoc.EncryptedAtRest = encrypted
+		}
+	}
+
 	var v *vfs.Version
 	if olddoc != nil {
 		v = vfs.NewVersion(olddoc)
@@ -820,6 +1035,9 @@ func (f *swiftFileCreationV3) Close() (err error) {
 		err = f.fs.Indexer.CreateNamedFileDoc(newdoc)
 	}
 	if err != nil {
+		if hash := vfs.BlobOf(newdoc.InternalID); hash != "" {
+			_ = f.fs.deleteObject(makeBlobNameV3(hash))
+		}
 		return err
 	}
 
@@ -835,8 +1053,7 @@ func (f *swiftFileCreationV3) Close() (err error) {
 			if parts := strings.SplitN(v.DocID, "/", 2); len(parts) > 1 {
 				internalID = parts[1]
 			}
-			objName := MakeObjectNameV3(newdoc.DocID, internalID)
-			_ = f.fs.c.ObjectDelete(f.fs.ctx, f.fs.container, objName)
+			_ = f.fs.deleteObject(f.fs.objectName(newdoc.DocID, internalID))
 		}
 		for _, old := range toClean {
 			_ = cleanOldVersion(f.fs, newdoc.DocID, old)
@@ -866,8 +1083,7 @@ func cleanOldVersion(sfs *swiftVFSV3, fileID string, v *vfs.Version) error {
 	if parts := strings.SplitN(v.DocID, "/", 2); len(parts) > 1 {
 		internalID = parts[1]
 	}
-	objName := MakeObjectNameV3(fileID, internalID)
-	return sfs.c.ObjectDelete(sfs.ctx, sfs.container, objName)
+	return sfs.deleteObject(sfs.objectName(fileID, internalID))
 }
 
 func (sfs *swiftVFSV3) ClearOldVersions() error {
@@ -884,7 +1100,7 @@ func (sfs *swiftVFSV3) ClearOldVersions() error {
 	var destroyed int64
 	for _, v := range versions {
 		if parts := strings.SplitN(v.DocID, "/", 2); len(parts) > 1 {
-			objNames = append(objNames, MakeObjectNameV3(parts[0], parts[1]))
+			objNames = append(objNames, sfs.objectName(parts[0], parts[1]))
 		}
 		destroyed += v.ByteSize
 	}
@@ -892,7 +1108,7 @@ func (sfs *swiftVFSV3) ClearOldVersions() error {
 		return err
 	}
 	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
-	return deleteContainerFiles(sfs.ctx, sfs.c, sfs.container, objNames)
+	return sfs.deleteObjects(objNames)
 }
 
 type swiftFileOpenV3 struct {
@@ -0,0 +1,59 @@
+package vfsswift
+
+import (
+	"io"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+)
+
+// The layouts v1 and v2 have no place for the chunks of the upload sessions:
+// the resumable uploads are refused with an explicit error.
+
+// CheckChunkedUpload is part of the vfs.ChunkedUploader interface
+func (sfs *swiftVFS) CheckChunkedUpload() error {
+	return vfs.ErrChunkedUploadSwiftLayout
+}
+
+func (sfs *swiftVFS) CreateUploadChunk(sessionID, chunkName string) (io.WriteCloser, error) {
+	return nil, vfs.ErrChunkedUploadSwiftLayout
+}
+
+func (sfs *swiftVFS) OpenUploadChunk(sessionID, chunkName string) (io.ReadCloser, error) {
+	return nil, vfs.ErrChunkedUploadSwiftLayout
+}
+
+func (sfs *swiftVFS) DeleteUploadChunk(sessionID, chunkName string) error {
+	return vfs.ErrChunkedUploadSwiftLayout
+}
+
+// DeleteUploadChunks is a no-op, as no chunk can have been uploaded.
+func (sfs *swiftVFS) DeleteUploadChunks(sessionID string) error {
+	return nil
+}
+
+// CheckChunkedUpload is part of the vfs.ChunkedUploader interface
+func (sfs *swiftVFSV2) CheckChunkedUpload() error {
+	return vfs.ErrChunkedUploadSwiftLayout
+}
+
+func (sfs *swiftVFSV2) CreateUploadChunk(sessionID, chunkName string) (io.WriteCloser, error) {
+	return nil, vfs.ErrChunkedUploadSwiftLayout
+}
+
+func (sfs *swiftVFSV2) OpenUploadChunk(sessionID, chunkName string) (io.ReadCloser, error) {
+	return nil, vfs.ErrChunkedUploadSwiftLayout
+}
+
+func (sfs *swiftVFSV2) DeleteUploadChunk(sessionID, chunkName string) error {
+	return vfs.ErrChunkedUploadSwiftLayout
+}
+
+// DeleteUploadChunks is a no-op, as no chunk can have been uploaded.
+func (sfs *swiftVFSV2) DeleteUploadChunks(sessionID string) error {
+	return nil
+}
+
+var (
+	_ vfs.ChunkedUploader = (*swiftVFS)(nil)
+	_ vfs.ChunkedUploader = (*swiftVFSV2)(nil)
+)
@@ -0,0 +1,64 @@
+package vfsswift
+
+import (
+	"io"
+	"os"
+
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/ncw/swift/v2"
+)
+
+const uploadsPrefixV3 = "uploads/"
+
+func makeUploadChunkNameV3(sessionID, chunkName string) string {
+	return uploadsPrefixV3 + sessionID + "/" + chunkName
+}
+
+// CheckChunkedUpload is part of the vfs.ChunkedUploader interface
+func (sfs *swiftVFSV3) CheckChunkedUpload() error {
+	return nil
+}
+
+func (sfs *swiftVFSV3) CreateUploadChunk(sessionID, chunkName string) (io.WriteCloser, error) {
+	objName := makeUploadChunkNameV3(sessionID, chunkName)
+	f, err := sfs.c.ObjectCreate(sfs.ctx, sfs.container, objName, true, "", "application/octet-stream", nil)
+	if err != nil {
+		return nil, err
+	}
+	return vfs.EncryptWriteCloser(f, sfs.keys)
+}
+
+func (sfs *swiftVFSV3) OpenUploadChunk(sessionID, chunkName string) (io.ReadCloser, error) {
+	objName := makeUploadChunkNameV3(sessionID, chunkName)
+	f, _, err := sfs.c.ObjectOpen(sfs.ctx, sfs.container, objName, false, nil)
+	if err == swift.ObjectNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return vfs.DecryptReader(f, sfs.keys, sfs.keys != nil)
+}
+
+func (sfs *swiftVFSV3) DeleteUploadChunk(sessionID, chunkName string) error {
+	objName := makeUploadChunkNameV3(sessionID, chunkName)
+	err := sfs.c.ObjectDelete(sfs.ctx, sfs.container, objName)
+	if err == swift.ObjectNotFound {
+		return nil
+	}
+	return err
+}
+
+func (sfs *swiftVFSV3) DeleteUploadChunks(sessionID string) error {
+	opts := &swift.ObjectsOpts{Prefix: uploadsPrefixV3 + sessionID + "/"}
+	objNames, err := sfs.c.ObjectNamesAll(sfs.ctx, sfs.container, opts)
+	if err != nil {
+		return err
+	}
+	if len(objNames) == 0 {
+		return nil
+	}
+	return deleteContainerFiles(sfs.ctx, sfs.c, sfs.container, objNames)
+}
+
+var _ vfs.ChunkedUploader = (*swiftVFSV3)(nil)
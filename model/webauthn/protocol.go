@@ -0,0 +1,265 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+// URLEncodedBytes is a slice of bytes that is serialized in JSON with the
+// base64url encoding, as the binary fields of the WebAuthn JSON objects.
+type URLEncodedBytes []byte
+
+// MarshalJSON implements the json.Marshaler interface
+func (b URLEncodedBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (b *URLEncodedBytes) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(str, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// credentialResponse is the JSON serialization of a PublicKeyCredential sent
+// by the browser, for both the registration and the authentication
+// ceremonies.
+type credentialResponse struct {
+	ID       string          `json:"id"`
+	RawID    URLEncodedBytes `json:"rawId"`
+	Type     string          `json:"type"`
+	Response struct {
+		ClientDataJSON    URLEncodedBytes `json:"clientDataJSON"`
+		AttestationObject URLEncodedBytes `json:"attestationObject,omitempty"`
+		AuthenticatorData URLEncodedBytes `json:"authenticatorData,omitempty"`
+		Signature         URLEncodedBytes `json:"signature,omitempty"`
+		UserHandle        URLEncodedBytes `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+func parseCredentialResponse(raw []byte) (*credentialResponse, error) {
+	var resp credentialResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return nil, fmt.Errorf("cannot parse credential: %s", err)
+	}
+	if resp.Type != "public-key" {
+		return nil, errors.New("invalid credential type")
+	}
+	if len(resp.RawID) == 0 {
+		return nil, errors.New("missing credential id")
+	}
+	return &resp, nil
+}
+
+// clientData is described by
+// https://www.w3.org/TR/webauthn/#dictionary-client-data
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func parseClientData(raw []byte) (*clientData, error) {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("cannot parse client data: %s", err)
+	}
+	return &data, nil
+}
+
+type attestationObject struct {
+	Format       string                 `codec:"fmt"`
+	AttStatement map[string]interface{} `codec:"attStmt,omitempty"`
+	RawAuthData  []byte                 `codec:"authData"`
+}
+
+// authenticatorData is described by
+// https://www.w3.org/TR/webauthn/#sctn-authenticator-data
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        authenticatorFlags
+	Counter      uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+type authenticatorFlags byte
+
+func (f authenticatorFlags) Has(flag authenticatorFlags) bool {
+	return (f & flag) == flag
+}
+
+const (
+	flagUserPresent            authenticatorFlags = 1  // Bit 0: User Present (UP)
+	flagUserVerified           authenticatorFlags = 4  // Bit 2: User Verified (UV)
+	flagAttestedCredentialData authenticatorFlags = 64 // Bit 6: Attested credential data included (AT)
+)
+
+func parseAttestationObject(raw []byte) (*attestationObject, *authenticatorData, error) {
+	obj := attestationObject{}
+	cborHandler := codec.CborHandle{}
+	if err := codec.NewDecoderBytes(raw, &cborHandler).Decode(&obj); err != nil {
+		return nil, nil, fmt.Errorf("error decoding cbor: %s", err)
+	}
+	authData, err := parseAuthData(obj.RawAuthData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decoding auth data: %s", err)
+	}
+	if !authData.Flags.Has(flagAttestedCredentialData) {
+		return nil, nil, errors.New("missing attested credential data flag")
+	}
+	return &obj, authData, nil
+}
+
+func parseAuthData(raw []byte) (*authenticatorData, error) {
+	var data authenticatorData
+	if len(raw) < 37 {
+		return nil, errors.New("raw AuthData is too short")
+	}
+	data.RPIDHash = raw[:32]
+	data.Flags = authenticatorFlags(raw[32])
+	data.Counter = binary.BigEndian.Uint32(raw[33:37])
+	if !data.Flags.Has(flagAttestedCredentialData) {
+		return &data, nil
+	}
+
+	if len(raw) < 55 {
+		return nil, errors.New("raw AuthData is too short")
+	}
+	data.AAGUID = raw[37:53]
+	idLength := int(binary.BigEndian.Uint16(raw[53:55]))
+	if len(raw) < 55+idLength {
+		return nil, errors.New("raw AuthData is too short")
+	}
+	data.CredentialID = raw[55 : 55+idLength]
+
+	// The credential public key is a COSE_Key, that can be followed by the
+	// extensions: we need to decode it to know where it ends.
+	var key interface{}
+	rest := raw[55+idLength:]
+	cborHandler := codec.CborHandle{}
+	dec := codec.NewDecoderBytes(rest, &cborHandler)
+	if err := dec.Decode(&key); err != nil {
+		return nil, fmt.Errorf("cannot decode the credential public key: %s", err)
+	}
+	data.PublicKey = rest[:dec.NumBytesRead()]
+	return &data, nil
+}
+
+// The COSE algorithms that are supported for the credentials, by order of
+// preference.
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+var supportedAlgorithms = []int{coseAlgES256, coseAlgEdDSA, coseAlgRS256}
+
+// coseKey is a public key in the COSE_Key format (RFC 8152).
+type coseKey struct {
+	Algorithm int
+	PublicKey crypto.PublicKey
+}
+
+func parseCOSEKey(raw []byte) (*coseKey, error) {
+	params := make(map[int]interface{})
+	cborHandler := codec.CborHandle{}
+	if err := codec.NewDecoderBytes(raw, &cborHandler).Decode(&params); err != nil {
+		return nil, fmt.Errorf("cannot decode the COSE key: %s", err)
+	}
+	kty, _ := coseInt(params[1])
+	alg, _ := coseInt(params[3])
+	key := &coseKey{Algorithm: alg}
+
+	switch {
+	case kty == 2 && alg == coseAlgES256: // EC2 with P-256
+		crv, _ := coseInt(params[-1])
+		x, _ := params[-2].([]byte)
+		y, _ := params[-3].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid EC2 key")
+		}
+		key.PublicKey = &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+	case kty == 1 && alg == coseAlgEdDSA: // OKP with Ed25519
+		crv, _ := coseInt(params[-1])
+		x, _ := params[-2].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid OKP key")
+		}
+		key.PublicKey = ed25519.PublicKey(x)
+	case kty == 3 && alg == coseAlgRS256: // RSA
+		n, _ := params[-1].([]byte)
+		e, _ := params[-2].([]byte)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		key.PublicKey = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: exponent,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %d with algorithm %d", kty, alg)
+	}
+	return key, nil
+}
+
+func coseInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int64:
+		return int(n), true
+	case uint64:
+		return int(n), true
+	}
+	return 0, false
+}
+
+// Verify checks that the signature has been made by the private key of the
+// credential for the given authenticator data and client data.
+func (k *coseKey) Verify(authData, clientDataJSON, signature []byte) bool {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := make([]byte, 0, len(authData)+len(clientDataHash))
+	signed = append(signed, authData...)
+	signed = append(signed, clientDataHash[:]...)
+
+	switch pub := k.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(signed)
+		return ecdsa.VerifyASN1(pub, hash[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, signed, signature)
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature) == nil
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+)
+
+func encodeCBOR(t *testing.T, v interface{}) []byte {
+	var out []byte
+	cborHandler := codec.CborHandle{}
+	require.NoError(t, codec.NewEncoderBytes(&out, &cborHandler).Encode(v))
+	return out
+}
+
+func TestParseAuthDataAndVerify(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	priv.X.FillBytes(x)
+	priv.Y.FillBytes(y)
+	cose := encodeCBOR(t, map[int]interface{}{
+		1:  2,
+		3:  coseAlgES256,
+		-1: 1,
+		-2: x,
+		-3: y,
+	})
+
+	rpIDHash := sha256.Sum256([]byte("alice.example.com"))
+	credID := []byte("my-credential-id")
+	raw := append([]byte{}, rpIDHash[:]...)
+	raw = append(raw, byte(flagUserPresent|flagUserVerified|flagAttestedCredentialData))
+	raw = append(raw, 0, 0, 0, 42)
+	raw = append(raw, make([]byte, 16)...) // AAGUID
+	raw = append(raw, 0, byte(len(credID)))
+	raw = append(raw, credID...)
+	raw = append(raw, cose...)
+	// Extensions after the public key must be ignored
+	raw = append(raw, encodeCBOR(t, map[string]interface{}{"credProtect": 1})...)
+
+	data, err := parseAuthData(raw)
+	require.NoError(t, err)
+	assert.Equal(t, rpIDHash[:], data.RPIDHash)
+	assert.True(t, data.Flags.Has(flagUserPresent))
+	assert.True(t, data.Flags.Has(flagUserVerified))
+	assert.Equal(t, uint32(42), data.Counter)
+	assert.Equal(t, credID, data.CredentialID)
+	assert.Equal(t, cose, data.PublicKey)
+
+	key, err := parseCOSEKey(data.PublicKey)
+	require.NoError(t, err)
+	assert.Equal(t, coseAlgES256, key.Algorithm)
+
+	authData := make([]byte, 37)
+	copy(authData, rpIDHash[:])
+	authData[32] = byte(flagUserPresent)
+	binary.BigEndian.PutUint32(authData[33:], 43)
+	clientDataJSON := []byte(`{"type":"webauthn.get","challenge":"abc","origin":"https://alice.example.com"}`)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, signed[:])
+	require.NoError(t, err)
+
+	assert.True(t, key.Verify(authData, clientDataJSON, sig))
+	assert.False(t, key.Verify(authData, []byte(`{"type":"webauthn.get"}`), sig))
+}
+
+func TestParseCOSEKeyUnsupported(t *testing.T) {
+	cose := encodeCBOR(t, map[int]interface{}{
+		1: 2,
+		3: -35, // ES384
+	})
+	_, err := parseCOSEKey(cose)
+	assert.Error(t, err)
+}
+
+func TestURLEncodedBytes(t *testing.T) {
+	var b URLEncodedBytes
+	assert.NoError(t, b.UnmarshalJSON([]byte(`"_-8"`)))
+	assert.Equal(t, []byte{0xff, 0xef}, []byte(b))
+	out, err := b.MarshalJSON()
+	assert.NoError(t, err)
+	assert.Equal(t, `"_-8"`, string(out))
+}
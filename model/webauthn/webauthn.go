@@ -0,0 +1,424 @@
+// Package webauthn implements the registration and authentication ceremonies
+// of WebAuthn (https://www.w3.org/TR/webauthn/), to use security keys and
+// passkeys for logging in a Cozy.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+)
+
+// ChallengeLen is the length of the challenges (in bytes).
+const ChallengeLen = 32
+
+// The types of the ceremonies, as given in the client data. A challenge is
+// bound to the ceremony for which it has been created.
+const (
+	ceremonyCreate = "webauthn.create"
+	ceremonyGet    = "webauthn.get"
+)
+
+// Timeout is the time given to the user to complete a ceremony (in
+// milliseconds).
+const Timeout = 300000
+
+var (
+	// ErrInvalidChallenge is used when the challenge is unknown or has expired
+	ErrInvalidChallenge = errors.New("webauthn: invalid challenge")
+	// ErrInvalidOrigin is used when the ceremony has been done on a page that
+	// is not on the instance
+	ErrInvalidOrigin = errors.New("webauthn: invalid origin")
+	// ErrInvalidCredential is used when the response of the authenticator
+	// cannot be verified
+	ErrInvalidCredential = errors.New("webauthn: invalid credential")
+	// ErrUnknownCredential is used when the credential has not been
+	// registered on the instance
+	ErrUnknownCredential = errors.New("webauthn: unknown credential")
+	// ErrUserNotVerified is used when the user verification is required, but
+	// the authenticator has not verified the user
+	ErrUserNotVerified = errors.New("webauthn: user not verified")
+)
+
+// Credential is a public key credential registered on the instance. The
+// private key is kept by the authenticator (security key, smartphone, etc.).
+type Credential struct {
+	DocID        string     `json:"_id,omitempty"`
+	DocRev       string     `json:"_rev,omitempty"`
+	Name         string     `json:"name"`
+	CredentialID []byte     `json:"credential_id"`
+	PublicKey    []byte     `json:"public_key"`
+	SignCount    uint32     `json:"sign_count"`
+	AAGUID       []byte     `json:"aaguid,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+}
+
+// ID implements the couchdb.Doc interface
+func (c *Credential) ID() string { return c.DocID }
+
+// Rev implements the couchdb.Doc interface
+func (c *Credential) Rev() string { return c.DocRev }
+
+// DocType implements the couchdb.Doc interface
+func (c *Credential) DocType() string { return consts.WebAuthnCredentials }
+
+// SetID implements the couchdb.Doc interface
+func (c *Credential) SetID(id string) { c.DocID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (c *Credential) SetRev(rev string) { c.DocRev = rev }
+
+// Clone implements the couchdb.Doc interface
+func (c *Credential) Clone() couchdb.Doc {
+	cloned := *c
+	cloned.CredentialID = make([]byte, len(c.CredentialID))
+	copy(cloned.CredentialID, c.CredentialID)
+	cloned.PublicKey = make([]byte, len(c.PublicKey))
+	copy(cloned.PublicKey, c.PublicKey)
+	if c.LastUsedAt != nil {
+		last := *c.LastUsedAt
+		cloned.LastUsedAt = &last
+	}
+	return &cloned
+}
+
+// List returns the credentials registered on the instance.
+func List(inst *instance.Instance) ([]*Credential, error) {
+	var creds []*Credential
+	req := &couchdb.AllDocsRequest{Limit: 1000}
+	err := couchdb.GetAllDocs(inst, consts.WebAuthnCredentials, req, &creds)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// HasCredentials returns true if at least one credential has been registered
+// on the instance.
+func HasCredentials(inst *instance.Instance) bool {
+	creds, err := List(inst)
+	return err == nil && len(creds) > 0
+}
+
+// Find returns the credential with the given identifier.
+func Find(inst *instance.Instance, id string) (*Credential, error) {
+	var cred Credential
+	if err := couchdb.GetDoc(inst, consts.WebAuthnCredentials, id, &cred); err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+// Delete removes the credential: it can no longer be used to log in.
+func (c *Credential) Delete(inst *instance.Instance) error {
+	return couchdb.DeleteDoc(inst, c)
+}
+
+// RelyingParty is the entity that asks for the registration and
+// authentication of the credentials: the instance.
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// User is the user account for the credentials.
+type User struct {
+	ID          URLEncodedBytes `json:"id"`
+	Name        string          `json:"name"`
+	DisplayName string          `json:"displayName"`
+}
+
+// CredentialParameter is a type of credential that can be created.
+type CredentialParameter struct {
+	Type      string `json:"type"`
+	Algorithm int    `json:"alg"`
+}
+
+// CredentialDescriptor identifies a credential.
+type CredentialDescriptor struct {
+	Type string          `json:"type"`
+	ID   URLEncodedBytes `json:"id"`
+}
+
+// AuthenticatorSelection is the requirements for the authenticators.
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are the options for navigator.credentials.create().
+type CreationOptions struct {
+	RelyingParty           RelyingParty           `json:"rp"`
+	User                   User                   `json:"user"`
+	Challenge              URLEncodedBytes        `json:"challenge"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the options for navigator.credentials.get().
+type RequestOptions struct {
+	RelyingPartyID   string                 `json:"rpId"`
+	Challenge        URLEncodedBytes        `json:"challenge"`
+	Timeout          int                    `json:"timeout"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// NewCreationOptions starts the registration of a new credential, and
+// returns the options for the browser.
+func NewCreationOptions(inst *instance.Instance) (*CreationOptions, error) {
+	creds, err := List(inst)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := newChallenge(inst, ceremonyCreate)
+	if err != nil {
+		return nil, err
+	}
+	displayName, err := inst.PublicName()
+	if err != nil || displayName == "" {
+		displayName = inst.Domain
+	}
+
+	params := make([]CredentialParameter, len(supportedAlgorithms))
+	for i, alg := range supportedAlgorithms {
+		params[i] = CredentialParameter{Type: "public-key", Algorithm: alg}
+	}
+	return &CreationOptions{
+		RelyingParty: RelyingParty{
+			ID:   relyingPartyID(inst),
+			Name: inst.TemplateTitle(),
+		},
+		User: User{
+			ID:          URLEncodedBytes(inst.ID()),
+			Name:        inst.Domain,
+			DisplayName: displayName,
+		},
+		Challenge:          challenge,
+		PubKeyCredParams:   params,
+		Timeout:            Timeout,
+		ExcludeCredentials: descriptors(creds),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: "preferred",
+		},
+		Attestation: "none",
+	}, nil
+}
+
+// Register checks the response of the authenticator for the registration
+// ceremony, and saves the new credential.
+func Register(inst *instance.Instance, name string, raw []byte) (*Credential, error) {
+	resp, err := parseCredentialResponse(raw)
+	if err != nil {
+		return nil, ErrInvalidCredential
+	}
+	if err := checkClientData(inst, resp.Response.ClientDataJSON, ceremonyCreate); err != nil {
+		return nil, err
+	}
+	// The attestation statement is not verified, as we ask for the "none"
+	// conveyance preference: we don't need to know the model of the
+	// authenticator.
+	_, authData, err := parseAttestationObject(resp.Response.AttestationObject)
+	if err != nil {
+		inst.Logger().WithNamespace("webauthn").Infof("Invalid attestation: %s", err)
+		return nil, ErrInvalidCredential
+	}
+	if err := checkAuthData(inst, authData, false); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(authData.CredentialID, resp.RawID) {
+		return nil, ErrInvalidCredential
+	}
+	if _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		inst.Logger().WithNamespace("webauthn").Infof("Invalid public key: %s", err)
+		return nil, ErrInvalidCredential
+	}
+
+	if name == "" {
+		name = "Security key"
+	}
+	cred := &Credential{
+		Name:         name,
+		CredentialID: authData.CredentialID,
+		PublicKey:    authData.PublicKey,
+		SignCount:    authData.Counter,
+		AAGUID:       authData.AAGUID,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := couchdb.CreateDoc(inst, cred); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+// NewRequestOptions starts the authentication with a credential, and returns
+// the options for the browser.
+func NewRequestOptions(inst *instance.Instance) (*RequestOptions, error) {
+	creds, err := List(inst)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := newChallenge(inst, ceremonyGet)
+	if err != nil {
+		return nil, err
+	}
+	return &RequestOptions{
+		RelyingPartyID:   relyingPartyID(inst),
+		Challenge:        challenge,
+		Timeout:          Timeout,
+		AllowCredentials: descriptors(creds),
+		UserVerification: "preferred",
+	}, nil
+}
+
+// Authenticate checks the response of the authenticator for the
+// authentication ceremony, and returns the credential that has been used.
+// When userVerification is true, the authenticator must have verified the
+// user (PIN, biometrics), and not only their presence.
+func Authenticate(inst *instance.Instance, raw []byte, userVerification bool) (*Credential, error) {
+	resp, err := parseCredentialResponse(raw)
+	if err != nil {
+		return nil, ErrInvalidCredential
+	}
+	if err := checkClientData(inst, resp.Response.ClientDataJSON, ceremonyGet); err != nil {
+		return nil, err
+	}
+	authData, err := parseAuthData(resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, ErrInvalidCredential
+	}
+	if err := checkAuthData(inst, authData, userVerification); err != nil {
+		return nil, err
+	}
+
+	cred, err := findByCredentialID(inst, resp.RawID)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Response.UserHandle) > 0 && string(resp.Response.UserHandle) != inst.ID() {
+		return nil, ErrUnknownCredential
+	}
+	key, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return nil, ErrInvalidCredential
+	}
+	if !key.Verify(resp.Response.AuthenticatorData, resp.Response.ClientDataJSON, resp.Response.Signature) {
+		return nil, ErrInvalidCredential
+	}
+
+	// A signature counter that does not increase is a sign that the
+	// authenticator may have been cloned.
+	if authData.Counter != 0 || cred.SignCount != 0 {
+		if authData.Counter <= cred.SignCount {
+			inst.Logger().WithNamespace("webauthn").
+				Warnf("Signature counter has not increased for credential %s", cred.ID())
+			return nil, ErrInvalidCredential
+		}
+	}
+	now := time.Now().UTC()
+	cred.SignCount = authData.Counter
+	cred.LastUsedAt = &now
+	if err := couchdb.UpdateDoc(inst, cred); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+func findByCredentialID(inst *instance.Instance, id []byte) (*Credential, error) {
+	creds, err := List(inst)
+	if err != nil {
+		return nil, err
+	}
+	for _, cred := range creds {
+		if subtle.ConstantTimeCompare(cred.CredentialID, id) == 1 {
+			return cred, nil
+		}
+	}
+	return nil, ErrUnknownCredential
+}
+
+func descriptors(creds []*Credential) []CredentialDescriptor {
+	list := make([]CredentialDescriptor, len(creds))
+	for i, cred := range creds {
+		list[i] = CredentialDescriptor{Type: "public-key", ID: cred.CredentialID}
+	}
+	return list
+}
+
+func newChallenge(inst *instance.Instance, ceremony string) ([]byte, error) {
+	challenge := crypto.GenerateRandomBytes(ChallengeLen)
+	encoded := base64.RawURLEncoding.EncodeToString(challenge)
+	if err := GetStore().SaveChallenge(inst, ceremony, encoded); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+func checkClientData(inst *instance.Instance, raw []byte, typ string) error {
+	data, err := parseClientData(raw)
+	if err != nil {
+		return ErrInvalidCredential
+	}
+	if data.Type != typ {
+		return ErrInvalidCredential
+	}
+	challenge := strings.TrimRight(data.Challenge, "=")
+	if !GetStore().CheckAndClearChallenge(inst, typ, challenge) {
+		return ErrInvalidChallenge
+	}
+	if !isAllowedOrigin(inst, data.Origin) {
+		return ErrInvalidOrigin
+	}
+	return nil
+}
+
+func checkAuthData(inst *instance.Instance, authData *authenticatorData, userVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(relyingPartyID(inst)))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return ErrInvalidOrigin
+	}
+	if !authData.Flags.Has(flagUserPresent) {
+		return ErrInvalidCredential
+	}
+	if userVerification && !authData.Flags.Has(flagUserVerified) {
+		return ErrUserNotVerified
+	}
+	return nil
+}
+
+// relyingPartyID returns the domain of the instance, without the port.
+func relyingPartyID(inst *instance.Instance) string {
+	domain := inst.ContextualDomain()
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		return host
+	}
+	return domain
+}
+
+// isAllowedOrigin returns true if the origin is the instance itself, where the
+// pages of /auth are served. The applications are never allowed, even with
+// nested subdomains, as a compromised application could otherwise register a
+// credential or log in on behalf of the user.
+func isAllowedOrigin(inst *instance.Instance, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != inst.Scheme() {
+		return false
+	}
+	return u.Host == inst.ContextualDomain()
+}
@@ -0,0 +1,266 @@
+package appfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/filetype"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/s3"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/labstack/echo/v4"
+)
+
+// The applications are stored in the same bucket as the files, with keys
+// prefixed by the name of the swift container that would have been used
+// (apps-web/ or apps-konnectors/).
+
+type s3Copier struct {
+	c       *s3.Client
+	root    string
+	appKey  string
+	tmpKey  string
+	started bool
+	keys    []string
+	ctx     context.Context
+}
+
+// NewS3Copier defines a Copier storing data into an S3 bucket.
+func NewS3Copier(c *s3.Client, appsType consts.AppType) Copier {
+	return &s3Copier{
+		c:    c,
+		root: containerName(appsType) + "/",
+		ctx:  context.Background(),
+	}
+}
+
+func (f *s3Copier) Start(slug, version, shasum string) (bool, error) {
+	f.appKey = f.root + path.Join(slug, version)
+	if shasum != "" {
+		f.appKey += "-" + shasum
+	}
+	_, err := f.c.HeadObject(f.ctx, f.appKey)
+	if err == nil {
+		return true, nil
+	}
+	if !s3.IsNotFound(err) {
+		return false, err
+	}
+	f.tmpKey = f.root + "tmp-" + utils.RandomString(20) + "/"
+	f.keys = []string{}
+	f.started = true
+	return false, nil
+}
+
+func (f *s3Copier) Copy(stat os.FileInfo, src io.Reader) (err error) {
+	if !f.started {
+		panic("copier should call Start() before Copy()")
+	}
+
+	key := path.Join(f.tmpKey, stat.Name())
+	contentType := filetype.ByExtension(path.Ext(stat.Name()))
+	if contentType == "" {
+		contentType, src = filetype.FromReader(src)
+	}
+
+	f.keys = append(f.keys, key)
+	w := f.c.NewWriter(f.ctx, key, &s3.PutOptions{
+		ContentType: contentType,
+		Metadata: map[string]string{
+			"content-encoding":        "br",
+			"original-content-length": strconv.FormatInt(stat.Size(), 10),
+		},
+	})
+	bw := brotli.NewWriter(w)
+	_, err = io.Copy(bw, src)
+	if errc := bw.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err != nil {
+		_ = w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+func (f *s3Copier) Abort() error {
+	return f.c.DeleteObjects(f.ctx, f.keys)
+}
+
+func (f *s3Copier) Commit() (err error) {
+	defer func() {
+		if errc := f.c.DeleteObjects(f.ctx, f.keys); errc != nil {
+			logger.WithNamespace("appfs").Errorf("Cannot DeleteObjects after commit: %s", errc)
+		}
+	}()
+	// We check if the appKey has not been created concurrently by another
+	// copier.
+	if _, err = f.c.HeadObject(f.ctx, f.appKey); err == nil {
+		return nil
+	}
+	for _, srcKey := range f.keys {
+		dstKey := path.Join(f.appKey, strings.TrimPrefix(srcKey, f.tmpKey))
+		if err = f.c.CopyObject(f.ctx, srcKey, dstKey, nil); err != nil {
+			logger.WithNamespace("appfs").Errorf("Cannot copy file: %s", err)
+			return err
+		}
+	}
+	_, err = f.c.PutObject(f.ctx, f.appKey, bytes.NewReader(nil), 0, &s3.PutOptions{
+		ContentType: "text/plain",
+	})
+	return err
+}
+
+type s3Server struct {
+	c    *s3.Client
+	root string
+	ctx  context.Context
+}
+
+// NewS3FileServer returns provides the apps.FileServer implementation using
+// an S3 bucket as file server.
+func NewS3FileServer(c *s3.Client, appsType consts.AppType) FileServer {
+	return &s3Server{
+		c:    c,
+		root: containerName(appsType) + "/",
+		ctx:  context.Background(),
+	}
+}
+
+func (s *s3Server) makeKey(slug, version, shasum, file string) string {
+	basepath := path.Join(slug, version)
+	if shasum != "" {
+		basepath += "-" + shasum
+	}
+	return s.root + path.Join(basepath, file)
+}
+
+func (s *s3Server) Open(slug, version, shasum, file string) (io.ReadCloser, error) {
+	obj, err := s.c.GetObject(s.ctx, s.makeKey(slug, version, shasum, file), 0, 0)
+	if err != nil {
+		return nil, wrapS3Err(err)
+	}
+	switch obj.Metadata["content-encoding"] {
+	case "br":
+		return newBrotliReadCloser(obj.Body)
+	case "gzip":
+		return newGzipReadCloser(obj.Body)
+	}
+	return obj.Body, nil
+}
+
+func (s *s3Server) ServeFileContent(w http.ResponseWriter, req *http.Request, slug, version, shasum, file string) error {
+	obj, err := s.c.GetObject(s.ctx, s.makeKey(slug, version, shasum, file), 0, 0)
+	if err != nil {
+		return wrapS3Err(err)
+	}
+	defer obj.Body.Close()
+
+	if checkETag := req.Header.Get("Cache-Control") == ""; checkETag && len(obj.ETag) >= 10 {
+		etag := fmt.Sprintf(`"%s"`, obj.ETag[:10])
+		if utils.CheckPreconditions(w, req, etag) {
+			return nil
+		}
+		w.Header().Set("Etag", etag)
+	}
+
+	var r io.Reader = obj.Body
+	size := obj.Size
+	contentType := obj.ContentType
+	originalSize, _ := strconv.ParseInt(obj.Metadata["original-content-length"], 10, 64)
+	switch obj.Metadata["content-encoding"] {
+	case "br":
+		if acceptBrotliEncoding(req) {
+			w.Header().Set(echo.HeaderContentEncoding, "br")
+		} else {
+			size = originalSize
+			r = brotli.NewReader(obj.Body)
+		}
+	case "gzip":
+		if acceptGzipEncoding(req) {
+			w.Header().Set(echo.HeaderContentEncoding, "gzip")
+		} else {
+			size = originalSize
+			gr, err := gzip.NewReader(obj.Body)
+			if err != nil {
+				return err
+			}
+			defer gr.Close()
+			r = gr
+		}
+	}
+
+	ext := path.Ext(file)
+	if contentType == "" {
+		contentType = mime.TypeByExtension(ext)
+	}
+	if contentType == "text/xml" && ext == ".svg" {
+		// override for files with text/xml content because of leading <?xml tag
+		contentType = "image/svg+xml"
+	}
+
+	utils.ServeContent(w, req, contentType, size, r)
+	return nil
+}
+
+func (s *s3Server) ServeCodeTarball(w http.ResponseWriter, req *http.Request, slug, version, shasum string) error {
+	key := s.root + path.Join(slug, version)
+	if shasum != "" {
+		key += "-" + shasum
+	}
+	key += ".tgz"
+
+	obj, err := s.c.GetObject(s.ctx, key, 0, 0)
+	if err == nil {
+		defer obj.Body.Close()
+		utils.ServeContent(w, req, obj.ContentType, obj.Size, obj.Body)
+		return nil
+	}
+
+	buf, err := prepareTarball(s, slug, version, shasum)
+	if err != nil {
+		return err
+	}
+	contentType := mime.TypeByExtension(".gz")
+
+	_, _ = s.c.PutObject(s.ctx, key, bytes.NewReader(buf.Bytes()), int64(buf.Len()), &s3.PutOptions{
+		ContentType: contentType,
+	})
+
+	utils.ServeContent(w, req, contentType, int64(buf.Len()), buf)
+	return nil
+}
+
+func (s *s3Server) FilesList(slug, version, shasum string) ([]string, error) {
+	prefix := s.makeKey(slug, version, shasum, "") + "/"
+	keys, err := s.c.ListKeys(s.ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	filtered := keys[:0]
+	for _, k := range keys {
+		k = strings.TrimPrefix(k, prefix)
+		if k != "" {
+			filtered = append(filtered, k)
+		}
+	}
+	return filtered, nil
+}
+
+func wrapS3Err(err error) error {
+	if s3.IsNotFound(err) {
+		return os.ErrNotExist
+	}
+	return err
+}
@@ -14,6 +14,8 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/assets/model"
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/s3"
+	"github.com/cozy/cozy-stack/pkg/s3/s3test"
 	"github.com/ncw/swift/v2/swifttest"
 
 	"github.com/spf13/viper"
@@ -88,6 +90,43 @@ func TestRemoveCustomAsset(t *testing.T) {
 	assert.Equal(t, len(finalAssetsList["bar"]), len(assetsList["bar"]))
 }
 
+func TestS3FS(t *testing.T) {
+	server := s3test.NewServer()
+	defer server.Close()
+	client, err := s3.NewClient(s3.Options{
+		Endpoint:  server.URL,
+		Bucket:    "cozy",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.CreateBucket(context.Background()))
+	fs := &s3FS{client: client, ctx: context.Background()}
+
+	_, err = fs.CheckStatus()
+	assert.NoError(t, err)
+
+	_, err = fs.Get("bar", "/baz.css")
+	assert.True(t, os.IsNotExist(err))
+
+	sum := sha256.Sum256([]byte("body {}"))
+	asset := model.NewAsset(model.AssetOption{
+		Name:    "/baz.css",
+		Context: "bar",
+		Shasum:  hex.EncodeToString(sum[:]),
+	}, []byte("body {}"), nil)
+	assert.NoError(t, fs.Add("bar", "/baz.css", asset))
+	content, err := fs.Get("bar", "/baz.css")
+	assert.NoError(t, err)
+	assert.Equal(t, "body {}", string(content))
+	assert.Equal(t, []string{DynamicAssetsContainerName + "/bar/baz.css"}, server.Keys("cozy"))
+
+	assert.NoError(t, fs.Remove("bar", "/baz.css"))
+	_, err = fs.Get("bar", "/baz.css")
+	assert.True(t, os.IsNotExist(err))
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
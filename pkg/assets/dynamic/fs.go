@@ -15,6 +15,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/assets/model"
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/s3"
 	"github.com/ncw/swift/v2"
 	"github.com/spf13/afero"
 )
@@ -40,6 +41,11 @@ type swiftFS struct {
 	ctx       context.Context
 }
 
+type s3FS struct {
+	client *s3.Client
+	ctx    context.Context
+}
+
 type aferoFS struct {
 	fs     afero.Fs
 	folder *url.URL
@@ -65,6 +71,8 @@ func InitDynamicAssetFS() error {
 		if err != nil {
 			return err
 		}
+	case config.SchemeS3, config.SchemeS3Insecure:
+		assetFS = newS3FS()
 	default:
 		return fmt.Errorf("Invalid scheme %s for dynamic assets FS", scheme)
 	}
@@ -99,6 +107,12 @@ func newswiftFS() (*swiftFS, error) {
 	return swiftFS, nil
 }
 
+// The dynamic assets are stored in the same bucket as the files, with keys
+// prefixed by the name of the swift container.
+func newS3FS() *s3FS {
+	return &s3FS{client: config.GetS3Client(), ctx: context.Background()}
+}
+
 func (a *aferoFS) Add(context, name string, asset *model.Asset) error {
 	filePath := a.GetAssetFolderName(context, name)
 
@@ -251,3 +265,67 @@ func (s *swiftFS) CheckStatus() (time.Duration, error) {
 	}
 	return time.Since(before), nil
 }
+
+func (s *s3FS) key(context, name string) string {
+	return path.Join(DynamicAssetsContainerName, context, name)
+}
+
+func (s *s3FS) Add(context, name string, asset *model.Asset) error {
+	data := asset.GetData()
+	key := s.key(asset.Context, asset.Name)
+	_, err := s.client.PutObject(s.ctx, key, bytes.NewReader(data), int64(len(data)), nil)
+	return err
+}
+
+func (s *s3FS) Get(context, name string) ([]byte, error) {
+	obj, err := s.client.GetObject(s.ctx, s.key(context, name), 0, 0)
+	if err != nil {
+		if s3.IsNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	defer obj.Body.Close()
+	return ioutil.ReadAll(obj.Body)
+}
+
+func (s *s3FS) Remove(context, name string) error {
+	return s.client.DeleteObject(s.ctx, s.key(context, name))
+}
+
+func (s *s3FS) List() (map[string][]*model.Asset, error) {
+	objs := map[string][]*model.Asset{}
+
+	prefix := DynamicAssetsContainerName + "/"
+	keys, err := s.client.ListKeys(s.ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		splitted := strings.SplitN(strings.TrimPrefix(key, prefix), "/", 2)
+		if len(splitted) != 2 {
+			continue
+		}
+		ctx := splitted[0]
+		assetName := model.NormalizeAssetName(splitted[1])
+
+		a, err := GetAsset(ctx, assetName)
+		if err != nil {
+			return nil, err
+		}
+
+		objs[ctx] = append(objs[ctx], a)
+	}
+
+	return objs, nil
+}
+
+func (s *s3FS) CheckStatus() (time.Duration, error) {
+	before := time.Now()
+	_, err := s.client.HeadObject(s.ctx, DynamicAssetsContainerName)
+	if err != nil && !s3.IsNotFound(err) {
+		return 0, err
+	}
+	return time.Since(before), nil
+}
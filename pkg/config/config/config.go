@@ -74,6 +74,12 @@ const (
 	// SchemeSwiftSecure is the URL scheme used to configure the swift filesystem
 	// in secure mode (HTTPS).
 	SchemeSwiftSecure = "swift+https"
+	// SchemeS3 is the URL scheme used to configure an S3-compatible object
+	// storage (HTTPS).
+	SchemeS3 = "s3"
+	// SchemeS3Insecure is the URL scheme used to configure an S3-compatible
+	// object storage over plain HTTP, like a local MinIO.
+	SchemeS3Insecure = "s3+http"
 )
 
 // defaultAdminSecretFileName is the default name of the file containing the
@@ -107,6 +113,7 @@ type Config struct {
 
 	CredentialsEncryptorKey string
 	CredentialsDecryptorKey string
+	FilesEncryptionKeys     []string
 
 	RemoteAssets map[string]string
 
@@ -152,6 +159,7 @@ type Config struct {
 type Vault struct {
 	credsEncryptor *keymgmt.NACLKey
 	credsDecryptor *keymgmt.NACLKey
+	filesKeys      []*keymgmt.SecretKey
 }
 
 // CredentialsEncryptorKey returns the key used to encrypt credentials values,
@@ -166,6 +174,28 @@ func (v *Vault) CredentialsDecryptorKey() *keymgmt.NACLKey {
 	return v.credsDecryptor
 }
 
+// FilesEncryptionKey returns the key used to wrap the keys that encrypt the
+// content of the files of the instances. It returns nil if the encryption at
+// rest has not been configured.
+func (v *Vault) FilesEncryptionKey() *keymgmt.SecretKey {
+	if len(v.filesKeys) == 0 {
+		return nil
+	}
+	return v.filesKeys[0]
+}
+
+// FilesDecryptionKey returns the key with the given identifier, from the
+// current key and the previous ones. It is used to unwrap the keys of the
+// instances.
+func (v *Vault) FilesDecryptionKey(id string) *keymgmt.SecretKey {
+	for _, key := range v.filesKeys {
+		if key.ID() == id {
+			return key
+		}
+	}
+	return nil
+}
+
 // Fs contains the configuration values of the file-system
 type Fs struct {
 	Auth                  *url.Userinfo
@@ -173,6 +203,7 @@ type Fs struct {
 	Transport             http.RoundTripper
 	DefaultLayout         int
 	CanQueryInfo          bool
+	Deduplication         bool
 	AutoCleanTrashedAfter map[string]string
 	Versioning            FsVersioning
 	Contexts              map[string]interface{}
@@ -272,10 +303,12 @@ type SMS struct {
 
 // Worker contains the configuration fields for a specific worker type.
 type Worker struct {
-	WorkerType   string
-	Concurrency  *int
-	MaxExecCount *int
-	Timeout      *time.Duration
+	WorkerType     string
+	Concurrency    *int
+	MaxExecCount   *int
+	Timeout        *time.Duration
+	FairScheduling *bool
+	MaxPerInstance *int
 }
 
 // RedisConfig contains the configuration values for a redis system
@@ -673,6 +706,14 @@ func UseViper(v *viper.Viper) error {
 							if maxExecCount, ok := v.(int); ok {
 								w.MaxExecCount = &maxExecCount
 							}
+						case "fair_scheduling":
+							if fair, ok := v.(bool); ok {
+								w.FairScheduling = &fair
+							}
+						case "max_per_instance":
+							if maxPerInstance, ok := v.(int); ok {
+								w.MaxPerInstance = &maxPerInstance
+							}
 						case "timeout":
 							if timeout, ok := v.(string); ok {
 								var d time.Duration
@@ -752,12 +793,14 @@ func UseViper(v *viper.Viper) error {
 
 		CredentialsEncryptorKey: v.GetString("vault.credentials_encryptor_key"),
 		CredentialsDecryptorKey: v.GetString("vault.credentials_decryptor_key"),
+		FilesEncryptionKeys:     v.GetStringSlice("vault.files_encryption_keys"),
 
 		Fs: Fs{
 			URL:                   fsURL,
 			Transport:             fsClient.Transport,
 			DefaultLayout:         defaultLayout,
 			CanQueryInfo:          v.GetBool("fs.can_query_info"),
+			Deduplication:         v.GetBool("fs.deduplication"),
 			AutoCleanTrashedAfter: v.GetStringMapString("fs.auto_clean_trashed_after"),
 			Versioning: FsVersioning{
 				MaxNumberToKeep:            v.GetInt("fs.versioning.max_number_of_versions_to_keep"),
@@ -869,6 +912,22 @@ func (c contextPrint) Printf(ctx context.Context, format string, args ...interfa
 func MakeVault(c *Config) error {
 	var credsEncryptor *keymgmt.NACLKey
 	var credsDecryptor *keymgmt.NACLKey
+	var filesKeys []*keymgmt.SecretKey
+
+	// The first key is the current one, the others are the previous keys,
+	// still needed to unwrap the keys of the instances until they have been
+	// rotated.
+	for _, filename := range config.FilesEncryptionKeys {
+		keyBytes, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		key, err := keymgmt.UnmarshalSecretKey(keyBytes)
+		if err != nil {
+			return err
+		}
+		filesKeys = append(filesKeys, key)
+	}
 
 	if credsEncryptorKey := config.CredentialsEncryptorKey; credsEncryptorKey != "" {
 		keyBytes, err := ioutil.ReadFile(credsEncryptorKey)
@@ -902,20 +961,24 @@ func MakeVault(c *Config) error {
 		// obviously not a good idea from a security point of view, and it
 		// should not be used to store sensible data. But for development, it
 		// should be enough.
-		if !build.IsDevRelease() {
-			return nil
-		}
-		var err error
-		r := utils.NewSeededRand(42)
-		credsEncryptor, credsDecryptor, err = keymgmt.GenerateKeyPair(r)
-		if err != nil {
-			return err
+		if build.IsDevRelease() {
+			var err error
+			r := utils.NewSeededRand(42)
+			credsEncryptor, credsDecryptor, err = keymgmt.GenerateKeyPair(r)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
+	if credsEncryptor == nil && credsDecryptor == nil && len(filesKeys) == 0 {
+		return nil
+	}
+
 	vault = &Vault{
 		credsEncryptor: credsEncryptor,
 		credsDecryptor: credsDecryptor,
+		filesKeys:      filesKeys,
 	}
 	return nil
 }
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/s3"
+)
+
+var s3Client *s3.Client
+
+// InitDefaultS3Client initializes the default S3 client.
+func InitDefaultS3Client() error {
+	return InitS3Client(config.Fs)
+}
+
+// InitS3Client initializes the global S3 client, and creates the bucket if it
+// does not exist. This is not a thread-safe method.
+//
+// The URL looks like s3://access_key:secret_key@host/bucket?Region=eu-west-1,
+// with s3+http:// instead of s3:// for a server without TLS.
+func InitS3Client(fs Fs) error {
+	fsURL := fs.URL
+	if fsURL.Scheme != SchemeS3 && fsURL.Scheme != SchemeS3Insecure {
+		return nil
+	}
+
+	q := fsURL.Query()
+	scheme := "https"
+	if fsURL.Scheme == SchemeS3Insecure {
+		scheme = "http"
+	}
+
+	bucket := strings.Trim(fsURL.Path, "/")
+	if bucket == "" {
+		return errors.New("s3: the bucket must be given in the path of fs.url")
+	}
+
+	var accessKey, secretKey string
+	if fsURL.User != nil {
+		accessKey = fsURL.User.Username()
+		secretKey, _ = fsURL.User.Password()
+	} else {
+		accessKey = q.Get("AccessKeyID")
+		secretKey = q.Get("SecretAccessKey")
+	}
+
+	pathStyle, _ := strconv.ParseBool(q.Get("PathStyle"))
+
+	timeout := 300 * time.Second
+	if param := q.Get("Timeout"); param != "" {
+		if t, err := time.ParseDuration(param); err == nil {
+			timeout = t
+		}
+	}
+
+	client, err := s3.NewClient(s3.Options{
+		Endpoint:  scheme + "://" + fsURL.Host,
+		Bucket:    bucket,
+		Region:    q.Get("Region"),
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		PathStyle: pathStyle,
+		Transport: fs.Transport,
+		Timeout:   timeout,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = client.CreateBucket(context.Background()); err != nil {
+		log.Errorf("Cannot create the bucket %q on the S3 server %s: %s",
+			bucket, fsURL.Host, err)
+		return err
+	}
+	s3Client = client
+	log.Infof("Successfully connected to the S3 server %s", fsURL.Host)
+	return nil
+}
+
+// GetS3Client returns the s3.Client created from the actual configuration.
+func GetS3Client() *s3.Client {
+	if s3Client == nil {
+		panic("Called GetS3Client() before InitS3Client()")
+	}
+	return s3Client
+}
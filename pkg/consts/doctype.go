@@ -34,6 +34,11 @@ const (
 	FilesMetadata = "io.cozy.files.metadata"
 	// FilesVersions doc type for versioning file contents
 	FilesVersions = "io.cozy.files.versions"
+	// FilesBlobs doc type for the reference counts of the blobs shared by
+	// several files when the deduplication is enabled
+	FilesBlobs = "io.cozy.files.blobs"
+	// FilesUploads doc type for the sessions of resumable uploads
+	FilesUploads = "io.cozy.files.uploads"
 	// FilesShortcuts doc type for high-level information about .url files
 	FilesShortcuts = "io.cozy.files.shortcuts"
 	// Thumbnails is a synthetic doctype for thumbnails, used for realtime
@@ -54,6 +59,12 @@ const (
 	Intents = "io.cozy.intents"
 	// Jobs doc type for queued jobs
 	Jobs = "io.cozy.jobs"
+	// DeadJobs doc type for the jobs that have failed after all their
+	// attempts (the dead-letter queue, in the global database)
+	DeadJobs = "io.cozy.jobs.dead"
+	// JobsLogs doc type for the lines of the logs of the jobs, sent in real
+	// time
+	JobsLogs = "io.cozy.jobs.logs"
 	// JobEvents doc type for real time events sent by jobs
 	JobEvents = "io.cozy.jobs.events"
 	// Support doc type for sending mail to the support
@@ -68,6 +79,8 @@ const (
 	Permissions = "io.cozy.permissions"
 	// Contacts doc type for sharing
 	Contacts = "io.cozy.contacts"
+	// Groups doc type for the groups of contacts
+	Groups = "io.cozy.contacts.groups"
 	// RemoteRequests doc type for logging requests to remote websites
 	RemoteRequests = "io.cozy.remote.requests"
 	// RemoteSecrets doc type for secrets used by remote doctypes
@@ -78,6 +91,12 @@ const (
 	SessionsLogins = "io.cozy.sessions.logins"
 	// Settings doc type for settings to customize an instance
 	Settings = "io.cozy.settings"
+	// WebAuthnCredentials doc type for the security keys and passkeys that
+	// can be used to log in
+	WebAuthnCredentials = "io.cozy.webauthn.credentials"
+	// AppPasswords doc type for the application passwords that can be used
+	// by the WebDAV clients
+	AppPasswords = "io.cozy.webdav.passwords"
 	// Shared doc type for keepking track of documents in sharings
 	Shared = "io.cozy.shared"
 	// Sharings doc type for document and file sharing
@@ -91,6 +110,9 @@ const (
 	// SharingsInitialSync doc type for real-time events for initial sync of a
 	// sharing
 	SharingsInitialSync = "io.cozy.sharings.initial_sync"
+	// SharingsActivity doc type for the log of the changes received from the
+	// other members of a sharing
+	SharingsActivity = "io.cozy.sharings.activity"
 	// Triggers doc type for triggers, jobs launchers
 	Triggers = "io.cozy.triggers"
 	// TriggersState doc type for triggers current state, jobs launchers
@@ -8,6 +8,7 @@ const (
 	KonnectorAudience         = "konn"         // used by konnectors
 	CLIAudience               = "cli"          // used by command line interface
 	ShareAudience             = "share"        // used for share by links code
+	UnlockedShareAudience     = "unlocked"     // share by link unlocked with a password
 	RegistrationTokenAudience = "registration" // OAuth registration tokens
 	AccessTokenAudience       = "access"       // OAuth access tokens
 	RefreshTokenAudience      = "refresh"      // OAuth refresh tokens
@@ -438,6 +438,22 @@ func GetDocWithRevs(db prefixer.Prefixer, doctype, id string, out Doc) error {
 	return makeRequest(db, doctype, http.MethodGet, url, nil, out)
 }
 
+// GetDocRevWithRevs fetches a document by its docType and ID on a specific
+// revision, with the list of the revisions before it. It works for the
+// tombstone of a deleted document too.
+func GetDocRevWithRevs(db prefixer.Prefixer, doctype, id, rev string, out Doc) error {
+	var err error
+	id, err = validateDocID(id)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return fmt.Errorf("Missing ID for GetDoc")
+	}
+	url := url.PathEscape(id) + "?revs=true&rev=" + url.QueryEscape(rev)
+	return makeRequest(db, doctype, http.MethodGet, url, nil, out)
+}
+
 // EnsureDBExist creates the database for the doctype if it doesn't exist
 func EnsureDBExist(db prefixer.Prefixer, doctype string) error {
 	_, err := DBStatus(db, doctype)
@@ -11,7 +11,7 @@ import (
 
 // IndexViewsVersion is the version of current definition of views & indexes.
 // This number should be incremented when this file changes.
-const IndexViewsVersion int = 33
+const IndexViewsVersion int = 36
 
 // Indexes is the index list required by an instance to run properly.
 var Indexes = []*mango.Index{
@@ -50,6 +50,9 @@ var Indexes = []*mango.Index{
 	// date
 	mango.IndexOnFields(consts.Notifications, "by-source-id", []string{"source_id", "created_at"}),
 
+	// Used to list the activity of a sharing, ordered by date
+	mango.IndexOnFields(consts.SharingsActivity, "by-sharing-id", []string{"sharing_id", "created_at"}),
+
 	// Used to find the myself document
 	mango.IndexOnFields(consts.Contacts, "by-me", []string{"me"}),
 
@@ -85,6 +88,21 @@ function(doc) {
 	Reduce: "_sum",
 }
 
+// BlobsSavedSpaceView is the view used for computing the disk space saved by
+// the deduplication of the file contents.
+var BlobsSavedSpaceView = &View{
+	Name:    "blobs-saved-space",
+	Doctype: consts.FilesBlobs,
+	Map: `
+function(doc) {
+  if (doc.refs > 1) {
+    emit(doc._id, (doc.refs - 1) * +doc.size);
+  }
+}
+`,
+	Reduce: "_sum",
+}
+
 // DirNotSynchronizedOnView is the view used for fetching directories that are
 // not synchronized on a given device.
 var DirNotSynchronizedOnView = &View{
@@ -258,6 +276,38 @@ function(doc) {
 `,
 }
 
+// ContactsByGroupView is used to find the contacts of a group
+var ContactsByGroupView = &View{
+	Name:    "contacts-by-group",
+	Doctype: consts.Contacts,
+	Map: `
+function(doc) {
+	if (doc.relationships && doc.relationships.groups && isArray(doc.relationships.groups.data)) {
+		for (var i = 0; i < doc.relationships.groups.data.length; i++) {
+			emit(doc.relationships.groups.data[i]._id, doc._id);
+		}
+	}
+}
+`,
+}
+
+// SharingsByGroupView is the view for fetching the sharings with a group of
+// contacts as recipient
+var SharingsByGroupView = &View{
+	Name:    "sharings-by-group",
+	Doctype: consts.Sharings,
+	Map: `
+function(doc) {
+	if (isArray(doc.groups)) {
+		for (var i = 0; i < doc.groups.length; i++) {
+			if (!doc.groups[i].revoked) {
+				emit(doc.groups[i].id, i);
+			}
+		}
+	}
+}`,
+}
+
 // Views is the list of all views that are created by the stack.
 var Views = []*View{
 	DiskUsageView,
@@ -272,7 +322,10 @@ var Views = []*View{
 	PermissionsShareByShortcodeView,
 	SharedDocsBySharingID,
 	SharingsByDocTypeView,
+	SharingsByGroupView,
 	ContactByEmail,
+	ContactsByGroupView,
+	BlobsSavedSpaceView,
 }
 
 // ViewsByDoctype returns the list of views for a specified doc type.
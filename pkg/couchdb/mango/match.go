@@ -0,0 +1,352 @@
+package mango
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// This file provides an evaluation of the mango selectors in go, for
+// checking that a document matches a selector without asking CouchDB. Only a
+// subset of the operators is supported, and the strings are compared by
+// their bytes, not with the UCA algorithm of CouchDB.
+
+// ErrInvalidSelector is used when a selector uses an unknown operator, or
+// when an operator has an invalid argument.
+var ErrInvalidSelector = errors.New("mango: invalid selector")
+
+const (
+	eq    ValueOperator = "$eq"
+	in    ValueOperator = "$in"
+	nin   ValueOperator = "$nin"
+	regex ValueOperator = "$regex"
+)
+
+// ValidateSelector checks that the selector can be evaluated by Match.
+func ValidateSelector(selector Map) error {
+	return validateSelector(selector, nil)
+}
+
+// Matcher is a selector that has been validated, and whose regular
+// expressions have been compiled, to be matched against many documents.
+type Matcher struct {
+	selector Map
+	regexps  map[string]*regexp.Regexp
+}
+
+// NewMatcher validates the selector and compiles its regular expressions.
+func NewMatcher(selector Map) (*Matcher, error) {
+	regexps := make(map[string]*regexp.Regexp)
+	if err := validateSelector(selector, regexps); err != nil {
+		return nil, err
+	}
+	return &Matcher{selector: selector, regexps: regexps}, nil
+}
+
+// Match returns true if the document matches the selector, like the Match
+// function.
+func (m *Matcher) Match(doc map[string]interface{}) bool {
+	return match(m.selector, doc, m.regexps)
+}
+
+// validateSelector checks the selector, and puts its compiled regular
+// expressions in the regexps map if it is not nil.
+func validateSelector(selector Map, regexps map[string]*regexp.Regexp) error {
+	for key, value := range selector {
+		switch LogicOperator(key) {
+		case and, or, nor:
+			list, ok := value.([]interface{})
+			if !ok {
+				return ErrInvalidSelector
+			}
+			for _, item := range list {
+				sub, ok := asMap(item)
+				if !ok {
+					return ErrInvalidSelector
+				}
+				if err := validateSelector(sub, regexps); err != nil {
+					return err
+				}
+			}
+			continue
+		case not:
+			sub, ok := asMap(value)
+			if !ok {
+				return ErrInvalidSelector
+			}
+			if err := validateSelector(sub, regexps); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "$") {
+			return ErrInvalidSelector
+		}
+		if err := validateCondition(value, regexps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateCondition(condition interface{}, regexps map[string]*regexp.Regexp) error {
+	ops, ok := asMap(condition)
+	if !ok || !isOperators(ops) {
+		if ok {
+			return validateSelector(ops, regexps)
+		}
+		return nil
+	}
+	for op, arg := range ops {
+		switch ValueOperator(op) {
+		case eq, ne, gt, gte, lt, lte:
+		case exists:
+			if _, ok := arg.(bool); !ok {
+				return ErrInvalidSelector
+			}
+		case in, nin:
+			if _, ok := arg.([]interface{}); !ok {
+				return ErrInvalidSelector
+			}
+		case regex:
+			s, ok := arg.(string)
+			if !ok {
+				return ErrInvalidSelector
+			}
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return ErrInvalidSelector
+			}
+			if regexps != nil {
+				regexps[s] = re
+			}
+		default:
+			if LogicOperator(op) == not {
+				if err := validateCondition(arg, regexps); err != nil {
+					return err
+				}
+				continue
+			}
+			return ErrInvalidSelector
+		}
+	}
+	return nil
+}
+
+// Match returns true if the document matches the selector. The fields of
+// the document can be accessed with a dotted path, like "metadata.title". A
+// string value of the document that is a number, like the size of a file, is
+// compared as a number with a number of the selector. The regular
+// expressions are compiled on each call: a Matcher should be used for
+// matching a selector against many documents.
+func Match(selector Map, doc map[string]interface{}) bool {
+	return match(selector, doc, nil)
+}
+
+func match(selector Map, doc map[string]interface{}, regexps map[string]*regexp.Regexp) bool {
+	for key, value := range selector {
+		switch LogicOperator(key) {
+		case and:
+			list, _ := value.([]interface{})
+			for _, item := range list {
+				if sub, ok := asMap(item); !ok || !match(sub, doc, regexps) {
+					return false
+				}
+			}
+			continue
+		case or, nor:
+			list, _ := value.([]interface{})
+			found := false
+			for _, item := range list {
+				if sub, ok := asMap(item); ok && match(sub, doc, regexps) {
+					found = true
+					break
+				}
+			}
+			if found != (LogicOperator(key) == or) {
+				return false
+			}
+			continue
+		case not:
+			sub, _ := asMap(value)
+			if match(sub, doc, regexps) {
+				return false
+			}
+			continue
+		}
+		field, present := lookup(doc, key)
+		if !matchCondition(value, field, present, regexps) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchCondition(condition, field interface{}, present bool, regexps map[string]*regexp.Regexp) bool {
+	ops, ok := asMap(condition)
+	if !ok || !isOperators(ops) {
+		if ok {
+			// A nested selector
+			sub, isMap := field.(map[string]interface{})
+			return isMap && match(ops, sub, regexps)
+		}
+		return present && equal(field, condition)
+	}
+	for op, arg := range ops {
+		if !matchOperator(op, arg, field, present, regexps) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchOperator(op string, arg, field interface{}, present bool, regexps map[string]*regexp.Regexp) bool {
+	switch ValueOperator(op) {
+	case exists:
+		return present == (arg == true)
+	case eq:
+		return present && equal(field, arg)
+	case ne:
+		return !present || !equal(field, arg)
+	case gt, gte, lt, lte:
+		if !present {
+			return false
+		}
+		cmp, ok := compare(field, arg)
+		if !ok {
+			return false
+		}
+		switch ValueOperator(op) {
+		case gt:
+			return cmp > 0
+		case gte:
+			return cmp >= 0
+		case lt:
+			return cmp < 0
+		default:
+			return cmp <= 0
+		}
+	case in, nin:
+		list, _ := arg.([]interface{})
+		found := false
+		for _, item := range list {
+			if present && equal(field, item) {
+				found = true
+				break
+			}
+		}
+		return found == (ValueOperator(op) == in)
+	case regex:
+		s, ok := field.(string)
+		if !ok {
+			return false
+		}
+		pattern, _ := arg.(string)
+		if re, ok := regexps[pattern]; ok {
+			return re.MatchString(s)
+		}
+		matched, err := regexp.MatchString(pattern, s)
+		return err == nil && matched
+	}
+	if LogicOperator(op) == not {
+		return !matchCondition(arg, field, present, regexps)
+	}
+	return false
+}
+
+// isOperators returns true if the keys of the map are operators, and false
+// if it is a nested selector.
+func isOperators(m map[string]interface{}) bool {
+	for key := range m {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case Map:
+		return m, true
+	}
+	return nil, false
+}
+
+func lookup(doc map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func equal(field, value interface{}) bool {
+	if cmp, ok := compare(field, value); ok {
+		return cmp == 0
+	}
+	return reflect.DeepEqual(field, value)
+}
+
+// compare returns -1, 0 or 1 if the field is lower, equal or greater than
+// the value, and false if they can't be compared.
+func compare(field, value interface{}) (int, bool) {
+	if v, ok := toNumber(value); ok {
+		f, ok := toNumber(field)
+		if !ok {
+			s, isString := field.(string)
+			if !isString {
+				return 0, false
+			}
+			if f, ok = parseNumber(s); !ok {
+				return 0, false
+			}
+		}
+		switch {
+		case f < v:
+			return -1, true
+		case f > v:
+			return 1, true
+		}
+		return 0, true
+	}
+	if v, ok := value.(string); ok {
+		f, ok := field.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(f, v), true
+	}
+	return 0, false
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func parseNumber(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
@@ -0,0 +1,69 @@
+package mango
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatch(t *testing.T) {
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"status": "paid",
+		"size": "12582912",
+		"amount": 42.5,
+		"tags": ["invoice"],
+		"metadata": {"carbonCopy": true, "datetime": "2021-04-12T12:34:56Z"}
+	}`), &doc))
+
+	cases := []struct {
+		selector string
+		expected bool
+	}{
+		{`{"status": "paid"}`, true},
+		{`{"status": "pending"}`, false},
+		{`{"status": {"$in": ["pending", "paid"]}}`, true},
+		{`{"status": {"$nin": ["pending", "paid"]}}`, false},
+		{`{"status": {"$ne": "pending"}}`, true},
+		{`{"size": {"$gt": 10485760}}`, true},
+		{`{"size": {"$lte": 10485760}}`, false},
+		{`{"amount": {"$gte": 42.5, "$lt": 100}}`, true},
+		{`{"metadata.carbonCopy": true}`, true},
+		{`{"metadata": {"carbonCopy": false}}`, false},
+		{`{"metadata.datetime": {"$gt": "2021-01-01"}}`, true},
+		{`{"metadata.qualification": {"$exists": false}}`, true},
+		{`{"tags": ["invoice"]}`, true},
+		{`{"status": {"$regex": "^pa"}}`, true},
+		{`{"$or": [{"status": {"$regex": "^pe"}}, {"status": {"$not": {"$regex": "d$"}}}]}`, false},
+		{`{"$or": [{"status": "pending"}, {"amount": {"$gt": 40}}]}`, true},
+		{`{"$and": [{"status": "paid"}, {"amount": {"$gt": 50}}]}`, false},
+		{`{"$nor": [{"status": "pending"}]}`, true},
+		{`{"$not": {"status": "paid"}}`, false},
+		{`{"status": {"$not": {"$eq": "paid"}}}`, false},
+	}
+	for _, c := range cases {
+		var selector Map
+		require.NoError(t, json.Unmarshal([]byte(c.selector), &selector))
+		assert.NoError(t, ValidateSelector(selector), c.selector)
+		assert.Equal(t, c.expected, Match(selector, doc), c.selector)
+		matcher, err := NewMatcher(selector)
+		require.NoError(t, err, c.selector)
+		assert.Equal(t, c.expected, matcher.Match(doc), c.selector)
+	}
+
+	for _, invalid := range []string{
+		`{"$where": "true"}`,
+		`{"status": {"$unknown": 1}}`,
+		`{"status": {"$in": "paid"}}`,
+		`{"$or": {"status": "paid"}}`,
+		`{"status": {"$regex": "("}}`,
+	} {
+		var selector Map
+		require.NoError(t, json.Unmarshal([]byte(invalid), &selector))
+		assert.Equal(t, ErrInvalidSelector, ValidateSelector(selector), invalid)
+		_, err := NewMatcher(selector)
+		assert.Equal(t, ErrInvalidSelector, err, invalid)
+	}
+}
@@ -156,6 +156,9 @@ func Lt(field string, value interface{}) Filter { return &valueFilter{field, lt,
 // Lte returns a filter that check if a field <= value
 func Lte(field string, value interface{}) Filter { return &valueFilter{field, lte, value} }
 
+// In returns a filter that check if field is one of the values
+func In(field string, values []interface{}) Filter { return &valueFilter{field, in, values} }
+
 // Between returns a filter that check if v1 <= field < v2
 func Between(field string, v1 interface{}, v2 interface{}) Filter {
 	return &logicFilter{op: and, filters: []Filter{
@@ -33,6 +33,9 @@ func TestQueryMarshaling(t *testing.T) {
 
 	q4 := Not(Equal("DirID", "ab123"))
 	DeepEqual(t, q4.ToMango(), M{"$not": M{"DirID": "ab123"}})
+
+	q5 := In("DirID", []interface{}{"ab123", "cd456"})
+	DeepEqual(t, q5.ToMango(), M{"DirID": M{"$in": S{"ab123", "cd456"}}})
 }
 
 func TestSortMarshaling(t *testing.T) {
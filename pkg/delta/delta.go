@@ -0,0 +1,469 @@
+// Package delta implements a block-based algorithm, like the one of rsync, to
+// send only the changed parts of a file to a peer that already has an older
+// version of it. The peer computes a signature of its version, and the sender
+// uses this signature to build a delta: a list of blocks to copy from the old
+// version, and of new data. The peer can then rebuild the new version from its
+// old version and the delta.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// ContentType is the content type for the requests with a delta as body.
+	ContentType = "application/vnd.cozy.delta"
+	// MinSize is the minimal size of a file for sending a delta instead of
+	// the whole content.
+	MinSize = 1 << 20
+	// MinBlockSize is the minimal size of a block for a signature.
+	MinBlockSize = 4 << 10
+	// MaxBlockSize is the maximal size of a block for a signature.
+	MaxBlockSize = 1 << 20
+
+	// maxBlocks is the targeted maximal number of blocks in a signature
+	maxBlocks = 16 << 10
+)
+
+const (
+	opCopy    byte = 'C'
+	opLiteral byte = 'L'
+	opEnd     byte = 'E'
+)
+
+// magic is the prefix of a delta, to recognize its format.
+var magic = []byte("CZD1")
+
+var (
+	// ErrInvalidSignature is used when a signature cannot be used to compute
+	// a delta.
+	ErrInvalidSignature = errors.New("The signature is invalid")
+	// ErrInvalidDelta is used when a delta is not in the expected format.
+	ErrInvalidDelta = errors.New("The delta is invalid")
+)
+
+// Block is the signature of a block of the old version of a file: a weak
+// checksum that can be rolled over the new version, and a strong hash to
+// confirm a match.
+type Block struct {
+	Weak   uint32 `json:"weak"`
+	Strong []byte `json:"strong"`
+}
+
+// Signature is the list of the signatures of the blocks of the old version of
+// a file. MD5Sum is the md5 of this version, to check that the delta is
+// applied to the same content.
+type Signature struct {
+	BlockSize int     `json:"block_size"`
+	MD5Sum    []byte  `json:"md5sum"`
+	Blocks    []Block `json:"blocks"`
+}
+
+// BlockSizeFor returns the size of the blocks for the signature of a file
+// with the given size.
+func BlockSizeFor(size int64) int {
+	bs := size / maxBlocks
+	if bs < MinBlockSize {
+		return MinBlockSize
+	}
+	if bs > MaxBlockSize {
+		return MaxBlockSize
+	}
+	return int(bs)
+}
+
+// NewSignature reads the old version of a file, with the given md5, and
+// returns its signature.
+func NewSignature(r io.Reader, blockSize int, md5sum []byte) (*Signature, error) {
+	if blockSize <= 0 || blockSize > MaxBlockSize {
+		return nil, ErrInvalidSignature
+	}
+	sig := &Signature{
+		BlockSize: blockSize,
+		MD5Sum:    md5sum,
+		Blocks:    []Block{},
+	}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, Block{
+				Weak:   weakSum(buf[:n]),
+				Strong: strongSum(buf[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Validate checks that the signature can be used to compute a delta.
+func (s *Signature) Validate() error {
+	if s.BlockSize <= 0 || s.BlockSize > MaxBlockSize || len(s.MD5Sum) > 255 {
+		return ErrInvalidSignature
+	}
+	for _, b := range s.Blocks {
+		if len(b.Strong) != md5.Size {
+			return ErrInvalidSignature
+		}
+	}
+	return nil
+}
+
+// find returns the index of a block of the signature that matches the
+// window. Only the last block can be shorter than the block size.
+func (s *Signature) find(index map[uint32][]int, weak uint32, window []byte) (int, bool) {
+	candidates, ok := index[weak]
+	if !ok {
+		return 0, false
+	}
+	var strong []byte
+	for _, i := range candidates {
+		if len(window) < s.BlockSize && i != len(s.Blocks)-1 {
+			continue
+		}
+		if strong == nil {
+			strong = strongSum(window)
+		}
+		if bytes.Equal(strong, s.Blocks[i].Strong) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Compute reads the new version of a file, and writes in w the delta from the
+// old version with the given signature.
+func Compute(w io.Writer, sig *Signature, r io.Reader) error {
+	if err := sig.Validate(); err != nil {
+		return err
+	}
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for i, b := range sig.Blocks {
+		index[b.Weak] = append(index[b.Weak], i)
+	}
+
+	enc := &encoder{w: bufio.NewWriter(w)}
+	enc.header(sig.BlockSize, sig.MD5Sum)
+
+	// buf contains the pending literal data (buf[:pos]) followed by the
+	// window (buf[pos:]), with a window of at most size bytes.
+	size := sig.BlockSize
+	br := bufio.NewReader(r)
+	buf := make([]byte, 0, 2*size)
+	pos := 0
+	eof := false
+	fill := func() error {
+		for !eof && len(buf) < pos+size {
+			n, err := br.Read(buf[len(buf) : pos+size])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var roll rolling
+	fresh := true
+	for {
+		if enc.err != nil {
+			return enc.err
+		}
+		if err := fill(); err != nil {
+			return err
+		}
+		window := buf[pos:]
+		if len(window) == 0 {
+			break
+		}
+		if fresh {
+			roll.init(window)
+			fresh = false
+		}
+		if i, ok := sig.find(index, roll.sum(), window); ok {
+			enc.literal(buf[:pos])
+			enc.copy(i)
+			buf = buf[:0]
+			pos = 0
+			fresh = true
+			continue
+		}
+
+		out := buf[pos]
+		pos++
+		if err := fill(); err != nil {
+			return err
+		}
+		if len(buf) >= pos+size {
+			roll.roll(out, buf[pos+size-1])
+		} else {
+			roll.rollOut(out)
+		}
+		if pos >= size {
+			enc.literal(buf[:pos])
+			buf = buf[:copy(buf, buf[pos:])]
+			pos = 0
+		}
+	}
+	enc.literal(buf[:pos])
+	return enc.end()
+}
+
+// encoder writes the operations of a delta, and merges the copies of
+// consecutive blocks. The first error on writing is kept in err.
+type encoder struct {
+	w     *bufio.Writer
+	start int
+	count int
+	err   error
+}
+
+func (e *encoder) write(data []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(data)
+	}
+}
+
+func (e *encoder) uint32(n uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	e.write(b[:])
+}
+
+func (e *encoder) header(blockSize int, md5sum []byte) {
+	e.write(magic)
+	e.uint32(uint32(blockSize))
+	e.write([]byte{byte(len(md5sum))})
+	e.write(md5sum)
+}
+
+func (e *encoder) copy(i int) {
+	if e.count > 0 && e.start+e.count == i {
+		e.count++
+		return
+	}
+	e.flushCopy()
+	e.start = i
+	e.count = 1
+}
+
+func (e *encoder) flushCopy() {
+	if e.count == 0 {
+		return
+	}
+	e.write([]byte{opCopy})
+	e.uint32(uint32(e.start))
+	e.uint32(uint32(e.count))
+	e.count = 0
+}
+
+func (e *encoder) literal(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	e.flushCopy()
+	e.write([]byte{opLiteral})
+	e.uint32(uint32(len(data)))
+	e.write(data)
+}
+
+func (e *encoder) end() error {
+	e.flushCopy()
+	e.write([]byte{opEnd})
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// Patcher is an io.Reader that rebuilds the new version of a file from the old
+// version and a delta. The old version is read sequentially, with a seek only
+// when the copied blocks are not contiguous, so that it can be streamed from an
+// object storage without loading it in memory.
+type Patcher struct {
+	base      io.ReadSeeker
+	basePos   int64
+	baseSize  int64
+	blockSize int64
+	md5sum    []byte
+	r         *bufio.Reader
+	cur       *io.LimitedReader
+	fromBase  bool
+	done      bool
+}
+
+// NewPatcher reads the header of the delta, and returns a Patcher for the old
+// version of the file in base.
+func NewPatcher(base io.ReadSeeker, baseSize int64, delta io.Reader) (*Patcher, error) {
+	p := &Patcher{
+		base:     base,
+		baseSize: baseSize,
+		r:        bufio.NewReader(delta),
+	}
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(p.r, head); err != nil || !bytes.Equal(head, magic) {
+		return nil, ErrInvalidDelta
+	}
+	blockSize, err := p.uint32()
+	if err != nil || blockSize == 0 || blockSize > MaxBlockSize {
+		return nil, ErrInvalidDelta
+	}
+	p.blockSize = int64(blockSize)
+	n, err := p.r.ReadByte()
+	if err != nil {
+		return nil, ErrInvalidDelta
+	}
+	p.md5sum = make([]byte, n)
+	if _, err = io.ReadFull(p.r, p.md5sum); err != nil {
+		return nil, ErrInvalidDelta
+	}
+	return p, nil
+}
+
+// BaseMD5Sum returns the md5 of the old version used to compute the delta.
+func (p *Patcher) BaseMD5Sum() []byte {
+	return p.md5sum
+}
+
+// Read is part of the io.Reader interface
+func (p *Patcher) Read(buf []byte) (int, error) {
+	for {
+		if p.cur != nil {
+			n, err := p.cur.Read(buf)
+			if p.fromBase {
+				p.basePos += int64(n)
+			}
+			if err == io.EOF {
+				if p.cur.N > 0 {
+					if p.fromBase {
+						return n, io.ErrUnexpectedEOF
+					}
+					return n, ErrInvalidDelta
+				}
+				p.cur = nil
+				err = nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		if p.done {
+			return 0, io.EOF
+		}
+		if err := p.next(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// next reads the next operation of the delta.
+func (p *Patcher) next() error {
+	op, err := p.r.ReadByte()
+	if err != nil {
+		return ErrInvalidDelta
+	}
+	switch op {
+	case opCopy:
+		start, err := p.uint32()
+		if err != nil {
+			return ErrInvalidDelta
+		}
+		count, err := p.uint32()
+		if err != nil || count == 0 {
+			return ErrInvalidDelta
+		}
+		offset := int64(start) * p.blockSize
+		length := int64(count) * p.blockSize
+		if offset+length-p.blockSize >= p.baseSize {
+			return ErrInvalidDelta
+		}
+		if offset+length > p.baseSize {
+			length = p.baseSize - offset
+		}
+		if offset != p.basePos {
+			if _, err := p.base.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+			p.basePos = offset
+		}
+		p.cur = &io.LimitedReader{R: p.base, N: length}
+		p.fromBase = true
+	case opLiteral:
+		n, err := p.uint32()
+		if err != nil {
+			return ErrInvalidDelta
+		}
+		p.cur = &io.LimitedReader{R: p.r, N: int64(n)}
+		p.fromBase = false
+	case opEnd:
+		p.done = true
+	default:
+		return ErrInvalidDelta
+	}
+	return nil
+}
+
+func (p *Patcher) uint32() (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(p.r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// rolling is a weak checksum, like Adler-32, that can be updated in constant
+// time when the window moves by one byte.
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func (r *rolling) init(data []byte) {
+	r.a, r.b = 0, 0
+	r.n = uint32(len(data))
+	for i, c := range data {
+		r.a += uint32(c)
+		r.b += (r.n - uint32(i)) * uint32(c)
+	}
+}
+
+// roll removes the first byte of the window, and adds a byte at its end.
+func (r *rolling) roll(out, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.n*uint32(out) + r.a
+}
+
+// rollOut removes the first byte of the window, at the end of the file.
+func (r *rolling) rollOut(out byte) {
+	r.a -= uint32(out)
+	r.b -= r.n * uint32(out)
+	r.n--
+}
+
+func (r *rolling) sum() uint32 {
+	return (r.a & 0xffff) | (r.b&0xffff)<<16
+}
+
+func weakSum(data []byte) uint32 {
+	var r rolling
+	r.init(data)
+	return r.sum()
+}
+
+func strongSum(data []byte) []byte {
+	sum := md5.Sum(data)
+	return sum[:]
+}
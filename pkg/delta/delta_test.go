@@ -0,0 +1,166 @@
+package delta
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomBytes(rng *rand.Rand, n int) []byte {
+	data := make([]byte, n)
+	rng.Read(data)
+	return data
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func roundTrip(t *testing.T, old, updated []byte, blockSize int) int {
+	sum := md5.Sum(old)
+	sig, err := NewSignature(bytes.NewReader(old), blockSize, sum[:])
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, Compute(&buf, sig, bytes.NewReader(updated)))
+	size := buf.Len()
+
+	p, err := NewPatcher(bytes.NewReader(old), int64(len(old)), &buf)
+	require.NoError(t, err)
+	assert.Equal(t, sum[:], p.BaseMD5Sum())
+	rebuilt, err := ioutil.ReadAll(p)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(updated, rebuilt))
+	return size
+}
+
+func TestRolling(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	data := randomBytes(rng, 100)
+	var r rolling
+	r.init(data[:16])
+	for i := 1; i+16 <= len(data); i++ {
+		r.roll(data[i-1], data[i+15])
+		assert.Equal(t, weakSum(data[i:i+16]), r.sum())
+	}
+	r.init(data[84:])
+	for i := 85; i < len(data); i++ {
+		r.rollOut(data[i-1])
+		assert.Equal(t, weakSum(data[i:]), r.sum())
+	}
+}
+
+func TestDelta(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	a := randomBytes(rng, 1000)
+	b := randomBytes(rng, 1000)
+	c := randomBytes(rng, 1000)
+	old := join(a, b, c)
+
+	// Same content: only copies
+	size := roundTrip(t, old, old, 64)
+	assert.Less(t, size, 100)
+
+	// Changes in the middle, at the start, and at the end
+	modified := join(a, randomBytes(rng, 10), b[10:], c)
+	size = roundTrip(t, old, modified, 64)
+	assert.Less(t, size, 500)
+	roundTrip(t, old, join(randomBytes(rng, 7), old), 64)
+	roundTrip(t, old, join(old, randomBytes(rng, 7)), 64)
+	roundTrip(t, old, join(a, c), 64)
+	roundTrip(t, old, old[:2999], 64)
+	roundTrip(t, old, old[1:], 64)
+
+	// Empty files and different contents
+	roundTrip(t, []byte{}, old, 64)
+	roundTrip(t, old, []byte{}, 64)
+	roundTrip(t, old, randomBytes(rng, 3000), 64)
+
+	// Blocks larger than the files
+	roundTrip(t, old, modified, 4096)
+}
+
+func TestInvalidDelta(t *testing.T) {
+	old := []byte("Hello world, this is the old version of the file")
+	_, err := NewPatcher(bytes.NewReader(old), int64(len(old)), bytes.NewReader([]byte("foo")))
+	assert.Equal(t, ErrInvalidDelta, err)
+
+	sig, err := NewSignature(bytes.NewReader(old), 8, nil)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, Compute(&buf, sig, bytes.NewReader([]byte("Hello world, this is the new version"))))
+	truncated := buf.Bytes()[:buf.Len()-1]
+	p, err := NewPatcher(bytes.NewReader(old), int64(len(old)), bytes.NewReader(truncated))
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(p)
+	assert.Equal(t, ErrInvalidDelta, err)
+
+	sig.Blocks[0].Strong = []byte("foo")
+	assert.Equal(t, ErrInvalidSignature, Compute(&buf, sig, bytes.NewReader(old)))
+}
+
+// seekCounter is a base that only supports sequential reads and seeks, like
+// the content of a file on an object storage.
+type seekCounter struct {
+	r     io.ReadSeeker
+	seeks int
+}
+
+func (s *seekCounter) Read(p []byte) (int, error) { return s.r.Read(p) }
+
+func (s *seekCounter) Seek(offset int64, whence int) (int64, error) {
+	s.seeks++
+	return s.r.Seek(offset, whence)
+}
+
+func TestPatcherReadsBaseSequentially(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	old := randomBytes(rng, 100000)
+	sig, err := NewSignature(bytes.NewReader(old), 1024, nil)
+	require.NoError(t, err)
+
+	modified := join(old[:50000], randomBytes(rng, 100), old[50100:])
+	var buf bytes.Buffer
+	require.NoError(t, Compute(&buf, sig, bytes.NewReader(modified)))
+	base := &seekCounter{r: bytes.NewReader(old)}
+	p, err := NewPatcher(base, int64(len(old)), &buf)
+	require.NoError(t, err)
+	rebuilt, err := ioutil.ReadAll(p)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(modified, rebuilt))
+	assert.Equal(t, 1, base.seeks)
+
+	// A base shorter than announced
+	buf.Reset()
+	require.NoError(t, Compute(&buf, sig, bytes.NewReader(old)))
+	p, err = NewPatcher(bytes.NewReader(old[:60000]), int64(len(old)), &buf)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(p)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+type closedWriter struct{}
+
+func (closedWriter) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+func TestComputeStopsOnWriteError(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	old := randomBytes(rng, 10000)
+	sig, err := NewSignature(bytes.NewReader(old), 64, nil)
+	require.NoError(t, err)
+	err = Compute(closedWriter{}, sig, bytes.NewReader(randomBytes(rng, 100000)))
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
+
+func TestBlockSizeFor(t *testing.T) {
+	assert.Equal(t, MinBlockSize, BlockSizeFor(0))
+	assert.Equal(t, MinBlockSize, BlockSizeFor(10<<20))
+	assert.Equal(t, 64<<10, BlockSizeFor(1<<30))
+	assert.Equal(t, MaxBlockSize, BlockSizeFor(1<<40))
+}
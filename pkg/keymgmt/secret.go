@@ -0,0 +1,123 @@
+package keymgmt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io"
+)
+
+const (
+	secretKeyBlockType = "SECRET KEY"
+
+	secretKeyLen = 32
+)
+
+var (
+	errSecretBadKey     = errors.New("keymgmt: bad secret key")
+	errSecretBadWrapped = errors.New("keymgmt: cannot unwrap the key")
+)
+
+// SecretKey is a 256 bits key for symmetric encryption. It is used as a key
+// encryption key: it wraps other keys with AES-256-GCM.
+type SecretKey struct {
+	id  string
+	key []byte
+}
+
+// ID returns a fingerprint of the key, that can be stored next to the
+// wrapped keys to know which secret key must be used to unwrap them.
+func (s *SecretKey) ID() string {
+	return s.id
+}
+
+// GenerateSecretKey returns a new random secret key.
+func GenerateSecretKey(r io.Reader) (*SecretKey, error) {
+	key := make([]byte, secretKeyLen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+	return newSecretKey(key), nil
+}
+
+// GenerateEncodedSecretKey returns the encoded value of a secret key freshly
+// generated.
+func GenerateEncodedSecretKey() ([]byte, error) {
+	key, err := GenerateSecretKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalSecretKey(key), nil
+}
+
+// UnmarshalSecretKey takes an encoded value of a secret key and unmarshal
+// it.
+func UnmarshalSecretKey(marshaledKey []byte) (*SecretKey, error) {
+	key, err := unmarshalPEMBlock(marshaledKey, secretKeyBlockType)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != secretKeyLen {
+		return nil, errSecretBadKey
+	}
+	return newSecretKey(key), nil
+}
+
+// MarshalSecretKey takes a secret key and returns its encoded version.
+func MarshalSecretKey(key *SecretKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  secretKeyBlockType,
+		Bytes: key.key,
+	})
+}
+
+// Wrap encrypts the given key material. The result contains the random nonce
+// followed by the sealed key.
+func (s *SecretKey) Wrap(plain []byte) ([]byte, error) {
+	aead, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// Unwrap decrypts a key wrapped by Wrap.
+func (s *SecretKey) Unwrap(wrapped []byte) ([]byte, error) {
+	aead, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize()+aead.Overhead() {
+		return nil, errSecretBadWrapped
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errSecretBadWrapped
+	}
+	return plain, nil
+}
+
+func (s *SecretKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newSecretKey(key []byte) *SecretKey {
+	sum := sha256.Sum256(key)
+	return &SecretKey{
+		id:  hex.EncodeToString(sum[:8]),
+		key: key,
+	}
+}
@@ -224,6 +224,7 @@ var configs = []counterConfig{
 // attacks.
 type Counter interface {
 	Increment(key string, timeLimit time.Duration) (int64, error)
+	Get(key string) (int64, error)
 	Reset(key string) error
 }
 
@@ -288,6 +289,17 @@ func (c *memCounter) Increment(key string, timeLimit time.Duration) (int64, erro
 	return c.vals[key].val, nil
 }
 
+func (c *memCounter) Get(key string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ref, ok := c.vals[key]
+	if !ok || time.Now().After(ref.exp) {
+		return 0, nil
+	}
+	return ref.val, nil
+}
+
 func (c *memCounter) Reset(key string) error {
 	delete(c.vals, key)
 	return nil
@@ -323,6 +335,14 @@ func (r *redisCounter) Increment(key string, timeLimit time.Duration) (int64, er
 	return count.(int64), nil
 }
 
+func (r *redisCounter) Get(key string) (int64, error) {
+	count, err := r.Client.Get(r.ctx, key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return count, err
+}
+
 func (r *redisCounter) Reset(key string) error {
 	_, err := r.Client.Del(r.ctx, key).Result()
 	return err
@@ -353,6 +373,16 @@ func CheckRateLimitKey(customKey string, ct CounterType) error {
 	return nil
 }
 
+// IsLimitExceededKey returns true if the counter for a key has already
+// exceeded the limit, without incrementing it. It can be used with
+// CheckRateLimitKey to count only the failed attempts.
+func IsLimitExceededKey(customKey string, ct CounterType) bool {
+	cfg := configs[ct]
+	key := cfg.Prefix + ":" + customKey
+	val, err := getCounter().Get(key)
+	return err == nil && val > cfg.Limit
+}
+
 // ResetCounter sets again to zero the counter for the given type and instance.
 func ResetCounter(p prefixer.Prefixer, ct CounterType) {
 	cfg := configs[ct]
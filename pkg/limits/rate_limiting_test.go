@@ -111,3 +111,19 @@ func Test2FAExceededRedis(t *testing.T) {
 	}
 	assert.Error(t, CheckRateLimit(testInstance, TwoFactorType))
 }
+
+func TestIsLimitExceededKeyMem(t *testing.T) {
+	globalCounter = NewMemCounter()
+	was := GetMaximumLimit(SharingPublicLinkType)
+	defer SetMaximumLimit(SharingPublicLinkType, was)
+	SetMaximumLimit(SharingPublicLinkType, 2)
+
+	assert.False(t, IsLimitExceededKey("link", SharingPublicLinkType))
+	assert.NoError(t, CheckRateLimitKey("link", SharingPublicLinkType))
+	assert.NoError(t, CheckRateLimitKey("link", SharingPublicLinkType))
+	assert.False(t, IsLimitExceededKey("link", SharingPublicLinkType))
+	assert.Equal(t, ErrRateLimitReached, CheckRateLimitKey("link", SharingPublicLinkType))
+	assert.True(t, IsLimitExceededKey("link", SharingPublicLinkType))
+	assert.True(t, IsLimitExceededKey("link", SharingPublicLinkType))
+	assert.False(t, IsLimitExceededKey("other", SharingPublicLinkType))
+}
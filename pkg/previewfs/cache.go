@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/s3"
 	"github.com/ncw/swift/v2"
 	"github.com/spf13/afero"
 )
@@ -40,6 +41,10 @@ func SystemCache() Cache {
 		conn := config.GetSwiftConnection()
 		ctx := context.Background()
 		return swiftCache{conn, ctx}
+	case config.SchemeS3, config.SchemeS3Insecure:
+		client := config.GetS3Client()
+		ctx := context.Background()
+		return s3Cache{client, ctx}
 	default:
 		panic(fmt.Errorf("previewfs: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -150,6 +155,53 @@ func (s swiftCache) SetPreview(md5sum []byte, buffer *bytes.Buffer) error {
 	return err
 }
 
+// The previews are stored in the same bucket as the files, with keys prefixed
+// by the name of the swift container. S3 has no equivalent of X-Delete-After
+// for a single object, so the expired previews are removed when they are read.
+type s3Cache struct {
+	c   *s3.Client
+	ctx context.Context
+}
+
+func (s s3Cache) GetIcon(md5sum []byte) (*bytes.Buffer, error) {
+	return s.get(iconFilename(md5sum))
+}
+
+func (s s3Cache) SetIcon(md5sum []byte, buffer *bytes.Buffer) error {
+	return s.set(iconFilename(md5sum), buffer)
+}
+
+func (s s3Cache) GetPreview(md5sum []byte) (*bytes.Buffer, error) {
+	return s.get(previewFilename(md5sum))
+}
+
+func (s s3Cache) SetPreview(md5sum []byte, buffer *bytes.Buffer) error {
+	return s.set(previewFilename(md5sum), buffer)
+}
+
+func (s s3Cache) get(name string) (*bytes.Buffer, error) {
+	key := path.Join(containerName, name)
+	obj, err := s.c.GetObject(s.ctx, key, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(obj.LastModified) > ttl {
+		obj.Body.Close()
+		_ = s.c.DeleteObject(s.ctx, key)
+		return nil, os.ErrNotExist
+	}
+	return readClose(obj.Body)
+}
+
+func (s s3Cache) set(name string, buffer *bytes.Buffer) error {
+	key := path.Join(containerName, name)
+	data := buffer.Bytes()
+	_, err := s.c.PutObject(s.ctx, key, bytes.NewReader(data), int64(len(data)), &s3.PutOptions{
+		ContentType: "image/jpg",
+	})
+	return err
+}
+
 func iconFilename(md5sum []byte) string {
 	return "icon-" + hex.EncodeToString(md5sum) + ".jpg"
 }
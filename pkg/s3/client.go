@@ -0,0 +1,379 @@
+// Package s3 gives the operations on an S3-compatible object storage (Amazon
+// S3, MinIO, Ceph RGW, etc.) that are needed by the stack, on a single bucket.
+// The protocol itself (signatures, retries, XML payloads) is handled by the
+// minio-go library, and this package only adapts it to the needs of the VFS:
+// checksums of the content, metadata, and streams of unknown size.
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Options are the parameters for creating a new client.
+type Options struct {
+	// Endpoint is the URL of the S3 server, like https://s3.amazonaws.com or
+	// http://localhost:9000 for a local MinIO.
+	Endpoint string
+	// Bucket is the name of the bucket used by the client.
+	Bucket string
+	// Region is used for signing the requests (us-east-1 by default).
+	Region string
+	// AccessKey and SecretKey are the credentials. If they are empty, the
+	// requests are not signed.
+	AccessKey string
+	SecretKey string
+	// PathStyle is used to put the bucket name in the path of the URL,
+	// instead of the host name (virtual-hosted style). It is often required
+	// for the self-hosted servers.
+	PathStyle bool
+	// Transport is the optional http.RoundTripper for the requests.
+	Transport http.RoundTripper
+	// Timeout is the optional maximal duration to wait for the headers of a
+	// response. It is not a limit on the time for reading the body, as the
+	// content of large files can take a long time to be transferred.
+	Timeout time.Duration
+}
+
+// Client is a client for a bucket of an S3-compatible object storage.
+type Client struct {
+	core   *minio.Core
+	bucket string
+	region string
+}
+
+// ObjectInfo is the information about an object returned by S3.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+// MD5Sum returns the MD5 checksum of the object content, if the ETag is one.
+// It is not the case for the objects uploaded in several parts.
+func (o *ObjectInfo) MD5Sum() ([]byte, bool) {
+	if len(o.ETag) != 2*md5.Size {
+		return nil, false
+	}
+	sum, err := hex.DecodeString(o.ETag)
+	if err != nil {
+		return nil, false
+	}
+	return sum, true
+}
+
+// Object is an object opened for reading.
+type Object struct {
+	ObjectInfo
+	Body io.ReadCloser
+}
+
+// PutOptions are the options for creating an object.
+type PutOptions struct {
+	ContentType string
+	// ContentMD5 is the expected MD5 checksum of the content. The object is not
+	// created if the content does not match it.
+	ContentMD5 []byte
+	// Metadata are the user-defined metadata, sent as x-amz-meta-* headers.
+	Metadata map[string]string
+}
+
+var (
+	// ErrBadDigest is returned when the content of an object does not match
+	// its expected MD5 checksum.
+	ErrBadDigest = errors.New("s3: the content does not match the MD5 checksum")
+	// ErrInvalidEndpoint is returned when the endpoint of the S3 server cannot
+	// be parsed.
+	ErrInvalidEndpoint = errors.New("s3: invalid endpoint")
+)
+
+// errorCode returns the code of an error response from the S3 server, or an
+// empty string for the other errors.
+func errorCode(err error) string {
+	var e minio.ErrorResponse
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// IsNotFound returns true if the error is an error from S3 for a missing
+// object or bucket.
+func IsNotFound(err error) bool {
+	var e minio.ErrorResponse
+	if errors.As(err, &e) {
+		return e.StatusCode == http.StatusNotFound ||
+			e.Code == "NoSuchKey" || e.Code == "NoSuchBucket"
+	}
+	return false
+}
+
+// NewClient returns a client for the given options.
+func NewClient(opts Options) (*Client, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, ErrInvalidEndpoint
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, ErrInvalidEndpoint
+	}
+	if opts.Bucket == "" {
+		return nil, errors.New("s3: a bucket name is required")
+	}
+	secure := endpoint.Scheme == "https"
+	region := opts.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	transport := opts.Transport
+	if transport == nil {
+		if transport, err = minio.DefaultTransport(secure); err != nil {
+			return nil, err
+		}
+	}
+	if t, ok := transport.(*http.Transport); ok && opts.Timeout > 0 {
+		t = t.Clone()
+		t.ResponseHeaderTimeout = opts.Timeout
+		transport = t
+	}
+	lookup := minio.BucketLookupDNS
+	if opts.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	core, err := minio.NewCore(endpoint.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""),
+		Secure:       secure,
+		Transport:    transport,
+		Region:       region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{core: core, bucket: opts.Bucket, region: region}, nil
+}
+
+// Bucket returns the name of the bucket used by the client.
+func (c *Client) Bucket() string {
+	return c.bucket
+}
+
+func objectInfo(info minio.ObjectInfo) *ObjectInfo {
+	obj := &ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+		Metadata:     make(map[string]string),
+	}
+	for k, v := range info.Metadata {
+		name := strings.ToLower(k)
+		if strings.HasPrefix(name, "x-amz-meta-") && len(v) > 0 {
+			obj.Metadata[strings.TrimPrefix(name, "x-amz-meta-")] = v[0]
+		}
+	}
+	return obj
+}
+
+func putOptions(opts *PutOptions) (minio.PutObjectOptions, string) {
+	if opts == nil {
+		return minio.PutObjectOptions{}, ""
+	}
+	var md5Base64 string
+	if len(opts.ContentMD5) > 0 {
+		md5Base64 = base64.StdEncoding.EncodeToString(opts.ContentMD5)
+	}
+	return minio.PutObjectOptions{
+		ContentType:  opts.ContentType,
+		UserMetadata: opts.Metadata,
+	}, md5Base64
+}
+
+// CreateBucket creates the bucket, if it does not already exist.
+func (c *Client) CreateBucket(ctx context.Context) error {
+	err := c.core.MakeBucket(ctx, c.bucket, minio.MakeBucketOptions{Region: c.region})
+	if err != nil {
+		code := errorCode(err)
+		if code == "BucketAlreadyOwnedByYou" || code == "BucketAlreadyExists" {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// PutObject creates an object with the given content. The size of the content
+// must be known.
+func (c *Client) PutObject(ctx context.Context, key string, body io.Reader, size int64, opts *PutOptions) (*ObjectInfo, error) {
+	putOpts, md5Base64 := putOptions(opts)
+	uploaded, err := c.core.PutObject(ctx, c.bucket, key, body, size, md5Base64, "", putOpts)
+	if err != nil {
+		if errorCode(err) == "BadDigest" {
+			return nil, ErrBadDigest
+		}
+		return nil, err
+	}
+	info := &ObjectInfo{
+		Key:      key,
+		Size:     size,
+		ETag:     uploaded.ETag,
+		Metadata: make(map[string]string),
+	}
+	if opts != nil {
+		info.ContentType = opts.ContentType
+		for k, v := range opts.Metadata {
+			info.Metadata[k] = v
+		}
+	}
+	return info, nil
+}
+
+// GetObject opens an object for reading. If offset is positive, the content
+// starts at this offset, and if length is positive, the content is limited to
+// length bytes. The caller must close the body of the returned object.
+func (c *Client) GetObject(ctx context.Context, key string, offset, length int64) (*Object, error) {
+	getOpts := minio.GetObjectOptions{}
+	if length > 0 {
+		_ = getOpts.SetRange(offset, offset+length-1)
+	} else if offset > 0 {
+		_ = getOpts.SetRange(offset, 0)
+	}
+	body, minfo, h, err := c.core.GetObject(ctx, c.bucket, key, getOpts)
+	if err != nil {
+		return nil, err
+	}
+	info := objectInfo(minfo)
+	info.Key = key
+	if cr := h.Get("Content-Range"); cr != "" {
+		// Content-Range: bytes 0-9/1234
+		if idx := strings.LastIndexByte(cr, '/'); idx >= 0 {
+			if size, err := strconv.ParseInt(cr[idx+1:], 10, 64); err == nil {
+				info.Size = size
+			}
+		}
+	}
+	return &Object{ObjectInfo: *info, Body: body}, nil
+}
+
+// HeadObject returns the information about an object.
+func (c *Client) HeadObject(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := c.core.StatObject(ctx, c.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return objectInfo(info), nil
+}
+
+// CopyObject copies an object inside the bucket. If opts is nil, the metadata
+// are copied from the source object, else they are replaced by the options.
+func (c *Client) CopyObject(ctx context.Context, srcKey, dstKey string, opts *PutOptions) error {
+	dst := minio.CopyDestOptions{Bucket: c.bucket, Object: dstKey}
+	if opts != nil {
+		dst.ReplaceMetadata = true
+		dst.UserMetadata = make(map[string]string, len(opts.Metadata)+1)
+		for k, v := range opts.Metadata {
+			dst.UserMetadata[k] = v
+		}
+		if opts.ContentType != "" {
+			dst.UserMetadata["Content-Type"] = opts.ContentType
+		}
+	}
+	src := minio.CopySrcOptions{Bucket: c.bucket, Object: srcKey}
+	_, err := c.core.Client.CopyObject(ctx, dst, src)
+	return err
+}
+
+// DeleteObject removes an object. It is not an error if the object does not
+// exist.
+func (c *Client) DeleteObject(ctx context.Context, key string) error {
+	err := c.core.RemoveObject(ctx, c.bucket, key, minio.RemoveObjectOptions{})
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// DeleteObjects removes several objects, with the multi-objects delete
+// operation. The first error is returned, but the deletion continues for the
+// other objects.
+func (c *Client) DeleteObjects(ctx context.Context, keys []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	objects := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objects)
+		for _, key := range keys {
+			select {
+			case objects <- minio.ObjectInfo{Key: key}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var errm error
+	for res := range c.core.RemoveObjects(ctx, c.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if res.Err != nil && errm == nil && !IsNotFound(res.Err) {
+			errm = res.Err
+		}
+	}
+	return errm
+}
+
+// ListObjects calls fn for each object whose key starts with the given prefix,
+// in the lexicographical order of the keys. The content type and metadata are
+// not filled.
+func (c *Client) ListObjects(ctx context.Context, prefix string, fn func(obj *ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	list := c.core.Client.ListObjects(ctx, c.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+	for obj := range list {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if err := fn(objectInfo(obj)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListKeys returns the keys of all the objects with the given prefix.
+func (c *Client) ListKeys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := c.ListObjects(ctx, prefix, func(obj *ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		return nil
+	})
+	return keys, err
+}
+
+// DeletePrefix removes all the objects with the given prefix.
+func (c *Client) DeletePrefix(ctx context.Context, prefix string) error {
+	keys, err := c.ListKeys(ctx, prefix)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return c.DeleteObjects(ctx, keys)
+}
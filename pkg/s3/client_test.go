@@ -0,0 +1,159 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/s3/s3test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClient(t *testing.T) {
+	_, err := NewClient(Options{Endpoint: "localhost:9000", Bucket: "cozy"})
+	assert.Equal(t, ErrInvalidEndpoint, err)
+	_, err = NewClient(Options{Endpoint: "ftp://localhost:9000", Bucket: "cozy"})
+	assert.Equal(t, ErrInvalidEndpoint, err)
+	_, err = NewClient(Options{Endpoint: "http://localhost:9000"})
+	assert.Error(t, err)
+	c, err := NewClient(Options{Endpoint: "https://s3.example.net", Bucket: "cozy", Timeout: time.Minute})
+	assert.NoError(t, err)
+	assert.Equal(t, "cozy", c.Bucket())
+}
+
+func newTestClient(t *testing.T) (*Client, *s3test.Server) {
+	server := s3test.NewServer()
+	t.Cleanup(server.Close)
+	c, err := NewClient(Options{
+		Endpoint:  server.URL,
+		Bucket:    "cozy",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.CreateBucket(context.Background()))
+	// Creating the bucket twice is not an error
+	require.NoError(t, c.CreateBucket(context.Background()))
+	return c, server
+}
+
+func TestObjects(t *testing.T) {
+	c, server := newTestClient(t)
+	ctx := context.Background()
+
+	content := []byte("hello world")
+	sum := md5.Sum(content)
+	info, err := c.PutObject(ctx, "foo/bar baz.txt", bytes.NewReader(content), int64(len(content)), &PutOptions{
+		ContentType: "text/plain",
+		ContentMD5:  sum[:],
+		Metadata:    map[string]string{"created-at": "today"},
+	})
+	require.NoError(t, err)
+	md5sum, ok := info.MD5Sum()
+	assert.True(t, ok)
+	assert.Equal(t, sum[:], md5sum)
+
+	_, err = c.PutObject(ctx, "bad", strings.NewReader("bad"), 3, &PutOptions{ContentMD5: sum[:]})
+	assert.Equal(t, ErrBadDigest, err)
+
+	_, err = c.PutObject(ctx, "foo/empty", bytes.NewReader(nil), 0, nil)
+	require.NoError(t, err)
+
+	head, err := c.HeadObject(ctx, "foo/bar baz.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), head.Size)
+	assert.Equal(t, "text/plain", head.ContentType)
+	assert.Equal(t, "today", head.Metadata["created-at"])
+
+	_, err = c.HeadObject(ctx, "missing")
+	assert.True(t, IsNotFound(err))
+
+	obj, err := c.GetObject(ctx, "foo/bar baz.txt", 6, 3)
+	require.NoError(t, err)
+	buf, err := ioutil.ReadAll(obj.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, obj.Body.Close())
+	assert.Equal(t, "wor", string(buf))
+	assert.Equal(t, int64(len(content)), obj.Size)
+
+	require.NoError(t, c.CopyObject(ctx, "foo/bar baz.txt", "foo/copy", nil))
+	assert.Equal(t, content, server.Content("cozy", "foo/copy"))
+	require.NoError(t, c.CopyObject(ctx, "foo/bar baz.txt", "foo/other", &PutOptions{
+		Metadata: map[string]string{"copy-of": "bar"},
+	}))
+	head, err = c.HeadObject(ctx, "foo/other")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", head.Metadata["copy-of"])
+	assert.Empty(t, head.Metadata["created-at"])
+	assert.True(t, IsNotFound(c.CopyObject(ctx, "missing", "foo/missing", nil)))
+
+	r, err := c.OpenReader(ctx, "foo/bar baz.txt")
+	require.NoError(t, err)
+	p := make([]byte, 5)
+	n, err := r.ReadAt(p, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(p[:n]))
+	_, err = r.Seek(-5, io.SeekEnd)
+	assert.NoError(t, err)
+	buf, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(buf))
+	assert.NoError(t, r.Close())
+
+	server.MaxKeys = 2
+	keys, err := c.ListKeys(ctx, "foo/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo/bar baz.txt", "foo/copy", "foo/empty", "foo/other"}, keys)
+
+	require.NoError(t, c.DeleteObject(ctx, "foo/copy"))
+	require.NoError(t, c.DeleteObject(ctx, "foo/copy"))
+	require.NoError(t, c.DeleteObjects(ctx, []string{"foo/empty", "foo/missing"}))
+	assert.Equal(t, []string{"foo/bar baz.txt", "foo/other"}, server.Keys("cozy"))
+	require.NoError(t, c.DeletePrefix(ctx, "foo/"))
+	assert.Empty(t, server.Keys("cozy"))
+}
+
+func TestWriter(t *testing.T) {
+	c, server := newTestClient(t)
+	ctx := context.Background()
+
+	// Small object: a single PUT
+	w := c.NewWriter(ctx, "small", &PutOptions{ContentType: "text/plain"})
+	_, err := io.WriteString(w, "small content")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.Equal(t, "small content", string(server.Content("cozy", "small")))
+	assert.Equal(t, int64(13), w.Written())
+
+	// Large object: a multipart upload
+	content := bytes.Repeat([]byte("0123456789abcdef"), (2*PartSize+1000)/16)
+	sum := md5.Sum(content)
+	w = c.NewWriter(ctx, "large", &PutOptions{
+		ContentMD5: sum[:],
+		Metadata:   map[string]string{"foo": "bar"},
+	})
+	_, err = io.Copy(w, bytes.NewReader(content))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.Equal(t, sum[:], w.MD5Sum())
+	assert.Equal(t, content, server.Content("cozy", "large"))
+	head, err := c.HeadObject(ctx, "large")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", head.Metadata["foo"])
+	_, ok := head.MD5Sum()
+	assert.False(t, ok)
+
+	// Bad checksum: the object is not created
+	w = c.NewWriter(ctx, "bad", &PutOptions{ContentMD5: sum[:]})
+	_, err = io.Copy(w, bytes.NewReader(content[:PartSize+10]))
+	require.NoError(t, err)
+	assert.Equal(t, ErrBadDigest, w.Close())
+	assert.Nil(t, server.Content("cozy", "bad"))
+}
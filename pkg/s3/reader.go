@@ -0,0 +1,63 @@
+package s3
+
+import (
+	"context"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Reader is an object opened for reading, that can seek inside the content.
+// The requests with a Range header are sent by minio-go only when reading at
+// another position, as http.ServeContent seeks to the end and then to the
+// start of the content to know its size.
+//
+// Reader implements io.ReadSeekCloser and io.ReaderAt.
+type Reader struct {
+	obj  *minio.Object
+	info *ObjectInfo
+}
+
+// OpenReader opens an object for reading.
+func (c *Client) OpenReader(ctx context.Context, key string) (*Reader, error) {
+	obj, err := c.core.Client.GetObject(ctx, c.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		_ = obj.Close()
+		return nil, err
+	}
+	return &Reader{obj: obj, info: objectInfo(info)}, nil
+}
+
+// Info returns the information about the object.
+func (r *Reader) Info() *ObjectInfo {
+	return r.info
+}
+
+// Read is part of the io.Reader interface.
+func (r *Reader) Read(p []byte) (int, error) {
+	return r.obj.Read(p)
+}
+
+// ReadAt is part of the io.ReaderAt interface. Like for a file, there is no
+// error when p is filled by the last bytes of the content.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.obj.ReadAt(p, off)
+	if err == io.EOF && n == len(p) && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek is part of the io.Seeker interface.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	return r.obj.Seek(offset, whence)
+}
+
+// Close is part of the io.Closer interface.
+func (r *Reader) Close() error {
+	return r.obj.Close()
+}
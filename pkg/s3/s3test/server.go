@@ -0,0 +1,506 @@
+// Package s3test provides an in-memory S3 server, that can be used in tests as
+// a stand-in for an S3-compatible object storage, like swifttest does for
+// Swift. It supports only the operations used by the s3 package, with
+// path-style requests, and it does not check the signatures.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type object struct {
+	data         []byte
+	etag         string
+	contentType  string
+	metadata     http.Header
+	lastModified time.Time
+}
+
+type upload struct {
+	key         string
+	contentType string
+	metadata    http.Header
+	parts       map[int][]byte
+}
+
+// Server is an in-memory S3 server.
+type Server struct {
+	*httptest.Server
+	// MaxKeys is the maximal number of keys returned in a page of a listing,
+	// when the request does not ask for less (1000 by default).
+	MaxKeys int
+	mu      sync.Mutex
+	buckets map[string]map[string]*object
+	uploads map[string]*upload
+	nextID  int
+}
+
+// NewServer starts a new in-memory S3 server. The caller should call Close
+// when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		MaxKeys: 1000,
+		buckets: make(map[string]map[string]*object),
+		uploads: make(map[string]*upload),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Keys returns the sorted list of the keys of the objects in a bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Content returns the content of an object, or nil if it does not exist.
+func (s *Server) Content(bucket, key string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if obj, ok := s.buckets[bucket][key]; ok {
+		return obj.data
+	}
+	return nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		writeError(w, http.StatusForbidden, "AccessDenied", "")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := parts[0]
+	key := ""
+	if len(parts) > 1 {
+		key = parts[1]
+	}
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodPut:
+			s.createBucket(w, bucket)
+		case r.Method == http.MethodGet && query.Get("list-type") == "2":
+			s.listObjects(w, bucket, query)
+		case r.Method == http.MethodPost && hasParam(query, "delete"):
+			s.deleteObjects(w, r, bucket)
+		default:
+			writeError(w, http.StatusNotImplemented, "NotImplemented", "")
+		}
+		return
+	}
+
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "")
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && hasParam(query, "uploads"):
+		s.createUpload(w, r, key)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		s.uploadPart(w, r, query)
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		s.completeUpload(w, r, bucket, objects, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copyObject(w, r, bucket, objects, key)
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, objects, key)
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		s.getObject(w, r, objects, key)
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "")
+	}
+}
+
+func hasParam(query url.Values, name string) bool {
+	_, ok := query[name]
+	return ok
+}
+
+func writeError(w http.ResponseWriter, status int, code, key string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Error><Code>%s</Code><Key>%s</Key></Error>", code, key)
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func userMetadata(h http.Header) http.Header {
+	meta := make(http.Header)
+	for k, v := range h {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			meta[k] = v
+		}
+	}
+	return meta
+}
+
+func (s *Server) createBucket(w http.ResponseWriter, bucket string) {
+	if _, ok := s.buckets[bucket]; ok {
+		writeError(w, http.StatusConflict, "BucketAlreadyOwnedByYou", "")
+		return
+	}
+	s.buckets[bucket] = make(map[string]*object)
+	w.WriteHeader(http.StatusOK)
+}
+
+type listContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type listResult struct {
+	XMLName               xml.Name      `xml:"ListBucketResult"`
+	Contents              []listContent `xml:"Contents"`
+	IsTruncated           bool          `xml:"IsTruncated"`
+	NextContinuationToken string        `xml:"NextContinuationToken,omitempty"`
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, bucket string, query url.Values) {
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "")
+		return
+	}
+	maxKeys := s.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	if m, err := strconv.Atoi(query.Get("max-keys")); err == nil && m > 0 {
+		maxKeys = m
+	}
+	prefix := query.Get("prefix")
+	after := query.Get("continuation-token")
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	result := listResult{}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		obj := objects[key]
+		result.Contents = append(result.Contents, listContent{
+			Key:          key,
+			LastModified: obj.lastModified.Format(time.RFC3339),
+			ETag:         `"` + obj.etag + `"`,
+			Size:         int64(len(obj.data)),
+		})
+	}
+	writeXML(w, result)
+}
+
+type deleteRequest struct {
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+}
+
+func (s *Server) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "")
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if !checkMD5(r, body) {
+		writeError(w, http.StatusBadRequest, "BadDigest", "")
+		return
+	}
+	var req deleteRequest
+	if err := xml.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "")
+		return
+	}
+	for _, o := range req.Objects {
+		delete(objects, o.Key)
+	}
+	writeXML(w, deleteResult{})
+}
+
+// streamingPayload is the value of the X-Amz-Content-Sha256 header when the
+// body is sent in chunks, each with its own signature (aws-chunked encoding).
+const streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+
+var errIncompleteBody = errors.New("s3test: malformed aws-chunked body")
+
+// readBody returns the content sent in the body of a request, without the
+// chunk headers of the aws-chunked encoding.
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || r.Header.Get("X-Amz-Content-Sha256") != streamingPayload {
+		return body, err
+	}
+	var data []byte
+	for {
+		// Each chunk is: hex(size);chunk-signature=...\r\n<data>\r\n
+		idx := bytes.Index(body, []byte("\r\n"))
+		if idx < 0 {
+			return nil, errIncompleteBody
+		}
+		header := string(body[:idx])
+		if i := strings.IndexByte(header, ';'); i >= 0 {
+			header = header[:i]
+		}
+		size, err := strconv.ParseInt(header, 16, 64)
+		start := idx + 2
+		if err != nil || size < 0 || int64(len(body)-start) < size+2 {
+			return nil, errIncompleteBody
+		}
+		if size == 0 {
+			return data, nil
+		}
+		end := start + int(size)
+		data = append(data, body[start:end]...)
+		body = body[end+2:]
+	}
+}
+
+func checkMD5(r *http.Request, body []byte) bool {
+	expected := r.Header.Get("Content-Md5")
+	if expected == "" {
+		return true
+	}
+	sum := md5.Sum(body)
+	return expected == base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func newObject(data []byte, contentType string, metadata http.Header) *object {
+	sum := md5.Sum(data)
+	return &object{
+		data:         data,
+		etag:         hex.EncodeToString(sum[:]),
+		contentType:  contentType,
+		metadata:     metadata,
+		lastModified: time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, objects map[string]*object, key string) {
+	body, err := readBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", key)
+		return
+	}
+	if !checkMD5(r, body) {
+		writeError(w, http.StatusBadRequest, "BadDigest", key)
+		return
+	}
+	obj := newObject(body, r.Header.Get("Content-Type"), userMetadata(r.Header))
+	objects[key] = obj
+	w.Header().Set("Etag", `"`+obj.etag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+type copyResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, bucket string, objects map[string]*object, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", key)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	if len(parts) != 2 || s.buckets[parts[0]] == nil {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", key)
+		return
+	}
+	src, ok := s.buckets[parts[0]][parts[1]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", parts[1])
+		return
+	}
+	contentType, metadata := src.contentType, src.metadata
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		contentType, metadata = r.Header.Get("Content-Type"), userMetadata(r.Header)
+	}
+	dst := newObject(src.data, contentType, metadata)
+	dst.etag = src.etag
+	objects[key] = dst
+	writeXML(w, copyResult{
+		ETag:         `"` + dst.etag + `"`,
+		LastModified: dst.lastModified.Format(time.RFC3339),
+	})
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, objects map[string]*object, key string) {
+	obj, ok := objects[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", key)
+		return
+	}
+	for k, v := range obj.metadata {
+		w.Header()[k] = v
+	}
+	if obj.contentType != "" {
+		w.Header().Set("Content-Type", obj.contentType)
+	}
+	w.Header().Set("Etag", `"`+obj.etag+`"`)
+	w.Header().Set("Last-Modified", obj.lastModified.Format(http.TimeFormat))
+
+	data := obj.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); strings.HasPrefix(rng, "bytes=") {
+		size := int64(len(obj.data))
+		bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+		start, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err != nil || len(bounds) != 2 || start >= size {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", key)
+			return
+		}
+		end := size - 1
+		if bounds[1] != "" {
+			if e, err := strconv.ParseInt(bounds[1], 10, 64); err == nil && e < end {
+				end = e
+			}
+		}
+		data = obj.data[start : end+1]
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(data)
+	}
+}
+
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, key string) {
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.uploads[id] = &upload{
+		key:         key,
+		contentType: r.Header.Get("Content-Type"),
+		metadata:    userMetadata(r.Header),
+		parts:       make(map[int][]byte),
+	}
+	writeXML(w, initiateResult{Key: key, UploadID: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, query url.Values) {
+	up, ok := s.uploads[query.Get("uploadId")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "")
+		return
+	}
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || number < 1 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", up.key)
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", up.key)
+		return
+	}
+	if !checkMD5(r, body) {
+		writeError(w, http.StatusBadRequest, "BadDigest", up.key)
+		return
+	}
+	up.parts[number] = body
+	sum := md5.Sum(body)
+	w.Header().Set("Etag", `"`+hex.EncodeToString(sum[:])+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, bucket string, objects map[string]*object, id string) {
+	up, ok := s.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "")
+		return
+	}
+	var req completeRequest
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := xml.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", up.key)
+		return
+	}
+	var data, sums []byte
+	for _, p := range req.Parts {
+		part, ok := up.parts[p.PartNumber]
+		sum := md5.Sum(part)
+		if !ok || strings.Trim(p.ETag, `"`) != hex.EncodeToString(sum[:]) {
+			writeError(w, http.StatusBadRequest, "InvalidPart", up.key)
+			return
+		}
+		data = append(data, part...)
+		sums = append(sums, sum[:]...)
+	}
+	obj := newObject(data, up.contentType, up.metadata)
+	sum := md5.Sum(sums)
+	obj.etag = fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(req.Parts))
+	objects[up.key] = obj
+	delete(s.uploads, id)
+	writeXML(w, completeResult{Bucket: bucket, Key: up.key, ETag: `"` + obj.etag + `"`})
+}
@@ -0,0 +1,205 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"hash"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// PartSize is the size of the parts for the multipart uploads. S3 accepts at
+// most 10000 parts, so it allows objects of 80GB, which is more than the max
+// file size of the stack.
+const PartSize = 8 << (2 * 10) // 8 MiB
+
+// Writer is used to create an object from a stream whose size is not known in
+// advance. The content is buffered in memory, and sent in a single request if
+// it is small, or with a multipart upload for large objects. It is used instead
+// of PutObject from minio-go with an unknown size, as the latter always makes
+// a multipart upload, and cannot abort it when the content does not match
+// the expected MD5 checksum.
+//
+// Writer implements io.WriteCloser, and the object is visible only after a
+// successful call to Close.
+type Writer struct {
+	c        *Client
+	ctx      context.Context
+	key      string
+	opts     *PutOptions
+	buf      bytes.Buffer
+	hash     hash.Hash
+	written  int64
+	uploadID string
+	parts    []minio.CompletePart
+	info     *ObjectInfo
+	err      error
+	closed   bool
+}
+
+// NewWriter returns a writer for creating an object with the given key.
+func (c *Client) NewWriter(ctx context.Context, key string, opts *PutOptions) *Writer {
+	return &Writer{
+		c:    c,
+		ctx:  ctx,
+		key:  key,
+		opts: opts,
+		hash: md5.New(),
+	}
+}
+
+// Write is part of the io.Writer interface.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	_, _ = w.hash.Write(p)
+	n, _ := w.buf.Write(p)
+	w.written += int64(n)
+	for w.buf.Len() >= PartSize {
+		if err := w.uploadPart(w.buf.Next(PartSize)); err != nil {
+			w.err = err
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Written returns the number of bytes written.
+func (w *Writer) Written() int64 {
+	return w.written
+}
+
+// MD5Sum returns the MD5 checksum of the bytes written.
+func (w *Writer) MD5Sum() []byte {
+	return w.hash.Sum(nil)
+}
+
+// Info returns the information about the created object, after Close.
+func (w *Writer) Info() *ObjectInfo {
+	return w.info
+}
+
+// Abort cancels the creation of the object.
+func (w *Writer) Abort() error {
+	w.closed = true
+	w.buf.Reset()
+	if w.uploadID == "" {
+		return nil
+	}
+	err := w.c.core.AbortMultipartUpload(w.ctx, w.c.bucket, w.key, w.uploadID)
+	w.uploadID = ""
+	return err
+}
+
+// Close sends the remaining content and creates the object. It returns
+// ErrBadDigest if an MD5 checksum was given in the options, and the content
+// does not match it.
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	if w.err != nil {
+		_ = w.Abort()
+		return w.err
+	}
+	w.closed = true
+
+	sum := w.hash.Sum(nil)
+	if w.opts != nil && len(w.opts.ContentMD5) > 0 && !bytes.Equal(sum, w.opts.ContentMD5) {
+		w.err = ErrBadDigest
+		_ = w.Abort()
+		return w.err
+	}
+
+	if w.uploadID == "" {
+		opts := PutOptions{}
+		if w.opts != nil {
+			opts = *w.opts
+		}
+		opts.ContentMD5 = sum
+		content := w.buf.Bytes()
+		w.info, w.err = w.c.PutObject(w.ctx, w.key, bytes.NewReader(content), int64(len(content)), &opts)
+		w.buf.Reset()
+		return w.err
+	}
+
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(w.buf.Bytes()); err != nil {
+			w.err = err
+			_ = w.Abort()
+			return err
+		}
+		w.buf.Reset()
+	}
+	if err := w.complete(); err != nil {
+		w.err = err
+		_ = w.Abort()
+		return err
+	}
+	w.info = &ObjectInfo{Key: w.key, Size: w.written, Metadata: make(map[string]string)}
+	if w.opts != nil {
+		w.info.ContentType = w.opts.ContentType
+		for k, v := range w.opts.Metadata {
+			w.info.Metadata[k] = v
+		}
+	}
+	return nil
+}
+
+func (w *Writer) uploadPart(part []byte) error {
+	if w.uploadID == "" {
+		putOpts, _ := putOptions(&PutOptions{
+			ContentType: w.contentType(),
+			Metadata:    w.metadata(),
+		})
+		id, err := w.c.core.NewMultipartUpload(w.ctx, w.c.bucket, w.key, putOpts)
+		if err != nil {
+			return err
+		}
+		w.uploadID = id
+	}
+
+	number := len(w.parts) + 1
+	sum := md5.Sum(part)
+	md5Base64 := base64.StdEncoding.EncodeToString(sum[:])
+	uploaded, err := w.c.core.PutObjectPart(w.ctx, w.c.bucket, w.key, w.uploadID, number,
+		bytes.NewReader(part), int64(len(part)), md5Base64, "", nil)
+	if err != nil {
+		return err
+	}
+	w.parts = append(w.parts, minio.CompletePart{
+		PartNumber: number,
+		ETag:       uploaded.ETag,
+	})
+	return nil
+}
+
+func (w *Writer) complete() error {
+	_, err := w.c.core.CompleteMultipartUpload(w.ctx, w.c.bucket, w.key, w.uploadID, w.parts, minio.PutObjectOptions{})
+	if err != nil {
+		return err
+	}
+	w.uploadID = ""
+	return nil
+}
+
+func (w *Writer) contentType() string {
+	if w.opts == nil {
+		return ""
+	}
+	return w.opts.ContentType
+}
+
+func (w *Writer) metadata() map[string]string {
+	if w.opts == nil {
+		return nil
+	}
+	return w.opts.Metadata
+}
@@ -267,6 +267,12 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs appfs.FileServer, web
 		}
 	}
 
+	if sharecode := c.QueryParam("sharecode"); sharecode != "" && !isLoggedIn {
+		if err := checkShareByLink(c, i, slug, sharecode); err != nil {
+			return err
+		}
+	}
+
 	if intentID := c.QueryParam("intent"); intentID != "" {
 		handleIntent(c, i, slug, intentID)
 	}
@@ -303,6 +309,46 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs appfs.FileServer, web
 	return tmpl.Execute(res, params)
 }
 
+// checkShareByLink asks the visitor for the password of a share by link if
+// it is protected, and counts a view of the public page.
+func checkShareByLink(c echo.Context, i *instance.Instance, slug, sharecode string) error {
+	pdoc, err := middlewares.ParseJWT(c, i, sharecode)
+	switch err {
+	case nil:
+		if pdoc.Type != permission.TypeShareByLink {
+			return nil
+		}
+		if err := pdoc.AddView(i); err == permission.ErrTooManyUses {
+			return renderShareByLinkExhausted(c, i)
+		}
+		return nil
+	case permission.ErrPasswordRequired:
+		reqURL := c.Request().URL
+		redirect := i.SubDomain(slug)
+		redirect.Path = reqURL.Path
+		redirect.RawQuery = reqURL.RawQuery
+		return c.Redirect(http.StatusFound, auth.ShareByLinkPasswordURL(i, sharecode, redirect))
+	case permission.ErrTooManyUses:
+		return renderShareByLinkExhausted(c, i)
+	}
+	// Other errors are let to the app, as it was before
+	return nil
+}
+
+func renderShareByLinkExhausted(c echo.Context, i *instance.Instance) error {
+	return c.Render(http.StatusGone, "error.html", echo.Map{
+		"Domain":       i.ContextualDomain(),
+		"ContextName":  i.ContextName,
+		"Locale":       i.Locale,
+		"Title":        i.TemplateTitle(),
+		"ThemeCSS":     middlewares.ThemeCSS(i),
+		"Favicon":      middlewares.Favicon(i),
+		"Illustration": "/images/generic-error.svg",
+		"Error":        "Share by link too many uses",
+		"SupportEmail": i.SupportEmailAddress(),
+	})
+}
+
 func buildServeParams(
 	c echo.Context,
 	inst *instance.Instance,
@@ -12,6 +12,7 @@ import (
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/instance/lifecycle"
 	"github.com/cozy/cozy-stack/model/session"
+	"github.com/cozy/cozy-stack/model/webauthn"
 	build "github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/crypto"
@@ -209,6 +210,7 @@ func renderLoginForm(c echo.Context, i *instance.Instance, code int, credsErrors
 		"Redirect":         redirectStr,
 		"CSRF":             c.Get("csrf"),
 		"OAuth":            hasOAuth,
+		"WebAuthn":         webauthn.HasCredentials(i),
 	})
 }
 
@@ -338,8 +340,8 @@ func login(c echo.Context) error {
 		// check that the mail has been confirmed. If not, 2FA is not
 		// activated.
 		// If device is trusted, skip the 2FA.
-		if inst.HasAuthMode(instance.TwoFactorMail) && !isTrustedDevice(c, inst) {
-			twoFactorToken, err := lifecycle.SendTwoFactorPasscode(inst)
+		if inst.HasTwoFactorAuth() && !isTrustedDevice(c, inst) {
+			twoFactorToken, err := lifecycle.StartTwoFactorAuth(inst)
 			if err != nil {
 				return err
 			}
@@ -618,4 +620,12 @@ func Routes(router *echo.Group) {
 	// 2FA
 	router.GET("/twofactor", twoFactorForm)
 	router.POST("/twofactor", twoFactor)
+
+	// WebAuthn
+	router.POST("/webauthn/options", webAuthnOptions)
+	router.POST("/webauthn/login", loginWebAuthn, noCSRF, middlewares.CheckOnboardingNotFinished)
+
+	// Share by link protected by a password
+	router.GET("/share-by-link/password", shareByLinkPasswordForm, noCSRF)
+	router.POST("/share-by-link/password", unlockShareByLink, noCSRF)
 }
@@ -37,6 +37,7 @@ import (
 	"github.com/cozy/cozy-stack/web/middlewares"
 	jwt "github.com/golang-jwt/jwt/v4"
 	"github.com/labstack/echo/v4"
+	"github.com/pquerna/otp/totp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -1435,6 +1436,78 @@ func TestLoginFlagship(t *testing.T) {
 	assert.Equal(t, "bearer", resbody["token_type"])
 }
 
+func TestLoginFlagshipWithTOTP(t *testing.T) {
+	oauthClient := &oauth.Client{
+		RedirectURIs:    []string{"cozy://flagship"},
+		ClientName:      "Cozy Flagship",
+		ClientKind:      "mobile",
+		SoftwareID:      "cozy-flagship",
+		SoftwareVersion: "0.1.0",
+	}
+	require.Nil(t, oauthClient.Create(testInstance))
+	client, err := oauth.FindClient(testInstance, oauthClient.ClientID)
+	require.NoError(t, err)
+	client.CertifiedFromStore = true
+	require.NoError(t, client.SetFlagship(testInstance))
+
+	inst, err := instance.GetFromCouch(domain)
+	require.NoError(t, err)
+	key, err := lifecycle.NewTOTPKey(inst)
+	require.NoError(t, err)
+	passcode, err := totp.GenerateCode(key.Secret(), time.Now().UTC())
+	require.NoError(t, err)
+	_, err = lifecycle.EnableTOTP(inst, passcode)
+	require.NoError(t, err)
+	defer func() {
+		inst, err := instance.GetFromCouch(domain)
+		require.NoError(t, err)
+		require.NoError(t, lifecycle.Patch(inst, &lifecycle.Options{AuthMode: "basic"}))
+	}()
+
+	login := func(params echo.Map) (int, map[string]interface{}) {
+		params["passphrase"] = "MyPassphrase"
+		params["client_id"] = client.CouchID
+		params["client_secret"] = client.ClientSecret
+		args, err := json.Marshal(params)
+		require.NoError(t, err)
+		req, err := http.NewRequest("POST", ts.URL+"/auth/login/flagship", bytes.NewReader(args))
+		require.NoError(t, err)
+		req.Host = domain
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Accept", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		var resbody map[string]interface{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&resbody))
+		return res.StatusCode, resbody
+	}
+
+	// The passphrase is not enough
+	status, resbody := login(echo.Map{})
+	assert.Equal(t, 401, status)
+	token, _ := resbody["two_factor_token"].(string)
+	require.NotEmpty(t, token)
+	assert.Nil(t, resbody["access_token"])
+
+	// The passcode used for the activation cannot be used again
+	status, _ = login(echo.Map{
+		"two_factor_token":    token,
+		"two_factor_passcode": passcode,
+	})
+	assert.Equal(t, 403, status)
+
+	next, err := totp.GenerateCode(key.Secret(), time.Now().UTC().Add(30*time.Second))
+	require.NoError(t, err)
+	status, resbody = login(echo.Map{
+		"two_factor_token":    token,
+		"two_factor_passcode": next,
+	})
+	assert.Equal(t, 200, status)
+	assert.NotNil(t, resbody["access_token"])
+	assert.NotNil(t, resbody["refresh_token"])
+}
+
 func TestAppRedirectionOnLogin(t *testing.T) {
 	req, _ := http.NewRequest("GET", ts.URL+"/auth/login?redirect=drive/%23/foobar", nil)
 	req.Host = domain
@@ -70,8 +70,8 @@ func confirmAuth(c echo.Context) error {
 		})
 	}
 
-	if inst.HasAuthMode(instance.TwoFactorMail) && !isTrustedDevice(c, inst) {
-		twoFactorToken, err := lifecycle.SendTwoFactorPasscode(inst)
+	if inst.HasTwoFactorAuth() && !isTrustedDevice(c, inst) {
+		twoFactorToken, err := lifecycle.StartTwoFactorAuth(inst)
 		if err != nil {
 			return err
 		}
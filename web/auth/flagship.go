@@ -26,7 +26,7 @@ func CreateSessionCode(c echo.Context) error {
 	case allowedToCreateSessionCode:
 		// OK
 	case need2FAToCreateSessionCode:
-		twoFactorToken, err := lifecycle.SendTwoFactorPasscode(inst)
+		twoFactorToken, err := lifecycle.StartTwoFactorAuth(inst)
 		if err != nil {
 			return err
 		}
@@ -94,9 +94,13 @@ func canCreateSessionCode(c echo.Context, inst *instance.Instance) canCreateSess
 		return cannotCreateSessionCode
 	}
 
-	if inst.HasAuthMode(instance.TwoFactorMail) {
+	if inst.HasTwoFactorAuth() {
 		token := []byte(args.TwoFactorToken)
-		if ok := inst.ValidateTwoFactorPasscode(token, args.TwoFactorCode); !ok {
+		if err := lifecycle.CheckTwoFactorPasscode(inst, token, args.TwoFactorCode); err != nil {
+			if err != instance.ErrInvalidTwoFactor {
+				inst.Logger().WithNamespace("auth").
+					Warnf("Cannot check the 2FA passcode: %s", err)
+			}
 			return need2FAToCreateSessionCode
 		}
 	}
@@ -201,9 +205,9 @@ func loginFlagship(c echo.Context) error {
 		})
 	}
 
-	if inst.HasAuthMode(instance.TwoFactorMail) {
+	if inst.HasTwoFactorAuth() {
 		if len(args.TwoFactorPasscode) == 0 || len(args.TwoFactorToken) == 0 {
-			twoFactorToken, err := lifecycle.SendTwoFactorPasscode(inst)
+			twoFactorToken, err := lifecycle.StartTwoFactorAuth(inst)
 			if err != nil {
 				return err
 			}
@@ -212,7 +216,11 @@ func loginFlagship(c echo.Context) error {
 			})
 		}
 		twoFactorToken := []byte(args.TwoFactorToken)
-		if !inst.ValidateTwoFactorPasscode(twoFactorToken, args.TwoFactorPasscode) {
+		err := lifecycle.CheckTwoFactorPasscode(inst, twoFactorToken, args.TwoFactorPasscode)
+		if err != nil && err != instance.ErrInvalidTwoFactor {
+			return err
+		}
+		if err != nil {
 			return c.JSON(http.StatusForbidden, echo.Map{
 				"error": inst.Translate(TwoFactorErrorKey),
 			})
@@ -655,8 +655,11 @@ func authorizeMove(c echo.Context) error {
 		}
 		token := []byte(c.FormValue("two-factor-token"))
 		passcode := c.FormValue("two-factor-passcode")
-		correctPasscode := inst.ValidateTwoFactorPasscode(token, passcode)
-		if !correctPasscode {
+		err := lifecycle.CheckTwoFactorPasscode(inst, token, passcode)
+		if err != nil && err != instance.ErrInvalidTwoFactor {
+			return err
+		}
+		if err != nil {
 			errorMessage := inst.Translate(TwoFactorErrorKey)
 			mail, _ := inst.SettingsEMail()
 			return c.Render(http.StatusOK, "move_delegated_auth.html", echo.Map{
@@ -693,8 +696,8 @@ func authorizeMove(c echo.Context) error {
 		})
 	}
 
-	if inst.HasAuthMode(instance.TwoFactorMail) && !isTrustedDevice(c, inst) {
-		twoFactorToken, err := lifecycle.SendTwoFactorPasscode(inst)
+	if inst.HasTwoFactorAuth() && !isTrustedDevice(c, inst) {
+		twoFactorToken, err := lifecycle.StartTwoFactorAuth(inst)
 		if err != nil {
 			return err
 		}
@@ -23,8 +23,12 @@ func TwoFactorRateExceeded(i *instance.Instance) error {
 	if limits.IsLimitReachedOrExceeded(err) {
 		return TwoFactorGenerationExceeded(i)
 	}
-	// Reset the key and send a new passcode to the user
+	// Reset the key and send a new passcode to the user (except for the TOTP
+	// mode, where the passcodes are generated by an authenticator application)
 	limits.ResetCounter(i, limits.TwoFactorType)
+	if i.HasAuthMode(instance.TwoFactorTOTP) {
+		return nil
+	}
 	_, err = lifecycle.SendTwoFactorPasscode(i)
 	return err
 }
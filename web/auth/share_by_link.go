@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/limits"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// ShareByLinkPasswordErrorKey is the key for translating the message
+	// showed to the visitor when the password of a share by link is incorrect
+	ShareByLinkPasswordErrorKey = "Share by link password error"
+	// ShareByLinkExceededErrorKey is the key for translating the message
+	// showed to the visitor when there were too many attempts
+	ShareByLinkExceededErrorKey = "Share by link password attempts error"
+)
+
+func renderShareByLinkPasswordForm(c echo.Context, i *instance.Instance, code int, sharecode, redirect, errorMessage string) error {
+	return c.Render(code, "share_by_link_password.html", echo.Map{
+		"Domain":           i.ContextualDomain(),
+		"ContextName":      i.ContextName,
+		"Locale":           i.Locale,
+		"Title":            i.TemplateTitle(),
+		"Favicon":          middlewares.Favicon(i),
+		"CSRF":             c.Get("csrf"),
+		"Sharecode":        sharecode,
+		"Redirect":         redirect,
+		"CredentialsError": errorMessage,
+	})
+}
+
+// checkShareByLinkRedirect checks that the redirect URL is on the instance or
+// one of its apps, as the visitor will be sent there with a new sharecode.
+func checkShareByLinkRedirect(i *instance.Instance, redirect string) (*url.URL, error) {
+	u, err := url.Parse(redirect)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "bad url: could not parse")
+	}
+	if !i.HasDomain(u.Host) {
+		instanceHost, appSlug, _ := config.SplitCozyHost(u.Host)
+		if !i.HasDomain(instanceHost) || appSlug == "" {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "bad url: should be subdomain")
+		}
+	}
+	return u, nil
+}
+
+func shareByLinkPasswordForm(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharecode := c.QueryParam("sharecode")
+	redirect := c.QueryParam("redirect")
+	if _, err := checkShareByLinkRedirect(inst, redirect); err != nil {
+		return err
+	}
+	if _, err := middlewares.GetShareByLinkForCode(inst, sharecode); err != nil {
+		return renderError(c, http.StatusNotFound, "Share by link not found")
+	}
+	return renderShareByLinkPasswordForm(c, inst, http.StatusOK, sharecode, redirect, "")
+}
+
+// unlockShareByLink checks the password of a share by link, and sends the
+// visitor back to the app with a code that can be used instead of the
+// sharecode for a limited time.
+func unlockShareByLink(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharecode := c.FormValue("sharecode")
+	redirect := c.FormValue("redirect")
+	u, err := checkShareByLinkRedirect(inst, redirect)
+	if err != nil {
+		return err
+	}
+	pdoc, err := middlewares.GetShareByLinkForCode(inst, sharecode)
+	if err != nil {
+		return renderError(c, http.StatusNotFound, "Share by link not found")
+	}
+	if pdoc.Exhausted() {
+		return renderError(c, http.StatusGone, "Share by link too many uses")
+	}
+
+	// Only the failed attempts are counted
+	limitKey := "password:" + pdoc.ID()
+	if limits.IsLimitExceededKey(limitKey, limits.SharingPublicLinkType) {
+		errorMessage := inst.Translate(ShareByLinkExceededErrorKey)
+		return renderShareByLinkPasswordForm(c, inst, http.StatusTooManyRequests, sharecode, redirect, errorMessage)
+	}
+	if !pdoc.CheckPassword(c.FormValue("password")) {
+		err = limits.CheckRateLimitKey(limitKey, limits.SharingPublicLinkType)
+		if limits.IsLimitReachedOrExceeded(err) {
+			errorMessage := inst.Translate(ShareByLinkExceededErrorKey)
+			return renderShareByLinkPasswordForm(c, inst, http.StatusTooManyRequests, sharecode, redirect, errorMessage)
+		}
+		errorMessage := inst.Translate(ShareByLinkPasswordErrorKey)
+		return renderShareByLinkPasswordForm(c, inst, http.StatusUnauthorized, sharecode, redirect, errorMessage)
+	}
+
+	code, err := inst.CreateUnlockedShareCode(pdoc.ID(), pdoc.PasswordStamp())
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("sharecode", code)
+	u.RawQuery = q.Encode()
+	return c.Redirect(http.StatusSeeOther, u.String())
+}
+
+// ShareByLinkPasswordURL returns the URL of the page where a visitor can type
+// the password of a share by link, before being redirected to the given URL.
+func ShareByLinkPasswordURL(i *instance.Instance, sharecode string, redirect *url.URL) string {
+	return i.PageURL("/auth/share-by-link/password", url.Values{
+		"sharecode": {sharecode},
+		"redirect":  {redirect.String()},
+	})
+}
@@ -6,7 +6,9 @@ import (
 	"strconv"
 
 	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/instance/lifecycle"
 	"github.com/cozy/cozy-stack/model/session"
+	"github.com/cozy/cozy-stack/model/webauthn"
 	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/labstack/echo/v4"
@@ -49,6 +51,8 @@ func renderTwoFactorForm(c echo.Context, i *instance.Instance, code int, credsEr
 		"LongRunSession":        longRunSession,
 		"TwoFactorToken":        string(twoFactorToken),
 		"TrustedDeviceCheckBox": trustedCheckbox,
+		"TOTP":                  i.HasAuthMode(instance.TwoFactorTOTP),
+		"WebAuthn":              webauthn.HasCredentials(i),
 	})
 }
 
@@ -86,7 +90,7 @@ func twoFactorForm(c echo.Context) error {
 // twoFactor handles a the twoFactor POST request
 func twoFactor(c echo.Context) error {
 	inst := middlewares.GetInstance(c)
-	if !inst.HasAuthMode(instance.TwoFactorMail) {
+	if !inst.HasTwoFactorAuth() {
 		errorMessage := inst.Translate(TwoFactorErrorKey)
 		return c.JSON(http.StatusUnauthorized, echo.Map{
 			"error": errorMessage,
@@ -96,10 +100,20 @@ func twoFactor(c echo.Context) error {
 	// Retreiving data from request
 	token := []byte(c.FormValue("two-factor-token"))
 	passcode := c.FormValue("two-factor-passcode")
+	assertion := c.FormValue("two-factor-webauthn")
 	generateTrustedDeviceToken, _ := strconv.ParseBool(c.FormValue("two-factor-generate-trusted-device-token"))
 
 	// Handle 2FA failed
-	correctPasscode := inst.ValidateTwoFactorPasscode(token, passcode)
+	var correctPasscode bool
+	if assertion != "" {
+		correctPasscode = validateWebAuthnSecondFactor(inst, token, assertion)
+	} else {
+		err := lifecycle.CheckTwoFactorPasscode(inst, token, passcode)
+		if err != nil && err != instance.ErrInvalidTwoFactor {
+			return err
+		}
+		correctPasscode = err == nil
+	}
 	if !correctPasscode {
 		return twoFactorFailed(c, inst, token)
 	}
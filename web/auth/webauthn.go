@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/session"
+	"github.com/cozy/cozy-stack/model/webauthn"
+	"github.com/cozy/cozy-stack/pkg/limits"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// WebAuthnErrorKey is the key for translating the message showed to the user
+// when the security key or passkey cannot be used to log in
+const WebAuthnErrorKey = "Login WebAuthn error"
+
+// webAuthnOptions returns the options for the browser to ask the
+// authenticator for an assertion, for the passwordless login or as a second
+// factor.
+func webAuthnOptions(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if !inst.IsPasswordAuthenticationEnabled() {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "password authentication is disabled",
+		})
+	}
+	if !webauthn.HasCredentials(inst) {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"error": "no credential has been registered",
+		})
+	}
+	opts, err := webauthn.NewRequestOptions(inst)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{"publicKey": opts})
+}
+
+// loginWebAuthn is the passwordless login: the authenticator must verify the
+// user (PIN, biometrics), and it replaces both the passphrase and the second
+// factor.
+func loginWebAuthn(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if !inst.IsPasswordAuthenticationEnabled() {
+		return c.JSON(http.StatusForbidden, echo.Map{
+			"error": "password authentication is disabled",
+		})
+	}
+
+	redirect, err := checkRedirectParam(c, inst.DefaultRedirection())
+	if err != nil {
+		return err
+	}
+	longRunSession, _ := strconv.ParseBool(c.FormValue("long-run-session"))
+
+	assertion := []byte(c.FormValue("webauthn-credential"))
+	if _, err := webauthn.Authenticate(inst, assertion, true); err != nil {
+		inst.Logger().WithNamespace("auth").Infof("WebAuthn login failed: %s", err)
+		errorMessage := inst.Translate(WebAuthnErrorKey)
+		err := limits.CheckRateLimit(inst, limits.AuthType)
+		if limits.IsLimitReachedOrExceeded(err) {
+			if err = LoginRateExceeded(inst); err != nil {
+				inst.Logger().WithNamespace("auth").Warn(err.Error())
+			}
+		}
+		if wantsJSON(c) {
+			return c.JSON(http.StatusUnauthorized, echo.Map{
+				"error": errorMessage,
+			})
+		}
+		return renderLoginForm(c, inst, http.StatusUnauthorized, errorMessage, redirect)
+	}
+
+	if _, ok := middlewares.GetSession(c); !ok {
+		duration := session.NormalRun
+		if longRunSession {
+			duration = session.LongRun
+		}
+		if err := newSession(c, inst, redirect, duration, "webauthn"); err != nil {
+			return err
+		}
+	}
+	if wantsJSON(c) {
+		return c.JSON(http.StatusOK, echo.Map{
+			"redirect": redirect.String(),
+		})
+	}
+	return c.Redirect(http.StatusSeeOther, redirect.String())
+}
+
+// validateWebAuthnSecondFactor checks the (token, assertion) pair, when a
+// security key is used instead of a passcode for the two-factor
+// authentication.
+func validateWebAuthnSecondFactor(inst *instance.Instance, token []byte, assertion string) bool {
+	if !inst.ValidateTwoFactorToken(token) {
+		return false
+	}
+	if _, err := webauthn.Authenticate(inst, []byte(assertion), false); err != nil {
+		inst.Logger().WithNamespace("auth").Infof("WebAuthn second factor failed: %s", err)
+		return false
+	}
+	return true
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -242,7 +243,7 @@ func getInitialCredentials(c echo.Context) error {
 		})
 	}
 
-	if inst.HasAuthMode(instance.TwoFactorMail) {
+	if inst.HasTwoFactorAuth() {
 		if !checkTwoFactor(c, inst) {
 			return nil
 		}
@@ -348,9 +349,14 @@ func checkTwoFactor(c echo.Context, inst *instance.Instance) bool {
 
 	if passcode := c.FormValue("twoFactorToken"); passcode != "" {
 		if token, ok := cache.Get(key); ok {
-			if inst.ValidateTwoFactorPasscode(token, passcode) {
+			err := lifecycle.CheckTwoFactorPasscode(inst, token, passcode)
+			if err == nil {
 				return true
 			}
+			if err != instance.ErrInvalidTwoFactor {
+				inst.Logger().WithNamespace("bitwarden").
+					Warnf("Cannot check the 2FA passcode: %s", err)
+			}
 		}
 	}
 
@@ -361,20 +367,30 @@ func checkTwoFactor(c echo.Context, inst *instance.Instance) bool {
 		return true
 	}
 
-	email, err := inst.SettingsEMail()
-	if err != nil {
-		_ = c.JSON(http.StatusInternalServerError, echo.Map{
-			"error": err.Error(),
-		})
-		return false
-	}
-	var obscured string
-	if parts := strings.SplitN(email, "@", 2); len(parts) == 2 {
-		s := strings.Map(func(_ rune) rune { return '*' }, parts[0])
-		obscured = s + "@" + parts[1]
+	// 0 means authenticator and 1 means email
+	// https://github.com/bitwarden/jslib/blob/master/common/src/enums/twoFactorProviderType.ts
+	provider := 1
+	params := map[string]string{}
+	if inst.HasAuthMode(instance.TwoFactorTOTP) {
+		provider = 0
+		params = nil
+	} else {
+		email, err := inst.SettingsEMail()
+		if err != nil {
+			_ = c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": err.Error(),
+			})
+			return false
+		}
+		var obscured string
+		if parts := strings.SplitN(email, "@", 2); len(parts) == 2 {
+			s := strings.Map(func(_ rune) rune { return '*' }, parts[0])
+			obscured = s + "@" + parts[1]
+		}
+		params["Email"] = obscured
 	}
 
-	token, err := lifecycle.SendTwoFactorPasscode(inst)
+	token, err := lifecycle.StartTwoFactorAuth(inst)
 	if err != nil {
 		_ = c.JSON(http.StatusInternalServerError, echo.Map{
 			"error": err.Error(),
@@ -384,13 +400,11 @@ func checkTwoFactor(c echo.Context, inst *instance.Instance) bool {
 	cache.Set(key, token, 5*time.Minute)
 
 	_ = c.JSON(http.StatusBadRequest, echo.Map{
-		"error":             "invalid_grant",
-		"error_description": "Two factor required.",
-		// 1 means email
-		// https://github.com/bitwarden/jslib/blob/master/common/src/enums/twoFactorProviderType.ts
-		"TwoFactorProviders": []int{1},
+		"error":              "invalid_grant",
+		"error_description":  "Two factor required.",
+		"TwoFactorProviders": []int{provider},
 		"TwoFactorProviders2": map[string]map[string]string{
-			"1": {"Email": obscured},
+			strconv.Itoa(provider): params,
 		},
 	})
 	return false
@@ -0,0 +1,95 @@
+package files
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/notification"
+	"github.com/cozy/cozy-stack/model/notification/center"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// ErrFileDropForbidden is used when a file drop link is used for something
+// else than uploading new files
+var ErrFileDropForbidden = echo.NewHTTPError(http.StatusForbidden,
+	"A file drop can only be used to upload new files")
+
+// getFileDrop returns the permission of the request if it is a file drop.
+func getFileDrop(c echo.Context) (*permission.Permission, bool) {
+	perm, err := middlewares.GetPermission(c)
+	if err != nil || !perm.IsFileDrop() {
+		return nil, false
+	}
+	return perm, true
+}
+
+// ForbidFileDrop returns an error if the request is made with a file drop
+// link, for the routes that can't check the limits of a file drop.
+func ForbidFileDrop(c echo.Context) error {
+	if _, ok := getFileDrop(c); ok {
+		return ErrFileDropForbidden
+	}
+	return nil
+}
+
+// createFileDropHandler uploads a file with a file drop link. The visitor
+// cannot see the directory, so the file is renamed if another file has the
+// same name, and the limits of the link are checked.
+func createFileDropHandler(c echo.Context, inst *instance.Instance, perm *permission.Permission, doc *vfs.FileDoc) (*file, error) {
+	reserved := doc.ByteSize
+	if reserved < 0 {
+		reserved = 0
+	}
+	if err := perm.ReserveFileDropUpload(inst, doc.ByteSize); err != nil {
+		return nil, err
+	}
+
+	fs := inst.VFS()
+	file, err := vfs.CreateFileWithoutConflict(fs, doc)
+	if err == nil {
+		err = copyFileContent(inst, file, doc, c.Request())
+	}
+	if err != nil {
+		if errc := perm.CancelFileDropUpload(inst, reserved); errc != nil {
+			inst.Logger().WithNamespace("files").
+				Warnf("Cannot update the file drop %s: %s", perm.ID(), errc)
+		}
+		return nil, err
+	}
+
+	notify, err := perm.FinishFileDropUpload(inst, doc.ByteSize-reserved)
+	if err != nil {
+		inst.Logger().WithNamespace("files").
+			Warnf("Cannot update the file drop %s: %s", perm.ID(), err)
+	}
+	if notify {
+		notifyFileDrop(inst, doc)
+	}
+	return NewFile(doc, inst), nil
+}
+
+func notifyFileDrop(inst *instance.Instance, doc *vfs.FileDoc) {
+	dir, err := inst.VFS().DirByID(doc.DirID)
+	if err != nil {
+		return
+	}
+	link := inst.SubDomain(consts.DriveSlug)
+	link.Fragment = "/folder/" + dir.ID()
+	n := &notification.Notification{
+		Title:   inst.Translate("Notifications File Drop Subject"),
+		Message: inst.Translate("Notifications File Drop Intro", doc.DocName, dir.DocName),
+		Data: map[string]interface{}{
+			"FileName": doc.DocName,
+			"DirName":  dir.DocName,
+			"DirLink":  link.String(),
+		},
+	}
+	if err := center.PushStack(inst.Domain, center.NotificationFileDrop, n); err != nil {
+		inst.Logger().WithNamespace("files").
+			Warnf("Cannot notify the file drop: %s", err)
+	}
+}
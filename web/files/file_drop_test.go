@@ -0,0 +1,152 @@
+package files
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createFileDrop creates a directory and a file drop link on it, and returns
+// the identifier of the directory and the sharecode of the link.
+func createFileDrop(t *testing.T, name string, opts *permission.FileDrop) (string, string) {
+	res, data := createDir(t, "/files/?Name="+name+"&Type=directory")
+	require.Equal(t, 201, res.StatusCode)
+	dirID, _ := extractDirData(t, data)
+
+	code, err := testInstance.CreateShareCode(name)
+	require.NoError(t, err)
+	rules := permission.Set{
+		permission.Rule{
+			Type:   consts.Files,
+			Verbs:  permission.Verbs(permission.POST),
+			Values: []string{dirID},
+		},
+	}
+	parent := &permission.Permission{Type: permission.TypeWebapp, Permissions: rules}
+	perms := permission.Permission{Permissions: rules, FileDrop: opts}
+	_, err = permission.CreateShareSet(testInstance, parent, "", map[string]string{name: code}, nil, perms, nil)
+	require.NoError(t, err)
+	return dirID, code
+}
+
+// dropFile uploads a file with a file drop link, and returns the response
+// and the identifier and name of the created file.
+func dropFile(t *testing.T, dirID, code, name, body string) (*http.Response, string, string) {
+	res, err := request("POST", "/files/"+dirID+"?Type=file&Name="+name, code, strings.NewReader(body))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var data map[string]interface{}
+	if err := extractJSONRes(res, &data); err != nil || data == nil {
+		return res, "", ""
+	}
+	doc, _ := data["data"].(map[string]interface{})
+	attrs, _ := doc["attributes"].(map[string]interface{})
+	id, _ := doc["id"].(string)
+	filename, _ := attrs["name"].(string)
+	return res, id, filename
+}
+
+func TestFileDropUpload(t *testing.T) {
+	dirID, code := createFileDrop(t, "filedropupload", &permission.FileDrop{})
+
+	res, fileID, name := dropFile(t, dirID, code, "drop.txt", "foo")
+	assert.Equal(t, 201, res.StatusCode)
+	assert.Equal(t, "drop.txt", name)
+	buf, err := readFile(testInstance.VFS(), "/filedropupload/drop.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(buf))
+
+	// The visitor doesn't know the files of the directory, so a file with
+	// the same name is renamed instead of being rejected
+	res, otherID, name := dropFile(t, dirID, code, "drop.txt", "bar")
+	assert.Equal(t, 201, res.StatusCode)
+	assert.NotEqual(t, fileID, otherID)
+	assert.True(t, strings.HasPrefix(name, "drop.txt ("), name)
+
+	perm, err := permission.GetForShareCode(testInstance, code)
+	require.NoError(t, err)
+	assert.Equal(t, 2, perm.FileDrop.Files)
+	assert.EqualValues(t, 6, perm.FileDrop.Size)
+}
+
+func TestFileDropCannotReadOrList(t *testing.T) {
+	dirID, code := createFileDrop(t, "filedropread", &permission.FileDrop{})
+	res, fileID, _ := dropFile(t, dirID, code, "secret.txt", "foo")
+	require.Equal(t, 201, res.StatusCode)
+
+	for _, path := range []string{
+		"/files/" + dirID,
+		"/files/" + fileID,
+		"/files/download/" + fileID,
+		"/files/metadata?Path=/filedropread/secret.txt",
+	} {
+		res, err := request("GET", path, code, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 403, res.StatusCode, path)
+		res.Body.Close()
+	}
+}
+
+func TestFileDropMaxFiles(t *testing.T) {
+	dirID, code := createFileDrop(t, "filedropmaxfiles", &permission.FileDrop{MaxFiles: 2})
+
+	res, _, _ := dropFile(t, dirID, code, "one.txt", "1")
+	assert.Equal(t, 201, res.StatusCode)
+	res, _, _ = dropFile(t, dirID, code, "two.txt", "2")
+	assert.Equal(t, 201, res.StatusCode)
+	res, _, _ = dropFile(t, dirID, code, "three.txt", "3")
+	assert.Equal(t, 403, res.StatusCode)
+
+	_, err := testInstance.VFS().FileByPath("/filedropmaxfiles/three.txt")
+	assert.Error(t, err)
+}
+
+func TestFileDropMaxSize(t *testing.T) {
+	dirID, code := createFileDrop(t, "filedropmaxsize", &permission.FileDrop{MaxSize: 10})
+
+	res, _, _ := dropFile(t, dirID, code, "small.txt", "123456")
+	assert.Equal(t, 201, res.StatusCode)
+	res, _, _ = dropFile(t, dirID, code, "big.txt", "123456")
+	assert.Equal(t, 413, res.StatusCode)
+
+	// Without a Content-Length, the size of the file cannot be checked
+	body := ioutil.NopCloser(strings.NewReader("1234"))
+	res, err := request("POST", "/files/"+dirID+"?Type=file&Name=chunked.txt", code, body)
+	assert.NoError(t, err)
+	assert.Equal(t, 411, res.StatusCode)
+	res.Body.Close()
+
+	// The failed uploads have been removed from the counters
+	perm, err := permission.GetForShareCode(testInstance, code)
+	require.NoError(t, err)
+	assert.Equal(t, 1, perm.FileDrop.Files)
+	assert.EqualValues(t, 6, perm.FileDrop.Size)
+	res, _, _ = dropFile(t, dirID, code, "last.txt", "1234")
+	assert.Equal(t, 201, res.StatusCode)
+}
+
+func TestFileDropForbiddenRoutes(t *testing.T) {
+	dirID, code := createFileDrop(t, "filedropforbidden", &permission.FileDrop{})
+	res, fileID, _ := dropFile(t, dirID, code, "file.txt", "foo")
+	require.Equal(t, 201, res.StatusCode)
+
+	for _, path := range []string{
+		"/files/" + dirID + "?Type=directory&Name=subdir",
+		"/files/upload/sessions?Type=file&Name=session.txt&DirID=" + dirID + "&Size=3",
+		"/files/revert/" + fileID + "/1-123456",
+	} {
+		res, err := request("POST", path, code, strings.NewReader(""))
+		assert.NoError(t, err)
+		assert.Equal(t, 403, res.StatusCode, path)
+		res.Body.Close()
+	}
+
+	_, err := testInstance.VFS().DirByPath("/filedropforbidden/subdir")
+	assert.Error(t, err)
+}
@@ -71,6 +71,9 @@ func CreationHandler(c echo.Context) error {
 	case consts.FileType:
 		doc, err = createFileHandler(c, instance.VFS())
 	case consts.DirType:
+		if err = ForbidFileDrop(c); err != nil {
+			return err
+		}
 		doc, err = createDirHandler(c, instance.VFS())
 	default:
 		err = ErrDocTypeInvalid
@@ -109,6 +112,10 @@ func createFileHandler(c echo.Context, fs vfs.VFS) (*file, error) {
 		return nil, err
 	}
 
+	if perm, ok := getFileDrop(c); ok {
+		return createFileDropHandler(c, inst, perm, doc)
+	}
+
 	if filepath.Ext(doc.DocName) == ".cozy-note" {
 		err := note.ImportFile(inst, doc, nil, c.Request().Body)
 		if err != nil {
@@ -123,8 +130,15 @@ func createFileHandler(c echo.Context, fs vfs.VFS) (*file, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = copyFileContent(inst, file, doc, c.Request()); err != nil {
+		return nil, err
+	}
+	return NewFile(doc, inst), nil
+}
 
-	n, err := io.Copy(file, c.Request().Body)
+// copyFileContent writes the body of the request to the file, and closes it.
+func copyFileContent(inst *instance.Instance, file vfs.File, doc *vfs.FileDoc, req *http.Request) error {
+	n, err := io.Copy(file, req.Body)
 	if err != nil {
 		inst.Logger().WithNamespace("files").
 			Warnf("Error on uploading file (copy): %s (%d bytes written - expected %d)", err, n, doc.ByteSize)
@@ -135,9 +149,9 @@ func createFileHandler(c echo.Context, fs vfs.VFS) (*file, error) {
 			Warnf("Error on uploading file (close): %s", err)
 	}
 	if err != nil {
-		return nil, wrapVfsError(err)
+		return wrapVfsError(err)
 	}
-	return NewFile(doc, inst), nil
+	return nil
 }
 
 func createDirHandler(c echo.Context, fs vfs.VFS) (*dir, error) {
@@ -505,6 +519,118 @@ func CopyVersionHandler(c echo.Context) error {
 	return err
 }
 
+// CopyFileHandler handles POST requests on /files/:file-id/copy.
+//
+// It creates a copy of a file or of a directory, in the same directory or in
+// the one given by the DirID parameter. The content of a directory is copied
+// asynchronously by a job.
+func CopyFileHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	fs := inst.VFS()
+	srcDir, srcFile, err := fs.DirOrFileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permission.GET, srcDir, srcFile); err != nil {
+		return err
+	}
+
+	var srcName, srcParentID string
+	if srcFile != nil {
+		srcName, srcParentID = srcFile.DocName, srcFile.DirID
+	} else {
+		if srcDir.DocID == consts.RootDirID || srcDir.DocID == consts.TrashDirID {
+			return jsonapi.BadRequest(vfs.ErrForbiddenDocCopy)
+		}
+		srcName, srcParentID = srcDir.DocName, srcDir.DirID
+	}
+	dirID := c.QueryParam("DirID")
+	if dirID == "" {
+		dirID = srcParentID
+	}
+	name := c.QueryParam("Name")
+	if name == "" {
+		name = srcName
+		if dirID == srcParentID {
+			name = vfs.CopyName(srcName, srcFile != nil)
+		}
+	}
+	keepMetadata := c.QueryParam("KeepMetadata") == "true"
+
+	if srcFile != nil {
+		newdoc, err := vfs.NewFileDocCopy(srcFile, dirID, name, keepMetadata)
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		if _, ok := newdoc.Metadata[consts.CarbonCopyKey]; ok {
+			if err := middlewares.AllowWholeType(c, permission.POST, consts.CertifiedCarbonCopy); err != nil {
+				delete(newdoc.Metadata, consts.CarbonCopyKey)
+			}
+		}
+		if _, ok := newdoc.Metadata[consts.ElectronicSafeKey]; ok {
+			if err := middlewares.AllowWholeType(c, permission.POST, consts.CertifiedElectronicSafe); err != nil {
+				delete(newdoc.Metadata, consts.ElectronicSafeKey)
+			}
+		}
+		newdoc.CozyMetadata, _ = CozyMetadataFromClaims(c, true)
+		if err = checkPerm(c, permission.POST, nil, newdoc); err != nil {
+			return err
+		}
+		if err = fs.CopyFile(srcFile, newdoc); err != nil {
+			return WrapVfsError(err)
+		}
+		return FileData(c, http.StatusCreated, newdoc, false, nil)
+	}
+
+	parent, err := fs.DirByID(dirID)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	newdir, err := vfs.NewDirDocCopy(srcDir, parent, name, keepMetadata)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	newdir.CozyMetadata, _ = CozyMetadataFromClaims(c, false)
+	if err = checkPerm(c, permission.POST, newdir, nil); err != nil {
+		return err
+	}
+
+	if diskQuota := fs.DiskQuota(); diskQuota > 0 {
+		size, err := fs.DirSize(srcDir)
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		usage, err := fs.DiskUsage()
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		if size > diskQuota-usage {
+			return WrapVfsError(vfs.ErrFileTooBig)
+		}
+	}
+
+	if err = fs.CreateDir(newdir); err != nil {
+		return WrapVfsError(err)
+	}
+	msg, err := job.NewMessage(map[string]interface{}{
+		"src_id":        srcDir.DocID,
+		"dst_id":        newdir.DocID,
+		"keep_metadata": keepMetadata,
+	})
+	if err != nil {
+		return err
+	}
+	j, err := job.System().PushJob(inst, &job.JobRequest{
+		WorkerType: "copy-files",
+		Message:    msg,
+	})
+	if err != nil {
+		return err
+	}
+	links := &jsonapi.LinksList{Related: "/jobs/" + j.ID()}
+	return jsonapi.Data(c, http.StatusAccepted, newDir(newdir), links)
+}
+
 // ClearOldVersions is the handler for DELETE /files/versions.
 // It deletes all the old versions of all files to make space for new files.
 func ClearOldVersions(c echo.Context) error {
@@ -812,6 +938,9 @@ func ReadFileContentFromIDHandler(c echo.Context) error {
 	disposition := "inline"
 	if c.QueryParam("Dl") == "1" {
 		disposition = "attachment"
+		if err := middlewares.AddShareByLinkDownload(c); err != nil {
+			return err
+		}
 	}
 	err = vfs.ServeFileContent(instance.VFS(), doc, nil, "", disposition, c.Request(), c.Response())
 	if err != nil {
@@ -865,6 +994,9 @@ func RevertFileVersion(c echo.Context) error {
 	if err = checkPerm(c, permission.POST, nil, doc); err != nil {
 		return err
 	}
+	if err = ForbidFileDrop(c); err != nil {
+		return err
+	}
 
 	version, err := vfs.FindVersion(inst, doc.DocID+"/"+c.Param("version-id"))
 	if err != nil {
@@ -972,6 +1104,8 @@ func ThumbnailHandler(c echo.Context) error {
 			_, _ = job.System().PushJob(instance, &job.JobRequest{
 				WorkerType: "thumbnail",
 				Message:    msg,
+				// The user is waiting for the thumbnail
+				Options: &job.JobOptions{Priority: job.PriorityHigh},
 			})
 		}
 		return serveThumbnailPlaceholder(c.Response(), c.Request(), doc, format)
@@ -1018,6 +1152,11 @@ func sendFileFromPath(c echo.Context, path string, checkPermission bool) error {
 	disposition := "inline"
 	if c.QueryParam("Dl") == "1" {
 		disposition = "attachment"
+		if checkPermission {
+			if err := middlewares.AddShareByLinkDownload(c); err != nil {
+				return err
+			}
+		}
 	} else if !checkPermission {
 		addCSPRuleForDirectLink(c, doc.Class, doc.Mime)
 	}
@@ -1072,6 +1211,9 @@ func ArchiveDownloadCreateHandler(c echo.Context) error {
 			return err
 		}
 	}
+	if err := middlewares.AddShareByLinkDownload(c); err != nil {
+		return err
+	}
 
 	// if accept header is application/zip, send the archive immediately
 	if c.Request().Header.Get(echo.HeaderAccept) == "application/zip" {
@@ -1124,6 +1266,9 @@ func FileDownloadCreateHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	if err := middlewares.AddShareByLinkDownload(c); err != nil {
+		return err
+	}
 
 	var secret string
 	if versionID == "" {
@@ -1775,6 +1920,7 @@ func Routes(router *echo.Group) {
 	router.PATCH("/:file-id/:version-id", ModifyFileVersionMetadata)
 	router.DELETE("/:file-id/:version-id", DeleteFileVersionMetadata)
 	router.POST("/:file-id/versions", CopyVersionHandler)
+	router.POST("/:file-id/copy", CopyFileHandler)
 	router.DELETE("/versions", ClearOldVersions)
 
 	router.POST("/_find", FindFilesMango)
@@ -1795,6 +1941,12 @@ func Routes(router *echo.Group) {
 	router.POST("/:file-id", CreationHandler)
 	router.PUT("/:file-id", OverwriteFileContentHandler)
 	router.POST("/upload/metadata", UploadMetadataHandler)
+	router.POST("/upload/sessions", CreateUploadSessionHandler)
+	router.HEAD("/upload/sessions/:session-id", HeadUploadSessionHandler)
+	router.GET("/upload/sessions/:session-id", GetUploadSessionHandler)
+	router.PATCH("/upload/sessions/:session-id", UploadChunkHandler)
+	router.POST("/upload/sessions/:session-id", CommitUploadSessionHandler)
+	router.DELETE("/upload/sessions/:session-id", AbortUploadSessionHandler)
 
 	router.GET("/:file-id/icon/:secret", IconHandler)
 	router.GET("/:file-id/preview/:secret", PreviewHandler)
@@ -1851,6 +2003,8 @@ func wrapVfsError(err error) *jsonapi.Error {
 		return jsonapi.NotFound(err)
 	case vfs.ErrForbiddenDocMove:
 		return jsonapi.PreconditionFailed("dir-id", err)
+	case vfs.ErrForbiddenDocCopy:
+		return jsonapi.PreconditionFailed("dir-id", err)
 	case vfs.ErrIllegalFilename:
 		return jsonapi.InvalidParameter("name", err)
 	case vfs.ErrIllegalPath:
@@ -1872,6 +2026,14 @@ func wrapVfsError(err error) *jsonapi.Error {
 		return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "%s", err)
 	case vfs.ErrWrongToken:
 		return jsonapi.BadRequest(err)
+	case vfs.ErrChunkedUploadNotSupported, vfs.ErrChunkedUploadSwiftLayout:
+		return jsonapi.Errorf(http.StatusNotImplemented, "%s", err)
+	case vfs.ErrUploadSessionNotFound:
+		return jsonapi.NotFound(err)
+	case vfs.ErrUploadOffsetMismatch:
+		return jsonapi.Conflict(err)
+	case vfs.ErrUploadNotCompleted:
+		return jsonapi.PreconditionFailed(HeaderUploadOffset, err)
 	}
 	if _, ok := err.(*jsonapi.Error); !ok {
 		logger.WithNamespace("files").Warnf("Not wrapped error: %s", err)
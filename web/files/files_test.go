@@ -2,6 +2,8 @@ package files
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -29,6 +31,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	_ "github.com/cozy/cozy-stack/web/statik"
+	_ "github.com/cozy/cozy-stack/worker/files"
 	_ "github.com/cozy/cozy-stack/worker/thumbnail"
 )
 
@@ -764,6 +767,232 @@ func TestUploadWithSourceAccount(t *testing.T) {
 	assert.Equal(t, identifier, fcm["sourceAccountIdentifier"])
 }
 
+func TestResumableUpload(t *testing.T) {
+	doReq := func(method, path string, body string, headers map[string]string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		for k, v := range headers {
+			req.Header.Add(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		var v map[string]interface{}
+		_ = extractJSONRes(res, &v)
+		return res, v
+	}
+
+	res, v := doReq("POST", "/files/upload/sessions?DirID="+consts.RootDirID+"&Name=resumable.txt&Size=12", "",
+		map[string]string{"Content-MD5": "hvsmnRkNLIX24EaM7KQqIA==", "Content-Type": "text/plain"})
+	assert.Equal(t, 201, res.StatusCode)
+	assert.Equal(t, "0", res.Header.Get("Upload-Offset"))
+	assert.Equal(t, "12", res.Header.Get("Upload-Length"))
+	data := v["data"].(map[string]interface{})
+	sessionPath := "/files/upload/sessions/" + data["id"].(string)
+
+	res, _ = doReq("PATCH", sessionPath, "Hello ", map[string]string{"Upload-Offset": "0"})
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "6", res.Header.Get("Upload-Offset"))
+
+	res, _ = doReq("PATCH", sessionPath, "Hello ", map[string]string{"Upload-Offset": "0"})
+	assert.Equal(t, 409, res.StatusCode)
+
+	res, _ = doReq("POST", sessionPath, "", nil)
+	assert.Equal(t, 412, res.StatusCode)
+
+	res, _ = doReq("HEAD", sessionPath, "", nil)
+	assert.Equal(t, 204, res.StatusCode)
+	assert.Equal(t, "6", res.Header.Get("Upload-Offset"))
+
+	res, _ = doReq("PATCH", sessionPath, "world!", map[string]string{"Upload-Offset": "6"})
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "12", res.Header.Get("Upload-Offset"))
+
+	res, _ = doReq("POST", sessionPath, "", nil)
+	assert.Equal(t, 201, res.StatusCode)
+
+	buf, err := readFile(testInstance.VFS(), "/resumable.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello world!", string(buf))
+
+	res, _ = doReq("GET", sessionPath, "", nil)
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestResumableUploadQuota(t *testing.T) {
+	doReq := func(method, path string, body string, headers map[string]string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		for k, v := range headers {
+			req.Header.Add(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+	createSession := func(name, content string) (*http.Response, string) {
+		sum := md5.Sum([]byte(content))
+		path := "/files/upload/sessions?DirID=" + consts.RootDirID + "&Name=" + name + "&Size=" + strconv.Itoa(len(content))
+		req, err := http.NewRequest("POST", ts.URL+path, nil)
+		assert.NoError(t, err)
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		res, v := doUploadOrMod(t, req, "text/plain", base64.StdEncoding.EncodeToString(sum[:]))
+		if res.StatusCode != 201 {
+			return res, ""
+		}
+		data := v["data"].(map[string]interface{})
+		return res, "/files/upload/sessions/" + data["id"].(string)
+	}
+
+	usage, err := testInstance.VFS().DiskUsage()
+	assert.NoError(t, err)
+	testInstance.BytesDiskQuota = usage + 10
+	defer func() { testInstance.BytesDiskQuota = 0 }()
+
+	res, sessionA := createSession("quota-a.txt", "12345678")
+	assert.Equal(t, 201, res.StatusCode)
+	res, sessionB := createSession("quota-b.txt", "abcdefgh")
+	assert.Equal(t, 201, res.StatusCode)
+
+	// The chunks of a session count against the quota
+	res = doReq("PATCH", sessionA, "12345678", map[string]string{"Upload-Offset": "0"})
+	assert.Equal(t, 200, res.StatusCode)
+	res = doReq("PATCH", sessionB, "abcdefgh", map[string]string{"Upload-Offset": "0"})
+	assert.Equal(t, 413, res.StatusCode)
+	res, _ = createSession("quota-c.txt", "ABCDEFGH")
+	assert.Equal(t, 413, res.StatusCode)
+
+	// The chunks of the committed session are replaced by the file
+	res = doReq("POST", sessionA, "", nil)
+	assert.Equal(t, 201, res.StatusCode)
+	res = doReq("DELETE", sessionB, "", nil)
+	assert.Equal(t, 204, res.StatusCode)
+
+	// The quota is checked again when the session is committed
+	res, sessionD := createSession("quota-d.txt", "xy")
+	assert.Equal(t, 201, res.StatusCode)
+	res = doReq("PATCH", sessionD, "xy", map[string]string{"Upload-Offset": "0"})
+	assert.Equal(t, 200, res.StatusCode)
+	res, _ = upload(t, "/files/?Type=file&Name=quota-e.txt", "text/plain", "z", "")
+	assert.Equal(t, 201, res.StatusCode)
+	res = doReq("POST", sessionD, "", nil)
+	assert.Equal(t, 413, res.StatusCode)
+	res = doReq("DELETE", sessionD, "", nil)
+	assert.Equal(t, 204, res.StatusCode)
+}
+
+func TestCopyFile(t *testing.T) {
+	body := "foo"
+	res, v := upload(t, "/files/?Type=file&Name=tocopy.txt&Tags=foo", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res.StatusCode)
+	data := v["data"].(map[string]interface{})
+	srcID := data["id"].(string)
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/"+srcID+"/copy", nil)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	res.Body.Close()
+	data = result["data"].(map[string]interface{})
+	assert.NotEqual(t, srcID, data["id"])
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "tocopy (copy).txt", attrs["name"])
+
+	buf, err := readFile(testInstance.VFS(), "/tocopy (copy).txt")
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(buf))
+
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 409, res.StatusCode)
+	res.Body.Close()
+}
+
+func TestCopyDirectory(t *testing.T) {
+	res, data := createDir(t, "/files/?Name=dirtocopy&Type=directory")
+	assert.Equal(t, 201, res.StatusCode)
+	srcID, _ := extractDirData(t, data)
+	res, data = createDir(t, "/files/"+srcID+"?Name=sub&Type=directory")
+	assert.Equal(t, 201, res.StatusCode)
+	subID, _ := extractDirData(t, data)
+	res, _ = upload(t, "/files/"+srcID+"?Type=file&Name=foo.txt", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res.StatusCode)
+	res, _ = upload(t, "/files/"+subID+"?Type=file&Name=bar.txt", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res.StatusCode)
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/"+srcID+"/copy", nil)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 202, res.StatusCode)
+	var result map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	res.Body.Close()
+	data = result["data"].(map[string]interface{})
+	assert.NotEqual(t, srcID, data["id"])
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "dirtocopy (copy)", attrs["name"])
+	links := result["links"].(map[string]interface{})
+	assert.Contains(t, links["related"], "/jobs/")
+
+	// The content is copied in the background by the copy-files worker
+	assert.Eventually(t, func() bool {
+		buf, err := readFile(testInstance.VFS(), "/dirtocopy (copy)/sub/bar.txt")
+		return err == nil && string(buf) == "foo"
+	}, 10*time.Second, 100*time.Millisecond)
+	buf, err := readFile(testInstance.VFS(), "/dirtocopy (copy)/foo.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(buf))
+
+	// The name of the copy is already taken
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 409, res.StatusCode)
+	res.Body.Close()
+
+	// A directory cannot be copied inside itself
+	req, err = http.NewRequest("POST", ts.URL+"/files/"+srcID+"/copy?DirID="+subID, nil)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 412, res.StatusCode)
+	res.Body.Close()
+}
+
+func TestCopyDirectoryTooBig(t *testing.T) {
+	res, data := createDir(t, "/files/?Name=dirtoobig&Type=directory")
+	assert.Equal(t, 201, res.StatusCode)
+	srcID, _ := extractDirData(t, data)
+	res, _ = upload(t, "/files/"+srcID+"?Type=file&Name=foo.txt", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res.StatusCode)
+
+	usage, err := testInstance.VFS().DiskUsage()
+	assert.NoError(t, err)
+	testInstance.BytesDiskQuota = usage + 2
+	defer func() { testInstance.BytesDiskQuota = 0 }()
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/"+srcID+"/copy", nil)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 413, res.StatusCode)
+	res.Body.Close()
+
+	// The directory of the copy has not been created
+	_, err = testInstance.VFS().DirByPath("/dirtoobig (copy)")
+	assert.Error(t, err)
+}
+
 func TestModifyMetadataByPath(t *testing.T) {
 	body := "foo"
 	res1, data1 := upload(t, "/files/?Type=file&Name=file-move-me-by-path", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
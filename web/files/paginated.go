@@ -48,9 +48,10 @@ type file struct {
 
 type fileJSON struct {
 	*vfs.FileDoc
-	// XXX Hide the internal_vfs_id and referenced_by
-	InternalID   *interface{} `json:"internal_vfs_id,omitempty"`
-	ReferencedBy *interface{} `json:"referenced_by,omitempty"`
+	// XXX Hide the internal_vfs_id, encrypted_at_rest and referenced_by
+	InternalID      *interface{} `json:"internal_vfs_id,omitempty"`
+	EncryptedAtRest *interface{} `json:"encrypted_at_rest,omitempty"`
+	ReferencedBy    *interface{} `json:"referenced_by,omitempty"`
 	// Include the path if asked for
 	Fullpath string `json:"path,omitempty"`
 }
@@ -430,9 +431,10 @@ type findFile struct {
 	CreatedAt  *time.Time `json:"created_at,omitempty"`
 	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
 	Executable *bool      `json:"executable,omitempty"`
-	// Hide the internal_vfs_id and referenced_by
-	InternalID   *interface{} `json:"internal_vfs_id,omitempty"`
-	ReferencedBy *interface{} `json:"referenced_by,omitempty"`
+	// Hide the internal_vfs_id, encrypted_at_rest and referenced_by
+	InternalID      *interface{} `json:"internal_vfs_id,omitempty"`
+	EncryptedAtRest *interface{} `json:"encrypted_at_rest,omitempty"`
+	ReferencedBy    *interface{} `json:"referenced_by,omitempty"`
 }
 
 func (f *findFile) SetThumbSecret(secret string)           { f.file.SetThumbSecret(secret) }
@@ -442,7 +444,7 @@ func (f *findFile) Links() *jsonapi.LinksList              { return f.file.Links
 
 func newFindFile(doc *vfs.FileDoc, fields []string, i *instance.Instance) *findFile {
 	f := NewFile(doc, i)
-	ff := &findFile{doc, f, nil, nil, nil, nil, nil}
+	ff := &findFile{doc, f, nil, nil, nil, nil, nil, nil}
 	if hasField(fields, "created_at") {
 		ff.CreatedAt = &doc.CreatedAt
 	}
@@ -0,0 +1,262 @@
+package files
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// HeaderUploadOffset is the HTTP header used for the number of bytes
+	// already received for an upload session.
+	HeaderUploadOffset = "Upload-Offset"
+	// HeaderUploadLength is the HTTP header used for the total size of the
+	// file of an upload session.
+	HeaderUploadLength = "Upload-Length"
+
+	// purgeTriggerCacheTTL is how long the stack remembers that an instance
+	// has its purge-upload-sessions trigger, to avoid looking for it in
+	// CouchDB each time an upload session is created.
+	purgeTriggerCacheTTL = 24 * time.Hour
+)
+
+// CreateUploadSessionHandler handles POST requests on /files/upload/sessions
+// to start a resumable upload. The file metadata are given like for a classic
+// upload, except that the body is empty and the size of the file must be
+// given with the Size parameter.
+func CreateUploadSessionHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	fs := inst.VFS()
+
+	size, err := strconv.ParseInt(c.QueryParam("Size"), 10, 64)
+	if err != nil || size < 0 {
+		return jsonapi.InvalidParameter("Size", vfs.ErrContentLengthMismatch)
+	}
+
+	var newdoc, olddoc *vfs.FileDoc
+	if fileID := c.QueryParam("FileID"); fileID != "" {
+		olddoc, err = fs.FileByID(fileID)
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		if err = CheckIfMatch(c, olddoc.Rev()); err != nil {
+			return WrapVfsError(err)
+		}
+		newdoc, err = FileDocFromReq(c, olddoc.DocName, olddoc.DirID)
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		newdoc.SetID(olddoc.ID())
+		if err = checkPerm(c, permission.PUT, nil, olddoc); err != nil {
+			return err
+		}
+	} else {
+		newdoc, err = FileDocFromReq(c, c.QueryParam("Name"), c.QueryParam("DirID"))
+		if err != nil {
+			return WrapVfsError(err)
+		}
+	}
+	newdoc.ByteSize = size
+
+	if created := c.QueryParam("CreatedAt"); created != "" {
+		if at, err2 := time.Parse(time.RFC3339, created); err2 == nil {
+			newdoc.CreatedAt = at
+		}
+	}
+	if updated := c.QueryParam("UpdatedAt"); updated != "" {
+		if at, err3 := time.Parse(time.RFC3339, updated); err3 == nil {
+			newdoc.UpdatedAt = at
+		}
+	}
+
+	verb := permission.POST
+	if olddoc != nil {
+		verb = permission.PUT
+	}
+	if err = checkPerm(c, verb, nil, newdoc); err != nil {
+		return err
+	}
+	// The limits of a file drop are checked for simple uploads only
+	if err = ForbidFileDrop(c); err != nil {
+		return err
+	}
+
+	session, err := vfs.NewUploadSession(fs, newdoc, olddoc)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	ensurePurgeUploadSessionsTrigger(inst)
+	setUploadSessionHeaders(c, session)
+	return jsonapi.Data(c, http.StatusCreated, session, nil)
+}
+
+// HeadUploadSessionHandler handles HEAD requests on
+// /files/upload/sessions/:session-id. It returns the offset of the upload in
+// the Upload-Offset header, so that the client can resume it.
+func HeadUploadSessionHandler(c echo.Context) error {
+	session, _, _, err := findUploadSession(c)
+	if err != nil {
+		return err
+	}
+	setUploadSessionHeaders(c, session)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetUploadSessionHandler handles GET requests on
+// /files/upload/sessions/:session-id
+func GetUploadSessionHandler(c echo.Context) error {
+	session, _, _, err := findUploadSession(c)
+	if err != nil {
+		return err
+	}
+	setUploadSessionHeaders(c, session)
+	return jsonapi.Data(c, http.StatusOK, session, nil)
+}
+
+// UploadChunkHandler handles PATCH requests on
+// /files/upload/sessions/:session-id to send a chunk of the file content. The
+// Upload-Offset header must be the number of bytes already received.
+func UploadChunkHandler(c echo.Context) error {
+	session, _, _, err := findUploadSession(c)
+	if err != nil {
+		return err
+	}
+	offset, err := strconv.ParseInt(c.Request().Header.Get(HeaderUploadOffset), 10, 64)
+	if err != nil {
+		return jsonapi.InvalidParameter(HeaderUploadOffset, err)
+	}
+
+	fs := middlewares.GetInstance(c).VFS()
+	if err = session.AppendChunk(fs, offset, c.Request().Body); err != nil {
+		return WrapVfsError(err)
+	}
+	setUploadSessionHeaders(c, session)
+	return jsonapi.Data(c, http.StatusOK, session, nil)
+}
+
+// CommitUploadSessionHandler handles POST requests on
+// /files/upload/sessions/:session-id to create the file once all the chunks
+// have been sent.
+func CommitUploadSessionHandler(c echo.Context) error {
+	session, newdoc, olddoc, err := findUploadSession(c)
+	if err != nil {
+		return err
+	}
+
+	if olddoc != nil {
+		if olddoc.CozyMetadata != nil {
+			newdoc.CozyMetadata = olddoc.CozyMetadata.Clone()
+		}
+		updateFileCozyMetadata(c, newdoc, true)
+	} else {
+		newdoc.CozyMetadata, _ = CozyMetadataFromClaims(c, true)
+	}
+
+	inst := middlewares.GetInstance(c)
+	if err = session.Commit(inst.VFS(), newdoc, olddoc); err != nil {
+		return WrapVfsError(err)
+	}
+	status := http.StatusCreated
+	if olddoc != nil {
+		status = http.StatusOK
+	}
+	return FileData(c, status, newdoc, true, nil)
+}
+
+// AbortUploadSessionHandler handles DELETE requests on
+// /files/upload/sessions/:session-id to cancel an upload.
+func AbortUploadSessionHandler(c echo.Context) error {
+	session, _, _, err := findUploadSession(c)
+	if err != nil {
+		return err
+	}
+	fs := middlewares.GetInstance(c).VFS()
+	if err = session.Abort(fs); err != nil {
+		return WrapVfsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// findUploadSession loads the upload session from the request, and checks
+// that the client has the permission to create the file of this session.
+func findUploadSession(c echo.Context) (*vfs.UploadSession, *vfs.FileDoc, *vfs.FileDoc, error) {
+	fs := middlewares.GetInstance(c).VFS()
+	session, err := vfs.FindUploadSession(fs, c.Param("session-id"))
+	if err != nil {
+		return nil, nil, nil, WrapVfsError(err)
+	}
+
+	var olddoc *vfs.FileDoc
+	verb := permission.POST
+	if session.FileID != "" {
+		olddoc, err = fs.FileByID(session.FileID)
+		if err != nil {
+			return nil, nil, nil, WrapVfsError(err)
+		}
+		if err = checkPerm(c, permission.PUT, nil, olddoc); err != nil {
+			return nil, nil, nil, err
+		}
+		verb = permission.PUT
+	}
+
+	newdoc, err := session.FileDoc(olddoc)
+	if err != nil {
+		return nil, nil, nil, WrapVfsError(err)
+	}
+	if err = checkPerm(c, verb, nil, newdoc); err != nil {
+		return nil, nil, nil, err
+	}
+	return session, newdoc, olddoc, nil
+}
+
+func setUploadSessionHeaders(c echo.Context, session *vfs.UploadSession) {
+	header := c.Response().Header()
+	header.Set(HeaderUploadOffset, strconv.FormatInt(session.Offset(), 10))
+	header.Set(HeaderUploadLength, strconv.FormatInt(session.ByteSize, 10))
+	header.Set(echo.HeaderCacheControl, "no-store")
+}
+
+// ensurePurgeUploadSessionsTrigger creates the trigger that purges every day
+// the expired upload sessions of the instance, if it does not exist yet. The
+// result is kept in cache.
+func ensurePurgeUploadSessionsTrigger(inst *instance.Instance) {
+	cache := config.GetConfig().CacheStorage
+	key := "purge-upload-sessions-trigger:" + inst.Domain
+	if _, ok := cache.Get(key); ok {
+		return
+	}
+
+	sched := job.System()
+	infos := job.TriggerInfos{
+		Type:       "@cron",
+		WorkerType: "purge-upload-sessions",
+	}
+	if sched.HasTrigger(inst, infos) {
+		cache.Set(key, []byte("1"), purgeTriggerCacheTTL)
+		return
+	}
+
+	now := time.Now()
+	hours := (now.Hour() + 12) % 24
+	infos.Arguments = fmt.Sprintf("0 %d %d * * *", now.Minute(), hours)
+	trigger, err := job.NewTrigger(inst, infos, nil)
+	if err != nil {
+		inst.Logger().Errorf("Cannot create purge-upload-sessions trigger: %s", err)
+		return
+	}
+	if err = sched.AddTrigger(trigger); err != nil {
+		inst.Logger().Errorf("Cannot create purge-upload-sessions trigger: %s", err)
+		return
+	}
+	cache.Set(key, []byte("1"), purgeTriggerCacheTTL)
+}
@@ -0,0 +1,35 @@
+package instances
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/model/instance/lifecycle"
+	"github.com/labstack/echo/v4"
+)
+
+func enableFilesEncryption(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := lifecycle.GetInstance(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	if err := lifecycle.EnableFilesEncryption(inst); err != nil {
+		return wrapError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func rotateFilesKey(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := lifecycle.GetInstance(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	reencrypt, _ := strconv.ParseBool(c.QueryParam("Reencrypt"))
+	count, err := lifecycle.RotateFilesKey(inst, reencrypt)
+	if err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{"reencrypted": count})
+}
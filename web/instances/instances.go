@@ -13,6 +13,7 @@ import (
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/instance/lifecycle"
 	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
@@ -368,6 +369,7 @@ type diskUsageResult struct {
 	Versions      int64 `json:"versions,string,omitempty"`
 	VersionsCount int   `json:"versions_count,string,omitempty"`
 	Trashed       int64 `json:"trashed,string,omitempty"`
+	Physical      int64 `json:"physical,string,omitempty"`
 }
 
 func diskUsage(c echo.Context) error {
@@ -401,6 +403,14 @@ func diskUsage(c echo.Context) error {
 		result.Trashed = trashed
 	}
 
+	if dedup, ok := vfs.DeduplicatorOf(fs); ok {
+		physical, err := dedup.PhysicalDiskUsage()
+		if err != nil {
+			return err
+		}
+		result.Physical = physical
+	}
+
 	result.Quota = fs.DiskQuota()
 	if stats, err := couchdb.DBStatus(instance, consts.Files); err == nil {
 		result.Count = stats.DocCount
@@ -485,7 +495,11 @@ func wrapError(err error) error {
 		return jsonapi.BadRequest(err)
 	case instance.ErrInvalidPassphrase:
 		return jsonapi.BadRequest(err)
-	case instance.ErrBadTOSVersion:
+	case instance.ErrBadTOSVersion, instance.ErrTOTPAtCreation:
+		return jsonapi.BadRequest(err)
+	case instance.ErrFilesEncryptionNotEnabled, instance.ErrNoFilesEncryptionKey:
+		return jsonapi.BadRequest(err)
+	case vfs.ErrEncryptionNotSupported:
 		return jsonapi.BadRequest(err)
 	}
 	return err
@@ -529,6 +543,9 @@ func Routes(router *echo.Group) {
 	router.GET("/:domain/swift-prefix", getSwiftBucketName)
 	router.POST("/:domain/auth-mode", setAuthMode)
 	router.POST("/:domain/session_code", createSessionCode)
+	router.POST("/:domain/files-encryption", enableFilesEncryption)
+	router.POST("/:domain/files-encryption/rotate", rotateFilesKey)
+	router.POST("/:domain/sharings/:sharing-id/transfer", transferSharing)
 
 	// Config
 	router.POST("/redis", rebuildRedis)
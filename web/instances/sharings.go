@@ -0,0 +1,48 @@
+package instances
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/model/instance/lifecycle"
+	"github.com/cozy/cozy-stack/model/sharing"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/labstack/echo/v4"
+)
+
+// transferSharing is used by an admin to hand the role of owner of a sharing
+// to the recipient with the given email address, for example when the owner
+// is leaving.
+func transferSharing(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := lifecycle.GetInstance(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	s, err := sharing.FindSharing(inst, c.Param("sharing-id"))
+	if err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return jsonapi.NotFound(err)
+		}
+		return wrapError(err)
+	}
+	email := c.QueryParam("Email")
+	index := -1
+	for i, m := range s.Members {
+		if i > 0 && email != "" && m.Email == email {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return jsonapi.InvalidParameter("Email", errors.New("No member with this email address"))
+	}
+	if err = s.TransferOwnership(inst, index); err != nil {
+		if err == sharing.ErrInvalidSharing {
+			return jsonapi.BadRequest(err)
+		}
+		return wrapError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,91 @@
+package jobs
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/labstack/echo/v4"
+)
+
+func listDeadJobs(c echo.Context) error {
+	list, err := job.ListDeadJobs(c.QueryParam("Domain"), c.QueryParam("Worker"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func replayDeadJob(c echo.Context) error {
+	dead, err := job.GetDeadJob(c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	j, err := dead.Replay(job.System())
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusAccepted, apiJob{j}, nil)
+}
+
+func dropDeadJob(c echo.Context) error {
+	dead, err := job.GetDeadJob(c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err := dead.Drop(); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func replayDeadJobs(c echo.Context) error {
+	list, err := job.ListDeadJobs(c.QueryParam("Domain"), c.QueryParam("Worker"))
+	if err != nil {
+		return err
+	}
+	var errm error
+	replayed := 0
+	for _, dead := range list {
+		if _, err := dead.Replay(job.System()); err != nil {
+			errm = multierror.Append(errm, err)
+			continue
+		}
+		replayed++
+	}
+	if errm != nil {
+		return jsonapi.InternalServerError(errm)
+	}
+	return c.JSON(http.StatusOK, map[string]int{"replayed": replayed})
+}
+
+func dropDeadJobs(c echo.Context) error {
+	list, err := job.ListDeadJobs(c.QueryParam("Domain"), c.QueryParam("Worker"))
+	if err != nil {
+		return err
+	}
+	var errm error
+	dropped := 0
+	for _, dead := range list {
+		if err := dead.Drop(); err != nil {
+			errm = multierror.Append(errm, err)
+			continue
+		}
+		dropped++
+	}
+	if errm != nil {
+		return jsonapi.InternalServerError(errm)
+	}
+	return c.JSON(http.StatusOK, map[string]int{"dropped": dropped})
+}
+
+// AdminRoutes sets the routing for the admin interface to manage the
+// dead-letter queue of the jobs.
+func AdminRoutes(router *echo.Group) {
+	router.GET("/dlq", listDeadJobs)
+	router.DELETE("/dlq", dropDeadJobs)
+	router.POST("/dlq/replay", replayDeadJobs)
+	router.POST("/dlq/:job-id/replay", replayDeadJob)
+	router.DELETE("/dlq/:job-id", dropDeadJob)
+}
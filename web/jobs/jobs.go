@@ -28,6 +28,7 @@ import (
 
 	// import workers
 	_ "github.com/cozy/cozy-stack/worker/archive"
+	_ "github.com/cozy/cozy-stack/worker/files"
 	_ "github.com/cozy/cozy-stack/worker/log"
 	_ "github.com/cozy/cozy-stack/worker/mails"
 	_ "github.com/cozy/cozy-stack/worker/migrations"
@@ -47,10 +48,12 @@ type (
 		j *job.Job
 	}
 	apiJobRequest struct {
-		Arguments   json.RawMessage `json:"arguments"`
-		Manual      bool            `json:"manual"`
-		ForwardLogs bool            `json:"forward_logs"`
-		Options     *job.JobOptions `json:"options"`
+		Arguments   json.RawMessage    `json:"arguments"`
+		Manual      bool               `json:"manual"`
+		ForwardLogs bool               `json:"forward_logs"`
+		Options     *job.JobOptions    `json:"options"`
+		OnSuccess   []*job.JobFollowUp `json:"on_success"`
+		OnFailure   []*job.JobFollowUp `json:"on_failure"`
 	}
 	apiSupport struct {
 		Arguments map[string]string `json:"arguments"`
@@ -68,13 +71,15 @@ type (
 		s *job.TriggerState
 	}
 	apiTriggerRequest struct {
-		Type            string          `json:"type"`
-		Arguments       string          `json:"arguments"`
-		WorkerType      string          `json:"worker"`
-		Message         json.RawMessage `json:"message"`
-		WorkerArguments json.RawMessage `json:"worker_arguments"`
-		Debounce        string          `json:"debounce"`
-		Options         *job.JobOptions `json:"options"`
+		Type            string              `json:"type"`
+		Arguments       string              `json:"arguments"`
+		WorkerType      string              `json:"worker"`
+		Message         json.RawMessage     `json:"message"`
+		WorkerArguments json.RawMessage     `json:"worker_arguments"`
+		Debounce        string              `json:"debounce"`
+		Timezone        string              `json:"timezone"`
+		Condition       *job.EventCondition `json:"condition"`
+		Options         *job.JobOptions     `json:"options"`
 	}
 )
 
@@ -183,11 +188,20 @@ func pushJob(c echo.Context) error {
 		Manual:      req.Manual,
 		ForwardLogs: req.ForwardLogs,
 		Message:     job.Message(req.Arguments),
+		OnSuccess:   req.OnSuccess,
+		OnFailure:   req.OnFailure,
 	}
 
 	if err := middlewares.Allow(c, permission.POST, jr); err != nil {
 		return err
 	}
+	if err := job.ValidateOptions(jr.Options); err != nil {
+		return jsonapi.InvalidAttribute("options", err)
+	}
+	if attr, err := job.ValidateFollowUps(jr.OnSuccess, jr.OnFailure); err != nil {
+		return jsonapi.InvalidAttribute(attr, err)
+	}
+	followUps := append(append([]*job.JobFollowUp{}, jr.OnSuccess...), jr.OnFailure...)
 
 	permd, err := middlewares.GetPermission(c)
 	if err != nil {
@@ -202,6 +216,21 @@ func pushJob(c echo.Context) error {
 		}
 	}
 
+	// The follow-ups are checked like the jobs that are pushed directly
+	err = job.WalkFollowUps(followUps, func(f *job.JobFollowUp) error {
+		fr := &job.JobRequest{WorkerType: f.WorkerType, Message: f.Message}
+		if err := middlewares.Allow(c, permission.POST, fr); err != nil {
+			return err
+		}
+		if permd.Type != permission.TypeCLI {
+			return checkReservedWorker(f.WorkerType)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
 	j, err := job.System().PushJob(instance, jr)
 	if err != nil {
 		return wrapJobsError(err)
@@ -259,6 +288,9 @@ func newTrigger(c echo.Context) error {
 			return jsonapi.InvalidAttribute("debounce", err)
 		}
 	}
+	if err := job.ValidateOptions(req.Options); err != nil {
+		return jsonapi.InvalidAttribute("options", err)
+	}
 
 	// Handle metadata
 	md := metadata.New()
@@ -280,6 +312,8 @@ func newTrigger(c echo.Context) error {
 		Domain:     instance.Domain,
 		Arguments:  req.Arguments,
 		Debounce:   req.Debounce,
+		Timezone:   req.Timezone,
+		Condition:  req.Condition,
 		Options:    req.Options,
 		Metadata:   md,
 	}, msg)
@@ -577,6 +611,48 @@ func getJob(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, apiJob{j}, nil)
 }
 
+func getJobLogs(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	j, err := job.Get(inst, c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err := middlewares.Allow(c, permission.GET, j); err != nil {
+		return err
+	}
+
+	logs, err := job.GetLogs(inst, j.ID())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, logs)
+}
+
+func getWorkflow(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	j, err := job.Get(inst, c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err := middlewares.Allow(c, permission.GET, j); err != nil {
+		return err
+	}
+
+	js, err := job.GetWorkflow(inst, j.ID())
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	// The jobs of the workflow for other workers may be hidden by the
+	// permissions
+	objs := make([]jsonapi.Object, 0, len(js))
+	for _, j := range js {
+		if middlewares.Allow(c, permission.GET, j) == nil {
+			objs = append(objs, apiJob{j})
+		}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
 func patchJob(c echo.Context) error {
 	inst := middlewares.GetInstance(c)
 	j, err := job.Get(inst, c.Param("job-id"))
@@ -614,6 +690,27 @@ func patchJob(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, apiJob{j}, nil)
 }
 
+func cancelJob(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	j, err := job.Get(inst, c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err := middlewares.Allow(c, permission.POST, j); err != nil {
+		return err
+	}
+	j, err = job.System().CancelJob(inst, j.ID())
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	// The execution of a running job is stopped asynchronously
+	status := http.StatusOK
+	if j.State != job.Cancelled {
+		status = http.StatusAccepted
+	}
+	return jsonapi.Data(c, status, apiJob{j}, nil)
+}
+
 func cleanJobs(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	if err := middlewares.AllowWholeType(c, permission.POST, consts.Jobs); err != nil {
@@ -744,7 +841,47 @@ func purgeJobs(c echo.Context) error {
 		}
 	}
 
-	return c.JSON(http.StatusOK, map[string]int{"deleted": len(jobsToDelete)})
+	// Step 4: the jobs of the instance in the dead-letter queue are purged
+	// with the same rules, except the minimum number of jobs to keep.
+	deadDeleted, err := job.PurgeDeadJobs(instance.Domain, workers, d)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]int{
+		"deleted":      len(jobsToDelete),
+		"dead_deleted": deadDeleted,
+	})
+}
+
+func getStats(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	if err := middlewares.AllowWholeType(c, permission.GET, consts.Jobs); err != nil {
+		return err
+	}
+
+	dur := 24 * time.Hour
+	if durationParam := c.QueryParam("duration"); durationParam != "" {
+		var err error
+		dur, err = bigduration.ParseDuration(durationParam)
+		if err != nil {
+			return jsonapi.InvalidParameter("duration", err)
+		}
+	}
+	var workers []string
+	if workersParam := c.QueryParam("workers"); workersParam != "" {
+		workers = strings.Split(workersParam, ",")
+	}
+
+	since := time.Now().Add(-dur)
+	stats, err := job.GetStats(instance, since, workers)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"since":   since,
+		"workers": stats,
+	})
 }
 
 // Routes sets the routing for the jobs service
@@ -767,8 +904,12 @@ func Routes(router *echo.Group) {
 
 	router.POST("/clean", cleanJobs)
 	router.DELETE("/purge", purgeJobs)
+	router.GET("/stats", getStats)
 	router.GET("/:job-id", getJob)
+	router.GET("/:job-id/workflow", getWorkflow)
+	router.GET("/:job-id/logs", getJobLogs)
 	router.PATCH("/:job-id", patchJob)
+	router.POST("/:job-id/cancel", cancelJob)
 }
 
 func wrapJobsError(err error) error {
@@ -783,6 +924,8 @@ func wrapJobsError(err error) error {
 	case limits.ErrRateLimitReached,
 		limits.ErrRateLimitExceeded:
 		return jsonapi.BadRequest(err)
+	case job.ErrNotCancellable:
+		return jsonapi.Conflict(err)
 	}
 	return err
 }
@@ -189,20 +189,43 @@ func ExtractClaims(c echo.Context, instance *instance.Instance, token string) (*
 	return &claims, nil
 }
 
+// resolveShortcode returns the sharecode for a shortcode, or the token
+// unchanged if it is not a shortcode.
+func resolveShortcode(instance *instance.Instance, token string) (string, error) {
+	if !shortCodeRegexp.MatchString(token) {
+		return token, nil
+	}
+	// XXX in theory, the shortcode is exactly 12 characters. But
+	// somethimes, when people shares a public link with this token, they
+	// can put a "." just after the link to finish their sentence, and this
+	// "." can be added to the token. So, it's better to accept a shortcode
+	// with a final ".", and clean it.
+	token = strings.TrimSuffix(token, ".")
+	return permission.GetTokenFromShortcode(instance, token)
+}
+
+// GetShareByLinkForCode returns the permission document of a share by link
+// for a sharecode or a shortcode, without checking its password.
+func GetShareByLinkForCode(instance *instance.Instance, code string) (*permission.Permission, error) {
+	token, err := resolveShortcode(instance, code)
+	if err != nil {
+		return nil, err
+	}
+	pdoc, err := permission.GetForShareCode(instance, token)
+	if err != nil {
+		return nil, err
+	}
+	if pdoc.Type != permission.TypeShareByLink {
+		return nil, permission.ErrInvalidToken
+	}
+	return pdoc, nil
+}
+
 // ParseJWT parses a JSON Web Token, and returns the associated permissions.
 func ParseJWT(c echo.Context, instance *instance.Instance, token string) (*permission.Permission, error) {
-	if shortCodeRegexp.MatchString(token) { // token is a shortcode
-		var err error
-		// XXX in theory, the shortcode is exactly 12 characters. But
-		// somethimes, when people shares a public link with this token, they
-		// can put a "." just after the link to finish their sentence, and this
-		// "." can be added to the token. So, it's better to accept a shortcode
-		// with a final ".", and clean it.
-		token = strings.TrimSuffix(token, ".")
-		token, err = permission.GetTokenFromShortcode(instance, token)
-		if err != nil {
-			return nil, err
-		}
+	token, err := resolveShortcode(instance, token)
+	if err != nil {
+		return nil, err
 	}
 
 	claims, err := ExtractClaims(c, instance, token)
@@ -279,6 +302,31 @@ func ParseJWT(c echo.Context, instance *instance.Instance, token string) (*permi
 			}
 		}
 
+		if pdoc.Type == permission.TypeShareByLink {
+			if pdoc.HasPassword() {
+				return nil, permission.ErrPasswordRequired
+			}
+			if pdoc.Exhausted() {
+				return nil, permission.ErrTooManyUses
+			}
+		}
+
+		return pdoc, nil
+
+	case consts.UnlockedShareAudience:
+		// The password of a share by link has been checked, and the subject
+		// is the ID of the permission document
+		pdoc, err := permission.GetByID(instance, claims.Subject)
+		if err == permission.ErrExpiredToken {
+			return nil, err
+		}
+		if err != nil || pdoc.Type != permission.TypeShareByLink ||
+			claims.Scope != pdoc.PasswordStamp() {
+			return nil, permission.ErrInvalidToken
+		}
+		if pdoc.Exhausted() {
+			return nil, permission.ErrTooManyUses
+		}
 		return pdoc, nil
 
 	default:
@@ -314,6 +362,17 @@ func GetPermission(c echo.Context) (*permission.Permission, error) {
 	return pdoc, nil
 }
 
+// AddShareByLinkDownload counts a download for the share by link used for
+// the current request, if any. It returns an error if the maximal number of
+// downloads for this link has been exceeded.
+func AddShareByLinkDownload(c echo.Context) error {
+	pdoc, err := GetPermission(c)
+	if err != nil || pdoc.Type != permission.TypeShareByLink {
+		return nil
+	}
+	return pdoc.AddDownload(GetInstance(c))
+}
+
 // AllowWholeType validates that the context permission set can use a verb on
 // the whold doctype
 func AllowWholeType(c echo.Context, v permission.Verb, doctype string) error {
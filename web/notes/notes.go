@@ -62,6 +62,10 @@ func CreateNote(c echo.Context) error {
 		if err := middlewares.AllowVFS(c, permission.POST, fileDoc); err != nil {
 			return err
 		}
+		// The limits of a file drop are not checked for the notes
+		if err := files.ForbidFileDrop(c); err != nil {
+			return err
+		}
 	}
 
 	file, err := note.Create(inst, doc)
@@ -353,6 +357,9 @@ func UploadImage(c echo.Context) error {
 	if err := middlewares.AllowVFS(c, permission.POST, doc); err != nil {
 		return err
 	}
+	if err := files.ForbidFileDrop(c); err != nil {
+		return err
+	}
 
 	// Check that the uploaded file is an image
 	contentType := c.Request().Header.Get(echo.HeaderContentType)
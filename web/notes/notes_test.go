@@ -15,6 +15,8 @@ import (
 
 	"github.com/cozy/cozy-stack/model/instance"
 	"github.com/cozy/cozy-stack/model/note"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/realtime"
@@ -25,6 +27,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var ts *httptest.Server
@@ -851,6 +854,66 @@ Text with **bold** and [underlined]{.underlined}.
 	assert.Equal(t, inst.Domain, attrs["instance"])
 }
 
+func TestFileDropCannotUseNotes(t *testing.T) {
+	dir, err := vfs.Mkdir(inst.VFS(), "/filedropnotes", nil)
+	require.NoError(t, err)
+	code, err := inst.CreateShareCode("filedropnotes")
+	require.NoError(t, err)
+	rules := permission.Set{
+		permission.Rule{
+			Type:   consts.Files,
+			Verbs:  permission.Verbs(permission.POST),
+			Values: []string{dir.ID()},
+		},
+	}
+	parent := &permission.Permission{Type: permission.TypeWebapp, Permissions: rules}
+	perms := permission.Permission{Permissions: rules, FileDrop: &permission.FileDrop{}}
+	_, err = permission.CreateShareSet(inst, parent, "", map[string]string{"filedropnotes": code}, nil, perms, nil)
+	require.NoError(t, err)
+
+	// A note cannot be created in the directory of the file drop
+	body := `{
+  "data": {
+    "type": "io.cozy.notes.documents",
+    "attributes": { "title": "A dropped note", "dir_id": "` + dir.ID() + `" }
+  }
+}`
+	req, _ := http.NewRequest("POST", ts.URL+"/notes", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+code)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res.StatusCode)
+	res.Body.Close()
+
+	// An image cannot be added to a note of this directory
+	buf := strings.NewReader("# Title\n\nSome text\n")
+	path := "/files/" + dir.ID() + "?Type=file&Name=owner.cozy-note"
+	req, _ = http.NewRequest("POST", ts.URL+path, buf)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req.Header.Add("Content-Type", "text/plain")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	res.Body.Close()
+	require.NoError(t, err)
+	data, _ := result["data"].(map[string]interface{})
+	id, _ := data["id"].(string)
+
+	f, err := os.Open("../../tests/fixtures/wet-cozy_20160910__M4Dz.jpg")
+	require.NoError(t, err)
+	defer f.Close()
+	req, _ = http.NewRequest("POST", ts.URL+"/notes/"+id+"/images?Name=wet.jpg", f)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+code)
+	req.Header.Add("Content-Type", "image/jpeg")
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res.StatusCode)
+	res.Body.Close()
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
@@ -136,7 +136,7 @@ func Login(c echo.Context) error {
 
 		// Check 2FA if enabled, and if yes, render an HTML page to check if
 		// the browser has a trusted device token in its local storage.
-		if inst.HasAuthMode(instance.TwoFactorMail) {
+		if inst.HasTwoFactorAuth() {
 			return c.Render(http.StatusOK, "oidc_twofactor.html", echo.Map{
 				"Domain":      inst.ContextualDomain(),
 				"AccessToken": token,
@@ -172,7 +172,7 @@ func TwoFactor(c echo.Context) error {
 		return createSessionAndRedirect(c, inst, redirect, confirm)
 	}
 
-	twoFactorToken, err := lifecycle.SendTwoFactorPasscode(inst)
+	twoFactorToken, err := lifecycle.StartTwoFactorAuth(inst)
 	if err != nil {
 		return err
 	}
@@ -42,6 +42,12 @@ type APIPermission struct {
 
 // MarshalJSON implements jsonapi.Doc
 func (p *APIPermission) MarshalJSON() ([]byte, error) {
+	if p.Permission.HasPassword() {
+		// The hash of the password is never sent to the clients
+		cloned := *p.Permission
+		cloned.Password = true
+		return json.Marshal(&cloned)
+	}
 	return json.Marshal(p.Permission)
 }
 
@@ -308,14 +314,27 @@ func patchPermission(getPerms getPermsFunc, paramName string) echo.HandlerFunc {
 		}
 
 		var patch permission.Permission
-		if _, err = jsonapi.Bind(c.Request().Body, &patch); err != nil {
+		obj, err := jsonapi.Bind(c.Request().Body, &patch)
+		if err != nil {
 			return err
 		}
+		// The password and the maximal number of uses can be removed, so we
+		// need to know if they were present in the request
+		var patchLink struct {
+			Password *string `json:"password"`
+			MaxUses  *int    `json:"max_uses"`
+		}
+		if obj.Attributes != nil {
+			if err = json.Unmarshal(*obj.Attributes, &patchLink); err != nil {
+				return jsonapi.BadJSON()
+			}
+		}
 
 		patchSet := patch.Permissions != nil && len(patch.Permissions) > 0
 		patchCodes := len(patch.Codes) > 0
+		patchOptions := patchLink.Password != nil || patchLink.MaxUses != nil
 
-		if patchCodes == patchSet {
+		if patchSet == (patchCodes || patchOptions) {
 			return ErrPatchCodeOrSet
 		}
 
@@ -331,7 +350,27 @@ func patchPermission(getPerms getPermsFunc, paramName string) echo.HandlerFunc {
 			toPatch.PatchCodes(patch.Codes)
 		}
 
+		if patchOptions {
+			if toPatch.Type != permission.TypeShareByLink || !current.CanUpdateShareByLink(toPatch) {
+				return permission.ErrNotParent
+			}
+			if patchLink.Password != nil {
+				if err = toPatch.SetPassword(*patchLink.Password); err != nil {
+					return err
+				}
+			}
+			if patchLink.MaxUses != nil {
+				if err = toPatch.SetMaxUses(*patchLink.MaxUses); err != nil {
+					return err
+				}
+			}
+		}
+
 		if patchSet {
+			// The rules of a file drop can't be changed, only revoked
+			if toPatch.FileDrop != nil {
+				return permission.ErrInvalidFileDrop
+			}
 			for _, r := range patch.Permissions {
 				if r.Type == "" {
 					toPatch.RemoveRule(r)
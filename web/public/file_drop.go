@@ -0,0 +1,65 @@
+package public
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/web/auth"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// FileDrop shows a minimal page where a visitor with a file drop link can
+// upload files, without seeing the content of the directory.
+func FileDrop(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharecode := c.QueryParam("sharecode")
+
+	perm, err := middlewares.ParseJWT(c, inst, sharecode)
+	switch err {
+	case nil:
+	case permission.ErrPasswordRequired:
+		redirect, _ := url.Parse(inst.PageURL("/public/file-drop", url.Values{
+			"sharecode": {sharecode},
+		}))
+		return c.Redirect(http.StatusFound, auth.ShareByLinkPasswordURL(inst, sharecode, redirect))
+	default:
+		perm = nil
+	}
+	if perm == nil || !perm.IsFileDrop() {
+		return c.Render(http.StatusNotFound, "error.html", echo.Map{
+			"Domain":       inst.ContextualDomain(),
+			"ContextName":  inst.ContextName,
+			"Locale":       inst.Locale,
+			"Title":        inst.TemplateTitle(),
+			"Favicon":      middlewares.Favicon(inst),
+			"Illustration": "/images/generic-error.svg",
+			"Error":        "Share by link not found",
+			"SupportEmail": inst.SupportEmailAddress(),
+		})
+	}
+
+	publicName, err := inst.PublicName()
+	if err != nil {
+		publicName = ""
+	}
+	remaining := -1
+	if perm.FileDrop.MaxFiles > 0 {
+		remaining = perm.FileDrop.MaxFiles - perm.FileDrop.Files
+		if remaining < 0 {
+			remaining = 0
+		}
+	}
+	return c.Render(http.StatusOK, "file_drop.html", echo.Map{
+		"Domain":      inst.ContextualDomain(),
+		"ContextName": inst.ContextName,
+		"Locale":      inst.Locale,
+		"Title":       inst.TemplateTitle(),
+		"Favicon":     middlewares.Favicon(inst),
+		"PublicName":  publicName,
+		"Sharecode":   sharecode,
+		"DirID":       perm.FileDropDirID(),
+		"Remaining":   remaining,
+	})
+}
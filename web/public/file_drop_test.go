@@ -0,0 +1,117 @@
+package public_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/instance/lifecycle"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
+	build "github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/cozy/cozy-stack/web/errors"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/public"
+	"github.com/cozy/cozy-stack/web/statik"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+
+// createShareByLink creates a share by link for creating files in a new
+// directory, and returns the sharecode of the link.
+func createShareByLink(t *testing.T, name string, subdoc permission.Permission) string {
+	dir, err := vfs.Mkdir(testInstance.VFS(), "/"+name, nil)
+	require.NoError(t, err)
+	code, err := testInstance.CreateShareCode(name)
+	require.NoError(t, err)
+	subdoc.Permissions = permission.Set{
+		permission.Rule{
+			Type:   consts.Files,
+			Verbs:  permission.Verbs(permission.POST),
+			Values: []string{dir.ID()},
+		},
+	}
+	parent := &permission.Permission{Type: permission.TypeWebapp, Permissions: subdoc.Permissions}
+	_, err = permission.CreateShareSet(testInstance, parent, "", map[string]string{name: code}, nil, subdoc, nil)
+	require.NoError(t, err)
+	return code
+}
+
+func getFileDropPage(t *testing.T, sharecode string) (*http.Response, string) {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(ts.URL + "/public/file-drop?sharecode=" + url.QueryEscape(sharecode))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body)
+}
+
+func TestFileDropPage(t *testing.T) {
+	code := createShareByLink(t, "droppage", permission.Permission{
+		FileDrop: &permission.FileDrop{MaxFiles: 3},
+	})
+	res, body := getFileDropPage(t, code)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, body, `id="file-drop-form"`)
+	assert.Contains(t, body, "<title>"+testInstance.TemplateTitle()+"</title>")
+	perm, err := permission.GetForShareCode(testInstance, code)
+	require.NoError(t, err)
+	assert.Contains(t, body, `data-dir-id="`+perm.FileDropDirID()+`"`)
+	assert.Contains(t, body, "File drop remaining")
+}
+
+func TestFileDropPageNotFound(t *testing.T) {
+	// A share by link that is not a file drop has no drop page
+	code := createShareByLink(t, "notadrop", permission.Permission{})
+	res, body := getFileDropPage(t, code)
+	assert.Equal(t, 404, res.StatusCode)
+	assert.NotContains(t, body, `id="file-drop-form"`)
+
+	res, _ = getFileDropPage(t, "not-a-sharecode")
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestFileDropPageWithPassword(t *testing.T) {
+	code := createShareByLink(t, "droppassword", permission.Permission{
+		FileDrop: &permission.FileDrop{},
+		Password: "secret",
+	})
+	res, body := getFileDropPage(t, code)
+	assert.Equal(t, 302, res.StatusCode)
+	assert.NotContains(t, body, `id="file-drop-form"`)
+	assert.NotEmpty(t, res.Header.Get(echo.HeaderLocation))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	build.BuildMode = build.ModeDev
+	config.GetConfig().Assets = "../../assets"
+	testutils.NeedCouchdb()
+	render, _ := statik.NewDirRenderer("../../assets")
+	middlewares.BuildTemplates()
+
+	setup := testutils.NewSetup(m, "public_test")
+	testInstance = setup.GetTestInstance(&lifecycle.Options{
+		PublicName: "Alice",
+	})
+	ts = setup.GetTestServer("/public", public.Routes)
+	ts.Config.Handler.(*echo.Echo).Renderer = render
+	ts.Config.Handler.(*echo.Echo).HTTPErrorHandler = errors.ErrorHandler
+	os.Exit(setup.Run())
+}
@@ -68,4 +68,5 @@ func Routes(router *echo.Group) {
 	})
 	router.GET("/avatar", Avatar, cacheControl)
 	router.GET("/prelogin", Prelogin)
+	router.GET("/file-drop", FileDrop)
 }
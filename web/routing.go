@@ -43,6 +43,7 @@ import (
 	"github.com/cozy/cozy-stack/web/status"
 	"github.com/cozy/cozy-stack/web/swift"
 	"github.com/cozy/cozy-stack/web/version"
+	"github.com/cozy/cozy-stack/web/webdav"
 	"github.com/cozy/cozy-stack/web/wellknown"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -288,6 +289,7 @@ func SetupAdminRoutes(router *echo.Echo) error {
 
 	instances.Routes(router.Group("/instances", mws...))
 	apps.AdminRoutes(router.Group("/konnectors", mws...))
+	jobs.AdminRoutes(router.Group("/jobs", mws...))
 	version.Routes(router.Group("/version", mws...))
 	metrics.Routes(router.Group("/metrics", mws...))
 	oauth.Routes(router.Group("/oauth", mws...))
@@ -318,6 +320,7 @@ func CreateSubdomainProxy(router *echo.Echo, appsHandler echo.HandlerFunc) (*ech
 	main.HideBanner = true
 	main.HidePort = true
 	main.Renderer = router.Renderer
+	main.Pre(webdavRouting)
 	main.Any("/*", firstRouting(router, appsHandler))
 
 	main.HTTPErrorHandler = errors.HTMLErrorHandler
@@ -349,6 +352,30 @@ func firstRouting(router *echo.Echo, appsHandler echo.HandlerFunc) echo.HandlerF
 	}
 }
 
+// webdavRouting is a pre-middleware that handles the WebDAV requests. It can't
+// be a normal route, as the echo router does not know the WebDAV methods like
+// MKCOL or PROPPATCH.
+func webdavRouting(next echo.HandlerFunc) echo.HandlerFunc {
+	handler := middlewares.Compose(webdav.Handler,
+		middlewares.NeedInstance,
+		middlewares.CheckInstanceBlocked,
+		middlewares.CheckInstanceDeleting,
+	)
+	return func(c echo.Context) error {
+		if !webdav.IsWebDAVRequest(c.Request().URL.Path) {
+			return next(c)
+		}
+		host, err := idna.ToUnicode(c.Request().Host)
+		if err != nil {
+			return err
+		}
+		if _, slug, _ := config.SplitCozyHost(host); slug != "" {
+			return next(c)
+		}
+		return handler(c)
+	}
+}
+
 // setupRecover sets a recovering strategy of panics happening in handlers
 func setupRecover(router *echo.Echo) {
 	if !build.IsDevRelease() {
@@ -140,6 +140,46 @@ func TestParseHost(t *testing.T) {
 	}
 }
 
+func TestWebDAVRouting(t *testing.T) {
+	apis := echo.New()
+	api := func(c echo.Context) error {
+		return c.String(http.StatusOK, "API")
+	}
+	apis.GET("/dav/filesystem", api)
+	apis.GET("/test/dav/files", api)
+
+	router, err := CreateSubdomainProxy(apis, func(c echo.Context) error {
+		slug := c.Get("slug").(string)
+		return c.String(200, "OK:"+slug)
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The WebDAV requests are handled before the echo router, even with the
+	// methods that it does not know
+	for _, method := range []string{"PROPFIND", "MKCOL", http.MethodGet} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "https://"+domain+"/dav/files/", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, method)
+		assert.Equal(t, `Basic realm="Cozy"`, w.Header().Get(echo.HeaderWWWAuthenticate))
+	}
+
+	urls := map[string]string{
+		"https://" + domain + "/dav/filesystem": "API",
+		"https://" + domain + "/test/dav/files": "API",
+		"https://foo." + domain + "/dav/files/": "OK:foo",
+	}
+	for u, k := range urls {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", u, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, u)
+		assert.Equal(t, k, w.Body.String(), u)
+	}
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	config.GetConfig().Assets = "../assets"
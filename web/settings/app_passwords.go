@@ -0,0 +1,103 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/model/apppassword"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+type apiAppPassword struct{ *apppassword.AppPassword }
+
+// MarshalJSON does not include the hash of the secret
+func (p *apiAppPassword) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		*apppassword.AppPassword
+		Hash []byte `json:"hash,omitempty"`
+	}{AppPassword: p.AppPassword})
+}
+
+// Links is used to generate a JSON-API link for the application password -
+// see jsonapi.Object interface
+func (p *apiAppPassword) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/app-passwords/" + p.ID()}
+}
+
+// Relationships is part of the jsonapi.Object interface
+func (p *apiAppPassword) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Included is part of the jsonapi.Object interface
+func (p *apiAppPassword) Included() []jsonapi.Object { return nil }
+
+func listAppPasswords(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permission.GET, consts.Settings); err != nil {
+		return err
+	}
+
+	list, err := apppassword.List(inst)
+	if err != nil {
+		return err
+	}
+	objs := make([]jsonapi.Object, len(list))
+	for i, p := range list {
+		objs[i] = &apiAppPassword{p}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+func createAppPassword(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	// An application password gives access to all the files, so it is
+	// restricted to the owner of the instance.
+	if !middlewares.IsLoggedIn(c) {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	if err := middlewares.AllowWholeType(c, permission.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	args := struct {
+		Name string `json:"name"`
+	}{}
+	if err := c.Bind(&args); err != nil {
+		return jsonapi.BadJSON()
+	}
+
+	p, err := apppassword.Create(inst, args.Name)
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiAppPassword{p}, nil)
+}
+
+func revokeAppPassword(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if !middlewares.IsLoggedIn(c) {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	if err := middlewares.AllowWholeType(c, permission.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	p, err := apppassword.Find(inst, c.Param("id"))
+	if err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return jsonapi.NotFound(err)
+		}
+		return err
+	}
+	if err := p.Revoke(inst); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/jsonapi"
@@ -19,6 +20,7 @@ type apiDiskUsage struct {
 	Files    int64  `json:"files,string"`
 	Trash    *int64 `json:"trash,string,omitempty"`
 	Versions int64  `json:"versions,string"`
+	Physical *int64 `json:"physical,string,omitempty"`
 }
 
 func (j *apiDiskUsage) ID() string                             { return consts.DiskUsageID }
@@ -84,5 +86,10 @@ func diskUsage(c echo.Context) error {
 	result.Quota = quota
 	result.Files = files
 	result.Versions = versions
+	if dedup, ok := vfs.DeduplicatorOf(fs); ok {
+		if physical, err := dedup.PhysicalDiskUsage(); err == nil {
+			result.Physical = &physical
+		}
+	}
 	return jsonapi.Data(c, http.StatusOK, &result, nil)
 }
@@ -3,7 +3,11 @@
 package settings
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"image/png"
 	"net/http"
 
 	"github.com/cozy/cozy-stack/model/instance"
@@ -159,6 +163,18 @@ func updateInstanceAuthMode(c echo.Context) error {
 		if ok := inst.ValidateMailConfirmationCode(args.TwoFactorActivationCode); !ok {
 			return c.NoContent(http.StatusUnprocessableEntity)
 		}
+	case instance.TwoFactorTOTP:
+		if args.TwoFactorActivationCode == "" {
+			return jsonapi.BadRequest(errors.New("Missing two_factor_activation_code"))
+		}
+		codes, err := lifecycle.EnableTOTP(inst, args.TwoFactorActivationCode)
+		if err == instance.ErrInvalidTwoFactor {
+			return c.NoContent(http.StatusUnprocessableEntity)
+		}
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, echo.Map{"recovery_codes": codes})
 	}
 
 	err = lifecycle.Patch(inst, &lifecycle.Options{AuthMode: args.AuthMode})
@@ -169,6 +185,51 @@ func updateInstanceAuthMode(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
+func enrollTOTP(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permission.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	key, err := lifecycle.NewTOTPKey(inst)
+	if err != nil {
+		return err
+	}
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	qrCode := "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"secret":  key.Secret(),
+		"url":     key.URL(),
+		"qr_code": qrCode,
+	})
+}
+
+func regenerateRecoveryCodes(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permission.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	codes, err := lifecycle.RegenerateRecoveryCodes(inst)
+	if err == instance.ErrTOTPNotEnrolled {
+		return jsonapi.PreconditionFailed("auth_mode", err)
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{"recovery_codes": codes})
+}
+
 func clearMovedFrom(c echo.Context) error {
 	if !middlewares.IsLoggedIn(c) {
 		return echo.NewHTTPError(http.StatusForbidden)
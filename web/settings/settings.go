@@ -95,6 +95,8 @@ func Routes(router *echo.Group) {
 	router.GET("/instance", getInstance)
 	router.PUT("/instance", updateInstance)
 	router.PUT("/instance/auth_mode", updateInstanceAuthMode)
+	router.POST("/instance/auth_mode/totp", enrollTOTP)
+	router.POST("/instance/auth_mode/recovery_codes", regenerateRecoveryCodes)
 	router.PUT("/instance/sign_tos", updateInstanceTOS)
 	router.DELETE("/instance/moved_from", clearMovedFrom)
 
@@ -102,6 +104,15 @@ func Routes(router *echo.Group) {
 
 	router.GET("/sessions", getSessions)
 
+	router.GET("/webauthn", listWebAuthnCredentials)
+	router.POST("/webauthn/options", webAuthnCreationOptions)
+	router.POST("/webauthn", registerWebAuthnCredential)
+	router.DELETE("/webauthn/:id", deleteWebAuthnCredential)
+
+	router.GET("/app-passwords", listAppPasswords)
+	router.POST("/app-passwords", createAppPassword)
+	router.DELETE("/app-passwords/:id", revokeAppPassword)
+
 	router.GET("/clients", listClients)
 	router.DELETE("/clients/:id", revokeClient)
 	router.POST("/synchronized", synchronized)
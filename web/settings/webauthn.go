@@ -0,0 +1,128 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/webauthn"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+type apiCredential struct{ *webauthn.Credential }
+
+func (c *apiCredential) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Credential)
+}
+
+// Links is used to generate a JSON-API link for the credential - see
+// jsonapi.Object interface
+func (c *apiCredential) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/webauthn/" + c.ID()}
+}
+
+// Relationships is part of the jsonapi.Object interface
+func (c *apiCredential) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Included is part of the jsonapi.Object interface
+func (c *apiCredential) Included() []jsonapi.Object { return nil }
+
+func listWebAuthnCredentials(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permission.GET, consts.Settings); err != nil {
+		return err
+	}
+
+	creds, err := webauthn.List(inst)
+	if err != nil {
+		return err
+	}
+	objs := make([]jsonapi.Object, len(creds))
+	for i, cred := range creds {
+		objs[i] = &apiCredential{cred}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+func webAuthnCreationOptions(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	// Registering a credential gives a new way to log in, so it is restricted
+	// to the owner of the instance.
+	if !middlewares.IsLoggedIn(c) {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	if err := middlewares.AllowWholeType(c, permission.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	opts, err := webauthn.NewCreationOptions(inst)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{"publicKey": opts})
+}
+
+func registerWebAuthnCredential(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if !middlewares.IsLoggedIn(c) {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	if err := middlewares.AllowWholeType(c, permission.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	args := struct {
+		Name       string          `json:"name"`
+		Credential json.RawMessage `json:"credential"`
+	}{}
+	if err := c.Bind(&args); err != nil {
+		return jsonapi.BadJSON()
+	}
+
+	cred, err := webauthn.Register(inst, args.Name, args.Credential)
+	if err != nil {
+		return wrapWebAuthnError(err)
+	}
+	return jsonapi.Data(c, http.StatusCreated, &apiCredential{cred}, nil)
+}
+
+func deleteWebAuthnCredential(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if !middlewares.IsLoggedIn(c) {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	if err := middlewares.AllowWholeType(c, permission.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	cred, err := webauthn.Find(inst, c.Param("id"))
+	if err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return jsonapi.NotFound(err)
+		}
+		return err
+	}
+	if err := cred.Delete(inst); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func wrapWebAuthnError(err error) error {
+	switch err {
+	case webauthn.ErrInvalidChallenge, webauthn.ErrInvalidOrigin,
+		webauthn.ErrInvalidCredential, webauthn.ErrUserNotVerified:
+		return jsonapi.InvalidAttribute("credential", err)
+	case webauthn.ErrUnknownCredential:
+		return jsonapi.NotFound(err)
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package sharings
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/model/sharing"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+const defaultActivityLimit = 100
+
+// GetActivity returns the log of the changes received from the other members
+// of the sharing, the most recent first.
+func GetActivity(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharingID := c.Param("sharing-id")
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	if err = checkGetPermissions(c, s); err != nil {
+		return wrapErrors(err)
+	}
+
+	bookmark := c.QueryParam("page[cursor]")
+	limit, err := strconv.Atoi(c.QueryParam("page[limit]"))
+	if err != nil || limit <= 0 || limit > consts.MaxItemsPerPageForMango {
+		limit = defaultActivityLimit
+	}
+	acts, bookmark, err := s.ListActivities(inst, limit, bookmark)
+	if err != nil {
+		return wrapErrors(err)
+	}
+
+	objs := make([]jsonapi.Object, len(acts))
+	for i, a := range acts {
+		objs[i] = &sharing.APIActivity{Activity: a}
+	}
+	links := &jsonapi.LinksList{}
+	if bookmark != "" && len(objs) == limit {
+		v := url.Values{}
+		v.Set("page[cursor]", bookmark)
+		if limit != defaultActivityLimit {
+			v.Set("page[limit]", strconv.Itoa(limit))
+		}
+		links.Next = "/sharings/" + s.SID + "/activity?" + v.Encode()
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
@@ -0,0 +1,61 @@
+package sharings
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/sharing"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// SetSharingExpiration is used by the owner to change the date when the
+// sharing is revoked for all the members
+func SetSharingExpiration(c echo.Context) error {
+	return setExpiration(c, 0)
+}
+
+// SetRecipientExpiration is used by the owner to change the date when the
+// access of a recipient is revoked
+func SetRecipientExpiration(c echo.Context) error {
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		return jsonapi.InvalidParameter("index", err)
+	}
+	if index == 0 {
+		return jsonapi.InvalidParameter("index", errors.New("Invalid index"))
+	}
+	return setExpiration(c, index)
+}
+
+func setExpiration(c echo.Context, index int) error {
+	inst := middlewares.GetInstance(c)
+	sharingID := c.Param("sharing-id")
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	_, err = checkCreatePermissions(c, s)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	if index >= len(s.Members) {
+		return jsonapi.InvalidParameter("index", errors.New("Invalid index"))
+	}
+
+	var body struct {
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err = json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if err = s.SetExpiration(inst, index, body.ExpiresAt); err != nil {
+		return wrapErrors(err)
+	}
+	go s.NotifyRecipients(inst, nil)
+	return jsonapiSharingWithDocs(c, s)
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/cozy/cozy-stack/model/sharing"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/delta"
 	"github.com/cozy/cozy-stack/pkg/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/labstack/echo/v4"
@@ -56,7 +57,9 @@ func BulkDocs(c echo.Context) error {
 		inst.Logger().WithNamespace("replicator").Infof("No bulk docs")
 		return echo.NewHTTPError(http.StatusBadRequest)
 	}
-	err = s.ApplyBulkDocs(inst, docs)
+	// The member is only used for the activity log of the sharing
+	from, _ := requestMember(c, s)
+	err = s.ApplyBulkDocs(inst, docs, from)
 	if err != nil {
 		inst.Logger().WithNamespace("replicator").Infof("Error on apply: %s", err)
 		return wrapErrors(err)
@@ -106,7 +109,8 @@ func SyncFile(c echo.Context) error {
 		err = errors.New("The identifiers in the URL and in the doc are not the same")
 		return jsonapi.InvalidAttribute("id", err)
 	}
-	key, err := s.SyncFile(inst, &fileDoc)
+	from, _ := requestMember(c, s)
+	key, err := s.SyncFile(inst, &fileDoc, from)
 	if err != nil {
 		inst.Logger().WithNamespace("replicator").Infof("Error on sync file: %s", err)
 		return wrapErrors(err)
@@ -117,6 +121,24 @@ func SyncFile(c echo.Context) error {
 	return c.JSON(http.StatusOK, key)
 }
 
+// FileSignature returns the signature of the current content of a file, for
+// the sender to upload only a delta
+func FileSignature(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharingID := c.Param("sharing-id")
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		inst.Logger().WithNamespace("replicator").Infof("Sharing was not found: %s", err)
+		return wrapErrors(err)
+	}
+	sig, err := s.FileSignature(inst, c.Param("id"))
+	if err != nil {
+		inst.Logger().WithNamespace("replicator").Infof("Error on file signature: %s", err)
+		return wrapErrors(err)
+	}
+	return c.JSON(http.StatusOK, sig)
+}
+
 // FileHandler is used to receive a file upload
 func FileHandler(c echo.Context) error {
 	inst := middlewares.GetInstance(c)
@@ -126,7 +148,9 @@ func FileHandler(c echo.Context) error {
 		inst.Logger().WithNamespace("replicator").Infof("Sharing was not found: %s", err)
 		return wrapErrors(err)
 	}
-	if err := s.HandleFileUpload(inst, c.Param("id"), c.Request().Body); err != nil {
+	from, _ := requestMember(c, s)
+	withDelta := c.Request().Header.Get(echo.HeaderContentType) == delta.ContentType
+	if err := s.HandleFileUpload(inst, c.Param("id"), c.Request().Body, from, withDelta); err != nil {
 		inst.Logger().WithNamespace("replicator").Infof("Error on file upload: %s", err)
 		return wrapErrors(err)
 	}
@@ -167,6 +191,7 @@ func replicatorRoutes(router *echo.Group) {
 	group.GET("/:sharing-id/io.cozy.files/:id", GetFolder, checkSharingReadPermissions)
 	group.PUT("/:sharing-id/io.cozy.files/:id/metadata", SyncFile, checkSharingWritePermissions)
 	group.PUT("/:sharing-id/io.cozy.files/:id", FileHandler, checkSharingWritePermissions)
+	group.GET("/:sharing-id/io.cozy.files/:id/signature", FileSignature, checkSharingWritePermissions)
 	group.POST("/:sharing-id/reupload", ReuploadHandler, checkSharingReadPermissions)
 	group.DELETE("/:sharing-id/initial", EndInitial, checkSharingWritePermissions)
 }
@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/model/contact"
 	"github.com/cozy/cozy-stack/model/instance"
@@ -16,6 +17,7 @@ import (
 	"github.com/cozy/cozy-stack/model/vfs"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/delta"
 	"github.com/cozy/cozy-stack/pkg/initials"
 	"github.com/cozy/cozy-stack/pkg/jsonapi"
 	"github.com/cozy/cozy-stack/pkg/logger"
@@ -47,10 +49,8 @@ func CreateSharing(c echo.Context) error {
 	if rel, ok := obj.GetRelationship("recipients"); ok {
 		if data, ok := rel.Data.([]interface{}); ok {
 			for _, ref := range data {
-				if id, ok := ref.(map[string]interface{})["id"].(string); ok {
-					if err = s.AddContact(inst, id, false); err != nil {
-						return err
-					}
+				if err = addRecipient(inst, &s, ref, false); err != nil {
+					return err
 				}
 			}
 		}
@@ -59,10 +59,8 @@ func CreateSharing(c echo.Context) error {
 	if rel, ok := obj.GetRelationship("read_only_recipients"); ok {
 		if data, ok := rel.Data.([]interface{}); ok {
 			for _, ref := range data {
-				if id, ok := ref.(map[string]interface{})["id"].(string); ok {
-					if err = s.AddContact(inst, id, true); err != nil {
-						return err
-					}
+				if err = addRecipient(inst, &s, ref, true); err != nil {
+					return err
 				}
 			}
 		}
@@ -83,6 +81,19 @@ func CreateSharing(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusCreated, as, nil)
 }
 
+// addRecipient adds a contact or a group of contacts, depending on the type of
+// the reference, to a new sharing.
+func addRecipient(inst *instance.Instance, s *sharing.Sharing, ref interface{}, readOnly bool) error {
+	id, ok := ref.(map[string]interface{})["id"].(string)
+	if !ok {
+		return nil
+	}
+	if ref.(map[string]interface{})["type"] == consts.Groups {
+		return s.AddGroup(inst, id, readOnly)
+	}
+	return s.AddContact(inst, id, readOnly)
+}
+
 // PutSharing creates a sharing request (on the recipient's cozy)
 func PutSharing(c echo.Context) error {
 	inst := middlewares.GetInstance(c)
@@ -285,13 +296,21 @@ func addRecipientsToSharing(inst *instance.Instance, s *sharing.Sharing, rel *js
 	var err error
 	if data, ok := rel.Data.([]interface{}); ok {
 		ids := make(map[string]bool)
+		groupIDs := make(map[string]bool)
 		for _, ref := range data {
 			if id, ok := ref.(map[string]interface{})["id"].(string); ok {
-				ids[id] = readOnly
+				if ref.(map[string]interface{})["type"] == consts.Groups {
+					groupIDs[id] = readOnly
+				} else {
+					ids[id] = readOnly
+				}
 			}
 		}
 		if s.Owner {
-			err = s.AddContacts(inst, ids)
+			err = s.AddGroupsAndContacts(inst, groupIDs, ids)
+		} else if len(groupIDs) > 0 {
+			// The groups of contacts are kept in sync by the owner cozy
+			err = sharing.ErrInvalidSharing
 		} else {
 			err = s.DelegateAddContacts(inst, ids)
 		}
@@ -400,10 +419,14 @@ func PutRecipients(c echo.Context) error {
 
 	var body struct {
 		Members []sharing.Member `json:"data"`
+		Meta    struct {
+			ExpiresAt *time.Time `json:"expires_at"`
+		} `json:"meta"`
 	}
 	if err = json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
 		return wrapErrors(err)
 	}
+	s.ExpiresAt = body.Meta.ExpiresAt
 	if err = s.UpdateRecipients(inst, body.Members); err != nil {
 		return wrapErrors(err)
 	}
@@ -711,7 +734,10 @@ func Routes(router *echo.Group) {
 	router.PUT("/:sharing-id/recipients", PutRecipients)
 	router.DELETE("/:sharing-id/recipients", RevokeSharing)          // On the sharer
 	router.DELETE("/:sharing-id/recipients/:index", RevokeRecipient) // On the sharer
+	router.DELETE("/:sharing-id/groups/:index", RevokeGroup)         // On the sharer
 	router.POST("/:sharing-id/recipients/self/moved", ChangeCozyAddress)
+	router.PUT("/:sharing-id/expiration", SetSharingExpiration)                                              // On the sharer
+	router.PUT("/:sharing-id/recipients/:index/expiration", SetRecipientExpiration)                          // On the sharer
 	router.POST("/:sharing-id/recipients/:index/readonly", AddReadOnly)                                      // On the sharer
 	router.POST("/:sharing-id/recipients/self/readonly", DowngradeToReadOnly, checkSharingWritePermissions)  // On the recipient
 	router.DELETE("/:sharing-id/recipients/:index/readonly", RemoveReadOnly)                                 // On the sharer
@@ -721,6 +747,12 @@ func Routes(router *echo.Group) {
 	router.DELETE("/:sharing-id/answer", RevocationOwnerNotif, checkSharingWritePermissions)                 // On the sharer
 	router.POST("/:sharing-id/public-key", ReceivePublicKey)
 
+	// Transfer of ownership
+	router.POST("/:sharing-id/recipients/:index/owner", TransferOwnership)                          // On the sharer
+	router.POST("/:sharing-id/transfer/clients", TransferClients, checkSharingWritePermissions)     // On the new owner
+	router.POST("/:sharing-id/transfer/recipient", TransferRecipient, checkSharingWritePermissions) // On the other recipients
+	router.POST("/:sharing-id/transfer/owner", TransferOwner, checkSharingWritePermissions)         // On the new owner
+
 	// Delegated routes for open sharing
 	router.POST("/:sharing-id/recipients/delegated", AddRecipientsDelegated, checkSharingWritePermissions)
 
@@ -728,6 +760,7 @@ func Routes(router *echo.Group) {
 	router.GET("/news", CountNewShortcuts)
 	router.GET("/doctype/:doctype", GetSharingsInfoByDocType)
 	router.GET("/:sharing-id/recipients/:index/avatar", GetAvatar)
+	router.GET("/:sharing-id/activity", GetActivity)
 
 	// Register the URL of their Cozy for recipients
 	router.GET("/:sharing-id/discovery", GetDiscovery)
@@ -877,6 +910,12 @@ func wrapErrors(err error) error {
 		return jsonapi.BadRequest(err)
 	case sharing.ErrAlreadyAccepted:
 		return jsonapi.Conflict(err)
+	case sharing.ErrInvalidExpiration:
+		return jsonapi.InvalidAttribute("expires_at", err)
+	case sharing.ErrDeltaOutdated:
+		return jsonapi.PreconditionFailed("md5sum", err)
+	case delta.ErrInvalidDelta:
+		return jsonapi.BadRequest(err)
 	case vfs.ErrInvalidHash:
 		return jsonapi.InvalidParameter("md5sum", err)
 	case vfs.ErrContentLengthMismatch:
@@ -0,0 +1,123 @@
+package sharings
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/model/sharing"
+	"github.com/cozy/cozy-stack/pkg/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+)
+
+// TransferOwnership is used by the owner to hand the role of owner of the
+// sharing to a recipient
+func TransferOwnership(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharingID := c.Param("sharing-id")
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	_, err = checkCreatePermissions(c, s)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		return jsonapi.InvalidParameter("index", err)
+	}
+	if err = s.TransferOwnership(inst, index); err != nil {
+		return wrapErrors(err)
+	}
+	return jsonapiSharingWithDocs(c, s)
+}
+
+// TransferClients is used on the cozy of the new owner, during a transfer of
+// ownership, to create the OAuth clients for the other recipients
+func TransferClients(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharingID := c.Param("sharing-id")
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	if err = checkRequestFromOwner(c, s); err != nil {
+		return err
+	}
+	var body sharing.TransferClients
+	if err = json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return jsonapi.BadJSON()
+	}
+	res, err := s.CreateTransferClients(inst, body.Members)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// TransferRecipient is used on the cozy of a recipient, during a transfer of
+// ownership, to replace the old owner by the new one
+func TransferRecipient(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharingID := c.Param("sharing-id")
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	if err = checkRequestFromOwner(c, s); err != nil {
+		return err
+	}
+	var body sharing.TransferRecipient
+	if err = json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return jsonapi.BadJSON()
+	}
+	res, err := s.ChangeOwner(inst, &body)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// TransferOwner is used on the cozy of the new owner, at the end of a
+// transfer of ownership, to take over the sharing
+func TransferOwner(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharingID := c.Param("sharing-id")
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	// The old owner can retry the request if it has not seen the response:
+	// the sharing has already been taken over, and it is now a recipient.
+	if s.Owner && len(s.Members) > 1 {
+		if member, err := requestMember(c, s); err == nil && member == &s.Members[1] {
+			return c.NoContent(http.StatusNoContent)
+		}
+	}
+	if err = checkRequestFromOwner(c, s); err != nil {
+		return err
+	}
+	var body sharing.TransferOwner
+	if err = json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if err = s.TakeOverOwnership(inst, &body); err != nil {
+		return wrapErrors(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// checkRequestFromOwner returns an error if the request has not been made by
+// the owner of the sharing.
+func checkRequestFromOwner(c echo.Context, s *sharing.Sharing) error {
+	member, err := requestMember(c, s)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	if member != &s.Members[0] {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	return nil
+}
@@ -37,6 +37,7 @@ var (
 		"confirm_auth.html",
 		"confirm_flagship.html",
 		"error.html",
+		"file_drop.html",
 		"import.html",
 		"instance_blocked.html",
 		"login.html",
@@ -50,6 +51,7 @@ var (
 		"oidc_twofactor.html",
 		"passphrase_choose.html",
 		"passphrase_reset.html",
+		"share_by_link_password.html",
 		"sharing_discovery.html",
 		"twofactor.html",
 	}
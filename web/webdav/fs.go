@@ -0,0 +1,431 @@
+package webdav
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/web/files"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/webdav"
+)
+
+var errNotSupported = errors.New("webdav: operation not supported")
+
+// fileSystem is an implementation of webdav.FileSystem on top of the VFS of
+// an instance. It is created for each request, as it checks the permissions
+// of the request.
+type fileSystem struct {
+	c     echo.Context
+	inst  *instance.Instance
+	fs    vfs.VFS
+	perms permission.Set
+}
+
+func newFileSystem(c echo.Context, inst *instance.Instance, perms permission.Set) *fileSystem {
+	return &fileSystem{c: c, inst: inst, fs: inst.VFS(), perms: perms}
+}
+
+func (d *fileSystem) allow(v permission.Verb, o vfs.Fetcher) error {
+	if d.perms.IsMaximal() {
+		return nil
+	}
+	if err := vfs.Allows(d.fs, d.perms, v, o); err != nil {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// Mkdir is part of the webdav.FileSystem interface.
+func (d *fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	parent, err := d.fs.DirByPath(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	doc, err := vfs.NewDirDocWithParent(path.Base(name), parent, nil)
+	if err != nil {
+		return err
+	}
+	doc.CozyMetadata, _ = files.CozyMetadataFromClaims(d.c, false)
+	if err := d.allow(permission.POST, doc); err != nil {
+		return err
+	}
+	return d.fs.CreateDir(doc)
+}
+
+// OpenFile is part of the webdav.FileSystem interface.
+func (d *fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		return d.openForReading(name)
+	}
+	if flag&os.O_APPEND != 0 {
+		return nil, errNotSupported
+	}
+
+	olddoc, err := d.fs.FileByPath(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if olddoc == nil && flag&os.O_CREATE == 0 {
+		return nil, os.ErrNotExist
+	}
+	if olddoc != nil && flag&os.O_EXCL != 0 {
+		return nil, os.ErrExist
+	}
+
+	var dirID string
+	if olddoc != nil {
+		dirID = olddoc.DirID
+	} else {
+		parent, err := d.fs.DirByPath(path.Dir(name))
+		if err != nil {
+			return nil, err
+		}
+		dirID = parent.ID()
+	}
+
+	filename := path.Base(name)
+	mime, class := vfs.ExtractMimeAndClassFromFilename(filename)
+	newdoc, err := vfs.NewFileDoc(filename, dirID, -1, nil, mime, class,
+		time.Now(), false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if olddoc != nil {
+		if err := d.allow(permission.PUT, olddoc); err != nil {
+			return nil, err
+		}
+		newdoc.SetID(olddoc.ID())
+		newdoc.Tags = olddoc.Tags
+		newdoc.Executable = olddoc.Executable
+		newdoc.ReferencedBy = olddoc.ReferencedBy
+		if olddoc.CozyMetadata != nil {
+			newdoc.CozyMetadata = olddoc.CozyMetadata.Clone()
+			newdoc.CozyMetadata.UpdatedAt = newdoc.UpdatedAt
+		} else {
+			newdoc.CozyMetadata, _ = files.CozyMetadataFromClaims(d.c, true)
+		}
+		if err := d.allow(permission.PUT, newdoc); err != nil {
+			return nil, err
+		}
+	} else {
+		newdoc.CozyMetadata, _ = files.CozyMetadataFromClaims(d.c, true)
+		if err := d.allow(permission.POST, newdoc); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := d.fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	return &writeOnlyFile{file: f, doc: newdoc}, nil
+}
+
+func (d *fileSystem) openForReading(name string) (webdav.File, error) {
+	dir, file, err := d.fs.DirOrFileByPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if dir != nil {
+		if err := d.allow(permission.GET, dir); err != nil {
+			return nil, err
+		}
+		return &dirFile{fs: d, doc: dir}, nil
+	}
+	if err := d.allow(permission.GET, file); err != nil {
+		return nil, err
+	}
+	return &readOnlyFile{fs: d.fs, doc: file}, nil
+}
+
+// RemoveAll is part of the webdav.FileSystem interface. The files and
+// directories are moved to the trash, except if they already were in the
+// trash: in this case, they are destroyed.
+func (d *fileSystem) RemoveAll(ctx context.Context, name string) error {
+	dir, file, err := d.fs.DirOrFileByPath(name)
+	if err != nil {
+		return err
+	}
+	inTrash := name == vfs.TrashDirName || strings.HasPrefix(name, vfs.TrashDirName+"/")
+
+	if dir != nil {
+		if inTrash {
+			if err := d.allow(permission.DELETE, dir); err != nil {
+				return err
+			}
+			return d.fs.DestroyDirAndContent(dir, d.pushTrashJob)
+		}
+		if err := d.allow(permission.PATCH, dir); err != nil {
+			return err
+		}
+		if dir.CozyMetadata != nil {
+			dir.CozyMetadata.UpdatedAt = time.Now()
+		}
+		_, err = vfs.TrashDir(d.fs, dir)
+		return err
+	}
+
+	if inTrash {
+		if err := d.allow(permission.DELETE, file); err != nil {
+			return err
+		}
+		return d.fs.DestroyFile(file)
+	}
+	if err := d.allow(permission.PATCH, file); err != nil {
+		return err
+	}
+	if file.CozyMetadata != nil {
+		file.CozyMetadata.UpdatedAt = time.Now()
+	}
+	_, err = vfs.TrashFile(d.fs, file)
+	return err
+}
+
+func (d *fileSystem) pushTrashJob(journal vfs.TrashJournal) error {
+	msg, err := job.NewMessage(journal)
+	if err != nil {
+		return err
+	}
+	_, err = job.System().PushJob(d.inst, &job.JobRequest{
+		WorkerType: "trash-files",
+		Message:    msg,
+	})
+	return err
+}
+
+// Rename is part of the webdav.FileSystem interface.
+func (d *fileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	dir, file, err := d.fs.DirOrFileByPath(oldName)
+	if err != nil {
+		return err
+	}
+	parent, err := d.fs.DirByPath(path.Dir(newName))
+	if err != nil {
+		return err
+	}
+	if err := d.allow(permission.PATCH, parent); err != nil {
+		return err
+	}
+
+	name := path.Base(newName)
+	patch := &vfs.DocPatch{
+		Name:  &name,
+		DirID: &parent.DocID,
+	}
+	if dir != nil {
+		if err := d.allow(permission.PATCH, dir); err != nil {
+			return err
+		}
+		_, err = vfs.ModifyDirMetadata(d.fs, dir, patch)
+		return err
+	}
+	if err := d.allow(permission.PATCH, file); err != nil {
+		return err
+	}
+	_, err = vfs.ModifyFileMetadata(d.fs, file, patch)
+	return err
+}
+
+// Stat is part of the webdav.FileSystem interface.
+func (d *fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	dir, file, err := d.fs.DirOrFileByPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if dir != nil {
+		if err := d.allow(permission.GET, dir); err != nil {
+			return nil, err
+		}
+		return dir, nil
+	}
+	if err := d.allow(permission.GET, file); err != nil {
+		return nil, err
+	}
+	return &fileInfo{file}, nil
+}
+
+// fileInfo is an os.FileInfo for a file that can also give its content-type
+// and etag to the WebDAV handler, without having to read its content.
+type fileInfo struct {
+	*vfs.FileDoc
+}
+
+// ContentType is part of the webdav.ContentTyper interface.
+func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.Mime == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.Mime, nil
+}
+
+// ETag is part of the webdav.ETager interface.
+func (fi *fileInfo) ETag(ctx context.Context) (string, error) {
+	if len(fi.MD5Sum) == 0 {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + hex.EncodeToString(fi.MD5Sum) + `"`, nil
+}
+
+// readOnlyFile is a webdav.File for reading the content of a file. The
+// content is opened lazily, as the WebDAV handler opens the files just to
+// call Stat on them for PROPFIND requests.
+type readOnlyFile struct {
+	fs      vfs.VFS
+	doc     *vfs.FileDoc
+	content vfs.File
+}
+
+func (f *readOnlyFile) open() error {
+	if f.content != nil {
+		return nil
+	}
+	content, err := f.fs.OpenFile(f.doc)
+	if err != nil {
+		return err
+	}
+	f.content = content
+	return nil
+}
+
+func (f *readOnlyFile) Read(p []byte) (int, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.content.Read(p)
+}
+
+func (f *readOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.content.Seek(offset, whence)
+}
+
+func (f *readOnlyFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *readOnlyFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *readOnlyFile) Stat() (os.FileInfo, error) {
+	return &fileInfo{f.doc}, nil
+}
+
+func (f *readOnlyFile) Close() error {
+	if f.content == nil {
+		return nil
+	}
+	return f.content.Close()
+}
+
+// writeOnlyFile is a webdav.File for writing the content of a file.
+type writeOnlyFile struct {
+	file    vfs.File
+	doc     *vfs.FileDoc
+	written int64
+}
+
+func (f *writeOnlyFile) Read(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *writeOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekCurrent {
+		return f.written, nil
+	}
+	return 0, errNotSupported
+}
+
+func (f *writeOnlyFile) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+func (f *writeOnlyFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *writeOnlyFile) Stat() (os.FileInfo, error) {
+	doc := f.doc.Clone().(*vfs.FileDoc)
+	doc.ByteSize = f.written
+	return &fileInfo{doc}, nil
+}
+
+func (f *writeOnlyFile) Close() error {
+	return f.file.Close()
+}
+
+// dirFile is a webdav.File for listing the content of a directory.
+type dirFile struct {
+	fs   *fileSystem
+	doc  *vfs.DirDoc
+	iter vfs.DirIterator
+}
+
+func (f *dirFile) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *dirFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *dirFile) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.iter == nil {
+		f.iter = f.fs.fs.DirIterator(f.doc, nil)
+	}
+	var infos []os.FileInfo
+	for count <= 0 || len(infos) < count {
+		d, file, err := f.iter.Next()
+		if err == vfs.ErrIteratorDone {
+			if count > 0 && len(infos) == 0 {
+				return nil, io.EOF
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			infos = append(infos, d)
+		} else {
+			infos = append(infos, &fileInfo{file})
+		}
+	}
+	return infos, nil
+}
+
+func (f *dirFile) Stat() (os.FileInfo, error) {
+	return f.doc, nil
+}
+
+func (f *dirFile) Close() error {
+	return nil
+}
+
+var (
+	_ webdav.FileSystem   = (*fileSystem)(nil)
+	_ webdav.File         = (*readOnlyFile)(nil)
+	_ webdav.File         = (*writeOnlyFile)(nil)
+	_ webdav.File         = (*dirFile)(nil)
+	_ webdav.ContentTyper = (*fileInfo)(nil)
+	_ webdav.ETager       = (*fileInfo)(nil)
+)
@@ -0,0 +1,160 @@
+// Package webdav exposes the VFS of an instance with the WebDAV protocol, so
+// that the files can be mounted from desktop file managers and tools like
+// rclone or davfs2.
+package webdav
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/apppassword"
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/permission"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/webdav"
+)
+
+// Prefix is the path prefix for the WebDAV routes.
+const Prefix = "/dav/files"
+
+// Methods is the list of HTTP methods handled by the WebDAV server.
+var Methods = []string{
+	http.MethodOptions,
+	http.MethodHead,
+	http.MethodGet,
+	http.MethodPut,
+	http.MethodDelete,
+	"PROPFIND",
+	"PROPPATCH",
+	"MKCOL",
+	"COPY",
+	"MOVE",
+	"LOCK",
+	"UNLOCK",
+}
+
+// locksIdleTimeout is how long the locks of an instance are kept after the
+// last WebDAV request for this instance.
+const locksIdleTimeout = 1 * time.Hour
+
+type instanceLocks struct {
+	ls       webdav.LockSystem
+	lastUsed time.Time
+}
+
+var (
+	locksMu      sync.Mutex
+	locks        = make(map[string]*instanceLocks)
+	locksCleaned time.Time
+)
+
+// lockSystem returns the lock system for the given instance. The locks are
+// kept in the memory of the stack process, and they are only advisory (the
+// VFS does not check them): they are mainly here for the clients that refuse
+// to write on a WebDAV server without LOCK support. When several stack
+// processes are used, a lock taken on one process is not seen by the others.
+// The locks of an instance are forgotten when it has had no WebDAV requests
+// for locksIdleTimeout.
+func lockSystem(inst *instance.Instance) webdav.LockSystem {
+	locksMu.Lock()
+	defer locksMu.Unlock()
+	now := time.Now()
+	if now.Sub(locksCleaned) > locksIdleTimeout/4 {
+		for domain, l := range locks {
+			if now.Sub(l.lastUsed) > locksIdleTimeout {
+				delete(locks, domain)
+			}
+		}
+		locksCleaned = now
+	}
+	l, ok := locks[inst.Domain]
+	if !ok {
+		l = &instanceLocks{ls: webdav.NewMemLS()}
+		locks[inst.Domain] = l
+	}
+	l.lastUsed = now
+	return l.ls
+}
+
+// IsWebDAVRequest returns true if the request path is handled by the WebDAV
+// server.
+func IsWebDAVRequest(path string) bool {
+	return path == Prefix || strings.HasPrefix(path, Prefix+"/")
+}
+
+// Handler is the echo handler for all the WebDAV requests.
+//
+// The client can authenticate with an application password, created by the
+// user in the settings, as the password of the HTTP basic authentication
+// (with any username). It can also use an OAuth access token, either as a
+// bearer token, or as the password of the basic authentication.
+func Handler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	perms, status, err := checkAuth(c, inst)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusUnauthorized {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="Cozy"`)
+	}
+	if status != http.StatusOK {
+		return c.NoContent(status)
+	}
+
+	h := &webdav.Handler{
+		Prefix:     Prefix,
+		FileSystem: newFileSystem(c, inst, perms),
+		LockSystem: lockSystem(inst),
+		Logger: func(req *http.Request, err error) {
+			if err != nil {
+				inst.Logger().WithNamespace("webdav").
+					Infof("%s %s: %s", req.Method, req.URL.Path, err)
+			}
+		},
+	}
+	h.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// checkAuth returns the permissions on the files given by the credentials of
+// the request, or the HTTP status for refusing the request.
+func checkAuth(c echo.Context, inst *instance.Instance) (permission.Set, int, error) {
+	// An application password gives access to all the files
+	if _, password, ok := c.Request().BasicAuth(); ok && apppassword.IsAppPassword(password) {
+		_, err := apppassword.Check(inst, password)
+		if err == apppassword.ErrInvalidPassword {
+			return nil, http.StatusUnauthorized, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		return permission.Set{
+			permission.Rule{Type: consts.Files, Verbs: permission.ALL},
+		}, http.StatusOK, nil
+	}
+
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil {
+		return nil, http.StatusUnauthorized, nil
+	}
+	if pdoc.Type != permission.TypeOauth && pdoc.Type != permission.TypeCLI {
+		return nil, http.StatusForbidden, nil
+	}
+	if !hasFilesPermission(pdoc.Permissions) {
+		return nil, http.StatusForbidden, nil
+	}
+	return pdoc.Permissions, http.StatusOK, nil
+}
+
+func hasFilesPermission(set permission.Set) bool {
+	for _, rule := range set {
+		if permission.MatchType(rule, consts.Files) && rule.Verbs.Contains(permission.GET) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package webdav
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/apppassword"
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ts *httptest.Server
+var inst *instance.Instance
+var token string
+var contactsToken string
+
+func doRequest(t *testing.T, method, path string, body io.Reader, headers map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	require.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	content, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(content)
+}
+
+func TestAuthentication(t *testing.T) {
+	req, err := http.NewRequest("PROPFIND", ts.URL+"/dav/files/", nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Equal(t, `Basic realm="Cozy"`, res.Header.Get(echo.HeaderWWWAuthenticate))
+
+	// The token can be given as the password of the basic authentication
+	req, err = http.NewRequest("PROPFIND", ts.URL+"/dav/files/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Depth", "0")
+	req.SetBasicAuth("anything", token)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusMultiStatus, res.StatusCode)
+
+	// A token without a permission on the files is refused
+	req, err = http.NewRequest("PROPFIND", ts.URL+"/dav/files/", nil)
+	require.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+contactsToken)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestAppPassword(t *testing.T) {
+	p, err := apppassword.Create(inst, "davfs2")
+	require.NoError(t, err)
+	require.True(t, apppassword.IsAppPassword(p.Password))
+
+	propfind := func(password string) int {
+		req, err := http.NewRequest("PROPFIND", ts.URL+"/dav/files/", nil)
+		require.NoError(t, err)
+		req.Header.Set("Depth", "0")
+		req.SetBasicAuth("alice", password)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusMultiStatus, propfind(p.Password))
+	assert.Equal(t, http.StatusUnauthorized, propfind(p.DocID+"-"+strings.Repeat("x", 32)))
+
+	// A revoked password can no longer be used
+	password := p.Password
+	p, err = apppassword.Find(inst, p.DocID)
+	require.NoError(t, err)
+	require.NoError(t, p.Revoke(inst))
+	assert.Equal(t, http.StatusUnauthorized, propfind(password))
+}
+
+func TestFiles(t *testing.T) {
+	res, _ := doRequest(t, "MKCOL", "/dav/files/webdav", nil, nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	// PUT
+	res, _ = doRequest(t, http.MethodPut, "/dav/files/webdav/hello.txt", strings.NewReader("Hello"), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	file, err := inst.VFS().FileByPath("/webdav/hello.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), file.ByteSize)
+
+	// PROPFIND
+	res, body := doRequest(t, "PROPFIND", "/dav/files/webdav/", nil, map[string]string{"Depth": "1"})
+	assert.Equal(t, http.StatusMultiStatus, res.StatusCode)
+	assert.Contains(t, body, "/dav/files/webdav/hello.txt")
+	assert.Contains(t, body, "<D:getcontentlength>5</D:getcontentlength>")
+	res, _ = doRequest(t, "PROPFIND", "/dav/files/nope/", nil, map[string]string{"Depth": "1"})
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// GET
+	res, body = doRequest(t, http.MethodGet, "/dav/files/webdav/hello.txt", nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "Hello", body)
+
+	// PUT on an existing file replaces its content
+	res, _ = doRequest(t, http.MethodPut, "/dav/files/webdav/hello.txt", strings.NewReader("Hello world"), nil)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	_, body = doRequest(t, http.MethodGet, "/dav/files/webdav/hello.txt", nil, nil)
+	assert.Equal(t, "Hello world", body)
+
+	// COPY
+	res, _ = doRequest(t, "COPY", "/dav/files/webdav/hello.txt", nil, map[string]string{
+		"Destination": ts.URL + "/dav/files/webdav/copy.txt",
+	})
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	_, body = doRequest(t, http.MethodGet, "/dav/files/webdav/copy.txt", nil, nil)
+	assert.Equal(t, "Hello world", body)
+
+	// MOVE
+	res, _ = doRequest(t, "MOVE", "/dav/files/webdav/copy.txt", nil, map[string]string{
+		"Destination": ts.URL + "/dav/files/moved.txt",
+	})
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res, _ = doRequest(t, http.MethodGet, "/dav/files/webdav/copy.txt", nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	_, body = doRequest(t, http.MethodGet, "/dav/files/moved.txt", nil, nil)
+	assert.Equal(t, "Hello world", body)
+
+	// DELETE
+	res, _ = doRequest(t, http.MethodDelete, "/dav/files/moved.txt", nil, nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	res, _ = doRequest(t, http.MethodGet, "/dav/files/moved.txt", nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res, _ = doRequest(t, http.MethodDelete, "/dav/files/webdav", nil, nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, err = inst.VFS().DirByPath("/webdav")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "webdav_test")
+	inst = setup.GetTestInstance()
+	client, tok := setup.GetTestClient(consts.Files)
+	token = tok
+	var err error
+	contactsToken, err = inst.MakeJWT(consts.AccessTokenAudience,
+		client.ClientID, consts.Contacts, "", time.Now())
+	if err != nil {
+		setup.CleanupAndDie("Cannot create oauth token", err)
+	}
+
+	handler := echo.New()
+	handler.Pre(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !IsWebDAVRequest(c.Request().URL.Path) {
+				return next(c)
+			}
+			c.Set("instance", inst)
+			return Handler(c)
+		}
+	})
+	ts = httptest.NewServer(handler)
+	setup.AddCleanup(func() error { ts.Close(); return nil })
+	os.Exit(setup.Run())
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"io"
 	"math"
 	"runtime"
 	"strconv"
@@ -81,13 +82,16 @@ func worker(ctx *job.WorkerContext) (err error) {
 	cmd := CreateCmd(cmdStr, workDir)
 	cmd.Env = env
 
-	// set stderr writable with a bytes.Buffer limited total size of 256Ko
-	cmd.Stderr = utils.LimitWriterDiscard(&stderrBuf, 256*1024)
+	// set stderr writable with a bytes.Buffer limited total size of 256Ko,
+	// and send its lines to the logs of the job
+	stderrLogs := &logWriter{ctx: ctx}
+	cmd.Stderr = io.MultiWriter(utils.LimitWriterDiscard(&stderrBuf, 256*1024), stderrLogs)
 
 	// Log out all things printed in stderr, whatever the result of the
 	// konnector is.
 	log := worker.Logger(ctx)
 	defer func() {
+		stderrLogs.Flush()
 		if stderrBuf.Len() > 0 {
 			log.Errorf("Stderr: %s", stderrBuf.String())
 		}
@@ -123,6 +127,7 @@ func worker(ctx *job.WorkerContext) (err error) {
 		for scanOut.Scan() {
 			if errOut := worker.ScanOutput(ctx, ctx.Instance, scanOut.Bytes()); errOut != nil {
 				log.Debug(errOut.Error())
+				ctx.AppendLog(job.LogStreamStdout, "info", scanOut.Text())
 			}
 		}
 		if errs := scanOut.Err(); errs != nil {
@@ -165,3 +170,35 @@ func wrapErr(ctx context.Context, err error) error {
 	}
 	return err
 }
+
+// logWriter is an io.Writer that sends each line written on it to the logs
+// of the job.
+type logWriter struct {
+	ctx *job.WorkerContext
+	buf []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.ctx.AppendLog(job.LogStreamStderr, "error", string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	// Don't keep a very long line in memory
+	if len(w.buf) > 64*1024 {
+		w.Flush()
+	}
+	return len(p), nil
+}
+
+// Flush sends the last line, if it doesn't end with a newline.
+func (w *logWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.ctx.AppendLog(job.LogStreamStderr, "error", string(w.buf))
+		w.buf = nil
+	}
+}
@@ -52,6 +52,7 @@ const (
 	konnectorMsgTypeWarning  = "warning"
 	konnectorMsgTypeError    = "error"
 	konnectorMsgTypeCritical = "critical"
+	konnectorMsgTypeResult   = "result"
 )
 
 // KonnectorMessage is the message structure sent to the konnector worker.
@@ -547,6 +548,11 @@ func (w *konnectorWorker) PrepareCmdEnv(ctx *job.WorkerContext, i *instance.Inst
 	if triggerID, ok := ctx.TriggerID(); ok {
 		env = append(env, "COZY_TRIGGER_ID="+triggerID)
 	}
+	if parent, ok := ctx.Parent(); ok {
+		if parentJSON, err := json.Marshal(parent); err == nil {
+			env = append(env, "COZY_PARENT_JOB="+string(parentJSON))
+		}
+	}
 	return
 }
 
@@ -556,13 +562,17 @@ func (w *konnectorWorker) Logger(ctx *job.WorkerContext) *logger.Entry {
 
 func (w *konnectorWorker) ScanOutput(ctx *job.WorkerContext, i *instance.Instance, line []byte) error {
 	var msg struct {
-		Type    string `json:"type"`
-		Message string `json:"message"`
-		NoRetry bool   `json:"no_retry"`
+		Type    string          `json:"type"`
+		Message string          `json:"message"`
+		NoRetry bool            `json:"no_retry"`
+		Result  json.RawMessage `json:"result"`
 	}
 	if err := json.Unmarshal(line, &msg); err != nil {
 		return fmt.Errorf("Could not parse stdout as JSON: %q", string(line))
 	}
+	if msg.Type == konnectorMsgTypeResult {
+		return ctx.SetResult(msg.Result)
+	}
 
 	// Truncate very long messages
 	if len(msg.Message) > 4000 {
@@ -588,6 +598,7 @@ func (w *konnectorWorker) ScanOutput(ctx *job.WorkerContext, i *instance.Instanc
 		}
 		log.Error(msg.Message)
 	}
+	ctx.AppendLog(job.LogStreamStdout, msg.Type, msg.Message)
 
 	realtime.GetHub().Publish(i,
 		realtime.EventCreate,
@@ -188,6 +188,11 @@ func (w *serviceWorker) PrepareCmdEnv(ctx *job.WorkerContext, i *instance.Instan
 	if triggerID, ok := ctx.TriggerID(); ok {
 		env = append(env, "COZY_TRIGGER_ID="+triggerID)
 	}
+	if parent, ok := ctx.Parent(); ok {
+		if parentJSON, err := json.Marshal(parent); err == nil {
+			env = append(env, "COZY_PARENT_JOB="+string(parentJSON))
+		}
+	}
 	return
 }
 
@@ -201,12 +206,16 @@ func (w *serviceWorker) Logger(ctx *job.WorkerContext) *logger.Entry {
 
 func (w *serviceWorker) ScanOutput(ctx *job.WorkerContext, i *instance.Instance, line []byte) error {
 	var msg struct {
-		Type    string `json:"type"`
-		Message string `json:"message"`
+		Type    string          `json:"type"`
+		Message string          `json:"message"`
+		Result  json.RawMessage `json:"result"`
 	}
 	if err := json.Unmarshal(line, &msg); err != nil {
 		return fmt.Errorf("Could not parse stdout as JSON: %q", string(line))
 	}
+	if msg.Type == konnectorMsgTypeResult {
+		return ctx.SetResult(msg.Result)
+	}
 
 	// Truncate very long messages
 	if len(msg.Message) > 4000 {
@@ -224,6 +233,7 @@ func (w *serviceWorker) ScanOutput(ctx *job.WorkerContext, i *instance.Instance,
 	case konnectorMsgTypeCritical:
 		log.Error(msg.Message)
 	}
+	ctx.AppendLog(job.LogStreamStdout, msg.Type, msg.Message)
 	return nil
 }
 
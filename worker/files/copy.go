@@ -0,0 +1,52 @@
+// Package files is for the workers that manipulate the files of the VFS in the
+// background.
+package files
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/vfs"
+)
+
+func init() {
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "copy-files",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 1,
+		Reserved:     true,
+		Timeout:      2 * time.Hour,
+		WorkerFunc:   WorkerCopyFiles,
+	})
+}
+
+// CopyMessage is the message for a copy-files job.
+type CopyMessage struct {
+	SrcID        string `json:"src_id"`
+	DstID        string `json:"dst_id"`
+	KeepMetadata bool   `json:"keep_metadata,omitempty"`
+}
+
+// WorkerCopyFiles is a worker that copies the content of a directory inside
+// another directory (that has just been created for the copy).
+func WorkerCopyFiles(ctx *job.WorkerContext) error {
+	msg := &CopyMessage{}
+	if err := ctx.UnmarshalMessage(msg); err != nil {
+		return err
+	}
+	fs := ctx.Instance.VFS()
+	src, err := fs.DirByID(msg.SrcID)
+	if err != nil {
+		return err
+	}
+	dst, err := fs.DirByID(msg.DstID)
+	if err != nil {
+		return err
+	}
+	if err := vfs.CopyDirContent(fs, src, dst, msg.KeepMetadata); err != nil {
+		ctx.Logger().Warnf("Cannot copy %s to %s: %s", src.Fullpath, dst.Fullpath, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/instance"
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/vfs"
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var inst *instance.Instance
+
+func createFile(t *testing.T, dir *vfs.DirDoc, name, content string) {
+	fs := inst.VFS()
+	doc, err := vfs.NewFileDoc(name, dir.ID(), int64(len(content)), nil,
+		"text/plain", "text", time.Now(), false, false, false, []string{"foo"})
+	require.NoError(t, err)
+	f, err := fs.CreateFile(doc, nil)
+	require.NoError(t, err)
+	_, err = f.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func readFile(t *testing.T, name string) string {
+	fs := inst.VFS()
+	doc, err := fs.FileByPath(name)
+	require.NoError(t, err)
+	f, err := fs.OpenFile(doc)
+	require.NoError(t, err)
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	return string(buf)
+}
+
+func runCopy(t *testing.T, msg *CopyMessage) error {
+	m, err := job.NewMessage(msg)
+	require.NoError(t, err)
+	j := job.NewJob(inst, &job.JobRequest{
+		Message:    m,
+		WorkerType: "copy-files",
+	})
+	ctx := job.NewWorkerContext("id", j, inst)
+	return WorkerCopyFiles(ctx)
+}
+
+func TestCopyFiles(t *testing.T) {
+	fs := inst.VFS()
+	src, err := vfs.Mkdir(fs, "/workersrc/sub", nil)
+	require.NoError(t, err)
+	createFile(t, src, "foo.txt", "foo")
+	parent, err := fs.DirByPath("/workersrc")
+	require.NoError(t, err)
+	createFile(t, parent, "bar.txt", "bar")
+
+	dst, err := vfs.Mkdir(fs, "/workerdst", nil)
+	require.NoError(t, err)
+	err = runCopy(t, &CopyMessage{SrcID: parent.ID(), DstID: dst.ID()})
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", readFile(t, "/workerdst/sub/foo.txt"))
+	assert.Equal(t, "bar", readFile(t, "/workerdst/bar.txt"))
+	copied, err := fs.FileByPath("/workerdst/bar.txt")
+	require.NoError(t, err)
+	assert.Empty(t, copied.Tags)
+
+	kept, err := vfs.Mkdir(fs, "/workerkept", nil)
+	require.NoError(t, err)
+	err = runCopy(t, &CopyMessage{SrcID: parent.ID(), DstID: kept.ID(), KeepMetadata: true})
+	assert.NoError(t, err)
+	copied, err = fs.FileByPath("/workerkept/sub/foo.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, copied.Tags)
+
+	// The destination already has the files
+	err = runCopy(t, &CopyMessage{SrcID: parent.ID(), DstID: dst.ID()})
+	assert.Error(t, err)
+}
+
+func TestCopyFilesQuota(t *testing.T) {
+	fs := inst.VFS()
+	src, err := vfs.Mkdir(fs, "/quotasrc", nil)
+	require.NoError(t, err)
+	createFile(t, src, "one.txt", "0123456789")
+	createFile(t, src, "two.txt", "0123456789")
+	dst, err := vfs.Mkdir(fs, "/quotadst", nil)
+	require.NoError(t, err)
+
+	// The quota is checked for each file during the copy, and not only
+	// when the job is pushed
+	usage, err := fs.DiskUsage()
+	require.NoError(t, err)
+	inst.BytesDiskQuota = usage + 15
+	defer func() { inst.BytesDiskQuota = 0 }()
+
+	err = runCopy(t, &CopyMessage{SrcID: src.ID(), DstID: dst.ID()})
+	assert.Equal(t, vfs.ErrFileTooBig, err)
+	newUsage, err := fs.DiskUsage()
+	require.NoError(t, err)
+	assert.LessOrEqual(t, newUsage, inst.BytesDiskQuota)
+}
+
+func TestCopyFilesUnknownDir(t *testing.T) {
+	fs := inst.VFS()
+	dst, err := vfs.Mkdir(fs, "/unknowndst", nil)
+	require.NoError(t, err)
+	err = runCopy(t, &CopyMessage{SrcID: "no-such-dir", DstID: dst.ID()})
+	assert.True(t, os.IsNotExist(err), err)
+	err = runCopy(t, &CopyMessage{SrcID: consts.RootDirID, DstID: "no-such-dir"})
+	assert.True(t, os.IsNotExist(err), err)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "copy_files_test")
+	inst = setup.GetTestInstance()
+	os.Exit(setup.Run())
+}
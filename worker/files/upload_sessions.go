@@ -0,0 +1,27 @@
+package files
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/model/job"
+	"github.com/cozy/cozy-stack/model/vfs"
+)
+
+func init() {
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "purge-upload-sessions",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Reserved:     true,
+		Timeout:      1 * time.Hour,
+		WorkerFunc:   WorkerPurgeUploadSessions,
+	})
+}
+
+// WorkerPurgeUploadSessions is a worker that removes the upload sessions that
+// have expired, with their chunks. It is launched every day by a trigger
+// created with the first upload session of the instance.
+func WorkerPurgeUploadSessions(ctx *job.WorkerContext) error {
+	return vfs.PurgeExpiredUploadSessions(ctx.Instance.VFS())
+}
@@ -35,8 +35,11 @@ func initMailTemplates() {
 		"support_request":              subjectEntry{"Mail Support Confirmation Subject", nil},
 		"sharing_request":              subjectEntry{"Mail Sharing Request Subject", []string{"SharerPublicName"}},
 		"sharing_to_confirm":           subjectEntry{"Mail Sharing Member To Confirm Subject", nil},
+		"sharing_expiring":             subjectEntry{"Mail Sharing Expiring Subject", nil},
+		"sharing_expired":              subjectEntry{"Mail Sharing Expired Subject", nil},
 		"notifications_sharing":        subjectEntry{"Notification Sharing Subject", nil},
 		"notifications_diskquota":      subjectEntry{"Notifications Disk Quota Subject", nil},
+		"notifications_file_drop":      subjectEntry{"Notifications File Drop Subject", nil},
 	}
 }
 
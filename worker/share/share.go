@@ -18,6 +18,24 @@ func init() {
 		WorkerFunc:   WorkerTrack,
 	})
 
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "share-group",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Reserved:     true,
+		Timeout:      5 * time.Minute,
+		WorkerFunc:   WorkerGroup,
+	})
+
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType:   "share-expire",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Reserved:     true,
+		Timeout:      5 * time.Minute,
+		WorkerFunc:   WorkerExpire,
+	})
+
 	job.AddWorker(&job.WorkerConfig{
 		WorkerType:  "share-replicate",
 		Concurrency: runtime.NumCPU(),
@@ -41,6 +59,17 @@ func init() {
 		Timeout:      1 * time.Hour,
 		WorkerFunc:   WorkerUpload,
 	})
+
+	job.AddWorker(&job.WorkerConfig{
+		WorkerType: "share-transfer",
+		// The worker adds a new job to retry if it fails, like the
+		// share-replicate and share-upload workers
+		MaxExecCount: 1,
+		Concurrency:  runtime.NumCPU(),
+		Reserved:     true,
+		Timeout:      5 * time.Minute,
+		WorkerFunc:   WorkerTransfer,
+	})
 }
 
 // WorkerTrack is used to update the io.cozy.shared database when a document
@@ -59,6 +88,30 @@ func WorkerTrack(ctx *job.WorkerContext) error {
 	return sharing.UpdateShared(ctx.Instance, msg, evt)
 }
 
+// WorkerGroup is used to invite or revoke the members of the sharings when a
+// contact is added to or removed from a group of contacts
+func WorkerGroup(ctx *job.WorkerContext) error {
+	var msg sharing.ShareGroupMessage
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	ctx.Instance.Logger().WithNamespace("share").
+		Debugf("Group %#v", msg)
+	return sharing.UpdateGroups(ctx.Instance, msg)
+}
+
+// WorkerExpire is used to warn the members before the expiration of a sharing
+// (or of the access of a member), and to revoke it when it expires
+func WorkerExpire(ctx *job.WorkerContext) error {
+	var msg sharing.ExpirationMessage
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	ctx.Instance.Logger().WithNamespace("share").
+		Debugf("Expire %#v", msg)
+	return sharing.Expire(ctx.Instance, msg)
+}
+
 // WorkerReplicate is used for the replication of documents to the other
 // members of a sharing.
 func WorkerReplicate(ctx *job.WorkerContext) error {
@@ -72,7 +125,7 @@ func WorkerReplicate(ctx *job.WorkerContext) error {
 	if err != nil {
 		return err
 	}
-	if !s.Active {
+	if !s.Active || s.PendingTransfer != nil {
 		return nil
 	}
 	return s.Replicate(ctx.Instance, msg.Errors)
@@ -90,8 +143,27 @@ func WorkerUpload(ctx *job.WorkerContext) error {
 	if err != nil {
 		return err
 	}
-	if !s.Active {
+	if !s.Active || s.PendingTransfer != nil {
 		return nil
 	}
 	return s.Upload(ctx.Instance, msg.Errors)
 }
+
+// WorkerTransfer is used to retry the end of a transfer of ownership, when
+// the new owner could not be reached.
+func WorkerTransfer(ctx *job.WorkerContext) error {
+	var msg sharing.ReplicateMsg
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	ctx.Instance.Logger().WithNamespace("share").
+		Debugf("Transfer %#v", msg)
+	s, err := sharing.FindSharing(ctx.Instance, msg.SharingID)
+	if err != nil {
+		return err
+	}
+	if !s.Active {
+		return nil
+	}
+	return s.FinishTransfer(ctx.Instance, msg.Errors)
+}